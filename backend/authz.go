@@ -0,0 +1,16 @@
+package main
+
+import "net/http"
+
+// roleAdmin marks users who may modify any record.
+const roleAdmin = "admin"
+
+// canModify reports whether the authenticated caller may change a record
+// owned by ownerID: only the owner or an admin may.
+func canModify(r *http.Request, ownerID string) bool {
+	sess := currentSession(r)
+	if sess == nil {
+		return false
+	}
+	return sess.Role == roleAdmin || (ownerID != "" && sess.UserID == ownerID)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanModify(t *testing.T) {
+	tests := []struct {
+		description string
+		session     *Session
+		ownerID     string
+		expected    bool
+	}{
+		{"owner", &Session{UserID: "alice"}, "alice", true},
+		{"other user", &Session{UserID: "bob"}, "alice", false},
+		{"admin", &Session{UserID: "carol", Role: roleAdmin}, "alice", true},
+		{"unauthenticated", nil, "alice", false},
+		{"record without owner", &Session{UserID: ""}, "", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("DELETE", "/", nil)
+		if test.session != nil {
+			req = req.WithContext(context.WithValue(req.Context(), sessionContextKey, test.session))
+		}
+		assert.Equal(t, test.expected, canModify(req, test.ownerID), test.description)
+	}
+}
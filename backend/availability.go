@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxAvailabilityWindows bounds how finely a sublease's availability can be
+// split.
+const maxAvailabilityWindows = 20
+
+// DateRange is a span of dates with both ends included.
+type DateRange struct {
+	StartDate time.Time `json:"start_date" bson:"start_date"`
+	EndDate   time.Time `json:"end_date" bson:"end_date"`
+}
+
+// covers reports whether r includes the whole of other.
+func (r DateRange) covers(other DateRange) bool {
+	return !r.StartDate.After(other.StartDate) && !r.EndDate.Before(other.EndDate)
+}
+
+// normalizeAvailability checks a sublease's period and availability windows
+// and puts them in canonical form: dates are cut to midnight UTC, like the
+// stays they are checked against; without windows the whole period is
+// available; without a period it spans the windows. Windows are sorted, and
+// overlapping or back-to-back windows are merged so that a stay crossing
+// from one into the next is still found by an availability search. It also
+// refreshes OpenWindows.
+func normalizeAvailability(sublease *SubleasingRequest) string {
+	period := &sublease.Period
+	windows := sublease.Availability
+	if len(windows) > maxAvailabilityWindows {
+		return fmt.Sprintf("A sublease can have at most %d availability windows", maxAvailabilityWindows)
+	}
+	for i := range windows {
+		w := &windows[i]
+		if w.StartDate.IsZero() || w.EndDate.IsZero() {
+			return "Each availability window needs a start_date and an end_date"
+		}
+		w.StartDate, w.EndDate = civilDate(w.StartDate), civilDate(w.EndDate)
+		if w.EndDate.Before(w.StartDate) {
+			return "An availability window cannot end before it starts"
+		}
+	}
+	if period.StartDate.IsZero() && period.EndDate.IsZero() && len(windows) > 0 {
+		period.StartDate, period.EndDate = windows[0].StartDate, windows[0].EndDate
+		for _, w := range windows[1:] {
+			if w.StartDate.Before(period.StartDate) {
+				period.StartDate = w.StartDate
+			}
+			if w.EndDate.After(period.EndDate) {
+				period.EndDate = w.EndDate
+			}
+		}
+	}
+	if period.StartDate.IsZero() || period.EndDate.IsZero() {
+		return "Missing rental period"
+	}
+	period.StartDate, period.EndDate = civilDate(period.StartDate), civilDate(period.EndDate)
+	if period.EndDate.Before(period.StartDate) {
+		return "The rental period cannot end before it starts"
+	}
+	if len(windows) == 0 {
+		sublease.Availability = nil
+		sublease.OpenWindows = []DateRange{*period}
+		return ""
+	}
+
+	sorted := append([]DateRange(nil), windows...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].StartDate.Before(sorted[j].StartDate) })
+	merged := []DateRange{}
+	for _, w := range sorted {
+		if !period.covers(w) {
+			return "Availability windows must fall within the rental period"
+		}
+		if n := len(merged); n > 0 && !w.StartDate.After(merged[n-1].EndDate.AddDate(0, 0, 1)) {
+			if w.EndDate.After(merged[n-1].EndDate) {
+				merged[n-1].EndDate = w.EndDate
+			}
+			continue
+		}
+		merged = append(merged, w)
+	}
+	sublease.Availability, sublease.OpenWindows = merged, merged
+	return ""
+}
+
+// migrateAvailability gives subleases stored before availability windows
+// existed a single open window spanning their period.
+func migrateAvailability(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("subleasing_requests").UpdateMany(ctx,
+		bson.M{"open_windows": bson.M{"$exists": false}, "period.start_date": bson.M{"$exists": true}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"open_windows": bson.A{"$period"}}}}},
+	)
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func day(month time.Month, d int) time.Time {
+	return time.Date(2025, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestNormalizeAvailability(t *testing.T) {
+	sublease := SubleasingRequest{Availability: []DateRange{
+		{StartDate: day(7, 1), EndDate: day(7, 31)},
+		{StartDate: day(6, 1), EndDate: day(6, 30)},
+		{StartDate: day(8, 15), EndDate: day(8, 20)},
+		{StartDate: day(8, 18), EndDate: day(8, 25)},
+	}}
+	assert.Equal(t, "", normalizeAvailability(&sublease))
+	assert.Equal(t, DateRange{StartDate: day(6, 1), EndDate: day(8, 25)}, sublease.Period, "the period spans the windows")
+	assert.Equal(t, []DateRange{
+		{StartDate: day(6, 1), EndDate: day(7, 31)},
+		{StartDate: day(8, 15), EndDate: day(8, 25)},
+	}, sublease.Availability, "back-to-back and overlapping windows merge")
+	assert.Equal(t, sublease.Availability, sublease.OpenWindows)
+
+	plain := SubleasingRequest{Period: DateRange{StartDate: day(5, 1), EndDate: day(8, 1)}}
+	assert.Equal(t, "", normalizeAvailability(&plain))
+	assert.Nil(t, plain.Availability)
+	assert.Equal(t, []DateRange{plain.Period}, plain.OpenWindows)
+
+	tests := []struct {
+		description string
+		sublease    SubleasingRequest
+	}{
+		{"Period ends before it starts", SubleasingRequest{Period: DateRange{StartDate: day(8, 1), EndDate: day(5, 1)}}},
+		{"Window ends before it starts", SubleasingRequest{Availability: []DateRange{{StartDate: day(8, 1), EndDate: day(5, 1)}}}},
+		{"Window outside the period", SubleasingRequest{
+			Period:       DateRange{StartDate: day(5, 1), EndDate: day(6, 1)},
+			Availability: []DateRange{{StartDate: day(5, 15), EndDate: day(6, 15)}},
+		}},
+		{"No dates", SubleasingRequest{}},
+	}
+	for _, test := range tests {
+		assert.NotEqual(t, "", normalizeAvailability(&test.sublease), test.description)
+	}
+}
+
+func TestSubleaseAvailabilitySearch(t *testing.T) {
+	s, r := newTestServer()
+	token := loginAs(t, s, "alice")
+	post := func(title, dates string) int {
+		body := `{"title": "` + title + `", "description": "Near campus", "location": {"city": "Gainesville", "state": "FL", "country": "USA"}, "rent": 600, ` + dates + `}`
+		return serve(r, "POST", "/api/subleasing", token, body).Code
+	}
+	assert.Equal(t, http.StatusCreated, post("Summer", `"period": {"start_date": "2025-05-15T00:00:00Z", "end_date": "2025-08-15T00:00:00Z"}`))
+	assert.Equal(t, http.StatusCreated, post("Split", `"availability": [{"start_date": "2025-05-01T00:00:00Z", "end_date": "2025-06-20T00:00:00Z"}, {"start_date": "2025-07-10T00:00:00Z", "end_date": "2025-09-01T00:00:00Z"}]`))
+	assert.Equal(t, http.StatusCreated, post("June only", `"period": {"start_date": "2025-06-01T00:00:00Z", "end_date": "2025-06-30T00:00:00Z"}`))
+	assert.Equal(t, http.StatusBadRequest, post("Backwards", `"period": {"start_date": "2025-08-01T00:00:00Z", "end_date": "2025-05-01T00:00:00Z"}`))
+
+	tests := []struct {
+		description    string
+		query          string
+		expectedCode   int
+		expectedTitles []string
+	}{
+		{"Whole summer", "available_from=2025-06-01&available_to=2025-08-10", http.StatusOK, []string{"Summer"}},
+		{"Early June", "available_from=2025-06-01&available_to=2025-06-15", http.StatusOK, []string{"June only", "Split", "Summer"}},
+		{"Gap between windows", "available_from=2025-06-25", http.StatusOK, []string{"June only", "Summer"}},
+		{"Late summer", "available_from=2025-08-01&available_to=2025-08-31", http.StatusOK, []string{"Split"}},
+		{"Backwards range", "available_from=2025-08-01&available_to=2025-06-01", http.StatusBadRequest, nil},
+		{"Invalid date", "available_to=august", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		rr := serve(r, "GET", "/api/getSubleasingRequests?"+test.query, "", "")
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+		if test.expectedCode != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Subleases []SubleasingRequest `json:"requests"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		var titles []string
+		for _, sublease := range body.Subleases {
+			titles = append(titles, sublease.Title)
+		}
+		assert.ElementsMatch(t, test.expectedTitles, titles, test.description)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignV4(t *testing.T) {
+	// get-vanilla from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	signV4(req, sha256Hex(nil), "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+// fakeS3 is a minimal path-style S3 stand-in that keeps objects in memory
+// and rejects unsigned requests.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]memoryBlob
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[r.URL.Path] = memoryBlob{contentType: r.Header.Get("Content-Type"), data: body}
+	case http.MethodGet:
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Write(obj.data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	ctx := context.Background()
+
+	_, _, err := store.Get(ctx, "missing.png")
+	assert.ErrorIs(t, err, errNotFound)
+
+	assert.NoError(t, store.Put(ctx, "a1.png", "image/png", []byte("pixels")))
+	data, contentType, err := store.Get(ctx, "a1.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "pixels", string(data))
+	assert.Equal(t, "image/png", contentType)
+
+	assert.NoError(t, store.Delete(ctx, "a1.png"))
+	_, _, err = store.Get(ctx, "a1.png")
+	assert.ErrorIs(t, err, errNotFound)
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	store := newLocalBlobStore(t.TempDir())
+	testBlobStore(t, store)
+
+	assert.Error(t, store.Put(context.Background(), "../escape.png", "image/png", nil))
+}
+
+func TestS3BlobStore(t *testing.T) {
+	server := httptest.NewServer(&fakeS3{objects: map[string]memoryBlob{}})
+	defer server.Close()
+
+	testBlobStore(t, newS3BlobStore(server.URL, "us-east-1", "pictures", "test-key", "test-secret"))
+
+	unauthorized := newS3BlobStore(server.URL, "us-east-1", "pictures", "other-key", "test-secret")
+	assert.Error(t, unauthorized.Put(context.Background(), "a1.png", "image/png", []byte("pixels")))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// calendarDomain qualifies event UIDs. It must never change, or calendar
+// apps would see every event as new.
+const calendarDomain = "uni-marketplace"
+
+// meetingLength is how long a scheduled exchange meeting is shown for.
+const meetingLength = time.Hour
+
+// calendarEvent is one VEVENT. Events with AllDay set span whole days from
+// Start to End inclusive; others are timed in UTC.
+type calendarEvent struct {
+	UID         string
+	Sequence    int64
+	Stamp       time.Time
+	Start, End  time.Time
+	AllDay      bool
+	Summary     string
+	Description string
+	Location    string
+	Cancelled   bool
+}
+
+// writeCalendar renders events as an RFC 5545 calendar named name.
+func writeCalendar(w http.ResponseWriter, name, filename string, events []calendarEvent) {
+	var b strings.Builder
+	line := func(s string) {
+		// Lines are folded at 75 octets, continuing with a space
+		for len(s) > 75 {
+			cut := 75
+			for cut > 0 && s[cut]&0xC0 == 0x80 {
+				cut-- // keep UTF-8 sequences whole
+			}
+			b.WriteString(s[:cut] + "\r\n")
+			s = " " + s[cut:]
+		}
+		b.WriteString(s + "\r\n")
+	}
+
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//UniMarketplace//Calendar//EN")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	line("X-WR-CALNAME:" + icsText(name))
+	for _, e := range events {
+		line("BEGIN:VEVENT")
+		line("UID:" + e.UID)
+		line(fmt.Sprintf("SEQUENCE:%d", e.Sequence))
+		line("DTSTAMP:" + icsTime(e.Stamp))
+		if e.AllDay {
+			line("DTSTART;VALUE=DATE:" + e.Start.UTC().Format("20060102"))
+			line("DTEND;VALUE=DATE:" + e.End.UTC().AddDate(0, 0, 1).Format("20060102"))
+		} else {
+			line("DTSTART:" + icsTime(e.Start))
+			line("DTEND:" + icsTime(e.End))
+		}
+		line("SUMMARY:" + icsText(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION:" + icsText(e.Description))
+		}
+		if e.Location != "" {
+			line("LOCATION:" + icsText(e.Location))
+		}
+		if e.Cancelled {
+			line("STATUS:CANCELLED")
+		} else {
+			line("STATUS:CONFIRMED")
+		}
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="`+filename+`"`)
+	w.Write([]byte(b.String()))
+}
+
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsText escapes a TEXT property value.
+func icsText(s string) string {
+	return icsEscaper.Replace(s)
+}
+
+// subleaseEvents has one all-day event per open window of sublease. The
+// UIDs are keyed by window position, so editing a window updates its event.
+func subleaseEvents(sublease *SubleasingRequest) []calendarEvent {
+	windows := sublease.OpenWindows
+	if len(windows) == 0 {
+		windows = []DateRange{sublease.Period}
+	}
+	location := strings.Join(nonEmpty(sublease.Location.City, sublease.Location.State, sublease.Location.Country), ", ")
+	var events []calendarEvent
+	for i, window := range windows {
+		events = append(events, calendarEvent{
+			UID:         fmt.Sprintf("sublease-%s-%d@%s", sublease.ID.Hex(), i, calendarDomain),
+			Sequence:    sublease.Version,
+			Stamp:       sublease.UpdatedAt,
+			Start:       window.StartDate,
+			End:         window.EndDate,
+			AllDay:      true,
+			Summary:     "Sublease available: " + sublease.Title,
+			Description: fmt.Sprintf("%s\n\nRent: %s %s %s", sublease.Description, sublease.Rent, sublease.Currency, sublease.rentPeriod()),
+			Location:    location,
+			Cancelled:   sublease.Status == statusExpired,
+		})
+	}
+	return events
+}
+
+// meetingEvent is the event for a trade's meeting, seen by userID.
+func meetingEvent(match *ExchangeMatch, userID string) calendarEvent {
+	mine, theirs := match.Sides[0], match.Sides[1]
+	if theirs.UserID == userID {
+		mine, theirs = theirs, mine
+	}
+	return calendarEvent{
+		UID:      fmt.Sprintf("exchange-match-%s@%s", match.ID.Hex(), calendarDomain),
+		Sequence: match.Version,
+		Stamp:    match.UpdatedAt,
+		Start:    match.Meeting.At,
+		End:      match.Meeting.At.Add(meetingLength),
+		Summary:  fmt.Sprintf("Currency exchange with %s", theirs.UserID),
+		Description: fmt.Sprintf("You hand over %s %s and receive %s %s.",
+			mine.Amount, mine.Currency, theirs.Amount, theirs.Currency),
+		Location:  match.Meeting.Place,
+		Cancelled: match.Status == matchCancelled,
+	}
+}
+
+func nonEmpty(values ...string) []string {
+	var out []string
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// newFeedKey returns a random calendar feed signing key.
+func newFeedKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// calendarFeedKey returns the key feed URLs are signed with: the configured
+// secret, or else one generated on first start and kept in db, so that
+// subscribed URLs keep working across restarts.
+func calendarFeedKey(ctx context.Context, cfg Config, db *mongo.Database) ([]byte, error) {
+	if cfg.CalendarFeedSecret != "" {
+		return []byte(cfg.CalendarFeedSecret), nil
+	}
+	var stored struct {
+		Key []byte `bson:"key"`
+	}
+	err := db.Collection("server_keys").FindOneAndUpdate(ctx,
+		bson.M{"_id": "calendar_feed"},
+		bson.M{"$setOnInsert": bson.M{"key": newFeedKey()}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&stored)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored.Key) == 0 {
+		return nil, errors.New("stored calendar feed key is empty")
+	}
+	return stored.Key, nil
+}
+
+// feedToken authorizes the calendar feed of userID. Calendar apps cannot
+// send a bearer token, so the feed URL carries this signature instead.
+func (s *Server) feedToken(userID string) string {
+	mac := hmac.New(sha256.New, s.feedKey)
+	mac.Write([]byte("calendar-feed:" + userID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// getSubleaseCalendar serves a sublease's availability as an .ics feed.
+func (s *Server) getSubleaseCalendar(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	sublease, err := s.store.Subleases.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Sublease not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		http.Error(w, "Failed to load sublease", http.StatusInternalServerError)
+		return
+	}
+	writeCalendar(w, sublease.Title, "sublease-"+id.Hex()+".ics", subleaseEvents(sublease))
+}
+
+// getCalendarFeedURL returns the caller's personal feed URL.
+func (s *Server) getCalendarFeedURL(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID := currentUserID(r)
+	feed := s.publicURL + "/api/users/" + url.PathEscape(userID) + "/calendar.ics?token=" + s.feedToken(userID)
+	json.NewEncoder(w).Encode(map[string]string{"url": feed})
+}
+
+// getUserCalendar serves a user's subleases and exchange meetings as an
+// .ics feed, authorized by the token from getCalendarFeedURL.
+func (s *Server) getUserCalendar(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	token := r.URL.Query().Get("token")
+	if !hmac.Equal([]byte(token), []byte(s.feedToken(userID))) {
+		http.Error(w, "Invalid calendar token", http.StatusForbidden)
+		return
+	}
+
+	subleases, err := s.store.Subleases.ListByUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		http.Error(w, "Failed to load calendar", http.StatusInternalServerError)
+		return
+	}
+	var events []calendarEvent
+	for i := range subleases {
+		events = append(events, subleaseEvents(&subleases[i])...)
+	}
+
+	requests, err := s.store.Exchanges.ListByUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		http.Error(w, "Failed to load calendar", http.StatusInternalServerError)
+		return
+	}
+	var meetings []calendarEvent
+	for _, request := range requests {
+		matches, err := s.store.Matches.ListByRequest(r.Context(), request.ID)
+		if err != nil {
+			log.Printf("Database error: %v\n", err)
+			http.Error(w, "Failed to load calendar", http.StatusInternalServerError)
+			return
+		}
+		for i := range matches {
+			if matches[i].Meeting != nil {
+				meetings = append(meetings, meetingEvent(&matches[i], userID))
+			}
+		}
+	}
+	sort.SliceStable(meetings, func(i, j int) bool { return meetings[i].Start.Before(meetings[j].Start) })
+
+	writeCalendar(w, "UniMarketplace", "calendar.ics", append(events, meetings...))
+}
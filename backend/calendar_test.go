@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubleaseCalendar(t *testing.T) {
+	s, r := newTestServer()
+	token := loginAs(t, s, "alice")
+	body := `{"title": "Room, near campus", "description": "` + strings.Repeat("Sunny room with a desk. ", 10) + `", "location": {"city": "Gainesville", "state": "FL", "country": "USA"}, "rent": 600,
+		"availability": [{"start_date": "2025-05-01T00:00:00Z", "end_date": "2025-06-20T00:00:00Z"}, {"start_date": "2025-07-10T00:00:00Z", "end_date": "2025-08-01T00:00:00Z"}]}`
+	rr := serve(r, "POST", "/api/subleasing", token, body)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var sublease SubleasingRequest
+	json.Unmarshal(rr.Body.Bytes(), &sublease)
+
+	rr = serve(r, "GET", "/api/subleasing/"+sublease.ID.Hex()+"/calendar.ics", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/calendar; charset=utf-8", rr.Header().Get("Content-Type"))
+	ics := rr.Body.String()
+	assert.Equal(t, 2, strings.Count(ics, "BEGIN:VEVENT"))
+	assert.Contains(t, ics, "UID:sublease-"+sublease.ID.Hex()+"-0@uni-marketplace\r\n")
+	assert.Contains(t, ics, "DTSTART;VALUE=DATE:20250710\r\n")
+	assert.Contains(t, ics, "DTEND;VALUE=DATE:20250802\r\n", "all-day DTEND is exclusive")
+	assert.Contains(t, ics, `SUMMARY:Sublease available: Room\, near campus`)
+	for _, line := range strings.Split(strings.TrimSuffix(ics, "\r\n"), "\r\n") {
+		assert.LessOrEqual(t, len(line), 75, "lines are folded")
+	}
+
+	rr = serve(r, "GET", "/api/subleasing/000000000000000000000000/calendar.ics", "", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestUserCalendar(t *testing.T) {
+	f := newTradeFixture(t)
+	when := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Minute)
+	meeting := `{"at": "` + when.Format(time.RFC3339) + `", "place": "Marston Library"}`
+	assert.Equal(t, http.StatusOK, f.post("alice", f.aliceMatches+"/meeting", meeting))
+
+	rr := serve(f.r, "GET", "/api/calendar/feed", f.tokens["bob"], "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var feed struct {
+		URL string `json:"url"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &feed)
+	assert.True(t, strings.HasPrefix(feed.URL, "/api/users/bob/calendar.ics?token="))
+
+	rr = serve(f.r, "GET", feed.URL, "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	ics := rr.Body.String()
+	assert.Contains(t, ics, "UID:exchange-match-"+f.match.ID.Hex()+"@uni-marketplace\r\n")
+	assert.Contains(t, ics, "DTSTART:"+when.Format("20060102T150405Z")+"\r\n")
+	assert.Contains(t, ics, "SUMMARY:Currency exchange with alice\r\n")
+	assert.Contains(t, ics, "LOCATION:Marston Library\r\n")
+	assert.Contains(t, ics, "You hand over 8500.00 INR and receive 100.00 USD.")
+
+	// Moving the meeting keeps the UID and bumps the sequence
+	moved := `{"at": "` + when.Add(time.Hour).Format(time.RFC3339) + `", "place": "Reitz Union"}`
+	assert.Equal(t, http.StatusOK, f.post("bob", f.bobMatches+"/meeting", moved))
+	updated := serve(f.r, "GET", feed.URL, "", "").Body.String()
+	assert.Equal(t, 1, strings.Count(updated, "BEGIN:VEVENT"))
+	assert.Contains(t, updated, "LOCATION:Reitz Union\r\n")
+	assert.NotEqual(t, between(ics, "SEQUENCE:", "\r\n"), between(updated, "SEQUENCE:", "\r\n"))
+
+	rr = serve(f.r, "GET", strings.Replace(feed.URL, "/bob/", "/alice/", 1), "", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code, "a token only opens its own user's feed")
+	rr = serve(f.r, "GET", "/api/users/bob/calendar.ics", "", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+// between returns the text after the first start up to the next end.
+func between(s, start, end string) string {
+	_, rest, _ := strings.Cut(s, start)
+	value, _, _ := strings.Cut(rest, end)
+	return value
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultAtlasHost is the team cluster used when only MongoDB credentials
+// are configured, which is how existing .env files are written.
+const defaultAtlasHost = "unimarketplace.j4fsn.mongodb.net"
+
+// Config is the server configuration. Values are layered: defaults, then the
+// optional JSON config file, then environment variables, then flags.
+type Config struct {
+	MongoURI      string   `json:"mongodb_uri"`
+	MongoHost     string   `json:"mongodb_host"`
+	MongoUsername string   `json:"mongodb_username"`
+	MongoPassword string   `json:"mongodb_password"`
+	Database      string   `json:"database"`
+	Port          int      `json:"port"`
+	CORSOrigins   []string `json:"cors_origins"`
+
+	OTPSecret          string `json:"otp_secret"`
+	CalendarFeedSecret string `json:"calendar_feed_secret"`
+	SMTPHost           string `json:"smtp_host"`
+	SMTPPort           int    `json:"smtp_port"`
+	SMTPUsername       string `json:"smtp_username"`
+	SMTPPassword       string `json:"smtp_password"`
+	SMTPFrom           string `json:"smtp_from"`
+	MailOutboxFile     string `json:"mail_outbox_file"`
+
+	ListingMaxAgeDays  int `json:"listing_max_age_days"`
+	ExpiryWarningDays  int `json:"expiry_warning_days"`
+	ExpiryCheckMinutes int `json:"expiry_check_minutes"`
+
+	// PublicURL is the externally visible base URL of the API, used to build
+	// image URLs. Empty means URLs relative to the API host.
+	PublicURL         string `json:"public_url"`
+	UploadDir         string `json:"upload_dir"`
+	S3Endpoint        string `json:"s3_endpoint"`
+	S3Region          string `json:"s3_region"`
+	S3Bucket          string `json:"s3_bucket"`
+	S3AccessKeyID     string `json:"s3_access_key_id"`
+	S3SecretAccessKey string `json:"s3_secret_access_key"`
+
+	// RatesURL is a JSON exchange rate API, with {base} standing for the
+	// base currency; RatesFile is a local rate table. With neither, built-in
+	// fixture rates are used.
+	RatesURL          string `json:"rates_url"`
+	RatesFile         string `json:"rates_file"`
+	RatesCacheMinutes int    `json:"rates_cache_minutes"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Database: "uni_marketplace",
+		Port:     8080,
+		CORSOrigins: []string{
+			"http://localhost:5173",
+			"http://localhost:5174",
+			"http://localhost:5175",
+			"http://localhost:5176",
+		},
+		SMTPPort: 587,
+
+		ListingMaxAgeDays:  30,
+		ExpiryWarningDays:  3,
+		ExpiryCheckMinutes: 60,
+
+		UploadDir: "uploads",
+		S3Region:  "us-east-1",
+
+		RatesCacheMinutes: 60,
+	}
+}
+
+// loadConfig builds the configuration from args (without the program name)
+// and getenv. The config file is named by -config or CONFIG_FILE.
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("uni-marketplace", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("CONFIG_FILE"), "path to a JSON config file")
+	mongoURI := fs.String("mongodb-uri", "", "MongoDB connection URI")
+	database := fs.String("db", "", "MongoDB database name")
+	port := fs.Int("port", 0, "HTTP port to listen on")
+	corsOrigins := fs.String("cors-origins", "", "comma-separated list of allowed CORS origins")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %w", *configFile, err)
+		}
+	}
+
+	if err := applyEnv(&cfg, getenv); err != nil {
+		return cfg, err
+	}
+
+	if *mongoURI != "" {
+		cfg.MongoURI = *mongoURI
+	}
+	if *database != "" {
+		cfg.Database = *database
+	}
+	if *port != 0 {
+		cfg.Port = *port
+	}
+	if *corsOrigins != "" {
+		cfg.CORSOrigins = splitList(*corsOrigins)
+	}
+
+	return cfg, cfg.validate()
+}
+
+func applyEnv(cfg *Config, getenv func(string) string) error {
+	stringVars := map[string]*string{
+		"MONGODB_URI":          &cfg.MongoURI,
+		"MONGODB_HOST":         &cfg.MongoHost,
+		"MONGODB_USERNAME":     &cfg.MongoUsername,
+		"MONGODB_PASSWORD":     &cfg.MongoPassword,
+		"MONGODB_DATABASE":     &cfg.Database,
+		"OTP_SECRET":           &cfg.OTPSecret,
+		"CALENDAR_FEED_SECRET": &cfg.CalendarFeedSecret,
+		"SMTP_HOST":            &cfg.SMTPHost,
+		"SMTP_USERNAME":        &cfg.SMTPUsername,
+		"SMTP_PASSWORD":        &cfg.SMTPPassword,
+		"SMTP_FROM":            &cfg.SMTPFrom,
+		"MAIL_OUTBOX_FILE":     &cfg.MailOutboxFile,
+		"PUBLIC_URL":           &cfg.PublicURL,
+		"UPLOAD_DIR":           &cfg.UploadDir,
+		"S3_ENDPOINT":          &cfg.S3Endpoint,
+		"S3_REGION":            &cfg.S3Region,
+		"S3_BUCKET":            &cfg.S3Bucket,
+		"S3_ACCESS_KEY_ID":     &cfg.S3AccessKeyID,
+		"S3_SECRET_ACCESS_KEY": &cfg.S3SecretAccessKey,
+		"RATES_URL":            &cfg.RatesURL,
+		"RATES_FILE":           &cfg.RatesFile,
+	}
+	for key, field := range stringVars {
+		if v := getenv(key); v != "" {
+			*field = v
+		}
+	}
+
+	intVars := map[string]*int{
+		"PORT":                 &cfg.Port,
+		"SMTP_PORT":            &cfg.SMTPPort,
+		"LISTING_MAX_AGE_DAYS": &cfg.ListingMaxAgeDays,
+		"EXPIRY_WARNING_DAYS":  &cfg.ExpiryWarningDays,
+		"EXPIRY_CHECK_MINUTES": &cfg.ExpiryCheckMinutes,
+		"RATES_CACHE_MINUTES":  &cfg.RatesCacheMinutes,
+	}
+	for key, field := range intVars {
+		if v := getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s must be a number, got %q", key, v)
+			}
+			*field = n
+		}
+	}
+
+	if v := getenv("CORS_ORIGINS"); v != "" {
+		cfg.CORSOrigins = splitList(v)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c Config) validate() error {
+	var errs []error
+	if c.MongoURI != "" && !strings.HasPrefix(c.MongoURI, "mongodb://") && !strings.HasPrefix(c.MongoURI, "mongodb+srv://") {
+		errs = append(errs, errors.New("mongodb_uri must start with mongodb:// or mongodb+srv://"))
+	}
+	if c.MongoUsername != "" && c.MongoPassword == "" {
+		errs = append(errs, errors.New("mongodb_password is required with mongodb_username"))
+	}
+	if c.Database == "" || strings.ContainsAny(c.Database, `/\. "$`) {
+		errs = append(errs, fmt.Errorf("invalid database name %q", c.Database))
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d is out of range", c.Port))
+	}
+	if len(c.CORSOrigins) == 0 {
+		errs = append(errs, errors.New("at least one CORS origin is required"))
+	}
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			errs = append(errs, fmt.Errorf("invalid CORS origin %q", origin))
+		}
+	}
+	if c.CalendarFeedSecret != "" && c.CalendarFeedSecret == c.OTPSecret {
+		errs = append(errs, errors.New("calendar_feed_secret must differ from otp_secret"))
+	}
+	if c.SMTPHost != "" && (c.SMTPPort < 1 || c.SMTPPort > 65535) {
+		errs = append(errs, fmt.Errorf("smtp port %d is out of range", c.SMTPPort))
+	}
+	if c.S3Bucket != "" && (c.S3AccessKeyID == "" || c.S3SecretAccessKey == "") {
+		errs = append(errs, errors.New("s3_access_key_id and s3_secret_access_key are required with s3_bucket"))
+	}
+	if c.S3Bucket == "" && c.UploadDir == "" {
+		errs = append(errs, errors.New("upload_dir is required when no s3_bucket is set"))
+	}
+	if c.ListingMaxAgeDays < 1 {
+		errs = append(errs, errors.New("listing_max_age_days must be at least 1"))
+	}
+	if c.ExpiryWarningDays < 0 || c.ExpiryWarningDays >= c.ListingMaxAgeDays {
+		errs = append(errs, errors.New("expiry_warning_days must be between 0 and listing_max_age_days"))
+	}
+	if c.ExpiryCheckMinutes < 1 {
+		errs = append(errs, errors.New("expiry_check_minutes must be at least 1"))
+	}
+	if c.RatesURL != "" {
+		u, err := url.Parse(c.RatesURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid rates_url %q", c.RatesURL))
+		}
+	}
+	if c.RatesCacheMinutes < 1 {
+		errs = append(errs, errors.New("rates_cache_minutes must be at least 1"))
+	}
+	return errors.Join(errs...)
+}
+
+// mongoConnectionURI resolves where to connect: an explicit URI wins, then
+// credentials against MONGODB_HOST (the team Atlas cluster by default), and
+// finally a local mongod.
+func (c Config) mongoConnectionURI() string {
+	if c.MongoURI != "" {
+		return c.MongoURI
+	}
+	if c.MongoUsername != "" {
+		host := c.MongoHost
+		if host == "" {
+			host = defaultAtlasHost
+		}
+		return fmt.Sprintf("mongodb+srv://%s:%s@%s/?retryWrites=true&w=majority&appName=unimarketplace",
+			url.QueryEscape(c.MongoUsername), url.QueryEscape(c.MongoPassword), host)
+	}
+	if c.MongoHost != "" {
+		return "mongodb://" + c.MongoHost
+	}
+	return "mongodb://localhost:27017"
+}
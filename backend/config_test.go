@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func envMap(vars map[string]string) func(string) string {
+	return func(key string) string { return vars[key] }
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(nil, envMap(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "uni_marketplace", cfg.Database)
+	assert.Equal(t, 8080, cfg.Port)
+	assert.Len(t, cfg.CORSOrigins, 4)
+	assert.Equal(t, "mongodb://localhost:27017", cfg.mongoConnectionURI())
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"database": "from_file", "port": 9000, "cors_origins": ["https://staging.example.edu"]}`), 0o600)
+
+	cfg, err := loadConfig([]string{"-port", "9100"}, envMap(map[string]string{
+		"CONFIG_FILE": path,
+		"PORT":        "9050",
+		"MONGODB_URI": "mongodb://db.internal:27017",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, "from_file", cfg.Database, "file overrides defaults")
+	assert.Equal(t, []string{"https://staging.example.edu"}, cfg.CORSOrigins)
+	assert.Equal(t, 9100, cfg.Port, "flags override env and file")
+	assert.Equal(t, "mongodb://db.internal:27017", cfg.mongoConnectionURI())
+}
+
+func TestLoadConfigAtlasCredentials(t *testing.T) {
+	cfg, err := loadConfig(nil, envMap(map[string]string{
+		"MONGODB_USERNAME": "team",
+		"MONGODB_PASSWORD": "p@ss",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, "mongodb+srv://team:p%40ss@"+defaultAtlasHost+"/?retryWrites=true&w=majority&appName=unimarketplace", cfg.mongoConnectionURI())
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		description string
+		args        []string
+		env         map[string]string
+	}{
+		{"non-numeric port", nil, map[string]string{"PORT": "eighty"}},
+		{"port out of range", []string{"-port", "70000"}, nil},
+		{"bad database name", []string{"-db", "uni.marketplace"}, nil},
+		{"bad mongo uri", nil, map[string]string{"MONGODB_URI": "postgres://localhost"}},
+		{"bad cors origin", nil, map[string]string{"CORS_ORIGINS": "localhost:5173"}},
+		{"username without password", nil, map[string]string{"MONGODB_USERNAME": "team"}},
+		{"missing config file", []string{"-config", "/does/not/exist.json"}, nil},
+		{"bad rates url", nil, map[string]string{"RATES_URL": "rates.example.com/latest"}},
+		{"feed key reuses the otp key", nil, map[string]string{"OTP_SECRET": "shared", "CALENDAR_FEED_SECRET": "shared"}},
+	}
+
+	for _, test := range tests {
+		_, err := loadConfig(test.args, envMap(test.env))
+		assert.Error(t, err, test.description)
+	}
+}
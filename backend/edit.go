@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// editableRepository is the part of a listing repository the edit handlers
+// need.
+type editableRepository[T any] interface {
+	Get(ctx context.Context, id primitive.ObjectID) (*T, error)
+	Replace(ctx context.Context, doc *T, expectedVersion int64) error
+}
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// expectedVersion reads the version the client edited, from If-Match or,
+// failing that, the "version" field of the body.
+func expectedVersion(r *http.Request, body []byte) (int64, bool) {
+	if match := r.Header.Get("If-Match"); match != "" {
+		match = strings.Trim(strings.TrimPrefix(match, "W/"), `"`)
+		v, err := strconv.ParseInt(match, 10, 64)
+		return v, err == nil
+	}
+	var payload struct {
+		Version *int64 `json:"version"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Version == nil {
+		return 0, false
+	}
+	return *payload.Version, true
+}
+
+// updateRecord handles PATCH and PUT for one listing type. PATCH merges the
+// body into the stored document; PUT replaces every editable field. Either
+// way the result must pass the same validation as creation, and the write
+// only succeeds if nobody else has saved a newer version in the meantime.
+// conflict, if set, vetoes with 409 an edit that clashes with state the
+// owner cannot change, such as trades already under way. It returns the
+// document before and after the edit, or nils if it failed.
+func updateRecord[T any, P record[T]](w http.ResponseWriter, r *http.Request, repo editableRepository[T], validate func(*T) string, conflict func(before, after *T) string) (before, after *T) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	existing, err := repo.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load listing"})
+		return nil, nil
+	}
+
+	if !canModify(r, P(existing).ownerID()) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You can only edit your own listings"})
+		return nil, nil
+	}
+
+	version, ok := expectedVersion(r, body)
+	if !ok {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Send the version being edited in If-Match or the version field"})
+		return nil, nil
+	}
+	if version != P(existing).recordVersion() {
+		w.Header().Set("ETag", etag(P(existing).recordVersion()))
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(map[string]string{"error": errVersionConflict.Error()})
+		return nil, nil
+	}
+
+	var updated T
+	if r.Method == http.MethodPatch {
+		updated = *existing
+	}
+	if err := json.Unmarshal(body, &updated); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, nil
+	}
+	P(&updated).restoreServerFields(existing)
+	P(&updated).setUpdatedAt(time.Now())
+
+	if msg := validate(&updated); msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return nil, nil
+	}
+	if conflict != nil {
+		if msg := conflict(existing, &updated); msg != "" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+			return nil, nil
+		}
+	}
+
+	err = repo.Replace(r.Context(), &updated, version)
+	switch {
+	case errors.Is(err, errVersionConflict):
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return nil, nil
+	case errors.Is(err, errNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
+		return nil, nil
+	case err != nil:
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update listing"})
+		return nil, nil
+	}
+
+	w.Header().Set("ETag", etag(P(&updated).recordVersion()))
+	json.NewEncoder(w).Encode(updated)
+	return existing, &updated
+}
+
+func (s *Server) updateMarketplaceListing(w http.ResponseWriter, r *http.Request) {
+	before, after := updateRecord[MarketplaceListing](w, r, s.store.Listings, func(l *MarketplaceListing) string {
+		l.PictureVariants = pictureVariants(l.Pictures)
+		return validateListing(l)
+	}, nil)
+	if after != nil {
+		s.search.putListing(after)
+		s.listingPriceChanged(r.Context(), before, after)
+	}
+}
+
+func (s *Server) updateCurrencyExchangeRequest(w http.ResponseWriter, r *http.Request) {
+	_, after := updateRecord[CurrencyExchangeRequest](w, r, s.store.Exchanges, func(c *CurrencyExchangeRequest) string {
+		if c.exchangeStatus() != exchangeOpen {
+			return "Only open exchange requests can be edited"
+		}
+		if msg := validateExchangeRequest(c); msg != "" {
+			return msg
+		}
+		s.quoteExchangeRequest(r.Context(), c)
+		return ""
+	}, func(before, after *CurrencyExchangeRequest) string {
+		return s.exchangeEditConflict(r.Context(), before, after)
+	})
+	if after != nil {
+		if err := s.matcher.propose(r.Context(), after); err != nil {
+			log.Printf("Database error: %v\n", err)
+		}
+	}
+}
+
+// exchangeEditConflict keeps an edit from pulling the ground from under
+// fills and matches: the currencies are fixed once anything is filled or a
+// match is open, and the amount cannot drop below what is filled plus what
+// pending proposals promise.
+func (s *Server) exchangeEditConflict(ctx context.Context, before, after *CurrencyExchangeRequest) string {
+	matches, err := s.store.Matches.ListByRequest(ctx, before.ID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		return "Could not check the request's matches"
+	}
+	open := false
+	promised := before.Filled.Minor
+	for _, match := range matches {
+		switch match.Status {
+		case matchProposed:
+			promised += match.Sides[match.side(before.ID)].Amount.Minor
+			open = true
+		case matchAccepted, matchMeetingScheduled, matchDisputed:
+			open = true
+		}
+	}
+	currencyChanged := after.FromCurrency != before.FromCurrency || after.ToCurrency != before.ToCurrency
+	if currencyChanged && (before.Filled.Minor > 0 || open) {
+		return "The currencies cannot change once part of the request is filled or matched"
+	}
+	if !currencyChanged && after.Amount.Minor < promised {
+		return "The amount cannot be less than what is already filled or proposed"
+	}
+	return ""
+}
+
+func (s *Server) updateSubleasingRequest(w http.ResponseWriter, r *http.Request) {
+	before, after := updateRecord[SubleasingRequest](w, r, s.store.Subleases, func(sub *SubleasingRequest) string {
+		sub.PictureVariants = pictureVariants(sub.Pictures)
+		return validateSublease(sub)
+	}, nil)
+	if after != nil {
+		s.search.putSublease(after)
+		s.subleaseRentChanged(r.Context(), before, after)
+	}
+}
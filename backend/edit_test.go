@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUpdateMarketplaceListing(t *testing.T) {
+	s, r := newTestServer()
+	owner := loginAs(t, s, "alice")
+	intruder := loginAs(t, s, "bob")
+
+	listing := testListing("alice")
+	listing.Version = 1
+	s.store.Listings.Create(context.Background(), &listing)
+	route := "/api/marketplace/listings/" + listing.ID.Hex()
+
+	tests := []struct {
+		description  string
+		method       string
+		route        string
+		token        string
+		ifMatch      string
+		reqBody      string
+		expectedCode int
+	}{
+		{
+			description:  "PATCH another user's listing",
+			method:       "PATCH",
+			route:        route,
+			token:        intruder,
+			reqBody:      `{"version": 1, "price": 1}`,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			description:  "PATCH without a version",
+			method:       "PATCH",
+			route:        route,
+			token:        owner,
+			reqBody:      `{"price": 250}`,
+			expectedCode: http.StatusPreconditionRequired,
+		},
+		{
+			description:  "PATCH price with If-Match",
+			method:       "PATCH",
+			route:        route,
+			token:        owner,
+			ifMatch:      `"1"`,
+			reqBody:      `{"price": 250, "location": {"city": "Tampa"}, "user_id": "bob"}`,
+			expectedCode: http.StatusOK,
+		},
+		{
+			description:  "PATCH with a stale version",
+			method:       "PATCH",
+			route:        route,
+			token:        owner,
+			reqBody:      `{"version": 1, "price": 200}`,
+			expectedCode: http.StatusPreconditionFailed,
+		},
+		{
+			description:  "PATCH that fails create validation",
+			method:       "PATCH",
+			route:        route,
+			token:        owner,
+			reqBody:      `{"version": 2, "title": ""}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			description:  "PUT without pictures fails create validation",
+			method:       "PUT",
+			route:        route,
+			token:        owner,
+			reqBody:      `{"version": 2, "title": "Desk"}`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			description:  "PATCH unknown listing",
+			method:       "PATCH",
+			route:        "/api/marketplace/listings/" + primitive.NewObjectID().Hex(),
+			token:        owner,
+			reqBody:      `{"version": 1}`,
+			expectedCode: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		req := newRequest(test.method, test.route, test.token, test.reqBody)
+		if test.ifMatch != "" {
+			req.Header.Set("If-Match", test.ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+
+	updated, _ := s.store.Listings.Get(context.Background(), listing.ID)
+	assert.Equal(t, "250.00", updated.Price.String())
+	assert.Equal(t, "Tampa", updated.Location.City)
+	assert.Equal(t, "FL", updated.Location.State, "PATCH keeps nested fields that were not sent")
+	assert.Equal(t, "alice", updated.UserID, "owner cannot be changed")
+	assert.Equal(t, int64(2), updated.Version)
+	assert.True(t, updated.UpdatedAt.After(listing.DatePosted))
+}
+
+func TestUpdateSubleasingRequest(t *testing.T) {
+	s, r := newTestServer()
+	owner := loginAs(t, s, "alice")
+
+	sublease := SubleasingRequest{UserID: "alice", Title: "Room", Description: "Near campus", Rent: money(600, "USD"), Currency: "USD", Version: 1}
+	sublease.Location.City, sublease.Location.State, sublease.Location.Country = "Gainesville", "FL", "USA"
+	sublease.Period.StartDate = time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)
+	sublease.Period.EndDate = time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	s.store.Subleases.Create(context.Background(), &sublease)
+
+	rr := serve(r, "PATCH", "/api/subleasing/"+sublease.ID.Hex(), owner, `{"version": 1, "rent": 550}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `"2"`, rr.Header().Get("ETag"))
+
+	var body SubleasingRequest
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	assert.Equal(t, "550.00", body.Rent.String())
+	assert.Equal(t, "Near campus", body.Description)
+}
+
+func TestUpdateCurrencyExchangeRequest(t *testing.T) {
+	s, r := newTestServer()
+	owner := loginAs(t, s, "alice")
+
+	request := CurrencyExchangeRequest{UserID: "alice", Amount: money(100, "USD"), FromCurrency: "USD", ToCurrency: "INR", Version: 1}
+	s.store.Exchanges.Create(context.Background(), &request)
+
+	rr := serve(r, "PUT", "/api/currency/exchange/"+request.ID.Hex(), owner, `{"version": 1, "amount": 0, "from_currency": "USD", "to_currency": "INR"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = serve(r, "PUT", "/api/currency/exchange/"+request.ID.Hex(), owner, `{"version": 1, "amount": 80, "from_currency": "USD", "to_currency": "EUR"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	updated, _ := s.store.Exchanges.Get(context.Background(), request.ID)
+	assert.Equal(t, "EUR", updated.ToCurrency)
+	assert.Equal(t, int64(8000), updated.Amount.Minor)
+}
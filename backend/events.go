@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Real-time event types.
+const (
+	eventMessage        = "message"
+	eventMessageDeleted = "message_deleted"
+	eventListingStatus  = "listing_status"
+	eventMatch          = "match"
+	// eventReset tells a reconnecting client that events were missed, so it
+	// should reload instead of relying on the stream.
+	eventReset = "reset"
+)
+
+const (
+	// eventBuffer is how many events may wait for one connection before it
+	// is considered too slow and dropped.
+	eventBuffer = 64
+	// eventBacklog is how many recent events are kept for clients that
+	// reconnect with Last-Event-ID.
+	eventBacklog = 1024
+	// eventHeartbeat keeps idle connections from being closed by proxies.
+	eventHeartbeat = 25 * time.Second
+	// eventRetry is how long browsers wait before reconnecting.
+	eventRetry = 3 * time.Second
+)
+
+// Event is one real-time update sent to a user.
+type Event struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	At   time.Time       `json:"at"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// EventHub fans events out to the connections of their recipients. Event
+// IDs are the hub's epoch and a sequence number, so a client reconnecting
+// with the last ID it saw gets what it missed from the backlog, or a reset
+// event if the backlog no longer reaches back that far or the server has
+// restarted since. The hub is per process.
+type EventHub struct {
+	mu          sync.Mutex
+	epoch       string
+	seq         uint64
+	backlog     []hubEntry
+	subscribers map[string]map[*subscription]struct{}
+	now         func() time.Time
+}
+
+type hubEntry struct {
+	seq        uint64
+	event      Event
+	recipients []string
+}
+
+// subscription is one open connection. The hub closes events when it drops
+// a connection that stopped keeping up.
+type subscription struct {
+	userID string
+	events chan Event
+}
+
+func newEventHub() *EventHub {
+	return &EventHub{
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		subscribers: map[string]map[*subscription]struct{}{},
+		now:         time.Now,
+	}
+}
+
+func (h *EventHub) eventID(seq uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// Publish sends data as an event to every connection of the recipients.
+// It is encoded right away, so later changes to data are not seen. Blank
+// and repeated recipients are ignored.
+func (h *EventHub) Publish(eventType string, data interface{}, recipients ...string) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v\n", eventType, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var to []string
+	seen := map[string]bool{}
+	for _, userID := range recipients {
+		if userID != "" && !seen[userID] {
+			seen[userID] = true
+			to = append(to, userID)
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+
+	h.seq++
+	event := Event{ID: h.eventID(h.seq), Type: eventType, At: h.now(), Data: payload}
+	h.backlog = append(h.backlog, hubEntry{seq: h.seq, event: event, recipients: to})
+	if len(h.backlog) > eventBacklog {
+		h.backlog = h.backlog[len(h.backlog)-eventBacklog:]
+	}
+	for _, userID := range to {
+		for sub := range h.subscribers[userID] {
+			select {
+			case sub.events <- event:
+			default:
+				// The client resumes from the backlog when it reconnects
+				delete(h.subscribers[userID], sub)
+				close(sub.events)
+			}
+		}
+	}
+}
+
+// Subscribe opens a connection for userID. lastEventID is the last event
+// the client saw, if it is reconnecting; the events it missed are returned
+// to be sent before anything from the subscription.
+func (h *EventHub) Subscribe(userID, lastEventID string) (*subscription, []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var replay []Event
+	if lastEventID != "" {
+		epoch, seqText, _ := strings.Cut(lastEventID, "-")
+		seq, err := strconv.ParseUint(seqText, 10, 64)
+		missed := err != nil || epoch != h.epoch || seq > h.seq ||
+			(len(h.backlog) > 0 && h.backlog[0].seq > seq+1)
+		if missed {
+			replay = []Event{{ID: h.eventID(h.seq), Type: eventReset, At: h.now()}}
+		} else {
+			for _, entry := range h.backlog {
+				if entry.seq > seq && slices.Contains(entry.recipients, userID) {
+					replay = append(replay, entry.event)
+				}
+			}
+		}
+	}
+
+	sub := &subscription{userID: userID, events: make(chan Event, eventBuffer)}
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = map[*subscription]struct{}{}
+	}
+	h.subscribers[userID][sub] = struct{}{}
+	return sub, replay
+}
+
+// Unsubscribe forgets a connection that has closed.
+func (h *EventHub) Unsubscribe(sub *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[sub.userID][sub]; ok {
+		delete(h.subscribers[sub.userID], sub)
+		if len(h.subscribers[sub.userID]) == 0 {
+			delete(h.subscribers, sub.userID)
+		}
+	}
+}
+
+// writeEvent writes event in the text/event-stream format.
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// eventSourceToken lets browsers authenticate the event stream with an
+// access_token parameter, since EventSource cannot set headers.
+func eventSourceToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamEvents sends the caller's events as Server-Sent Events until the
+// client disconnects. Reconnecting clients send Last-Event-ID (browsers do
+// so automatically) or last_event_id to resume.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	sub, replay := s.events.Subscribe(currentUserID(r), lastEventID)
+	defer s.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	for _, event := range replay {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		log.Printf("Event stream cannot flush: %v\n", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				return // too slow; the client reconnects and resumes
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// listingStatusChanged tells the owner, the buyer it is reserved for,
+// everyone who has asked about listing and its watchers that its status
+// changed. Those who asked and watchers are also notified. Open offers on a
+// listing that is no longer active are declined.
+func (s *Server) listingStatusChanged(ctx context.Context, listing *MarketplaceListing) {
+	conversations, err := s.store.Conversations.ListBySubject(ctx, subjectListing, listing.ID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+	}
+	interested := s.watchers(ctx, subjectListing, listing.ID)
+	for _, conv := range conversations {
+		if !slices.Contains(interested, conv.StartedBy) {
+			interested = append(interested, conv.StartedBy)
+		}
+	}
+	// Only the owner gets the buyer and history; see hidePrivate
+	s.events.Publish(eventListingStatus, listing, listing.UserID)
+	public := *listing
+	public.hidePrivate()
+	s.events.Publish(eventListingStatus, &public, append([]string{listing.ReservedFor}, interested...)...)
+
+	if listing.currentStatus() != statusActive {
+		s.closeOffers(ctx, listing.ID, fmt.Sprintf("The listing is now %s.", listing.currentStatus()))
+	}
+
+	title := fmt.Sprintf("%q is now %s", listing.Title, listing.currentStatus())
+	for _, userID := range interested {
+		if err := s.notifications.Notify(ctx, userID, categoryListingUpdates, title, title+".", "/api/marketplace/listings/"+listing.ID.Hex()); err != nil {
+			log.Printf("Failed to notify %s: %v\n", userID, err)
+		}
+	}
+}
+
+// matchChanged tells both parties about a new or updated match, and
+// notifies them when it is proposed, changes status or its meeting moves.
+func (s *Server) matchChanged(match, previous *ExchangeMatch) {
+	s.events.Publish(eventMatch, match, match.Sides[0].UserID, match.Sides[1].UserID)
+
+	var title string
+	switch {
+	case previous == nil:
+		title = "New currency exchange match"
+	case previous.Status != match.Status:
+		title = "Currency exchange match " + strings.ReplaceAll(match.Status, "_", " ")
+	case match.Meeting != nil && (previous.Meeting == nil || *previous.Meeting != *match.Meeting):
+		title = "Currency exchange meeting moved"
+	default:
+		return
+	}
+	for i, side := range match.Sides {
+		other := match.Sides[1-i]
+		body := fmt.Sprintf("You hand over %s %s and receive %s %s.", side.Amount, side.Currency, other.Amount, other.Currency)
+		if match.Meeting != nil && match.Status == matchMeetingScheduled {
+			body += fmt.Sprintf(" Meet at %s on %s.", match.Meeting.Place, match.Meeting.At.UTC().Format("Jan 2, 2006 15:04 MST"))
+		}
+		link := "/api/currency/exchange/" + side.RequestID.Hex() + "/matches"
+		if err := s.notifications.Notify(context.Background(), side.UserID, categoryMatches, title, body, link); err != nil {
+			log.Printf("Failed to notify %s: %v\n", side.UserID, err)
+		}
+	}
+}
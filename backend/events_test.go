@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventHubResume(t *testing.T) {
+	h := newEventHub()
+	h.Publish(eventMatch, "first", "alice", "bob")
+	h.Publish(eventMatch, "for bob", "bob")
+	h.Publish(eventMatch, "second", "alice", "alice", "")
+
+	sub, replay := h.Subscribe("alice", "")
+	assert.Empty(t, replay, "a fresh connection starts from now")
+	h.Unsubscribe(sub)
+
+	_, replay = h.Subscribe("alice", h.eventID(1))
+	if assert.Len(t, replay, 1) {
+		assert.Equal(t, h.eventID(3), replay[0].ID)
+		assert.JSONEq(t, `"second"`, string(replay[0].Data))
+	}
+
+	for _, lastID := range []string{"stale-1", h.eventID(99), "garbage"} {
+		_, replay = h.Subscribe("alice", lastID)
+		if assert.Len(t, replay, 1, lastID) {
+			assert.Equal(t, eventReset, replay[0].Type, lastID)
+			assert.Equal(t, h.eventID(3), replay[0].ID, "resuming from a reset skips what was missed")
+		}
+	}
+
+	for i := 0; i < eventBacklog+1; i++ {
+		h.Publish(eventMatch, i, "alice")
+	}
+	_, replay = h.Subscribe("alice", h.eventID(3))
+	assert.Equal(t, eventReset, replay[0].Type, "the backlog no longer reaches back")
+}
+
+func TestEventHubDropsSlowConsumers(t *testing.T) {
+	h := newEventHub()
+	slow, _ := h.Subscribe("alice", "")
+	for i := 0; i < eventBuffer; i++ {
+		h.Publish(eventMatch, i, "alice")
+	}
+	h.Publish(eventMatch, "overflow", "alice")
+
+	received := 0
+	for range slow.events {
+		received++
+	}
+	assert.Equal(t, eventBuffer, received, "the channel is closed once the buffer overflows")
+
+	_, replay := h.Subscribe("alice", h.eventID(eventBuffer))
+	if assert.Len(t, replay, 1) {
+		assert.JSONEq(t, `"overflow"`, string(replay[0].Data), "reconnecting resumes where the stream broke off")
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	s, r := newTestServer()
+	alice, bob := loginAs(t, s, "alice"), loginAs(t, s, "bob")
+	listing := testListing("alice")
+	s.store.Listings.Create(context.Background(), &listing)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/events")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/events?access_token="+alice, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	stream := bufio.NewReader(resp.Body)
+	// next returns the next event of type want, skipping others
+	next := func(want string) Event {
+		var eventType string
+		var event Event
+		for {
+			line, err := stream.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Stream ended: %v", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+			case line == "" && eventType == want:
+				return event
+			case line == "":
+				eventType = ""
+			}
+		}
+	}
+
+	start := `{"subject_type": "listing", "subject_id": "` + listing.ID.Hex() + `", "body": "Is this still available?"}`
+	assert.Equal(t, http.StatusCreated, serve(r, "POST", "/api/conversations", bob, start).Code)
+	event := next(eventMessage)
+	var msg Message
+	json.Unmarshal(event.Data, &msg)
+	assert.Equal(t, "Is this still available?", msg.Body)
+
+	rr := serve(r, "POST", "/api/marketplace/listings/"+listing.ID.Hex()+"/reserve", alice, `{"buyer_id": "carol"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	event = next(eventListingStatus)
+	var changed MarketplaceListing
+	json.Unmarshal(event.Data, &changed)
+	assert.Equal(t, statusReserved, changed.Status)
+
+	// Bob asked about the listing, so the status change is kept for them too
+	sub, replay := s.events.Subscribe("bob", s.events.eventID(1))
+	defer s.events.Unsubscribe(sub)
+	var types []string
+	for _, event := range replay {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []string{eventListingStatus, eventNotification}, types)
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultListingMaxAge = 30 * 24 * time.Hour
+	defaultExpiryWarning = 3 * 24 * time.Hour
+	expiryBatchSize      = 100
+)
+
+// ExpiryService takes stale listings and subleases out of the results.
+// Marketplace listings expire maxAge after they were posted or last renewed;
+// subleases expire once their rental period has ended. Owners are notified
+// warnBefore ahead of either.
+type ExpiryService struct {
+	store      *Store
+	notifier   *NotificationService
+	maxAge     time.Duration
+	warnBefore time.Duration
+	// listingChanged, subleaseChanged and offerChanged, if set, are told
+	// about every listing, sublease and offer that expires.
+	listingChanged  func(ctx context.Context, listing *MarketplaceListing)
+	subleaseChanged func(ctx context.Context, sublease *SubleasingRequest)
+	offerChanged    func(ctx context.Context, offer *Offer)
+	now             func() time.Time
+}
+
+func newExpiryService(store *Store, notifier *NotificationService) *ExpiryService {
+	return &ExpiryService{
+		store:      store,
+		notifier:   notifier,
+		maxAge:     defaultListingMaxAge,
+		warnBefore: defaultExpiryWarning,
+		now:        time.Now,
+	}
+}
+
+// listingExpiry is when a listing posted or renewed at from expires.
+func (e *ExpiryService) listingExpiry(from time.Time) time.Time {
+	return from.Add(e.maxAge)
+}
+
+// run sweeps once at startup and then every interval until ctx is done.
+func (e *ExpiryService) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := e.sweep(ctx); err != nil {
+			log.Printf("Expiry sweep failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep performs one pass: it gives listings saved before expiry existed an
+// expiry date, warns owners of what expires soon and expires what is due,
+// including offers nobody answered in time.
+func (e *ExpiryService) sweep(ctx context.Context) error {
+	return errors.Join(
+		e.backfillListings(ctx),
+		e.warnListings(ctx),
+		e.expireListings(ctx),
+		e.warnSubleases(ctx),
+		e.expireSubleases(ctx),
+		e.expireOffers(ctx),
+	)
+}
+
+// forEachPage calls fn for every document find returns for q, one page at a
+// time. fn may change documents so they no longer match; the cursor still
+// resumes after the last document seen.
+func forEachPage[T any](ctx context.Context, find func(context.Context, listQuery) ([]T, string, error), q listQuery, fn func(*T) error) error {
+	q.limit = expiryBatchSize
+	var errs []error
+	for {
+		docs, next, err := find(ctx, q)
+		if err != nil {
+			return err
+		}
+		for i := range docs {
+			if err := fn(&docs[i]); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		if next == "" {
+			return errors.Join(errs...)
+		}
+		if q.after, err = decodeCursor(next); err != nil {
+			return err
+		}
+	}
+}
+
+var activeFilter = fieldFilter{field: "status", op: "$in", value: bson.A{statusActive, nil}}
+
+func (e *ExpiryService) backfillListings(ctx context.Context) error {
+	q := listQuery{sort: "date_posted", filters: []fieldFilter{
+		{field: "expires_at", op: "$in", value: bson.A{nil}},
+	}}
+	return forEachPage(ctx, e.store.Listings.Find, q, func(l *MarketplaceListing) error {
+		from := l.DatePosted
+		if from.IsZero() {
+			from = e.now()
+		}
+		l.ExpiresAt = e.listingExpiry(from)
+		return ignoreConflict(e.store.Listings.Replace(ctx, l, l.Version))
+	})
+}
+
+func (e *ExpiryService) warnListings(ctx context.Context) error {
+	now := e.now()
+	q := listQuery{sort: "expires_at", filters: []fieldFilter{
+		activeFilter,
+		{field: "expires_at", op: "$gt", value: now},
+		{field: "expires_at", op: "$lte", value: now.Add(e.warnBefore)},
+		{field: "expiry_notified_at", op: "$in", value: bson.A{nil}},
+	}}
+	return forEachPage(ctx, e.store.Listings.Find, q, func(l *MarketplaceListing) error {
+		msg := fmt.Sprintf("Your listing %q expires on %s. Renew it from your activity page to keep it visible.",
+			l.Title, l.ExpiresAt.Format("Jan 2, 2006"))
+		if err := e.notifier.Notify(ctx, l.UserID, categoryExpiry, "Your listing expires soon", msg, "/api/marketplace/listings/"+l.ID.Hex()); err != nil {
+			return err
+		}
+		l.ExpiryNotifiedAt = now
+		return ignoreConflict(e.store.Listings.Replace(ctx, l, l.Version))
+	})
+}
+
+func (e *ExpiryService) expireListings(ctx context.Context) error {
+	now := e.now()
+	q := listQuery{sort: "expires_at", filters: []fieldFilter{
+		activeFilter,
+		{field: "expires_at", op: "$lte", value: now},
+	}}
+	return forEachPage(ctx, e.store.Listings.Find, q, func(l *MarketplaceListing) error {
+		change := StatusChange{To: statusExpired, By: "system", At: now, Note: "Listing reached its expiry date"}
+		expired, err := transitionListing(ctx, e.store.Listings, l.ID, change, func(current *MarketplaceListing) error {
+			// Renewed or sold since the page was read
+			if current.currentStatus() != statusActive || current.ExpiresAt.After(now) {
+				return errInvalidTransition
+			}
+			return nil
+		})
+		if errors.Is(err, errInvalidTransition) || errors.Is(err, errNotFound) {
+			return nil
+		}
+		if err == nil && e.listingChanged != nil {
+			e.listingChanged(ctx, expired)
+		}
+		return err
+	})
+}
+
+func (e *ExpiryService) warnSubleases(ctx context.Context) error {
+	now := e.now()
+	q := listQuery{sort: "period.end_date", filters: []fieldFilter{
+		activeFilter,
+		{field: "period.end_date", op: "$gt", value: now},
+		{field: "period.end_date", op: "$lte", value: now.Add(e.warnBefore)},
+		{field: "expiry_notified_at", op: "$in", value: bson.A{nil}},
+	}}
+	return forEachPage(ctx, e.store.Subleases.Find, q, func(s *SubleasingRequest) error {
+		msg := fmt.Sprintf("Your sublease %q ends on %s and will then be taken down. Extend the rental period and renew it to keep it visible.",
+			s.Title, s.Period.EndDate.Format("Jan 2, 2006"))
+		if err := e.notifier.Notify(ctx, s.UserID, categoryExpiry, "Your sublease listing expires soon", msg, "/api/subleasing/"+s.ID.Hex()); err != nil {
+			return err
+		}
+		s.ExpiryNotifiedAt = now
+		return ignoreConflict(e.store.Subleases.Replace(ctx, s, s.Version))
+	})
+}
+
+func (e *ExpiryService) expireSubleases(ctx context.Context) error {
+	now := e.now()
+	q := listQuery{sort: "period.end_date", filters: []fieldFilter{
+		activeFilter,
+		{field: "period.end_date", op: "$lte", value: now},
+	}}
+	return forEachPage(ctx, e.store.Subleases.Find, q, func(s *SubleasingRequest) error {
+		s.Status = statusExpired
+		s.UpdatedAt = now
+		err := e.store.Subleases.Replace(ctx, s, s.Version)
+		if err == nil && e.subleaseChanged != nil {
+			e.subleaseChanged(ctx, s)
+		}
+		return ignoreConflict(err)
+	})
+}
+
+// ignoreConflict drops errors caused by the owner saving the document while
+// the sweep was running; the next sweep looks at it again.
+func ignoreConflict(err error) error {
+	if errors.Is(err, errVersionConflict) || errors.Is(err, errNotFound) {
+		return nil
+	}
+	return err
+}
+
+// renewListing restarts a listing's expiry clock. Expired listings become
+// active again; sold and withdrawn ones must be relisted instead.
+func (s *Server) renewListing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+
+	now := s.expiry.now()
+	var listing *MarketplaceListing
+	for attempt := 0; ; attempt++ {
+		listing, err = s.store.Listings.Get(r.Context(), id)
+		if err != nil {
+			break
+		}
+		if !canModify(r, listing.UserID) {
+			err = errNotListingOwner
+			break
+		}
+		version := listing.Version
+		switch listing.currentStatus() {
+		case statusActive, statusReserved:
+		case statusExpired:
+			err = listing.transition(StatusChange{To: statusActive, By: currentUserID(r), At: now, Note: "Renewed"})
+		default:
+			err = fmt.Errorf("%w: a %s listing cannot be renewed", errInvalidTransition, listing.currentStatus())
+		}
+		if err != nil {
+			break
+		}
+		listing.ExpiresAt = s.expiry.listingExpiry(now)
+		listing.ExpiryNotifiedAt = time.Time{}
+		listing.UpdatedAt = now
+		err = s.store.Listings.Replace(r.Context(), listing, version)
+		if !errors.Is(err, errVersionConflict) || attempt == 2 {
+			break
+		}
+	}
+
+	switch {
+	case errors.Is(err, errNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
+		return
+	case errors.Is(err, errNotListingOwner):
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You can only renew your own listings"})
+		return
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errVersionConflict):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to renew listing"})
+		return
+	}
+
+	s.search.putListing(listing)
+	w.Header().Set("ETag", etag(listing.Version))
+	json.NewEncoder(w).Encode(listing)
+}
+
+// renewSublease makes an expired sublease active again once its rental
+// period has been extended past today.
+func (s *Server) renewSublease(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+
+	sublease, err := s.store.Subleases.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Sublease not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load sublease"})
+		return
+	}
+	if !canModify(r, sublease.UserID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You can only renew your own listings"})
+		return
+	}
+
+	now := s.expiry.now()
+	if !sublease.Period.EndDate.After(now) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "The rental period has ended; update end_date before renewing"})
+		return
+	}
+
+	wasExpired := sublease.Status == statusExpired
+	sublease.Status = statusActive
+	sublease.ExpiryNotifiedAt = time.Time{}
+	sublease.UpdatedAt = now
+	err = s.store.Subleases.Replace(r.Context(), sublease, sublease.Version)
+	if errors.Is(err, errVersionConflict) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to renew sublease"})
+		return
+	}
+
+	s.search.putSublease(sublease)
+	if wasExpired {
+		s.subleaseStatusChanged(r.Context(), sublease)
+	}
+	w.Header().Set("ETag", etag(sublease.Version))
+	json.NewEncoder(w).Encode(sublease)
+}
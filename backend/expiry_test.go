@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestExpiry(s *Server) (*recordingMailer, *time.Time) {
+	mailer := &recordingMailer{}
+	clock := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.notifications.mailer = mailer
+	s.notifications.now = func() time.Time { return clock }
+	s.expiry.now = func() time.Time { return clock }
+	return mailer, &clock
+}
+
+func TestExpireListings(t *testing.T) {
+	s, _ := newTestServer()
+	mailer, clock := newTestExpiry(s)
+	ctx := context.Background()
+
+	owner, _ := s.store.Users.UpsertLogin(ctx, "alice@ufl.edu", *clock)
+	listing := testListing(owner.ID.Hex())
+	listing.DatePosted = clock.Add(-28 * 24 * time.Hour)
+	s.store.Listings.Create(ctx, &listing)
+
+	assert.NoError(t, s.expiry.sweep(ctx))
+	assert.NoError(t, s.notifications.sendDue(ctx))
+	stored, _ := s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, listing.DatePosted.Add(defaultListingMaxAge), stored.ExpiresAt, "legacy listings get an expiry date")
+	if assert.Len(t, mailer.sent, 1) {
+		assert.Equal(t, "alice@ufl.edu", mailer.sent[0].To)
+	}
+
+	assert.NoError(t, s.expiry.sweep(ctx))
+	assert.NoError(t, s.notifications.sendDue(ctx))
+	assert.Len(t, mailer.sent, 1, "owners are warned once")
+
+	*clock = clock.Add(3 * 24 * time.Hour)
+	assert.NoError(t, s.expiry.sweep(ctx))
+	stored, _ = s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, statusExpired, stored.Status)
+	if assert.Len(t, stored.History, 1) {
+		assert.Equal(t, "system", stored.History[0].By)
+	}
+}
+
+func TestRenewListing(t *testing.T) {
+	s, r := newTestServer()
+	_, clock := newTestExpiry(s)
+	ctx := context.Background()
+	owner := loginAs(t, s, "alice")
+	other := loginAs(t, s, "bob")
+
+	listing := testListing("alice")
+	listing.Status = statusExpired
+	listing.ExpiresAt = clock.Add(-time.Hour)
+	listing.ExpiryNotifiedAt = clock.Add(-48 * time.Hour)
+	s.store.Listings.Create(ctx, &listing)
+	route := "/api/marketplace/listings/" + listing.ID.Hex() + "/renew"
+
+	rr := serve(r, "POST", route, other, "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = serve(r, "POST", route, owner, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	stored, _ := s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, statusActive, stored.Status)
+	assert.Equal(t, clock.Add(defaultListingMaxAge), stored.ExpiresAt)
+	assert.True(t, stored.ExpiryNotifiedAt.IsZero())
+
+	sold := testListing("alice")
+	sold.Status = statusSold
+	s.store.Listings.Create(ctx, &sold)
+	rr = serve(r, "POST", "/api/marketplace/listings/"+sold.ID.Hex()+"/renew", owner, "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestExpireAndRenewSubleases(t *testing.T) {
+	s, r := newTestServer()
+	_, clock := newTestExpiry(s)
+	ctx := context.Background()
+	owner := loginAs(t, s, "alice")
+
+	sublease := SubleasingRequest{UserID: "alice", Title: "Room", Description: "Near campus", Rent: money(600, "USD"), Currency: "USD"}
+	sublease.Location.City, sublease.Location.State, sublease.Location.Country = "Gainesville", "FL", "USA"
+	sublease.Period.StartDate = clock.Add(-60 * 24 * time.Hour)
+	sublease.Period.EndDate = clock.Add(-24 * time.Hour)
+	s.store.Subleases.Create(ctx, &sublease)
+
+	s.expiry.sweep(ctx)
+	stored, _ := s.store.Subleases.Get(ctx, sublease.ID)
+	assert.Equal(t, statusExpired, stored.Status)
+
+	rr := serve(r, "GET", "/api/getSubleasingRequests", "", "")
+	assert.Contains(t, rr.Body.String(), `"request_count":0`, "expired subleases are hidden")
+
+	route := "/api/subleasing/" + sublease.ID.Hex() + "/renew"
+	rr = serve(r, "POST", route, owner, "")
+	assert.Equal(t, http.StatusConflict, rr.Code, "the period has to be extended first")
+
+	stored.Period.EndDate = clock.Add(30 * 24 * time.Hour)
+	s.store.Subleases.Replace(ctx, stored, stored.Version)
+	rr = serve(r, "POST", route, owner, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	stored, _ = s.store.Subleases.Get(ctx, sublease.ID)
+	assert.Equal(t, statusActive, stored.Status)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxImageBytes      = 5 << 20
+	maxImagesPerUpload = 10
+	maxImagePixels     = 40_000_000
+)
+
+// imageExtensions maps the accepted image types to the extension used in
+// blob keys.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+var errUnsupportedImage = errors.New("unsupported or corrupt image")
+
+// UploadedImage describes a stored image.
+type UploadedImage struct {
+	Key         string          `json:"key"`
+	URL         string          `json:"url"`
+	ContentType string          `json:"content_type"`
+	Size        int             `json:"size"`
+	Variants    PictureVariants `json:"variants"`
+}
+
+// imageURL is the stable address an image is served from. Listings store it
+// in Pictures.
+func (s *Server) imageURL(key string) string {
+	return s.publicURL + "/api/images/" + key
+}
+
+// sanitizeImage checks that data is an image type we accept and returns it
+// with metadata such as EXIF (including GPS position), XMP, IPTC and text
+// chunks removed. The pixels are left untouched.
+func sanitizeImage(data []byte) (clean []byte, contentType string, err error) {
+	contentType = http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg":
+		clean, err = stripJPEGMetadata(data)
+	case "image/png":
+		clean, err = stripPNGMetadata(data)
+	case "image/webp":
+		return stripWebPMetadata(data)
+	default:
+		return nil, "", errUnsupportedImage
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	// Make sure the pixels decode and the image is not absurdly large
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(clean))
+	if err != nil || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", errUnsupportedImage
+	}
+	return clean, contentType, nil
+}
+
+// stripJPEGMetadata drops APP1 (EXIF, XMP), APP13 (IPTC) and comment
+// segments. The EXIF orientation is kept in a minimal EXIF segment so
+// rotated phone photos still display upright.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errUnsupportedImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	orientationWritten := false
+
+	for i := 2; i < len(data); {
+		if data[i] != 0xFF || i+1 >= len(data) {
+			return nil, errUnsupportedImage
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		case marker == 0xD9:
+			out.Write(data[i : i+2])
+			return out.Bytes(), nil
+		}
+		if i+4 > len(data) {
+			return nil, errUnsupportedImage
+		}
+		// The length counts its own two bytes, so anything shorter is corrupt
+		length := int(binary.BigEndian.Uint16(data[i+2 : i+4]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, errUnsupportedImage
+		}
+		segment := data[i:end]
+
+		switch marker {
+		case 0xDA:
+			// Start of scan: entropy-coded data follows up to the end
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		case 0xE1:
+			if o := jpegOrientation(segment[4:]); o > 1 && !orientationWritten {
+				out.Write(minimalEXIF(o))
+				orientationWritten = true
+			}
+		case 0xED, 0xFE:
+		default:
+			out.Write(segment)
+		}
+		i = end
+	}
+	return nil, errUnsupportedImage
+}
+
+// jpegOrientation reads the orientation tag from an APP1 EXIF payload,
+// returning 0 if there is none.
+func jpegOrientation(payload []byte) uint16 {
+	if len(payload) < 14 || string(payload[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := payload[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd : ifd+2]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			return order.Uint16(tiff[entry+8 : entry+10])
+		}
+	}
+	return 0
+}
+
+// minimalEXIF builds an APP1 segment holding only the orientation tag.
+func minimalEXIF(orientation uint16) []byte {
+	payload := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" +
+		"\x00\x01" + // one IFD entry
+		"\x01\x12\x00\x03\x00\x00\x00\x01") // orientation, SHORT, count 1
+	payload = binary.BigEndian.AppendUint16(payload, orientation)
+	payload = append(payload, 0, 0, 0, 0, 0, 0) // value padding, no next IFD
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// pngMetadataChunks are the ancillary chunks that can carry EXIF or free
+// text.
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "iTXt": true, "zTXt": true, "tIME": true}
+
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errUnsupportedImage
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(signature)
+	for i := len(signature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, errUnsupportedImage
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:i+4]))
+		if end > len(data) || end < i {
+			return nil, errUnsupportedImage
+		}
+		chunkType := string(data[i+4 : i+8])
+		if !pngMetadataChunks[chunkType] {
+			out.Write(data[i:end])
+		}
+		if chunkType == "IEND" {
+			return out.Bytes(), nil
+		}
+		i = end
+	}
+	return nil, errUnsupportedImage
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of a WebP file and clears
+// their flags in the VP8X header.
+func stripWebPMetadata(data []byte) ([]byte, string, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, "", errUnsupportedImage
+	}
+	var chunks bytes.Buffer
+	hasImage := false
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, "", errUnsupportedImage
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4 : i+8]))
+		end := i + 8 + size + size%2
+		if end > len(data) || size < 0 {
+			return nil, "", errUnsupportedImage
+		}
+		chunk := data[i:end]
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk = append([]byte(nil), chunk...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04
+			}
+			chunks.Write(chunk)
+		case "VP8 ", "VP8L", "ANIM":
+			hasImage = true
+			chunks.Write(chunk)
+		default:
+			chunks.Write(chunk)
+		}
+		i = end
+	}
+	if !hasImage {
+		return nil, "", errUnsupportedImage
+	}
+	out := make([]byte, 0, 12+chunks.Len())
+	out = append(out, "RIFF"...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(4+chunks.Len()))
+	out = append(out, "WEBP"...)
+	return append(out, chunks.Bytes()...), "image/webp", nil
+}
+
+func newImageKey(contentType string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b) + imageExtensions[contentType]
+}
+
+func readImagePart(fh *multipart.FileHeader) ([]byte, error) {
+	if fh.Size > maxImageBytes {
+		return nil, fmt.Errorf("%s is larger than %d MB", fh.Filename, maxImageBytes>>20)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxImageBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImageBytes {
+		return nil, fmt.Errorf("%s is larger than %d MB", fh.Filename, maxImageBytes>>20)
+	}
+	return data, nil
+}
+
+// uploadImages accepts up to maxImagesPerUpload files in multipart "image"
+// fields and returns the URLs to put in a listing's pictures.
+func (s *Server) uploadImages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImagesPerUpload*maxImageBytes+1<<20)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Expected a multipart form no larger than the upload limit"})
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	files := r.MultipartForm.File["image"]
+	if len(files) == 0 || len(files) > maxImagesPerUpload {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Send between 1 and %d files in the image field", maxImagesPerUpload)})
+		return
+	}
+
+	// Validate every file before storing any of them
+	type pending struct {
+		data        []byte
+		contentType string
+	}
+	var images []pending
+	for _, fh := range files {
+		data, err := readImagePart(fh)
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		clean, contentType, err := sanitizeImage(data)
+		if err != nil {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			json.NewEncoder(w).Encode(map[string]string{"error": fh.Filename + ": only JPEG, PNG and WebP images are accepted"})
+			return
+		}
+		images = append(images, pending{data: clean, contentType: contentType})
+	}
+
+	uploaded := []UploadedImage{}
+	for _, img := range images {
+		key := newImageKey(img.contentType)
+		if err := s.images.blobs.Put(r.Context(), key, img.contentType, img.data); err != nil {
+			log.Printf("Storage error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to store image"})
+			return
+		}
+		record := ImageRecord{Key: key, UserID: currentUserID(r), ContentType: img.contentType, Status: imagePending, CreatedAt: time.Now()}
+		if err := s.images.records.Create(r.Context(), &record); err != nil {
+			log.Printf("Database error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to store image"})
+			return
+		}
+		s.images.enqueue(key)
+
+		url := s.imageURL(key)
+		uploaded = append(uploaded, UploadedImage{
+			Key: key, URL: url, ContentType: img.contentType, Size: len(img.data),
+			Variants: pictureVariants([]string{url})[0],
+		})
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"images": uploaded})
+}
+
+// getImage serves a stored image, or with ?size=thumb|small|medium|large or
+// ?w=<pixels> one of its variants. Keys are random and never reused, so the
+// response can be cached indefinitely once the variant exists.
+func (s *Server) getImage(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	size := r.URL.Query().Get("size")
+	width, _ := strconv.Atoi(r.URL.Query().Get("w"))
+
+	serveKey, cacheControl := key, "public, max-age=31536000, immutable"
+	if size != "" || width > 0 {
+		record, err := s.images.records.Get(r.Context(), key)
+		if err != nil && !errors.Is(err, errNotFound) {
+			log.Printf("Database error: %v\n", err)
+		}
+		if err == nil {
+			serveKey = record.variantKey(key, size, width)
+			if record.Status == imagePending {
+				// Serve the original until the worker has made the variant
+				cacheControl = "public, max-age=60"
+			}
+		}
+	}
+
+	data, contentType, err := s.images.blobs.Get(r.Context(), serveKey)
+	if errors.Is(err, errNotFound) || (err == nil && !strings.HasPrefix(contentType, "image/")) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Storage error: %v\n", err)
+		http.Error(w, "Failed to load image", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
+}
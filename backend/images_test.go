@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testJPEG returns a small JPEG whose EXIF block holds an orientation and a
+// GPS marker string.
+func testJPEG(t *testing.T, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	exif := []byte("Exif\x00\x00II\x2a\x00\x08\x00\x00\x00" +
+		"\x01\x00" + // one IFD entry
+		"\x12\x01\x03\x00\x01\x00\x00\x00") // orientation, SHORT, count 1
+	exif = binary.LittleEndian.AppendUint16(exif, orientation)
+	exif = append(exif, 0, 0, 0, 0, 0, 0)
+	exif = append(exif, "GPSLatitude 29.6516"...)
+	segment := []byte{0xFF, 0xE1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(exif)+2))
+	segment = append(segment, exif...)
+
+	data := buf.Bytes()
+	return append(append(append([]byte{}, data[:2]...), segment...), data[2:]...)
+}
+
+// testPNG returns a small PNG with a tEXt chunk carrying a location.
+func testPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	text := []byte("Comment\x00GPSLatitude 29.6516")
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(text)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, text...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// Insert after the IHDR chunk (8-byte signature + 25-byte chunk)
+	return append(append(append([]byte{}, data[:33]...), chunk...), data[33:]...)
+}
+
+func multipartImages(t *testing.T, files ...[]byte) (*bytes.Buffer, string) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, data := range files {
+		part, err := mw.CreateFormFile("image", "photo"+string(rune('a'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+func TestSanitizeImage(t *testing.T) {
+	clean, contentType, err := sanitizeImage(testJPEG(t, 6))
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+	assert.NotContains(t, string(clean), "GPSLatitude")
+	assert.Equal(t, uint16(6), jpegOrientation(clean[4+2:]), "orientation survives as the first segment")
+	_, err = jpeg.Decode(bytes.NewReader(clean))
+	assert.NoError(t, err)
+
+	clean, _, err = sanitizeImage(testJPEG(t, 1))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(clean), "Exif")
+
+	clean, contentType, err = sanitizeImage(testPNG(t))
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+	assert.NotContains(t, string(clean), "GPSLatitude")
+	_, err = png.Decode(bytes.NewReader(clean))
+	assert.NoError(t, err)
+
+	webp := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"VP8L\x02\x00\x00\x00\x2f\x00" + "EXIF\x05\x00\x00\x00GPS!!\x00")
+	binary.LittleEndian.PutUint32(webp[4:], uint32(len(webp)-8))
+	clean, contentType, err = sanitizeImage(webp)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/webp", contentType)
+	assert.NotContains(t, string(clean), "GPS")
+	assert.Equal(t, byte(0), clean[20]&0x08, "EXIF flag cleared")
+	assert.Equal(t, uint32(len(clean)-8), binary.LittleEndian.Uint32(clean[4:]))
+
+	_, _, err = sanitizeImage([]byte("<svg xmlns='http://www.w3.org/2000/svg'/>"))
+	assert.ErrorIs(t, err, errUnsupportedImage)
+
+	truncated := testJPEG(t, 1)[:40]
+	_, _, err = sanitizeImage(truncated)
+	assert.Error(t, err)
+}
+
+func TestUploadImages(t *testing.T) {
+	s, r := newTestServer()
+	s.publicURL = "https://api.example.edu"
+	token := loginAs(t, s, "alice")
+
+	upload := func(token string, files ...[]byte) *httptest.ResponseRecorder {
+		body, contentType := multipartImages(t, files...)
+		req := httptest.NewRequest("POST", "/api/images", body)
+		req.Header.Set("Content-Type", contentType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := upload("", testPNG(t))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	unsupported := []struct {
+		description string
+		data        []byte
+	}{
+		{"Not an image", []byte("just text")},
+		{"Lone 0xFF after a segment", []byte{0xFF, 0xD8, 0xFF, 0xFE, 0x00, 0x04, 'h', 'i', 0xFF}},
+		{"APP1 length below 2", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01, 0xFF, 0xD9}},
+		{"APP1 length of 0", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x00, 0xFF, 0xD9}},
+	}
+	for _, test := range unsupported {
+		rr = upload(token, test.data)
+		assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code, test.description)
+	}
+
+	rr = upload(token, bytes.Repeat([]byte{0xFF}, maxImageBytes+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	rr = upload(token, testJPEG(t, 3), testPNG(t))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var body struct {
+		Images []UploadedImage `json:"images"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	if !assert.Len(t, body.Images, 2) {
+		return
+	}
+	assert.True(t, strings.HasPrefix(body.Images[0].URL, "https://api.example.edu/api/images/"))
+	assert.True(t, strings.HasSuffix(body.Images[0].Key, ".jpg"))
+	assert.True(t, strings.HasSuffix(body.Images[1].Key, ".png"))
+
+	rr = serve(r, "GET", "/api/images/"+body.Images[0].Key, "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/jpeg", rr.Header().Get("Content-Type"))
+	assert.NotContains(t, rr.Body.String(), "GPSLatitude")
+
+	stored, _, _ := s.images.blobs.Get(context.Background(), body.Images[1].Key)
+	assert.Equal(t, body.Images[1].Size, len(stored))
+
+	rr = serve(r, "GET", "/api/images/missing.jpg", "", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Marketplace listing statuses.
+const (
+	statusActive    = "active"
+	statusReserved  = "reserved"
+	statusSold      = "sold"
+	statusExpired   = "expired"
+	statusWithdrawn = "withdrawn"
+)
+
+// listingTransitions lists, for each status, the statuses a listing may move
+// to. Sold is final; anything else can be relisted.
+var listingTransitions = map[string][]string{
+	statusActive:    {statusReserved, statusSold, statusExpired, statusWithdrawn},
+	statusReserved:  {statusActive, statusSold, statusWithdrawn},
+	statusExpired:   {statusActive, statusWithdrawn},
+	statusWithdrawn: {statusActive},
+	statusSold:      {},
+}
+
+// errInvalidTransition is returned when a listing cannot move from its
+// current status to the requested one.
+var errInvalidTransition = errors.New("invalid status transition")
+
+// StatusChange records one transition in a listing's history.
+type StatusChange struct {
+	From        string    `json:"from" bson:"from"`
+	To          string    `json:"to" bson:"to"`
+	By          string    `json:"by" bson:"by"`
+	At          time.Time `json:"at" bson:"at"`
+	ReservedFor string    `json:"reserved_for,omitempty" bson:"reserved_for,omitempty"`
+	Note        string    `json:"note,omitempty" bson:"note,omitempty"`
+}
+
+// currentStatus treats listings stored before statuses existed as active.
+func (l *MarketplaceListing) currentStatus() string {
+	if l.Status == "" {
+		return statusActive
+	}
+	return l.Status
+}
+
+// transition moves l to status to, recording the change in its history.
+func (l *MarketplaceListing) transition(change StatusChange) error {
+	change.From = l.currentStatus()
+	allowed := false
+	for _, next := range listingTransitions[change.From] {
+		if next == change.To {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s to %s", errInvalidTransition, change.From, change.To)
+	}
+
+	l.Status = change.To
+	l.ReservedFor = change.ReservedFor
+	l.UpdatedAt = change.At
+	l.History = append(l.History, change)
+	return nil
+}
+
+// hidePrivate clears what only a listing's owner may see: who it is
+// reserved for and its status history, whose notes can name offer amounts.
+func (l *MarketplaceListing) hidePrivate() {
+	l.ReservedFor = ""
+	l.History = nil
+}
+
+// hidePrivateListings hides the private fields of the listings r's caller
+// cannot modify.
+func hidePrivateListings(r *http.Request, listings []MarketplaceListing) {
+	for i := range listings {
+		if !canModify(r, listings[i].UserID) {
+			listings[i].hidePrivate()
+		}
+	}
+}
+
+// transitionListing applies change to the stored listing, retrying when a
+// concurrent write bumps the version between the read and the write. check,
+// if set, runs after the listing is loaded and may veto or adjust it.
+func transitionListing(ctx context.Context, repo ListingRepository, id primitive.ObjectID, change StatusChange, check func(*MarketplaceListing) error) (*MarketplaceListing, error) {
+	for attempt := 0; ; attempt++ {
+		listing, err := repo.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if check != nil {
+			if err := check(listing); err != nil {
+				return nil, err
+			}
+		}
+		version := listing.Version
+		if err := listing.transition(change); err != nil {
+			return nil, err
+		}
+		err = repo.Replace(ctx, listing, version)
+		if errors.Is(err, errVersionConflict) && attempt < 2 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return listing, nil
+	}
+}
+
+// errNotListingOwner vetoes transitions by anyone but the owner or an admin.
+var errNotListingOwner = errors.New("you can only change the status of your own listings")
+
+// listingTransitionHandler returns the handler for one transition endpoint.
+// Reserving takes the buyer in {"buyer_id": ...}; every endpoint accepts an
+// optional {"note": ...}.
+func (s *Server) listingTransitionHandler(to string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+
+		var body struct {
+			BuyerID string `json:"buyer_id"`
+			Note    string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if to == statusReserved && body.BuyerID == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "buyer_id is required to reserve a listing"})
+			return
+		}
+
+		change := StatusChange{To: to, By: currentUserID(r), At: time.Now(), Note: body.Note}
+		if to == statusReserved {
+			change.ReservedFor = body.BuyerID
+		}
+		listing, err := transitionListing(r.Context(), s.store.Listings, id, change, func(l *MarketplaceListing) error {
+			if !canModify(r, l.UserID) {
+				return errNotListingOwner
+			}
+			if to == statusActive && l.currentStatus() != statusReserved {
+				// Relisting starts a fresh expiry period
+				l.ExpiresAt = s.expiry.listingExpiry(change.At)
+				l.ExpiryNotifiedAt = time.Time{}
+			}
+			return nil
+		})
+		switch {
+		case errors.Is(err, errNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
+			return
+		case errors.Is(err, errNotListingOwner):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, errInvalidTransition), errors.Is(err, errVersionConflict):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case err != nil:
+			log.Printf("Database error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update listing status"})
+			return
+		}
+
+		s.search.putListing(listing)
+		s.listingStatusChanged(r.Context(), listing)
+		w.Header().Set("ETag", etag(listing.Version))
+		json.NewEncoder(w).Encode(listing)
+	}
+}
+
+// getListingHistory returns a listing's status and its transitions, oldest
+// first, to its owner or an admin.
+func (s *Server) getListingHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+
+	listing, err := s.store.Listings.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load listing"})
+		return
+	}
+	if !canModify(r, listing.UserID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You can only view the history of your own listings"})
+		return
+	}
+
+	history := listing.History
+	if history == nil {
+		history = []StatusChange{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"listing_id": listing.ID,
+		"status":     listing.currentStatus(),
+		"history":    history,
+	})
+}
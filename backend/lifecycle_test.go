@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListingTransitions(t *testing.T) {
+	s, r := newTestServer()
+	owner := loginAs(t, s, "alice")
+	buyer := loginAs(t, s, "bob")
+
+	listing := testListing("alice")
+	s.store.Listings.Create(context.Background(), &listing)
+	base := "/api/marketplace/listings/" + listing.ID.Hex()
+
+	tests := []struct {
+		description  string
+		route        string
+		token        string
+		reqBody      string
+		expectedCode int
+	}{
+		{"Reserve without a buyer", base + "/reserve", owner, `{}`, http.StatusBadRequest},
+		{"Reserve another user's listing", base + "/reserve", buyer, `{"buyer_id": "bob"}`, http.StatusForbidden},
+		{"Reserve for a buyer", base + "/reserve", owner, `{"buyer_id": "bob", "note": "pickup Friday"}`, http.StatusOK},
+		{"Reserve twice", base + "/reserve", owner, `{"buyer_id": "carol"}`, http.StatusConflict},
+		{"Release the reservation", base + "/relist", owner, ``, http.StatusOK},
+		{"Mark sold", base + "/sold", owner, ``, http.StatusOK},
+		{"Relist a sold listing", base + "/relist", owner, ``, http.StatusConflict},
+		{"Withdraw a sold listing", base + "/withdraw", owner, ``, http.StatusConflict},
+		{"Unknown listing", "/api/marketplace/listings/000000000000000000000000/sold", owner, ``, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		rr := serve(r, "POST", test.route, test.token, test.reqBody)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve(r, "GET", base+"/history", "", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(r, "GET", base+"/history", buyer, "").Code, "only the owner sees who it was reserved for")
+	rr := serve(r, "GET", base+"/history", owner, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body struct {
+		Status  string         `json:"status"`
+		History []StatusChange `json:"history"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	assert.Equal(t, statusSold, body.Status)
+	if assert.Len(t, body.History, 3) {
+		assert.Equal(t, StatusChange{From: statusActive, To: statusReserved, By: "alice", At: body.History[0].At, ReservedFor: "bob", Note: "pickup Friday"}, body.History[0])
+		assert.Equal(t, statusReserved, body.History[1].From)
+		assert.Equal(t, statusActive, body.History[1].To)
+		assert.Equal(t, statusSold, body.History[2].To)
+	}
+
+	var activities UserActivities
+	rr = serve(r, "GET", "/api/user/activities?user_id=alice", buyer, "")
+	json.Unmarshal(rr.Body.Bytes(), &activities)
+	if assert.Len(t, activities.MarketplaceListings, 1) {
+		assert.Empty(t, activities.MarketplaceListings[0].History, "lists hide the history from other users")
+	}
+}
+
+func TestListingsHideInactive(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+
+	legacy := testListing("alice")
+	s.store.Listings.Create(ctx, &legacy)
+	sold := testListing("alice")
+	sold.Status = statusSold
+	s.store.Listings.Create(ctx, &sold)
+
+	count := func(route string) int {
+		rr := serve(r, "GET", route, "", "")
+		assert.Equal(t, http.StatusOK, rr.Code, route)
+		var page listingPage
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		return page.Count
+	}
+	assert.Equal(t, 1, count("/api/getMarketplaceListings"), "listings without a status count as active")
+	assert.Equal(t, 1, count("/api/getMarketplaceListings?status=sold"))
+	assert.Equal(t, 2, count("/api/getMarketplaceListings?status=all"))
+
+	rr := serve(r, "GET", "/api/getMarketplaceListings?status=lost", "", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestEditKeepsStatus(t *testing.T) {
+	s, r := newTestServer()
+	owner := loginAs(t, s, "alice")
+
+	listing := testListing("alice")
+	listing.Status, listing.Version = statusReserved, 1
+	listing.ReservedFor = "bob"
+	s.store.Listings.Create(context.Background(), &listing)
+
+	rr := serve(r, "PATCH", "/api/marketplace/listings/"+listing.ID.Hex(), owner, `{"version": 1, "status": "active", "reserved_for": ""}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	updated, _ := s.store.Listings.Get(context.Background(), listing.ID)
+	assert.Equal(t, statusReserved, updated.Status, "status only changes through transitions")
+	assert.Equal(t, "bob", updated.ReservedFor)
+}
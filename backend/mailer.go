@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MailMessage is a plain-text email handed to a Mailer.
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers outgoing email. The server uses an SMTP mailer when an
+// SMTP host is configured and falls back to the outbox mailer otherwise, so
+// local runs and tests never need a real mail server.
+type Mailer interface {
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+// outboxMailer writes every message to a writer instead of delivering it.
+type outboxMailer struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newLogMailer() *outboxMailer {
+	return &outboxMailer{out: log.Writer()}
+}
+
+// newFileMailer appends messages to the file at path, creating it if needed.
+func newFileMailer(path string) (*outboxMailer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &outboxMailer{out: f}, nil
+}
+
+func (m *outboxMailer) Send(ctx context.Context, msg MailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.out, "--- mail %s\nTo: %s\nSubject: %s\n\n%s\n",
+		time.Now().Format(time.RFC3339), msg.To, msg.Subject, msg.Body)
+	return err
+}
+
+// smtpMailer delivers mail through an SMTP relay using PLAIN auth.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(host, port, username, password, from string) *smtpMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &smtpMailer{addr: host + ":" + port, from: from, auth: auth}
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg MailMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n")
+	b.WriteString(msg.Body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(b.String()))
+}
+
+// newMailer picks the SMTP mailer when an SMTP host is configured, the file
+// outbox when a mail outbox file is set, and the log outbox otherwise.
+func newMailer(cfg Config) Mailer {
+	if cfg.SMTPHost != "" {
+		return newSMTPMailer(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort), cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPFrom)
+	}
+	if cfg.MailOutboxFile != "" {
+		m, err := newFileMailer(cfg.MailOutboxFile)
+		if err != nil {
+			log.Printf("Cannot open mail outbox %s, logging mail instead: %v\n", cfg.MailOutboxFile, err)
+			return newLogMailer()
+		}
+		return m
+	}
+	return newLogMailer()
+}
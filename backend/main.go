@@ -2,34 +2,84 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var client *mongo.Client
+// Server holds the dependencies shared by every HTTP handler.
+type Server struct {
+	store    *Store
+	otp      *OTPService
+	sessions *SessionService
+	search   *searchIndex
+	expiry   *ExpiryService
+	matcher  *ExchangeMatcher
+	rates    RateProvider
+	// images holds uploaded images, served under publicURL.
+	images    *ImageService
+	publicURL string
+	// feedKey signs calendar feed URLs; see feedToken.
+	feedKey       []byte
+	events        *EventHub
+	notifications *NotificationService
+}
+
+func newServer(store *Store, mailer Mailer, otpSecret []byte) *Server {
+	events := newEventHub()
+	notifications := newNotificationService(store, mailer, events)
+	s := &Server{
+		store:         store,
+		otp:           newOTPService(store.OTPs, mailer, otpSecret),
+		sessions:      newSessionService(store.Sessions),
+		search:        newSearchIndex(store),
+		expiry:        newExpiryService(store, notifications),
+		matcher:       newExchangeMatcher(store),
+		rates:         newCachingRateProvider(newFixtureRateProvider(fixtureRates), time.Hour),
+		images:        newImageService(store.Images, newMemoryBlobStore()),
+		feedKey:       newFeedKey(),
+		events:        events,
+		notifications: notifications,
+	}
+	s.matcher.marketRate = s.marketRate
+	s.matcher.matchChanged = s.matchChanged
+	s.expiry.listingChanged = func(ctx context.Context, listing *MarketplaceListing) {
+		s.search.putListing(listing)
+		s.listingStatusChanged(ctx, listing)
+	}
+	s.expiry.subleaseChanged = func(ctx context.Context, sublease *SubleasingRequest) {
+		s.search.putSublease(sublease)
+		s.subleaseStatusChanged(ctx, sublease)
+	}
+	s.expiry.offerChanged = s.offerChanged
+	s.matcher.requestChanged = s.exchangeStatusChanged
+	return s
+}
 
 // Stavan - Updated the User struct to for Profile
 type User struct {
-	ID             primitive.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
-	Email          string             `json:"email" bson:"email"`
-	LastLogin      time.Time          `json:"last_login" bson:"last_login"`
-	Name           string             `json:"name" bson:"name"`
-	PreferredEmail string             `json:"preferred_email" bson:"preferred_email,omitempty"`
-	Preferences    string             `json:"preferences" bson:"preferences,omitempty"`
-	Location       string             `json:"location" bson:"location,omitempty"`
+	ID             primitive.ObjectID      `json:"id,omitempty" bson:"_id,omitempty"`
+	Email          string                  `json:"email" bson:"email"`
+	LastLogin      time.Time               `json:"last_login" bson:"last_login"`
+	Name           string                  `json:"name" bson:"name"`
+	PreferredEmail string                  `json:"preferred_email" bson:"preferred_email,omitempty"`
+	Preferences    NotificationPreferences `json:"preferences" bson:"preferences"`
+	Location       string                  `json:"location" bson:"location,omitempty"`
+	Role           string                  `json:"role,omitempty" bson:"role,omitempty"`
 }
 
 type MarketplaceListing struct {
@@ -39,7 +89,8 @@ type MarketplaceListing struct {
 	Pictures    []string           `json:"pictures" bson:"pictures"`
 	Description string             `json:"description" bson:"description"`
 	Category    string             `json:"category" bson:"category"`
-	Price       float64            `json:"price" bson:"price"`
+	Price       Money              `json:"price" bson:"price"`
+	Currency    string             `json:"currency" bson:"currency"`
 	Condition   string             `json:"condition" bson:"condition"`
 	Location    struct {
 		City    string `json:"city" bson:"city"`
@@ -47,15 +98,49 @@ type MarketplaceListing struct {
 		Country string `json:"country" bson:"country"`
 	} `json:"location" bson:"location"`
 	DatePosted time.Time `json:"date_posted" bson:"date_posted"`
+	UpdatedAt  time.Time `json:"updated_at" bson:"updated_at"`
+	Version    int64     `json:"version" bson:"version"`
+	// Status is one of the status constants in lifecycle.go; listings saved
+	// before statuses existed have none and count as active.
+	Status      string         `json:"status" bson:"status,omitempty"`
+	ReservedFor string         `json:"reserved_for,omitempty" bson:"reserved_for,omitempty"`
+	History     []StatusChange `json:"history,omitempty" bson:"history,omitempty"`
+	// ExpiresAt is when the expiry scheduler takes the listing down unless
+	// it is renewed.
+	ExpiresAt        time.Time `json:"expires_at" bson:"expires_at,omitempty"`
+	ExpiryNotifiedAt time.Time `json:"-" bson:"expiry_notified_at,omitempty"`
+	// PictureVariants has the resized renditions of each entry in Pictures.
+	PictureVariants []PictureVariants `json:"picture_variants,omitempty" bson:"picture_variants,omitempty"`
+	// WatcherCount is how many users have it on their watchlist.
+	WatcherCount int `json:"watcher_count" bson:"watcher_count,omitempty"`
 }
 
 type CurrencyExchangeRequest struct {
 	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	UserID       string             `json:"user_id" bson:"user_id"`
-	Amount       float64            `json:"amount" bson:"amount"`
+	Amount       Money              `json:"amount" bson:"amount"`
 	FromCurrency string             `json:"from_currency" bson:"from_currency"`
 	ToCurrency   string             `json:"to_currency" bson:"to_currency"`
-	RequestDate  time.Time          `json:"request_date" bson:"request_date"`
+	// Rate is the least the requester takes, in ToCurrency per unit of
+	// FromCurrency; zero leaves pricing to the counterparty.
+	Rate float64 `json:"rate,omitempty" bson:"rate,omitempty"`
+	// MinAmount is the smallest partial fill, in FromCurrency, worth making.
+	MinAmount Money `json:"min_amount" bson:"min_amount,omitempty"`
+	// QuotedRate is the market rate when the request was posted or last
+	// edited, as a reference for what a fair trade is.
+	QuotedRate float64   `json:"quoted_rate,omitempty" bson:"quoted_rate,omitempty"`
+	QuotedAt   time.Time `json:"quoted_at,omitempty" bson:"quoted_at,omitempty"`
+	Filled     Money     `json:"filled" bson:"filled"`
+	// Status is derived from the request's matches; see trades.go.
+	// Requests saved before statuses existed have none and count as open.
+	Status string `json:"status" bson:"status,omitempty"`
+	// Timeline is visible only to the owner, through its own endpoint.
+	Timeline    []ExchangeEvent `json:"-" bson:"timeline,omitempty"`
+	RequestDate time.Time       `json:"request_date" bson:"request_date"`
+	UpdatedAt   time.Time       `json:"updated_at" bson:"updated_at"`
+	Version     int64           `json:"version" bson:"version"`
+	// WatcherCount is how many users have it on their watchlist.
+	WatcherCount int `json:"watcher_count" bson:"watcher_count,omitempty"`
 }
 
 type SubleasingRequest struct {
@@ -69,12 +154,32 @@ type SubleasingRequest struct {
 		Country string `json:"country" bson:"country"`
 	} `json:"location" bson:"location"`
 	Pictures []string `json:"pictures" bson:"pictures"`
-	Rent     float64  `json:"rent" bson:"rent"`
-	Period   struct {
-		StartDate time.Time `json:"start_date" bson:"start_date"`
-		EndDate   time.Time `json:"end_date" bson:"end_date"`
-	} `json:"period" bson:"period"`
-	DatePosted time.Time `json:"date_posted" bson:"date_posted"`
+	Rent     Money    `json:"rent" bson:"rent"`
+	Currency string   `json:"currency" bson:"currency"`
+	// RentPeriod is what one Rent payment covers: monthly, weekly or total.
+	RentPeriod string `json:"rent_period" bson:"rent_period,omitempty"`
+	// Utilities are charged on top of Rent for the same period; Deposit
+	// is paid once and refunded.
+	Utilities Money     `json:"utilities" bson:"utilities,omitempty"`
+	Deposit   Money     `json:"deposit" bson:"deposit,omitempty"`
+	Period    DateRange `json:"period" bson:"period"`
+	// Availability optionally narrows Period to the windows the place can
+	// be taken; empty means all of Period. See normalizeAvailability.
+	Availability []DateRange `json:"availability,omitempty" bson:"availability,omitempty"`
+	// OpenWindows is Availability, or Period when that is empty, for
+	// availability searches.
+	OpenWindows []DateRange `json:"-" bson:"open_windows"`
+	DatePosted  time.Time   `json:"date_posted" bson:"date_posted"`
+	UpdatedAt   time.Time   `json:"updated_at" bson:"updated_at"`
+	Version     int64       `json:"version" bson:"version"`
+	// Status is active or expired; subleases saved before statuses existed
+	// have none and count as active.
+	Status           string    `json:"status" bson:"status,omitempty"`
+	ExpiryNotifiedAt time.Time `json:"-" bson:"expiry_notified_at,omitempty"`
+	// PictureVariants has the resized renditions of each entry in Pictures.
+	PictureVariants []PictureVariants `json:"picture_variants,omitempty" bson:"picture_variants,omitempty"`
+	// WatcherCount is how many users have it on their watchlist.
+	WatcherCount int `json:"watcher_count" bson:"watcher_count,omitempty"`
 }
 
 type UserActivities struct {
@@ -83,94 +188,85 @@ type UserActivities struct {
 	SubleasingRequests       []SubleasingRequest       `json:"subleasing_requests"`
 }
 
-func connectToMongoDB() {
-	err_0 := godotenv.Load()
-	if err_0 != nil {
-		log.Fatal("Error loading .env file")
-	}
-
-	username := os.Getenv("MONGODB_USERNAME")
-	password := os.Getenv("MONGODB_PASSWORD")
-	connectionString := fmt.Sprintf("mongodb+srv://%s:%s@unimarketplace.j4fsn.mongodb.net/?retryWrites=true&w=majority&appName=unimarketplace", username, password)
-	clientOptions := options.Client().ApplyURI(connectionString).SetTLSConfig(&tls.Config{})
-	var err error
-	client, err = mongo.Connect(context.TODO(), clientOptions)
+func connectToMongoDB(cfg Config) *mongo.Client {
+	clientOptions := options.Client().ApplyURI(cfg.mongoConnectionURI())
+	client, err := mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("Connected to MongoDB!")
+	return client
 }
 
-func saveUser(w http.ResponseWriter, r *http.Request) {
-	var user User
-	err := json.NewDecoder(r.Body).Decode(&user)
+// saveUser verifies the emailed one-time code and only then creates or
+// updates the user record for that address and starts a session.
+func (s *Server) saveUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	collection := client.Database("uni_marketplace").Collection("users")
+	email, ok := normalizeEmail(req.Email)
+	if !ok || req.Code == "" {
+		http.Error(w, "email and code are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.otp.Verify(r.Context(), email, req.Code); err != nil {
+		status := otpErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to verify OTP: %v\n", err)
+			http.Error(w, "Failed to verify code", status)
+			return
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	// Define the filter and update query
-	filter := bson.M{"email": user.Email}
-	update := bson.M{"$set": bson.M{"last_login": user.LastLogin}}
-	opts := options.Update().SetUpsert(true)
-
-	// Perform the update
-	result, err := collection.UpdateOne(ctx, filter, update, opts)
+	// Create the user on first login, otherwise just record the login
+	user, err := s.store.Users.UpsertLogin(ctx, email, time.Now())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	var userID interface{}
-	if result.UpsertedID != nil {
-		userID = result.UpsertedID // New user created
-	} else {
-		// Retrieve user ID for existing users
-		var existingUser struct {
-			ID primitive.ObjectID `bson:"_id"`
-		}
-		err := collection.FindOne(ctx, filter).Decode(&existingUser)
-		if err != nil {
-			http.Error(w, "Failed to retrieve user ID", http.StatusInternalServerError)
-			return
-		}
-		userID = existingUser.ID
+	tokens, err := s.sessions.Create(ctx, user.ID.Hex(), email, user.Role)
+	if err != nil {
+		log.Printf("Failed to create session: %v\n", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
 	}
 
 	// Send the response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": "User saved successfully",
-		"userID":  userID,
+		"message":            "User saved successfully",
+		"userID":             user.ID,
+		"access_token":       tokens.AccessToken,
+		"refresh_token":      tokens.RefreshToken,
+		"access_expires_at":  tokens.AccessExpiresAt,
+		"refresh_expires_at": tokens.RefreshExpiresAt,
 	})
 }
 
-func getUsers(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getUsers(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	collection := client.Database("uni_marketplace").Collection("users")
-
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	users, err := s.store.Users.List(r.Context())
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Failed to retrieve users:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve users"})
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var users []User
-	for cursor.Next(context.TODO()) {
-		var user User
-		if err := cursor.Decode(&user); err != nil {
-			log.Fatal(err)
-		}
-		users = append(users, user)
-	}
 
 	response := map[string]interface{}{
 		"user_count": len(users),
@@ -180,7 +276,7 @@ func getUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 // Stavan 20th April - To Save User Details from User Profile
-func updateUserProfile(w http.ResponseWriter, r *http.Request) {
+func (s *Server) updateUserProfile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userIDHex := vars["id"]
 
@@ -190,6 +286,11 @@ func updateUserProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canModify(r, userIDHex) {
+		http.Error(w, "You can only update your own profile", http.StatusForbidden)
+		return
+	}
+
 	var user User
 	err = json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
@@ -197,31 +298,19 @@ func updateUserProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("uni_marketplace").Collection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	filter := bson.M{"_id": objectID}
-	update := bson.M{
-		"$set": bson.M{
-			"name":            user.Name,
-			"preferred_email": user.PreferredEmail,
-			"preferences":     user.Preferences,
-			"location":        user.Location,
-		},
+	err = s.store.Users.UpdateProfile(ctx, objectID, user)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
 	}
-
-	result, err := collection.UpdateOne(ctx, filter, update)
 	if err != nil {
 		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
 		return
 	}
 
-	if result.MatchedCount == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "Profile updated successfully",
@@ -230,7 +319,7 @@ func updateUserProfile(w http.ResponseWriter, r *http.Request) {
 }
 
 // Stavan 20th April - To Get Profile User Details for User Profile
-func getUserProfile(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getUserProfile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	userIDHex := vars["id"]
 
@@ -240,12 +329,10 @@ func getUserProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("uni_marketplace").Collection("users")
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var user User
-	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&user)
+	user, err := s.store.Users.Get(ctx, objectID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -256,7 +343,6 @@ func getUserProfile(w http.ResponseWriter, r *http.Request) {
 		"name":            user.Name,
 		"email":           user.Email,
 		"preferred_email": user.PreferredEmail,
-		"preferences":     user.Preferences,
 		"location":        user.Location,
 	}
 
@@ -266,7 +352,36 @@ func getUserProfile(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func postMarketplaceListing(w http.ResponseWriter, r *http.Request) {
+// validateListing returns why a listing cannot be saved, or "" if it can.
+func validateListing(listing *MarketplaceListing) string {
+	if listing.UserID == "" || listing.Title == "" || len(listing.Pictures) == 0 {
+		return "Missing required fields"
+	}
+	if msg := resolvePrice(&listing.Currency, &listing.Price, "price"); msg != "" {
+		return msg
+	}
+	if listing.Price.Minor < 0 {
+		return "price cannot be negative"
+	}
+	return ""
+}
+
+// resolvePrice validates the currency of a listing or sublease, defaulting
+// it to USD, and converts amount to that currency's minor units.
+func resolvePrice(currency *string, amount *Money, field string) string {
+	if *currency = normalizeCurrency(*currency); *currency == "" {
+		*currency = defaultCurrency
+	}
+	if !isCurrency(*currency) {
+		return "currency must be an ISO 4217 currency code"
+	}
+	if err := amount.resolve(*currency); err != nil {
+		return "Invalid " + field + ": " + err.Error()
+	}
+	return ""
+}
+
+func (s *Server) postMarketplaceListing(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", origin) // Allow the specific origin making the request
@@ -288,20 +403,29 @@ func postMarketplaceListing(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The owner is always the authenticated caller, never the payload
+	listing.UserID = currentUserID(r)
+
 	// Validate required fields
-	if listing.UserID == "" || listing.Title == "" || len(listing.Pictures) == 0 {
+	if msg := validateListing(&listing); msg != "" {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Missing required fields"})
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
 		return
 	}
 
 	// Set server-side values
 	listing.DatePosted = time.Now()
-
-	collection := client.Database("uni_marketplace").Collection("marketplace_listings")
-
-	// Attempt to insert into MongoDB
-	result, err := collection.InsertOne(context.Background(), listing)
+	listing.UpdatedAt = listing.DatePosted
+	listing.Version = 1
+	listing.Status = statusActive
+	listing.ReservedFor = ""
+	listing.History = nil
+	listing.ExpiresAt = s.expiry.listingExpiry(listing.DatePosted)
+	listing.ExpiryNotifiedAt = time.Time{}
+	listing.PictureVariants = pictureVariants(listing.Pictures)
+
+	// Attempt to insert into the store
+	err = s.store.Listings.Create(r.Context(), &listing)
 	if err != nil {
 		log.Printf("Database error: %v\n", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -310,73 +434,101 @@ func postMarketplaceListing(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Log success and return created document with generated ID
-	log.Printf("Successfully inserted document with ID: %v\n", result.InsertedID)
+	log.Printf("Successfully inserted document with ID: %v\n", listing.ID)
+	s.search.putListing(&listing)
+	s.listingPosted(r.Context(), &listing)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(listing)
 }
 
-func getMarketplaceListings(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getMarketplaceListings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	collection := client.Database("uni_marketplace").Collection("marketplace_listings")
+	query, err := listingQueryFromURL(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	listings, next, err := s.store.Listings.Find(r.Context(), query)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Failed to retrieve listings:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve listings"})
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var listings []MarketplaceListing
-	for cursor.Next(context.TODO()) {
-		var listing MarketplaceListing
-		if err := cursor.Decode(&listing); err != nil {
-			log.Fatal(err)
-		}
-		listings = append(listings, listing)
-	}
+	hidePrivateListings(r, listings)
 
 	response := map[string]interface{}{
 		"listing_count": len(listings),
 		"listings":      listings,
+		"next_cursor":   next,
 	}
 	json.NewEncoder(w).Encode(response)
 }
-func getCurrencyExchangeListings(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getCurrencyExchangeListings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	collection := client.Database("uni_marketplace").Collection("currency_exchange_requests")
+	query, err := exchangeQueryFromURL(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	listings, next, err := s.store.Exchanges.Find(r.Context(), query)
 	if err != nil {
 		log.Println("Failed to retrieve currency exchange listings:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve listings"})
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var listings []CurrencyExchangeRequest
-	for cursor.Next(context.TODO()) {
-		var listing CurrencyExchangeRequest
-		if err := cursor.Decode(&listing); err != nil {
-			log.Println("Failed to decode listing:", err)
-			continue
-		}
-		listings = append(listings, listing)
-	}
 
 	response := map[string]interface{}{
 		"listing_count": len(listings),
 		"listings":      listings,
+		"next_cursor":   next,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
-func createCurrencyExchangeRequest(w http.ResponseWriter, r *http.Request) {
+// validateExchangeRequest returns why a request cannot be saved, or "".
+func validateExchangeRequest(request *CurrencyExchangeRequest) string {
+	if request.UserID == "" || request.FromCurrency == "" || request.ToCurrency == "" {
+		return "Missing or invalid fields"
+	}
+	request.FromCurrency = normalizeCurrency(request.FromCurrency)
+	request.ToCurrency = normalizeCurrency(request.ToCurrency)
+	if !isCurrency(request.FromCurrency) || !isCurrency(request.ToCurrency) {
+		return "from_currency and to_currency must be ISO 4217 currency codes"
+	}
+	if request.FromCurrency == request.ToCurrency {
+		return "from_currency and to_currency must differ"
+	}
+	amounts := []struct {
+		field string
+		money *Money
+	}{{"amount", &request.Amount}, {"min_amount", &request.MinAmount}, {"filled", &request.Filled}}
+	for _, amount := range amounts {
+		if err := amount.money.resolve(request.FromCurrency); err != nil {
+			return "Invalid " + amount.field + ": " + err.Error()
+		}
+	}
+	if request.Amount.Minor <= 0 {
+		return "Missing or invalid fields"
+	}
+	if request.Rate < 0 || request.MinAmount.Minor < 0 || request.MinAmount.Minor > request.Amount.Minor {
+		return "Invalid rate or min_amount"
+	}
+	if request.Amount.Minor < request.Filled.Minor {
+		return "amount cannot drop below what has already been exchanged"
+	}
+	return ""
+}
+
+func (s *Server) createCurrencyExchangeRequest(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", origin)
@@ -398,20 +550,27 @@ func createCurrencyExchangeRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The owner is always the authenticated caller, never the payload
+	request.UserID = currentUserID(r)
+
 	// Validate required fields
-	if request.UserID == "" || request.FromCurrency == "" || request.ToCurrency == "" || request.Amount <= 0 {
+	if msg := validateExchangeRequest(&request); msg != "" {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Missing or invalid fields"})
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
 		return
 	}
 
 	// Set server-side value
 	request.RequestDate = time.Now()
-
-	collection := client.Database("uni_marketplace").Collection("currency_exchange_requests")
-
-	// Attempt to insert into MongoDB
-	result, err := collection.InsertOne(context.Background(), request)
+	request.UpdatedAt = request.RequestDate
+	request.Version = 1
+	request.Filled = Money{Currency: request.FromCurrency}
+	request.Status = exchangeOpen
+	request.Timeline = []ExchangeEvent{{Type: eventCreated, By: request.UserID, At: request.RequestDate, Status: exchangeOpen}}
+	s.quoteExchangeRequest(r.Context(), &request)
+
+	// Attempt to insert into the store
+	err = s.store.Exchanges.Create(r.Context(), &request)
 	if err != nil {
 		log.Printf("Database error: %v\n", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -419,43 +578,60 @@ func createCurrencyExchangeRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Successfully inserted currency exchange with ID: %v\n", result.InsertedID)
+	log.Printf("Successfully inserted currency exchange with ID: %v\n", request.ID)
+
+	if err := s.matcher.propose(r.Context(), &request); err != nil {
+		log.Printf("Database error: %v\n", err)
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(request)
 }
 
-func getCurrencyExchangeRequests(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getCurrencyExchangeRequests(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	collection := client.Database("uni_marketplace").Collection("currency_exchange_requests")
+	query, err := exchangeQueryFromURL(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
 
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	requests, next, err := s.store.Exchanges.Find(r.Context(), query)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Failed to retrieve currency exchange requests:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve currency exchange requests"})
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var requests []CurrencyExchangeRequest
-	for cursor.Next(context.TODO()) {
-		var request CurrencyExchangeRequest
-		if err := cursor.Decode(&request); err != nil {
-			log.Fatal(err)
-		}
-		requests = append(requests, request)
-	}
 
 	response := map[string]interface{}{
 		"request_count": len(requests),
 		"requests":      requests,
+		"next_cursor":   next,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
-func postSubleasingRequest(w http.ResponseWriter, r *http.Request) {
+// validateSublease returns why a sublease cannot be saved, or "" if it can.
+func validateSublease(sublease *SubleasingRequest) string {
+	if msg := resolvePrice(&sublease.Currency, &sublease.Rent, "rent"); msg != "" {
+		return msg
+	}
+	if sublease.UserID == "" || sublease.Title == "" || sublease.Description == "" || sublease.Rent.Minor <= 0 {
+		return "Missing or invalid fields"
+	}
+	if sublease.Location.City == "" || sublease.Location.State == "" || sublease.Location.Country == "" {
+		return "Incomplete location info"
+	}
+	if msg := validateRentTerms(sublease); msg != "" {
+		return msg
+	}
+	return normalizeAvailability(sublease)
+}
+
+func (s *Server) postSubleasingRequest(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("Origin")
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", origin)
@@ -477,33 +653,26 @@ func postSubleasingRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate required fields
-	if sublease.UserID == "" || sublease.Title == "" || sublease.Description == "" || sublease.Rent <= 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Missing or invalid fields"})
-		return
-	}
+	// The owner is always the authenticated caller, never the payload
+	sublease.UserID = currentUserID(r)
 
-	// Validate nested fields
-	if sublease.Location.City == "" || sublease.Location.State == "" || sublease.Location.Country == "" {
+	// Validate required and nested fields
+	if msg := validateSublease(&sublease); msg != "" {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Incomplete location info"})
-		return
-	}
-
-	if sublease.Period.StartDate.IsZero() || sublease.Period.EndDate.IsZero() {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Missing rental period"})
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
 		return
 	}
 
 	// Set server-side values
 	sublease.DatePosted = time.Now()
-
-	collection := client.Database("uni_marketplace").Collection("subleasing_requests")
-
-	// Insert into MongoDB
-	result, err := collection.InsertOne(context.Background(), sublease)
+	sublease.UpdatedAt = sublease.DatePosted
+	sublease.Version = 1
+	sublease.Status = statusActive
+	sublease.ExpiryNotifiedAt = time.Time{}
+	sublease.PictureVariants = pictureVariants(sublease.Pictures)
+
+	// Insert into the store
+	err = s.store.Subleases.Create(r.Context(), &sublease)
 	if err != nil {
 		log.Printf("Database error: %v\n", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -511,79 +680,93 @@ func postSubleasingRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Successfully inserted sublease with ID: %v\n", result.InsertedID)
+	log.Printf("Successfully inserted sublease with ID: %v\n", sublease.ID)
+	s.search.putSublease(&sublease)
+	s.subleasePosted(r.Context(), &sublease)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(sublease)
 }
 
-// SS April 20 - Renaming this to old and updating new api below this
-func getSubleasingRequests_old(w http.ResponseWriter, r *http.Request) {
+// SS April 20 - Latsest API for getting subleasing
+func (s *Server) getSubleasingRequests(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
-	// Get the subleasing requests collection
-	collection := client.Database("uni_marketplace").Collection("subleasing_requests")
-
-	// Retrieve all subleasing requests
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	query, err := subleaseQueryFromURL(r.URL.Query())
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve subleasing requests"})
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var requests []bson.M
-	for cursor.Next(context.TODO()) {
-		var request bson.M
-		if err := cursor.Decode(&request); err != nil {
-			log.Fatal(err)
-		}
-		requests = append(requests, request)
-	}
-
-	// Response JSON
-	response := map[string]interface{}{
-		"request_count": len(requests),
-		"requests":      requests,
-	}
-	json.NewEncoder(w).Encode(response)
-}
 
-// SS April 20 - Latsest API for getting subleasing
-func getSubleasingRequests(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	collection := client.Database("uni_marketplace").Collection("subleasing_requests")
-
-	cursor, err := collection.Find(context.TODO(), bson.M{})
+	requests, next, err := s.store.Subleases.Find(r.Context(), query)
 	if err != nil {
 		log.Println("Error finding documents:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve subleasing requests"})
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var requests []SubleasingRequest
-	for cursor.Next(context.TODO()) {
-		var request SubleasingRequest
-		if err := cursor.Decode(&request); err != nil {
-			log.Println("Error decoding document:", err)
-			continue
-		}
-		requests = append(requests, request)
-	}
 
 	response := map[string]interface{}{
 		"request_count": len(requests),
 		"requests":      requests,
+		"next_cursor":   next,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
-func deleteListing(w http.ResponseWriter, r *http.Request) {
+// ownedCollection lets deleteListing treat the three listing repositories
+// alike: look up the owner of an ID, then delete it.
+type ownedCollection struct {
+	name string
+	// subject is the item type watchers know it by.
+	subject string
+	owner   func(ctx context.Context, id primitive.ObjectID) (string, error)
+	delete  func(ctx context.Context, id primitive.ObjectID) error
+}
+
+func (s *Server) ownedCollections() []ownedCollection {
+	return []ownedCollection{
+		{
+			name:    "marketplace_listings",
+			subject: subjectListing,
+			owner: func(ctx context.Context, id primitive.ObjectID) (string, error) {
+				listing, err := s.store.Listings.Get(ctx, id)
+				if err != nil {
+					return "", err
+				}
+				return listing.UserID, nil
+			},
+			delete: s.deleteMarketplaceListing,
+		},
+		{
+			name:    "currency_exchange_requests",
+			subject: subjectExchange,
+			owner: func(ctx context.Context, id primitive.ObjectID) (string, error) {
+				request, err := s.store.Exchanges.Get(ctx, id)
+				if err != nil {
+					return "", err
+				}
+				return request.UserID, nil
+			},
+			delete: s.deleteExchangeRequest,
+		},
+		{
+			name:    "subleasing_requests",
+			subject: subjectSublease,
+			owner: func(ctx context.Context, id primitive.ObjectID) (string, error) {
+				sublease, err := s.store.Subleases.Get(ctx, id)
+				if err != nil {
+					return "", err
+				}
+				return sublease.UserID, nil
+			},
+			delete: s.store.Subleases.Delete,
+		},
+	}
+}
+
+func (s *Server) deleteListing(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
@@ -593,14 +776,28 @@ func deleteListing(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// You can use a common deletion if you pass a `type` param too
-	collections := []string{"marketplace_listings", "currency_exchange_requests", "subleasing_requests"}
+	for _, coll := range s.ownedCollections() {
+		// Look up the owner first so only they (or an admin) can delete it
+		owner, err := coll.owner(r.Context(), objID)
+		if err != nil {
+			continue
+		}
+		if !canModify(r, owner) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "You can only delete your own listings"})
+			return
+		}
 
-	for _, coll := range collections {
-		collection := client.Database("uni_marketplace").Collection(coll)
-		result, err := collection.DeleteOne(context.Background(), bson.M{"_id": objID})
-		if err == nil && result.DeletedCount > 0 {
-			json.NewEncoder(w).Encode(map[string]string{"message": "Listing deleted successfully", "collection": coll})
+		err = coll.delete(r.Context(), objID)
+		if errors.Is(err, errTradeConfirmed) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		if err == nil {
+			s.search.remove(objID)
+			s.itemDeleted(r.Context(), coll.subject, objID)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Listing deleted successfully", "collection": coll.name})
 			return
 		}
 	}
@@ -609,7 +806,7 @@ func deleteListing(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
 }
 
-func getUserActivities(w http.ResponseWriter, r *http.Request) {
+func (s *Server) getUserActivities(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	userID := r.URL.Query().Get("user_id")
 	if userID == "" {
@@ -620,44 +817,24 @@ func getUserActivities(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	// Query marketplace_listings collection
-	marketplaceCollection := client.Database("uni_marketplace").Collection("marketplace_listings")
-	var marketplaceListings []MarketplaceListing
-	cursor, err := marketplaceCollection.Find(ctx, bson.M{"user_id": userID})
+	marketplaceListings, err := s.store.Listings.ListByUser(ctx, userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err = cursor.All(ctx, &marketplaceListings); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	hidePrivateListings(r, marketplaceListings)
 
-	// Query currency_exchange_requests collection
-	currencyExchangeCollection := client.Database("uni_marketplace").Collection("currency_exchange_requests")
-	var currencyExchangeRequests []CurrencyExchangeRequest
-	cursor, err = currencyExchangeCollection.Find(ctx, bson.M{"user_id": userID})
+	currencyExchangeRequests, err := s.store.Exchanges.ListByUser(ctx, userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err = cursor.All(ctx, &currencyExchangeRequests); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 
-	// Query subleasing_requests collection
-	subleasingCollection := client.Database("uni_marketplace").Collection("subleasing_requests")
-	var subleasingRequests []SubleasingRequest
-	cursor, err = subleasingCollection.Find(ctx, bson.M{"user_id": userID})
+	subleasingRequests, err := s.store.Subleases.ListByUser(ctx, userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err = cursor.All(ctx, &subleasingRequests); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
 
 	// Aggregate results
 	userActivities := UserActivities{
@@ -669,40 +846,153 @@ func getUserActivities(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(userActivities)
 }
 
-func main() {
-	connectToMongoDB()
+// newRouter registers every API route on a fresh router.
+func newRouter(s *Server) *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/api/saveUser", saveUser).Methods("POST")
-	r.HandleFunc("/api/users", getUsers).Methods("GET")
+	// Routes that act on behalf of a user go through requireAuth
+	authed := r.NewRoute().Subrouter()
+	authed.Use(s.requireAuth)
+
+	r.HandleFunc("/api/auth/otp/request", s.requestOTP).Methods("POST")
+	r.HandleFunc("/api/auth/otp/verify", s.saveUser).Methods("POST")
+	r.HandleFunc("/api/auth/refresh", s.refreshSession).Methods("POST")
+	authed.HandleFunc("/api/auth/logout", s.logout).Methods("POST")
+	r.HandleFunc("/api/saveUser", s.saveUser).Methods("POST")
+	r.HandleFunc("/api/users", s.getUsers).Methods("GET")
 	//r.HandleFunc("/api/marketplace/listing", postMarketplaceListing).Methods("POST")
 	//r.HandleFunc("/api/marketplace/listings", getMarketplaceListings).Methods("GET")
-	r.HandleFunc("/api/currency/exchange", createCurrencyExchangeRequest).Methods("POST")
-	r.HandleFunc("/api/currency/exchange/requests", getCurrencyExchangeRequests).Methods("GET")
-	r.HandleFunc("/api/subleasing", postSubleasingRequest).Methods("POST")
-	//Stavan - This is the old one
-	//r.HandleFunc("/api/subleasing/requests", getSubleasingRequests_old).Methods("GET")
-	r.HandleFunc("/api/getMarketplaceListings", getMarketplaceListings).Methods("GET")
-	r.HandleFunc("/api/postMarketplaceListing", postMarketplaceListing).Methods("POST")
-	r.HandleFunc("/api/user/activities", getUserActivities).Methods("GET")
+	authed.HandleFunc("/api/currency/exchange", s.createCurrencyExchangeRequest).Methods("POST")
+	r.HandleFunc("/api/currency/exchange/requests", s.getCurrencyExchangeRequests).Methods("GET")
+	authed.HandleFunc("/api/subleasing", s.postSubleasingRequest).Methods("POST")
+	r.HandleFunc("/api/getMarketplaceListings", s.getMarketplaceListings).Methods("GET")
+	authed.HandleFunc("/api/postMarketplaceListing", s.postMarketplaceListing).Methods("POST")
+	r.HandleFunc("/api/user/activities", s.getUserActivities).Methods("GET")
 	// 4 API Added by Stavan 20th April
-	r.HandleFunc("/api/getCurrencyExchangeListings", getCurrencyExchangeListings).Methods("GET")
-	r.HandleFunc("/api/updateUserProfile/{id}", updateUserProfile).Methods("POST")
-	r.HandleFunc("/api/getUserProfile/{id}", getUserProfile).Methods("GET")
-	r.HandleFunc("/api/getSubleasingRequests", getSubleasingRequests).Methods("GET")
+	r.HandleFunc("/api/getCurrencyExchangeListings", s.getCurrencyExchangeListings).Methods("GET")
+	authed.HandleFunc("/api/updateUserProfile/{id}", s.updateUserProfile).Methods("POST")
+	r.HandleFunc("/api/getUserProfile/{id}", s.getUserProfile).Methods("GET")
+	r.HandleFunc("/api/getSubleasingRequests", s.getSubleasingRequests).Methods("GET")
 	//Adding the DELETE API
-	r.HandleFunc("/api/deleteListing/{id}", deleteListing).Methods("DELETE")
+	authed.HandleFunc("/api/deleteListing/{id}", s.deleteListing).Methods("DELETE")
+	// PATCH merges the body into the stored document, PUT replaces it
+	authed.HandleFunc("/api/marketplace/listings/{id}", s.updateMarketplaceListing).Methods("PATCH", "PUT")
+	authed.HandleFunc("/api/currency/exchange/{id}", s.updateCurrencyExchangeRequest).Methods("PATCH", "PUT")
+	authed.HandleFunc("/api/subleasing/{id}", s.updateSubleasingRequest).Methods("PATCH", "PUT")
+
+	// Listing lifecycle; see listingTransitions for the allowed moves
+	authed.HandleFunc("/api/marketplace/listings/{id}/reserve", s.listingTransitionHandler(statusReserved)).Methods("POST")
+	authed.HandleFunc("/api/marketplace/listings/{id}/sold", s.listingTransitionHandler(statusSold)).Methods("POST")
+	authed.HandleFunc("/api/marketplace/listings/{id}/relist", s.listingTransitionHandler(statusActive)).Methods("POST")
+	authed.HandleFunc("/api/marketplace/listings/{id}/withdraw", s.listingTransitionHandler(statusWithdrawn)).Methods("POST")
+	authed.HandleFunc("/api/marketplace/listings/{id}/history", s.getListingHistory).Methods("GET")
+	authed.HandleFunc("/api/marketplace/listings/{id}/renew", s.renewListing).Methods("POST")
+	authed.HandleFunc("/api/subleasing/{id}/renew", s.renewSublease).Methods("POST")
+
+	r.HandleFunc("/api/currency/rates", s.getCurrencyRates).Methods("GET")
+	authed.HandleFunc("/api/currency/exchange/{id}/matches", s.getExchangeMatches).Methods("GET")
+	authed.HandleFunc("/api/currency/exchange/{id}/matches/{matchId}/accept", s.matchResponseHandler(true)).Methods("POST")
+	authed.HandleFunc("/api/currency/exchange/{id}/matches/{matchId}/decline", s.matchResponseHandler(false)).Methods("POST")
+	authed.HandleFunc("/api/currency/exchange/{id}/matches/{matchId}/meeting", s.tradeActionHandler("meeting")).Methods("POST")
+	authed.HandleFunc("/api/currency/exchange/{id}/matches/{matchId}/confirm", s.tradeActionHandler("confirm")).Methods("POST")
+	authed.HandleFunc("/api/currency/exchange/{id}/matches/{matchId}/dispute", s.tradeActionHandler("dispute")).Methods("POST")
+	authed.HandleFunc("/api/currency/exchange/{id}/cancel", s.cancelExchangeRequest).Methods("POST")
+	authed.HandleFunc("/api/currency/exchange/{id}/timeline", s.getExchangeTimeline).Methods("GET")
+
+	authed.HandleFunc("/api/images", s.uploadImages).Methods("POST")
+	r.HandleFunc("/api/images/{key}", s.getImage).Methods("GET")
+
+	r.HandleFunc("/api/search", s.searchListings).Methods("GET")
+
+	r.HandleFunc("/api/subleasing/{id}/calendar.ics", s.getSubleaseCalendar).Methods("GET")
+	r.HandleFunc("/api/subleasing/{id}/quote", s.getSubleaseQuote).Methods("GET")
+	authed.HandleFunc("/api/calendar/feed", s.getCalendarFeedURL).Methods("GET")
+	r.HandleFunc("/api/users/{id}/calendar.ics", s.getUserCalendar).Methods("GET")
+
+	// Conversations are visible to their participants only
+	authed.HandleFunc("/api/conversations", s.startConversation).Methods("POST")
+	authed.HandleFunc("/api/conversations", s.getConversations).Methods("GET")
+	authed.HandleFunc("/api/conversations/unread", s.getUnreadCount).Methods("GET")
+	authed.HandleFunc("/api/conversations/{id}", s.getConversation).Methods("GET")
+	authed.HandleFunc("/api/conversations/{id}/messages", s.getMessages).Methods("GET")
+	authed.HandleFunc("/api/conversations/{id}/messages", s.postMessage).Methods("POST")
+	authed.HandleFunc("/api/conversations/{id}/messages/{messageId}", s.deleteMessage).Methods("DELETE")
+
+	authed.HandleFunc("/api/notifications", s.getNotifications).Methods("GET")
+	authed.HandleFunc("/api/notifications/unread", s.getUnreadNotificationCount).Methods("GET")
+	authed.HandleFunc("/api/notifications/read", s.markNotificationsRead).Methods("POST")
+	authed.HandleFunc("/api/notifications/preferences", s.getNotificationPreferences).Methods("GET")
+	authed.HandleFunc("/api/notifications/preferences", s.updateNotificationPreferences).Methods("PUT")
+
+	authed.HandleFunc("/api/searches", s.createSavedSearch).Methods("POST")
+	authed.HandleFunc("/api/searches", s.getSavedSearches).Methods("GET")
+	authed.HandleFunc("/api/searches/{id}", s.deleteSavedSearch).Methods("DELETE")
+	authed.HandleFunc("/api/searches/{id}/hits", s.getSavedSearchHits).Methods("GET")
+
+	authed.HandleFunc("/api/watchlist", s.watchItem).Methods("POST")
+	authed.HandleFunc("/api/watchlist", s.getWatchlist).Methods("GET")
+	authed.HandleFunc("/api/watchlist/{type}/{id}", s.unwatchItem).Methods("DELETE")
+
+	authed.HandleFunc("/api/marketplace/listings/{id}/offers", s.makeOffer).Methods("POST")
+	authed.HandleFunc("/api/marketplace/listings/{id}/offers", s.getListingOffers).Methods("GET")
+	authed.HandleFunc("/api/offers", s.getOffers).Methods("GET")
+	authed.HandleFunc("/api/offers/{id}", s.getOffer).Methods("GET")
+	authed.HandleFunc("/api/offers/{id}/accept", s.offerActionHandler(offerActionAccept)).Methods("POST")
+	authed.HandleFunc("/api/offers/{id}/decline", s.offerActionHandler(offerActionDecline)).Methods("POST")
+	authed.HandleFunc("/api/offers/{id}/counter", s.offerActionHandler(offerActionCounter)).Methods("POST")
+	authed.HandleFunc("/api/offers/{id}/withdraw", s.offerActionHandler(offerActionWithdraw)).Methods("POST")
+
+	// Browsers cannot authenticate an EventSource with a header
+	r.Handle("/api/events", eventSourceToken(s.requireAuth(http.HandlerFunc(s.streamEvents)))).Methods("GET")
+
+	return r
+}
+
+func main() {
+	// A .env file is optional; real deployments set the environment directly
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal("Error loading .env file: ", err)
+	}
+
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	client := connectToMongoDB(cfg)
+
+	store, err := newMongoStore(context.Background(), client.Database(cfg.Database))
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := newServer(store, newMailer(cfg), otpSecret(cfg))
+	if s.feedKey, err = calendarFeedKey(context.Background(), cfg, client.Database(cfg.Database)); err != nil {
+		log.Fatal("Loading the calendar feed key: ", err)
+	}
+	s.expiry.maxAge = time.Duration(cfg.ListingMaxAgeDays) * 24 * time.Hour
+	s.expiry.warnBefore = time.Duration(cfg.ExpiryWarningDays) * 24 * time.Hour
+	go s.expiry.run(context.Background(), time.Duration(cfg.ExpiryCheckMinutes)*time.Minute)
+	s.images.blobs = newBlobStore(cfg)
+	if s.rates, err = newRateProvider(cfg); err != nil {
+		log.Fatal("Invalid exchange rate source: ", err)
+	}
+	go s.images.run(context.Background(), time.Minute)
+	go s.notifications.run(context.Background(), time.Minute)
+	s.publicURL = strings.TrimRight(cfg.PublicURL, "/")
+
+	r := newRouter(s)
 
 	// Enable CORS
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:5173", "http://localhost:5174", "http://localhost:5175", "http://localhost:5176"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowedOrigins:   cfg.CORSOrigins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "If-Match"},
+		ExposedHeaders:   []string{"ETag"},
 		AllowCredentials: true,
 	})
 
 	handler := c.Handler(r)
 
-	fmt.Println("Server is running on port 8080...")
-	log.Fatal(http.ListenAndServe(":8080", handler))
+	fmt.Printf("Server is running on port %d...\n", cfg.Port)
+	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(cfg.Port), handler))
 }
@@ -11,192 +11,71 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// MockHandlers to use MongoDB client passed as argument instead of global client
-func mockSaveUser(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var user User
-		json.NewDecoder(r.Body).Decode(&user)
-		user.LastLogin = time.Now()
-
-		collection := testClient.Database("uni_marketplace_test").Collection("users")
-		_, err := collection.InsertOne(context.Background(), user)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save user"})
-			return
-		}
-
-		json.NewEncoder(w).Encode(user)
-	}
-}
-
-func mockGetUsers(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		collection := testClient.Database("uni_marketplace_test").Collection("users")
-
-		cursor, err := collection.Find(context.Background(), bson.M{})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve users"})
-			return
-		}
-		defer cursor.Close(context.Background())
-
-		var users []User
-		for cursor.Next(context.Background()) {
-			var user User
-			if err := cursor.Decode(&user); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			users = append(users, user)
-		}
-
-		response := map[string]interface{}{
-			"user_count": len(users),
-			"users":      users,
-		}
-		json.NewEncoder(w).Encode(response)
-	}
+// newTestServer builds the real server on an in-memory store so handlers can
+// be exercised without MongoDB.
+func newTestServer() (*Server, *mux.Router) {
+	s := newServer(newMemoryStore(), &recordingMailer{}, []byte("test-secret"))
+	return s, newRouter(s)
 }
 
-func mockPostMarketplaceListing(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var listing MarketplaceListing
-		json.NewDecoder(r.Body).Decode(&listing)
-		listing.DatePosted = time.Now()
-
-		collection := testClient.Database("uni_marketplace_test").Collection("marketplace_listings")
-		_, err := collection.InsertOne(context.Background(), listing)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to post listing"})
-			return
-		}
-
-		json.NewEncoder(w).Encode(listing)
+// loginAs starts a session for userID and returns its access token.
+func loginAs(t *testing.T, s *Server, userID string) string {
+	tokens, err := s.sessions.Create(context.Background(), userID, userID+"@ufl.edu", "")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
 	}
+	return tokens.AccessToken
 }
 
-func mockGetMarketplaceListings(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		collection := testClient.Database("uni_marketplace_test").Collection("marketplace_listings")
-
-		cursor, err := collection.Find(context.Background(), bson.M{})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve listings"})
-			return
-		}
-		defer cursor.Close(context.Background())
-
-		var listings []MarketplaceListing
-		for cursor.Next(context.Background()) {
-			var listing MarketplaceListing
-			if err := cursor.Decode(&listing); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			listings = append(listings, listing)
-		}
-
-		response := map[string]interface{}{
-			"listing_count": len(listings),
-			"listings":      listings,
-		}
-		json.NewEncoder(w).Encode(response)
+// newRequest builds a JSON request, authenticated with token if set.
+func newRequest(method, route, token, body string) *http.Request {
+	req := httptest.NewRequest(method, route, bytes.NewReader([]byte(body)))
+	req.Header.Add("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Add("Authorization", "Bearer "+token)
 	}
+	return req
 }
 
-func mockCreateCurrencyExchangeRequest(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var request CurrencyExchangeRequest
-		json.NewDecoder(r.Body).Decode(&request)
-		request.RequestDate = time.Now()
-
-		collection := testClient.Database("uni_marketplace_test").Collection("currency_exchange_requests")
-		_, err := collection.InsertOne(context.Background(), request)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create currency exchange request"})
-			return
-		}
-
-		json.NewEncoder(w).Encode(request)
-	}
+// serve sends a request through the router and records the response.
+func serve(r *mux.Router, method, route, token, body string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, newRequest(method, route, token, body))
+	return rr
 }
 
-func mockGetCurrencyExchangeRequests(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		collection := testClient.Database("uni_marketplace_test").Collection("currency_exchange_requests")
-		cursor, err := collection.Find(context.Background(), bson.M{})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve currency exchange requests"})
-			return
-		}
-		defer cursor.Close(context.Background())
-
-		var requests []CurrencyExchangeRequest
-		for cursor.Next(context.Background()) {
-			var request CurrencyExchangeRequest
-			if err := cursor.Decode(&request); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to decode request"})
-				return
-			}
-			requests = append(requests, request)
-		}
-
-		response := map[string]interface{}{
-			"request_count": len(requests),
-			"requests":      requests,
-		}
-		json.NewEncoder(w).Encode(response)
+func testListing(userID string) MarketplaceListing {
+	listing := MarketplaceListing{
+		UserID:      userID,
+		Title:       "Laptop for Sale",
+		Pictures:    []string{"img1.jpg", "img2.jpg"},
+		Description: "Good condition laptop",
+		Category:    "Electronics",
+		Price:       money(300, "USD"),
+		Currency:    "USD",
+		Condition:   "Used",
+		DatePosted:  time.Now(),
 	}
+	listing.Location.City = "Gainesville"
+	listing.Location.State = "FL"
+	listing.Location.Country = "USA"
+	return listing
 }
 
-func mockPostSubleasingRequest(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var sublease SubleasingRequest
-		json.NewDecoder(r.Body).Decode(&sublease)
-		sublease.DatePosted = time.Now()
-
-		collection := testClient.Database("uni_marketplace_test").Collection("subleasing_requests")
-		_, err := collection.InsertOne(context.Background(), sublease)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to post subleasing request"})
-			return
-		}
-
-		json.NewEncoder(w).Encode(sublease)
-	}
+// money builds an amount of currency for test fixtures.
+func money(amount float64, currency string) Money {
+	return moneyFromFloat(amount, currency)
 }
 
 func TestSaveUser(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
+	mailer := &recordingMailer{}
+	s.otp.mailer = mailer
+
+	assert.NoError(t, s.otp.Issue(context.Background(), "testuser@example.com"))
 
 	tests := []struct {
 		description  string
@@ -208,40 +87,33 @@ func TestSaveUser(t *testing.T) {
 			description:  "POST status 200",
 			route:        "/api/saveUser",
 			expectedCode: 200,
-			reqBody:      `{"email": "testuser@example.com", "name": "Test User"}`,
+			reqBody:      `{"email": "testuser@example.com", "code": "` + mailer.lastCode() + `"}`,
+		},
+		{
+			description:  "POST code reuse",
+			route:        "/api/saveUser",
+			expectedCode: 401,
+			reqBody:      `{"email": "testuser@example.com", "code": "` + mailer.lastCode() + `"}`,
 		},
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest("POST", test.route, bytes.NewReader([]byte(test.reqBody)))
-		req.Header.Add("Content-Type", "application/json")
-
-		// Setting up a test server with mock handler
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/saveUser", mockSaveUser(testClient)).Methods("POST")
-		r.ServeHTTP(rr, req)
+		rr := serve(r, "POST", test.route, "", test.reqBody)
 
 		// Asserting the status code
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
 	}
+
+	users, _ := s.store.Users.List(context.Background())
+	assert.Len(t, users, 1)
+	assert.Equal(t, "testuser@example.com", users[0].Email)
 }
 
 func TestGetUsers(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
 
 	// Insert test data
-	collection := testClient.Database("uni_marketplace_test").Collection("users")
-	user := User{Email: "testuser@example.com", Name: "Test User", LastLogin: time.Now()}
-	_, err = collection.InsertOne(context.Background(), user)
-	if err != nil {
-		t.Fatalf("Failed to insert mock user data: %v", err)
-	}
+	s.store.Users.UpsertLogin(context.Background(), "testuser@example.com", time.Now())
 
 	tests := []struct {
 		description  string
@@ -256,24 +128,20 @@ func TestGetUsers(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest("GET", test.route, nil)
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/users", mockGetUsers(testClient)).Methods("GET")
-		r.ServeHTTP(rr, req)
+		rr := serve(r, "GET", test.route, "", "")
 
 		// Asserting the status code
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		assert.Equal(t, float64(1), response["user_count"])
 	}
 }
 
 func TestPostMarketplaceListing(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
+	token := loginAs(t, s, "12345")
 
 	tests := []struct {
 		description  string
@@ -282,61 +150,37 @@ func TestPostMarketplaceListing(t *testing.T) {
 		reqBody      string
 	}{
 		{
-			description:  "POST status 200",
-			route:        "/api/marketplace/listing",
-			expectedCode: 200,
+			description:  "POST status 201",
+			route:        "/api/postMarketplaceListing",
+			expectedCode: 201,
 			reqBody:      `{"user_id": "12345", "title": "Laptop for Sale", "pictures": ["img1.jpg", "img2.jpg"], "description": "Good condition laptop", "category": "Electronics", "price": 300.00, "condition": "Used", "location": {"city": "Gainesville", "state": "FL", "country": "USA"}}`,
 		},
+		{
+			description:  "POST missing pictures",
+			route:        "/api/postMarketplaceListing",
+			expectedCode: 400,
+			reqBody:      `{"title": "Laptop for Sale"}`,
+		},
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest("POST", test.route, bytes.NewReader([]byte(test.reqBody)))
-		req.Header.Add("Content-Type", "application/json")
-
-		// Setting up the test server
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/marketplace/listing", mockPostMarketplaceListing(testClient)).Methods("POST")
-		r.ServeHTTP(rr, req)
+		rr := serve(r, "POST", test.route, token, test.reqBody)
 
 		// Asserting the status code
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
 	}
+
+	listings, _ := s.store.Listings.List(context.Background())
+	assert.Len(t, listings, 1)
+	assert.False(t, listings[0].ID.IsZero())
 }
 
 func TestGetMarketplaceListings(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
 
 	// Insert test data
-	collection := testClient.Database("uni_marketplace_test").Collection("marketplace_listings")
-	listing := MarketplaceListing{
-		UserID:      "12345",
-		Title:       "Laptop for Sale",
-		Pictures:    []string{"img1.jpg", "img2.jpg"},
-		Description: "Good condition laptop",
-		Category:    "Electronics",
-		Price:       300.00,
-		Condition:   "Used",
-		Location: struct {
-			City    string `json:"city" bson:"city"`
-			State   string `json:"state" bson:"state"`
-			Country string `json:"country" bson:"country"`
-		}{
-			City:    "Gainesville",
-			State:   "FL",
-			Country: "USA",
-		},
-		DatePosted: time.Now(),
-	}
-	_, err = collection.InsertOne(context.Background(), listing)
-	if err != nil {
-		t.Fatalf("Failed to insert mock listing data: %v", err)
-	}
+	listing := testListing("12345")
+	s.store.Listings.Create(context.Background(), &listing)
 
 	tests := []struct {
 		description  string
@@ -345,30 +189,26 @@ func TestGetMarketplaceListings(t *testing.T) {
 	}{
 		{
 			description:  "GET status 200",
-			route:        "/api/marketplace/listings",
+			route:        "/api/getMarketplaceListings",
 			expectedCode: 200,
 		},
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest("GET", test.route, nil)
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/marketplace/listings", mockGetMarketplaceListings(testClient)).Methods("GET")
-		r.ServeHTTP(rr, req)
+		rr := serve(r, "GET", test.route, "", "")
 
 		// Asserting the status code
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		assert.Equal(t, float64(1), response["listing_count"])
 	}
 }
 
 func TestCreateCurrencyExchangeRequest(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
+	token := loginAs(t, s, "12345")
 
 	tests := []struct {
 		description  string
@@ -377,22 +217,21 @@ func TestCreateCurrencyExchangeRequest(t *testing.T) {
 		reqBody      string
 	}{
 		{
-			description:  "POST status 200",
+			description:  "POST status 201",
 			route:        "/api/currency/exchange",
-			expectedCode: 200,
+			expectedCode: 201,
 			reqBody:      `{"user_id": "12345", "amount": 100, "from_currency": "USD", "to_currency": "EUR"}`,
 		},
+		{
+			description:  "POST invalid amount",
+			route:        "/api/currency/exchange",
+			expectedCode: 400,
+			reqBody:      `{"amount": 0, "from_currency": "USD", "to_currency": "EUR"}`,
+		},
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest("POST", test.route, bytes.NewReader([]byte(test.reqBody)))
-		req.Header.Add("Content-Type", "application/json")
-
-		// Setting up the test server
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/currency/exchange", mockCreateCurrencyExchangeRequest(testClient)).Methods("POST")
-		r.ServeHTTP(rr, req)
+		rr := serve(r, "POST", test.route, token, test.reqBody)
 
 		// Asserting the status code
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
@@ -400,12 +239,8 @@ func TestCreateCurrencyExchangeRequest(t *testing.T) {
 }
 
 func TestPostSubleasingRequest(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
+	token := loginAs(t, s, "12345")
 
 	tests := []struct {
 		description  string
@@ -414,22 +249,21 @@ func TestPostSubleasingRequest(t *testing.T) {
 		reqBody      string
 	}{
 		{
-			description:  "POST status 200",
+			description:  "POST status 201",
 			route:        "/api/subleasing",
-			expectedCode: 200,
-			reqBody:      `{"user_id": "12345", "title": "Room for Rent", "description": "Spacious room in a shared apartment", "location": {"city": "Gainesville", "state": "FL", "country": "USA"}, "pictures": ["img1.jpg"], "rent": 500, "period": {"start_date": "2025-04-01", "end_date": "2025-08-01"}}`,
+			expectedCode: 201,
+			reqBody:      `{"user_id": "12345", "title": "Room for Rent", "description": "Spacious room in a shared apartment", "location": {"city": "Gainesville", "state": "FL", "country": "USA"}, "pictures": ["img1.jpg"], "rent": 500, "period": {"start_date": "2025-04-01T00:00:00Z", "end_date": "2025-08-01T00:00:00Z"}}`,
+		},
+		{
+			description:  "POST incomplete location",
+			route:        "/api/subleasing",
+			expectedCode: 400,
+			reqBody:      `{"title": "Room for Rent", "description": "Spacious room", "location": {"city": "Gainesville"}, "rent": 500}`,
 		},
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest("POST", test.route, bytes.NewReader([]byte(test.reqBody)))
-		req.Header.Add("Content-Type", "application/json")
-
-		// Setting up the test server
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/subleasing", mockPostSubleasingRequest(testClient)).Methods("POST") // Fixed function reference
-		r.ServeHTTP(rr, req)
+		rr := serve(r, "POST", test.route, token, test.reqBody)
 
 		// Asserting the status code
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
@@ -437,19 +271,11 @@ func TestPostSubleasingRequest(t *testing.T) {
 }
 
 func TestGetCurrencyExchangeRequests(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
 
 	// Insert test data
-	collection := testClient.Database("uni_marketplace").Collection("currency_exchange_requests")
-	collection.InsertMany(context.Background(), []interface{}{
-		bson.M{"user_id": "12345", "amount": 100, "from_currency": "USD", "to_currency": "EUR", "request_date": time.Now()},
-		bson.M{"user_id": "67890", "amount": 200, "from_currency": "GBP", "to_currency": "USD", "request_date": time.Now()},
-	})
+	s.store.Exchanges.Create(context.Background(), &CurrencyExchangeRequest{UserID: "12345", Amount: money(100, "USD"), FromCurrency: "USD", ToCurrency: "EUR", RequestDate: time.Now()})
+	s.store.Exchanges.Create(context.Background(), &CurrencyExchangeRequest{UserID: "67890", Amount: money(200, "GBP"), FromCurrency: "GBP", ToCurrency: "USD", RequestDate: time.Now()})
 
 	tests := []struct {
 		description  string
@@ -458,20 +284,13 @@ func TestGetCurrencyExchangeRequests(t *testing.T) {
 	}{
 		{
 			description:  "GET status 200 with data",
-			route:        "/api/currency/exchange",
+			route:        "/api/currency/exchange/requests",
 			expectedCode: 200,
 		},
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest("GET", test.route, nil)
-		req.Header.Add("Content-Type", "application/json")
-
-		// Setting up the test server
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/currency/exchange", mockGetCurrencyExchangeRequests(testClient)).Methods("GET")
-		r.ServeHTTP(rr, req)
+		rr := serve(r, "GET", test.route, "", "")
 
 		// Asserting the status code
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
@@ -484,251 +303,41 @@ func TestGetCurrencyExchangeRequests(t *testing.T) {
 	}
 }
 
-func mockGetUserActivities(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		userID := r.URL.Query().Get("user_id")
-		if userID == "" {
-			http.Error(w, "user_id is required", http.StatusBadRequest)
-			return
-		}
-
-		ctx := context.Background()
-
-		// Query marketplace_listings
-		marketplaceCollection := testClient.Database("uni_marketplace_test").Collection("marketplace_listings")
-		var marketplaceListings []MarketplaceListing
-		cursor, err := marketplaceCollection.Find(ctx, bson.M{"user_id": userID})
-		if err == nil {
-			cursor.All(ctx, &marketplaceListings)
-		}
-
-		// Query currency_exchange_requests
-		currencyExchangeCollection := testClient.Database("uni_marketplace_test").Collection("currency_exchange_requests")
-		var currencyExchangeRequests []CurrencyExchangeRequest
-		cursor, err = currencyExchangeCollection.Find(ctx, bson.M{"user_id": userID})
-		if err == nil {
-			cursor.All(ctx, &currencyExchangeRequests)
-		}
-
-		// Query subleasing_requests
-		subleasingCollection := testClient.Database("uni_marketplace_test").Collection("subleasing_requests")
-		var subleasingRequests []SubleasingRequest
-		cursor, err = subleasingCollection.Find(ctx, bson.M{"user_id": userID})
-		if err == nil {
-			cursor.All(ctx, &subleasingRequests)
-		}
-
-		// Aggregate results
-		userActivities := UserActivities{
-			MarketplaceListings:      marketplaceListings,
-			CurrencyExchangeRequests: currencyExchangeRequests,
-			SubleasingRequests:       subleasingRequests,
-		}
-
-		json.NewEncoder(w).Encode(userActivities)
-	}
-}
-
 func TestGetUserActivities(t *testing.T) {
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
 
 	userID := "12345"
-	collection := testClient.Database("uni_marketplace_test").Collection("marketplace_listings")
-	collection.InsertOne(context.Background(), MarketplaceListing{
-		UserID:      userID,
-		Title:       "Bike for Sale",
-		Description: "Good condition",
-		Category:    "Vehicles",
-		Price:       150.00,
-		Condition:   "Used",
-		DatePosted:  time.Now(),
-	})
-
-	req := httptest.NewRequest("GET", "/api/user/activities?user_id="+userID, nil)
-	rr := httptest.NewRecorder()
-	r := mux.NewRouter()
-	r.HandleFunc("/api/user/activities", mockGetUserActivities(testClient)).Methods("GET")
-	r.ServeHTTP(rr, req)
+	listing := testListing(userID)
+	s.store.Listings.Create(context.Background(), &listing)
+	other := testListing("67890")
+	s.store.Listings.Create(context.Background(), &other)
 
+	rr := serve(r, "GET", "/api/user/activities?user_id="+userID, "", "")
 	assert.Equal(t, http.StatusOK, rr.Code)
-}
-func mockUpdateUserProfile(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		vars := mux.Vars(r)
-		userIDHex := vars["id"]
-
-		objectID, err := primitive.ObjectIDFromHex(userIDHex)
-		if err != nil {
-			http.Error(w, "Invalid user ID format", http.StatusBadRequest)
-			return
-		}
-
-		var user User
-		err = json.NewDecoder(r.Body).Decode(&user)
-		if err != nil {
-			http.Error(w, "Invalid request payload", http.StatusBadRequest)
-			return
-		}
 
-		collection := testClient.Database("uni_marketplace_test").Collection("users")
-		filter := bson.M{"_id": objectID}
-		update := bson.M{
-			"$set": bson.M{
-				"name":            user.Name,
-				"preferred_email": user.PreferredEmail,
-				"preferences":     user.Preferences,
-				"location":        user.Location,
-			},
-		}
+	var activities UserActivities
+	json.Unmarshal(rr.Body.Bytes(), &activities)
+	assert.Len(t, activities.MarketplaceListings, 1)
 
-		result, err := collection.UpdateOne(context.Background(), filter, update)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update profile"})
-			return
-		}
-
-		if result.MatchedCount == 0 {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
-			return
-		}
-
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"message": "Profile updated successfully",
-			"userID":  userIDHex,
-		})
-	}
-}
-
-func mockGetUserProfile(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		vars := mux.Vars(r)
-		userIDHex := vars["id"]
-
-		objectID, err := primitive.ObjectIDFromHex(userIDHex)
-		if err != nil {
-			http.Error(w, "Invalid user ID format", http.StatusBadRequest)
-			return
-		}
-
-		collection := testClient.Database("uni_marketplace_test").Collection("users")
-		var user User
-		err = collection.FindOne(context.Background(), bson.M{"_id": objectID}).Decode(&user)
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
-			return
-		}
-
-		profile := map[string]string{
-			"name":            user.Name,
-			"email":           user.Email,
-			"preferred_email": user.PreferredEmail,
-			"preferences":     user.Preferences,
-			"location":        user.Location,
-		}
-
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"profile": profile,
-		})
-	}
-}
-
-func mockGetCurrencyExchangeListings(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-
-		collection := testClient.Database("uni_marketplace_test").Collection("currency_exchange_requests")
-		cursor, err := collection.Find(context.Background(), bson.M{})
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve listings"})
-			return
-		}
-		defer cursor.Close(context.Background())
-
-		var listings []CurrencyExchangeRequest
-		for cursor.Next(context.Background()) {
-			var listing CurrencyExchangeRequest
-			if err := cursor.Decode(&listing); err != nil {
-				continue
-			}
-			listings = append(listings, listing)
-		}
-
-		response := map[string]interface{}{
-			"listing_count": len(listings),
-			"listings":      listings,
-		}
-		json.NewEncoder(w).Encode(response)
-	}
-}
-
-func mockDeleteListing(testClient *mongo.Client) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		vars := mux.Vars(r)
-		id := vars["id"]
-
-		objID, err := primitive.ObjectIDFromHex(id)
-		if err != nil {
-			http.Error(w, "Invalid ID format", http.StatusBadRequest)
-			return
-		}
-
-		collections := []string{"marketplace_listings", "currency_exchange_requests", "subleasing_requests"}
-		deleted := false
-
-		for _, coll := range collections {
-			collection := testClient.Database("uni_marketplace_test").Collection(coll)
-			result, err := collection.DeleteOne(context.Background(), bson.M{"_id": objID})
-			if err == nil && result.DeletedCount > 0 {
-				json.NewEncoder(w).Encode(map[string]string{"message": "Listing deleted successfully", "collection": coll})
-				deleted = true
-				break
-			}
-		}
-
-		if !deleted {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
-		}
-	}
+	rr = serve(r, "GET", "/api/user/activities", "", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
 }
 
 func TestUpdateUserProfile(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
 
 	// Insert a test user
-	collection := testClient.Database("uni_marketplace_test").Collection("users")
-	userID := primitive.NewObjectID()
-	_, err = collection.InsertOne(context.Background(), bson.M{
-		"_id":   userID,
-		"email": "test@example.com",
-		"name":  "Original Name",
-	})
-	if err != nil {
-		t.Fatalf("Failed to insert test user: %v", err)
-	}
+	user, _ := s.store.Users.UpsertLogin(context.Background(), "test@example.com", time.Now())
+	userID := user.ID
+	token := loginAs(t, s, userID.Hex())
+	admin, _ := s.sessions.Create(context.Background(), "admin", "admin@ufl.edu", roleAdmin)
 
 	tests := []struct {
 		description  string
 		route        string
 		method       string
 		userID       string
+		token        string
 		reqBody      string
 		expectedCode int
 	}{
@@ -737,6 +346,7 @@ func TestUpdateUserProfile(t *testing.T) {
 			route:        "/api/updateUserProfile/",
 			method:       "POST",
 			userID:       userID.Hex(),
+			token:        token,
 			reqBody:      `{"name": "Updated Name", "preferred_email": "updated@example.com", "preferences": "Book exchanges", "location": "New York"}`,
 			expectedCode: http.StatusOK,
 		},
@@ -745,6 +355,7 @@ func TestUpdateUserProfile(t *testing.T) {
 			route:        "/api/updateUserProfile/",
 			method:       "POST",
 			userID:       primitive.NewObjectID().Hex(),
+			token:        admin.AccessToken,
 			reqBody:      `{"name": "Updated Name"}`,
 			expectedCode: http.StatusNotFound,
 		},
@@ -753,46 +364,42 @@ func TestUpdateUserProfile(t *testing.T) {
 			route:        "/api/updateUserProfile/",
 			method:       "POST",
 			userID:       "invalid-id",
+			token:        token,
 			reqBody:      `{"name": "Updated Name"}`,
 			expectedCode: http.StatusBadRequest,
 		},
+		{
+			description:  "Update profile - another user's profile",
+			route:        "/api/updateUserProfile/",
+			method:       "POST",
+			userID:       primitive.NewObjectID().Hex(),
+			token:        token,
+			reqBody:      `{"name": "Updated Name"}`,
+			expectedCode: http.StatusForbidden,
+		},
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest(test.method, test.route+test.userID, bytes.NewReader([]byte(test.reqBody)))
-		req.Header.Add("Content-Type", "application/json")
-
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/updateUserProfile/{id}", mockUpdateUserProfile(testClient)).Methods(test.method)
-		r.ServeHTTP(rr, req)
+		rr := serve(r, test.method, test.route+test.userID, test.token, test.reqBody)
 
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
 	}
+
+	updated, _ := s.store.Users.Get(context.Background(), userID)
+	assert.Equal(t, "Updated Name", updated.Name)
 }
 
 func TestGetUserProfile(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
 
 	// Insert a test user
-	collection := testClient.Database("uni_marketplace_test").Collection("users")
-	userID := primitive.NewObjectID()
-	_, err = collection.InsertOne(context.Background(), bson.M{
-		"_id":             userID,
-		"email":           "test@example.com",
-		"name":            "Test User",
-		"preferred_email": "preferred@example.com",
-		"preferences":     "Science fiction books",
-		"location":        "Miami",
+	user, _ := s.store.Users.UpsertLogin(context.Background(), "test@example.com", time.Now())
+	userID := user.ID
+	s.store.Users.UpdateProfile(context.Background(), userID, User{
+		Name:           "Test User",
+		PreferredEmail: "preferred@example.com",
+		Location:       "Miami",
 	})
-	if err != nil {
-		t.Fatalf("Failed to insert test user: %v", err)
-	}
 
 	tests := []struct {
 		description  string
@@ -825,11 +432,7 @@ func TestGetUserProfile(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest(test.method, test.route+test.userID, nil)
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/getUserProfile/{id}", mockGetUserProfile(testClient)).Methods(test.method)
-		r.ServeHTTP(rr, req)
+		rr := serve(r, test.method, test.route+test.userID, "", "")
 
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
 
@@ -845,45 +448,18 @@ func TestGetUserProfile(t *testing.T) {
 }
 
 func TestGetCurrencyExchangeListings(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
 
 	// Insert test data
-	collection := testClient.Database("uni_marketplace_test").Collection("currency_exchange_requests")
-	_, err = collection.InsertMany(context.Background(), []interface{}{
-		bson.M{
-			"user_id":       "123",
-			"amount":        100.0,
-			"from_currency": "USD",
-			"to_currency":   "EUR",
-			"request_date":  time.Now(),
-		},
-		bson.M{
-			"user_id":       "456",
-			"amount":        200.0,
-			"from_currency": "GBP",
-			"to_currency":   "USD",
-			"request_date":  time.Now(),
-		},
-	})
-	if err != nil {
-		t.Fatalf("Failed to insert test exchange requests: %v", err)
-	}
+	s.store.Exchanges.Create(context.Background(), &CurrencyExchangeRequest{UserID: "123", Amount: money(100, "USD"), FromCurrency: "USD", ToCurrency: "EUR", RequestDate: time.Now()})
+	s.store.Exchanges.Create(context.Background(), &CurrencyExchangeRequest{UserID: "456", Amount: money(200, "GBP"), FromCurrency: "GBP", ToCurrency: "USD", RequestDate: time.Now()})
 
-	req := httptest.NewRequest("GET", "/api/getCurrencyExchangeListings", nil)
-	rr := httptest.NewRecorder()
-	r := mux.NewRouter()
-	r.HandleFunc("/api/getCurrencyExchangeListings", mockGetCurrencyExchangeListings(testClient)).Methods("GET")
-	r.ServeHTTP(rr, req)
+	rr := serve(r, "GET", "/api/getCurrencyExchangeListings", "", "")
 
 	assert.Equal(t, http.StatusOK, rr.Code, "Should return status OK")
 
 	var response map[string]interface{}
-	err = json.Unmarshal(rr.Body.Bytes(), &response)
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
 	assert.Nil(t, err, "Failed to parse response")
 
 	listingCount, ok := response["listing_count"].(float64)
@@ -891,40 +467,79 @@ func TestGetCurrencyExchangeListings(t *testing.T) {
 	assert.GreaterOrEqual(t, int(listingCount), 2, "Should have at least 2 listings")
 }
 
+func TestGetSubleasingRequests(t *testing.T) {
+	s, r := newTestServer()
+
+	s.store.Subleases.Create(context.Background(), &SubleasingRequest{UserID: "123", Title: "Room", Rent: money(500, "USD"), Currency: "USD"})
+
+	rr := serve(r, "GET", "/api/getSubleasingRequests", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &response)
+	assert.Equal(t, float64(1), response["request_count"])
+}
+
 func TestDeleteListing(t *testing.T) {
-	// Set up a test MongoDB client
-	testClient, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		t.Fatalf("Failed to connect to test MongoDB: %v", err)
-	}
-	defer testClient.Disconnect(context.Background())
+	s, r := newTestServer()
+	owner := loginAs(t, s, "test_user")
+	intruder := loginAs(t, s, "someone_else")
+	admin, _ := s.sessions.Create(context.Background(), "admin", "admin@ufl.edu", roleAdmin)
 
 	// Insert test data
-	collection := testClient.Database("uni_marketplace_test").Collection("marketplace_listings")
-	objID := primitive.NewObjectID()
-	_, err = collection.InsertOne(context.Background(), bson.M{
-		"_id":         objID,
-		"user_id":     "test_user",
-		"title":       "Test Listing",
-		"description": "Test Description",
-		"date_posted": time.Now(),
-	})
-	if err != nil {
-		t.Fatalf("Failed to insert test listing: %v", err)
-	}
+	listing := testListing("test_user")
+	s.store.Listings.Create(context.Background(), &listing)
+	exchange := CurrencyExchangeRequest{UserID: "test_user", Amount: money(50, "USD"), FromCurrency: "USD", ToCurrency: "INR"}
+	s.store.Exchanges.Create(context.Background(), &exchange)
+	sublease := SubleasingRequest{UserID: "test_user", Title: "Room", Rent: money(500, "USD"), Currency: "USD"}
+	s.store.Subleases.Create(context.Background(), &sublease)
 
 	tests := []struct {
 		description  string
 		route        string
 		method       string
 		id           string
+		token        string
 		expectedCode int
 	}{
+		{
+			description:  "Delete listing - another user's listing",
+			route:        "/api/deleteListing/",
+			method:       "DELETE",
+			id:           listing.ID.Hex(),
+			token:        intruder,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			description:  "Delete exchange request - another user's request",
+			route:        "/api/deleteListing/",
+			method:       "DELETE",
+			id:           exchange.ID.Hex(),
+			token:        intruder,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			description:  "Delete sublease - another user's sublease",
+			route:        "/api/deleteListing/",
+			method:       "DELETE",
+			id:           sublease.ID.Hex(),
+			token:        intruder,
+			expectedCode: http.StatusForbidden,
+		},
 		{
 			description:  "Delete listing - success",
 			route:        "/api/deleteListing/",
 			method:       "DELETE",
-			id:           objID.Hex(),
+			id:           listing.ID.Hex(),
+			token:        owner,
+			expectedCode: http.StatusOK,
+		},
+		{
+			description:  "Delete sublease - admin",
+			route:        "/api/deleteListing/",
+			method:       "DELETE",
+			id:           sublease.ID.Hex(),
+			token:        admin.AccessToken,
 			expectedCode: http.StatusOK,
 		},
 		{
@@ -932,6 +547,7 @@ func TestDeleteListing(t *testing.T) {
 			route:        "/api/deleteListing/",
 			method:       "DELETE",
 			id:           primitive.NewObjectID().Hex(),
+			token:        owner,
 			expectedCode: http.StatusNotFound,
 		},
 		{
@@ -939,16 +555,13 @@ func TestDeleteListing(t *testing.T) {
 			route:        "/api/deleteListing/",
 			method:       "DELETE",
 			id:           "invalid-id",
+			token:        owner,
 			expectedCode: http.StatusBadRequest,
 		},
 	}
 
 	for _, test := range tests {
-		req := httptest.NewRequest(test.method, test.route+test.id, nil)
-		rr := httptest.NewRecorder()
-		r := mux.NewRouter()
-		r.HandleFunc("/api/deleteListing/{id}", mockDeleteListing(testClient)).Methods(test.method)
-		r.ServeHTTP(rr, req)
+		rr := serve(r, test.method, test.route+test.id, test.token, "")
 
 		assert.Equal(t, test.expectedCode, rr.Code, test.description)
 
@@ -959,8 +572,7 @@ func TestDeleteListing(t *testing.T) {
 			assert.Equal(t, "Listing deleted successfully", response["message"], "Should return success message")
 		}
 	}
-}
 
-// Note: The getSubleasingRequests mock function already exists,
-// but we need to make sure we're testing the updated version, not the old one.
-// Let's add a specific test for the updated version:
+	_, err := s.store.Exchanges.Get(context.Background(), exchange.ID)
+	assert.NoError(t, err, "exchange request must survive the cross-user delete")
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Match statuses. A proposed match becomes accepted once both sides accept
+// it; either side may decline it, and it is cancelled if a side can no
+// longer cover its amount when the second acceptance arrives. Accepted
+// matches are trades; see trades.go for how they are carried out.
+const (
+	matchProposed         = "proposed"
+	matchAccepted         = "accepted"
+	matchDeclined         = "declined"
+	matchCancelled        = "cancelled"
+	matchMeetingScheduled = "meeting_scheduled"
+	matchCompleted        = "completed"
+	matchDisputed         = "disputed"
+)
+
+var (
+	errNotMatchParty    = errors.New("you are not a party to this match")
+	errMatchClosed      = errors.New("match is no longer open")
+	errMatchUnavailable = errors.New("a request in this match can no longer cover its amount")
+	errCannotFill       = errors.New("the request cannot take this fill")
+)
+
+// MatchSide is one request's part in a match: what its owner hands over.
+type MatchSide struct {
+	RequestID primitive.ObjectID `json:"request_id" bson:"request_id"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	Currency  string             `json:"currency" bson:"currency"`
+	Amount    Money              `json:"amount" bson:"amount"`
+	Accepted  bool               `json:"accepted" bson:"accepted"`
+	// Confirmed is set once this side reports the trade took place.
+	Confirmed bool `json:"confirmed" bson:"confirmed"`
+}
+
+// ExchangeMatch pairs two complementary exchange requests for part or all of
+// their amounts. Rate is units of Sides[1].Currency per Sides[0].Currency.
+type ExchangeMatch struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Sides      [2]MatchSide       `json:"sides" bson:"sides"`
+	Rate       float64            `json:"rate" bson:"rate"`
+	Status     string             `json:"status" bson:"status"`
+	DeclinedBy string             `json:"declined_by,omitempty" bson:"declined_by,omitempty"`
+	Meeting    *ExchangeMeeting   `json:"meeting,omitempty" bson:"meeting,omitempty"`
+	DisputedBy string             `json:"disputed_by,omitempty" bson:"disputed_by,omitempty"`
+	Dispute    string             `json:"dispute,omitempty" bson:"dispute,omitempty"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time          `json:"updated_at" bson:"updated_at"`
+	Version    int64              `json:"version" bson:"version"`
+}
+
+// side returns the index of requestID's side, or -1.
+func (m *ExchangeMatch) side(requestID primitive.ObjectID) int {
+	for i := range m.Sides {
+		if m.Sides[i].RequestID == requestID {
+			return i
+		}
+	}
+	return -1
+}
+
+// exchangeStatus treats requests stored before statuses existed as open,
+// and ones stored as filled before trades had a lifecycle as matched.
+func (c *CurrencyExchangeRequest) exchangeStatus() string {
+	switch c.Status {
+	case "":
+		return exchangeOpen
+	case exchangeLegacyFilled:
+		return exchangeMatched
+	}
+	return c.Status
+}
+
+// remaining is the part of Amount, in minor units, that no accepted match
+// covers yet.
+func (c *CurrencyExchangeRequest) remaining() int64 {
+	return c.Amount.Minor - c.Filled.Minor
+}
+
+// ExchangeMatcher pairs requests that want opposite currency directions.
+// Proposals reserve their amounts until they are accepted or declined, so a
+// request can be split across several counterparties without promising more
+// than it has.
+type ExchangeMatcher struct {
+	store *Store
+	// marketRate, if set, prices matches where neither request names a
+	// rate. It returns units of to per unit of from.
+	marketRate func(ctx context.Context, from, to string) (float64, bool)
+	// matchChanged, if set, is told about every match created or updated,
+	// along with the match as it was before, which is nil for new ones.
+	matchChanged func(match, previous *ExchangeMatch)
+	// requestChanged, if set, is told about every request whose status
+	// changes.
+	requestChanged func(ctx context.Context, request *CurrencyExchangeRequest)
+	now            func() time.Time
+}
+
+func newExchangeMatcher(store *Store) *ExchangeMatcher {
+	return &ExchangeMatcher{store: store, now: time.Now}
+}
+
+// available is what a request can still offer in new proposals, in minor
+// units: its remaining amount less what its pending proposals promise.
+func available(request *CurrencyExchangeRequest, matches []ExchangeMatch) int64 {
+	free := request.remaining()
+	for _, match := range matches {
+		if i := match.side(request.ID); i >= 0 && match.Status == matchProposed {
+			free -= match.Sides[i].Amount.Minor
+		}
+	}
+	return free
+}
+
+// matchRate is the rate, in units of request.ToCurrency per unit of
+// request.FromCurrency, at which the two requests can trade. When both name
+// a rate the older request's wins, as in an order book.
+func (m *ExchangeMatcher) matchRate(ctx context.Context, request, other *CurrencyExchangeRequest) (float64, bool) {
+	switch {
+	case request.Rate > 0 && other.Rate > 0:
+		// other.Rate is in request.FromCurrency per request.ToCurrency
+		if request.Rate*other.Rate > 1+1e-9 {
+			return 0, false
+		}
+		if other.RequestDate.Before(request.RequestDate) {
+			return 1 / other.Rate, true
+		}
+		return request.Rate, true
+	case request.Rate > 0:
+		return request.Rate, true
+	case other.Rate > 0:
+		return 1 / other.Rate, true
+	case m.marketRate != nil:
+		return m.marketRate(ctx, request.FromCurrency, request.ToCurrency)
+	}
+	return 0, false
+}
+
+// propose creates proposals for request against the oldest compatible
+// counterparties until its available amount is spoken for. Counterparties
+// it already has an open or declined match with are skipped.
+func (m *ExchangeMatcher) propose(ctx context.Context, request *CurrencyExchangeRequest) error {
+	if request.exchangeStatus() != exchangeOpen {
+		return nil
+	}
+	matches, err := m.store.Matches.ListByRequest(ctx, request.ID)
+	if err != nil {
+		return err
+	}
+	free := available(request, matches)
+	skip := map[primitive.ObjectID]bool{}
+	for _, match := range matches {
+		if match.Status == matchProposed || match.Status == matchDeclined {
+			skip[match.Sides[1-match.side(request.ID)].RequestID] = true
+		}
+	}
+
+	q := listQuery{sort: "request_date", filters: []fieldFilter{
+		{field: "from_currency", op: "$eq", value: request.ToCurrency},
+		{field: "to_currency", op: "$eq", value: request.FromCurrency},
+		{field: "status", op: "$in", value: bson.A{exchangeOpen, nil}},
+	}}
+	return forEachPage(ctx, m.store.Exchanges.Find, q, func(other *CurrencyExchangeRequest) error {
+		if free <= 0 || free < request.MinAmount.Minor || other.UserID == request.UserID || skip[other.ID] {
+			return nil
+		}
+		rate, ok := m.matchRate(ctx, request, other)
+		if !ok || rate <= 0 {
+			return nil
+		}
+		otherMatches, err := m.store.Matches.ListByRequest(ctx, other.ID)
+		if err != nil {
+			return err
+		}
+
+		amount := min(free, convertMinor(available(other, otherMatches), 1/rate, other.FromCurrency, request.FromCurrency))
+		counter := convertMinor(amount, rate, request.FromCurrency, other.FromCurrency)
+		if amount <= 0 || counter <= 0 || amount < request.MinAmount.Minor || counter < other.MinAmount.Minor {
+			return nil
+		}
+
+		now := m.now()
+		match := ExchangeMatch{
+			Sides: [2]MatchSide{
+				{RequestID: request.ID, UserID: request.UserID, Currency: request.FromCurrency, Amount: Money{Minor: amount, Currency: request.FromCurrency}},
+				{RequestID: other.ID, UserID: other.UserID, Currency: other.FromCurrency, Amount: Money{Minor: counter, Currency: other.FromCurrency}},
+			},
+			Rate:      rate,
+			Status:    matchProposed,
+			CreatedAt: now,
+			UpdatedAt: now,
+			Version:   1,
+		}
+		if err := m.store.Matches.Create(ctx, &match); err != nil {
+			return err
+		}
+		m.changed(&match, nil)
+		free -= amount
+		return nil
+	})
+}
+
+// updateMatch applies change to the stored match on behalf of the party
+// owning requestID, retrying when a concurrent write bumps the version.
+// change gets the index of that party's side and may veto the update.
+func (m *ExchangeMatcher) updateMatch(ctx context.Context, matchID, requestID primitive.ObjectID, allowed func(owner string) bool, change func(match *ExchangeMatch, i int) error) (*ExchangeMatch, error) {
+	for attempt := 0; ; attempt++ {
+		match, err := m.store.Matches.Get(ctx, matchID)
+		if err != nil {
+			return nil, err
+		}
+		i := match.side(requestID)
+		if i < 0 {
+			return nil, errNotFound
+		}
+		if !allowed(match.Sides[i].UserID) {
+			return nil, errNotMatchParty
+		}
+
+		version, previous := match.Version, *match
+		if err := change(match, i); err != nil {
+			return nil, err
+		}
+		match.UpdatedAt = m.now()
+		err = m.store.Matches.Replace(ctx, match, version)
+		if errors.Is(err, errVersionConflict) && attempt < 2 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.changed(match, &previous)
+		return match, nil
+	}
+}
+
+func (m *ExchangeMatcher) changed(match, previous *ExchangeMatch) {
+	if m.matchChanged != nil {
+		m.matchChanged(match, previous)
+	}
+}
+
+// respond records an answer to a match on behalf of requestID. The second
+// acceptance settles it.
+func (m *ExchangeMatcher) respond(ctx context.Context, matchID, requestID primitive.ObjectID, allowed func(owner string) bool, accept bool) (*ExchangeMatch, error) {
+	var by string
+	var complete bool
+	match, err := m.updateMatch(ctx, matchID, requestID, allowed, func(match *ExchangeMatch, i int) error {
+		// Both sides having accepted means the match is being settled
+		if match.Status != matchProposed || (match.Sides[0].Accepted && match.Sides[1].Accepted) {
+			return errMatchClosed
+		}
+		by = match.Sides[i].UserID
+		if !accept {
+			match.Status = matchDeclined
+			match.DeclinedBy = by
+			return nil
+		}
+		match.Sides[i].Accepted = true
+		complete = match.Sides[1-i].Accepted
+		return nil
+	})
+	if err != nil || !complete {
+		return match, err
+	}
+	return m.settle(ctx, match, by)
+}
+
+// settle fills both requests of a match both parties accepted and only then
+// marks it accepted. Each fill is a conditional update, so matches accepted
+// at the same time cannot overfill a request; if either request can no
+// longer cover its side the match is cancelled and the other fill undone.
+func (m *ExchangeMatcher) settle(ctx context.Context, match *ExchangeMatch, by string) (*ExchangeMatch, error) {
+	filled := 0
+	var fillErr error
+	for ; filled < len(match.Sides); filled++ {
+		side := match.Sides[filled]
+		if fillErr = m.store.Exchanges.AddFilled(ctx, side.RequestID, side.Currency, side.Amount.Minor); fillErr != nil {
+			break
+		}
+	}
+	status := matchAccepted
+	if fillErr != nil {
+		status = matchCancelled
+	}
+	settled, err := m.updateMatch(ctx, match.ID, match.Sides[0].RequestID, func(string) bool { return true }, func(match *ExchangeMatch, i int) error {
+		if match.Status != matchProposed {
+			return errMatchClosed
+		}
+		match.Status = status
+		return nil
+	})
+	if err != nil || status == matchCancelled {
+		for _, side := range match.Sides[:filled] {
+			if err := m.store.Exchanges.AddFilled(ctx, side.RequestID, side.Currency, -side.Amount.Minor); err != nil {
+				log.Printf("Failed to release exchange request %s: %v\n", side.RequestID.Hex(), err)
+			}
+		}
+	}
+	switch {
+	case err != nil:
+		return nil, err
+	case errors.Is(fillErr, errCannotFill), errors.Is(fillErr, errNotFound):
+		return settled, errMatchUnavailable
+	case fillErr != nil:
+		return nil, fillErr
+	}
+
+	// The fills are in; this settles each request's status and records the
+	// match on its timeline
+	for i, side := range settled.Sides {
+		if err := m.updateRequest(ctx, side.RequestID, m.event(eventMatched, by, settled, i), nil); err != nil {
+			log.Printf("Failed to update exchange request %s: %v\n", side.RequestID.Hex(), err)
+		}
+	}
+	return settled, nil
+}
+
+// updateRequest applies change to a stored request, settles its status
+// against its matches and appends event to its timeline, retrying when a
+// concurrent write bumps the version.
+func (m *ExchangeMatcher) updateRequest(ctx context.Context, id primitive.ObjectID, event ExchangeEvent, change func(*CurrencyExchangeRequest) error) error {
+	for attempt := 0; ; attempt++ {
+		request, err := m.store.Exchanges.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		matches, err := m.store.Matches.ListByRequest(ctx, id)
+		if err != nil {
+			return err
+		}
+		version, previousStatus := request.Version, request.exchangeStatus()
+		if change != nil {
+			if err := change(request); err != nil {
+				return err
+			}
+		}
+		request.Status = settledStatus(request, matches)
+		event.Status = request.Status
+		request.Timeline = append(request.Timeline, event)
+		request.UpdatedAt = event.At
+		err = m.store.Exchanges.Replace(ctx, request, version)
+		if errors.Is(err, errVersionConflict) && attempt < 2 {
+			continue
+		}
+		if err == nil && request.exchangeStatus() != previousStatus && m.requestChanged != nil {
+			m.requestChanged(ctx, request)
+		}
+		return err
+	}
+}
+
+// getExchangeMatches refreshes the proposals for one of the caller's
+// requests and returns every match it is part of, newest first.
+func (s *Server) getExchangeMatches(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+
+	request, err := s.store.Exchanges.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Exchange request not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load exchange request"})
+		return
+	}
+	if !canModify(r, request.UserID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You can only view matches for your own requests"})
+		return
+	}
+
+	if err := s.matcher.propose(r.Context(), request); err != nil {
+		log.Printf("Database error: %v\n", err)
+	}
+	matches, err := s.store.Matches.ListByRequest(r.Context(), id)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve matches"})
+		return
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].CreatedAt.After(matches[j].CreatedAt) })
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_id":  request.ID,
+		"status":      request.exchangeStatus(),
+		"remaining":   Money{Minor: request.remaining(), Currency: request.FromCurrency},
+		"available":   Money{Minor: available(request, matches), Currency: request.FromCurrency},
+		"match_count": len(matches),
+		"matches":     matches,
+	})
+}
+
+// matchResponseHandler returns the accept or decline handler for a match on
+// one of the caller's requests.
+func (s *Server) matchResponseHandler(accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		requestID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+		matchID, err := primitive.ObjectIDFromHex(mux.Vars(r)["matchId"])
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+
+		allowed := func(owner string) bool { return canModify(r, owner) }
+		match, err := s.matcher.respond(r.Context(), matchID, requestID, allowed, accept)
+		switch {
+		case errors.Is(err, errNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Match not found"})
+			return
+		case errors.Is(err, errNotMatchParty):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, errMatchClosed), errors.Is(err, errMatchUnavailable), errors.Is(err, errVersionConflict):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case err != nil:
+			log.Printf("Database error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update match"})
+			return
+		}
+
+		if !accept {
+			// The declined amounts are free again; offer them elsewhere
+			for _, side := range match.Sides {
+				if request, err := s.store.Exchanges.Get(r.Context(), side.RequestID); err == nil {
+					if err := s.matcher.propose(r.Context(), request); err != nil {
+						log.Printf("Database error: %v\n", err)
+					}
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(match)
+	}
+}
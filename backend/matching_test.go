@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type matchesResponse struct {
+	Available Money           `json:"available"`
+	Matches   []ExchangeMatch `json:"matches"`
+}
+
+func TestExchangeMatching(t *testing.T) {
+	s, r := newTestServer()
+	tokens := map[string]string{}
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		tokens[user] = loginAs(t, s, user)
+	}
+	create := func(user, body string) CurrencyExchangeRequest {
+		rr := serve(r, "POST", "/api/currency/exchange", tokens[user], body)
+		assert.Equal(t, http.StatusCreated, rr.Code, rr.Body.String())
+		var request CurrencyExchangeRequest
+		json.Unmarshal(rr.Body.Bytes(), &request)
+		return request
+	}
+	matchesOf := func(user string, request CurrencyExchangeRequest) matchesResponse {
+		rr := serve(r, "GET", "/api/currency/exchange/"+request.ID.Hex()+"/matches", tokens[user], "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var body matchesResponse
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		return body
+	}
+	respond := func(user string, request CurrencyExchangeRequest, match ExchangeMatch, action string) int {
+		route := "/api/currency/exchange/" + request.ID.Hex() + "/matches/" + match.ID.Hex() + "/" + action
+		return serve(r, "POST", route, tokens[user], "").Code
+	}
+
+	bob := create("bob", `{"amount": 5000, "from_currency": "inr", "to_currency": "usd"}`)
+	carol := create("carol", `{"amount": 8300, "from_currency": "INR", "to_currency": "USD", "rate": 0.0125}`)
+	dave := create("dave", `{"amount": 4150, "from_currency": "INR", "to_currency": "USD"}`)
+	alice := create("alice", `{"amount": 100, "from_currency": "USD", "to_currency": "INR", "rate": 83}`)
+
+	// Carol wants at least 0.0125 USD per INR, i.e. at most 80 INR per USD,
+	// which is below Alice's 83; Bob and Dave split Alice's 100 USD
+	found := matchesOf("alice", alice)
+	assert.Equal(t, "0.00", found.Available.String())
+	if !assert.Len(t, found.Matches, 2) {
+		return
+	}
+	withBob, withDave := found.Matches[1], found.Matches[0]
+	assert.Equal(t, alice.ID, withBob.Sides[0].RequestID)
+	assert.Equal(t, "USD", withBob.Sides[0].Currency)
+	assert.Equal(t, "60.24", withBob.Sides[0].Amount.String())
+	assert.Equal(t, bob.ID, withBob.Sides[1].RequestID)
+	assert.Equal(t, "INR", withBob.Sides[1].Currency)
+	assert.Equal(t, "4999.92", withBob.Sides[1].Amount.String())
+	assert.Equal(t, "39.76", withDave.Sides[0].Amount.String())
+	assert.Equal(t, "3300.08", withDave.Sides[1].Amount.String())
+	assert.Empty(t, matchesOf("carol", carol).Matches)
+
+	rr := serve(r, "GET", "/api/currency/exchange/"+alice.ID.Hex()+"/matches", tokens["bob"], "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, http.StatusForbidden, respond("carol", alice, withBob, "accept"))
+	assert.Equal(t, http.StatusNotFound, respond("carol", carol, withBob, "accept"))
+
+	assert.Equal(t, http.StatusOK, respond("alice", alice, withBob, "accept"))
+	stored, _ := s.store.Exchanges.Get(context.Background(), alice.ID)
+	assert.Equal(t, int64(0), stored.Filled.Minor, "nothing is exchanged until both accept")
+
+	assert.Equal(t, http.StatusOK, respond("bob", bob, withBob, "accept"))
+	stored, _ = s.store.Exchanges.Get(context.Background(), alice.ID)
+	assert.Equal(t, int64(6024), stored.Filled.Minor)
+	assert.Equal(t, exchangeOpen, stored.Status)
+	stored, _ = s.store.Exchanges.Get(context.Background(), bob.ID)
+	assert.Equal(t, int64(499992), stored.Filled.Minor)
+	assert.Equal(t, http.StatusConflict, respond("bob", bob, withBob, "decline"))
+
+	// Dave declines; the freed 39.76 USD finds no other counterparty
+	assert.Equal(t, http.StatusOK, respond("dave", dave, withDave, "decline"))
+	found = matchesOf("alice", alice)
+	assert.Equal(t, "39.76", found.Available.String())
+	assert.Len(t, found.Matches, 2, "a declined pair is not proposed again")
+
+	// A newcomer can take the rest, filling Alice's request
+	erin := create("erin", `{"amount": 3300.08, "from_currency": "INR", "to_currency": "USD"}`)
+	found = matchesOf("alice", alice)
+	last := found.Matches[0]
+	assert.Equal(t, erin.ID, last.Sides[0].RequestID, "the newcomer's request proposed the match")
+	assert.Equal(t, http.StatusOK, respond("erin", erin, last, "accept"))
+	assert.Equal(t, http.StatusOK, respond("alice", alice, last, "accept"))
+	stored, _ = s.store.Exchanges.Get(context.Background(), alice.ID)
+	assert.Equal(t, exchangeMatched, stored.Status)
+
+	rr = serve(r, "GET", "/api/currency/exchange/requests?from_currency=USD", "", "")
+	assert.NotContains(t, rr.Body.String(), alice.ID.Hex(), "matched requests leave the default list")
+	rr = serve(r, "GET", "/api/currency/exchange/requests?from_currency=USD&status=matched", "", "")
+	assert.Contains(t, rr.Body.String(), alice.ID.Hex())
+}
+
+func TestMatchCancelledWhenRequestShrinks(t *testing.T) {
+	s, r := newTestServer()
+	alice, bob := loginAs(t, s, "alice"), loginAs(t, s, "bob")
+	serve(r, "POST", "/api/currency/exchange", bob, `{"amount": 90, "from_currency": "EUR", "to_currency": "USD", "rate": 1.1}`)
+	rr := serve(r, "POST", "/api/currency/exchange", alice, `{"amount": 100, "from_currency": "USD", "to_currency": "EUR"}`)
+	var request CurrencyExchangeRequest
+	json.Unmarshal(rr.Body.Bytes(), &request)
+
+	matches, _ := s.store.Matches.ListByRequest(context.Background(), request.ID)
+	if !assert.Len(t, matches, 1) {
+		return
+	}
+	match := matches[0]
+	assert.Equal(t, 1/1.1, match.Rate, "Bob's rate, inverted to Alice's direction")
+	assert.Equal(t, money(99, "USD"), match.Sides[0].Amount)
+	assert.Equal(t, money(90, "EUR"), match.Sides[1].Amount)
+
+	rr = serve(r, "PUT", "/api/currency/exchange/"+request.ID.Hex(), alice, `{"version": 1, "amount": 50, "from_currency": "USD", "to_currency": "EUR"}`)
+	assert.Equal(t, http.StatusConflict, rr.Code, "edits cannot shrink below the proposal")
+
+	// The request can still shrink behind the match's back, e.g. through a
+	// concurrent fill, by the time both sides accept
+	stored, _ := s.store.Exchanges.Get(context.Background(), request.ID)
+	stored.Amount = money(50, "USD")
+	assert.NoError(t, s.store.Exchanges.Replace(context.Background(), stored, stored.Version))
+
+	route := "/api/currency/exchange/" + request.ID.Hex() + "/matches/" + match.ID.Hex() + "/accept"
+	assert.Equal(t, http.StatusOK, serve(r, "POST", route, alice, "").Code)
+	bobRoute := "/api/currency/exchange/" + match.Sides[1].RequestID.Hex() + "/matches/" + match.ID.Hex() + "/accept"
+	assert.Equal(t, http.StatusConflict, serve(r, "POST", bobRoute, bob, "").Code)
+
+	settled, _ := s.store.Matches.Get(context.Background(), match.ID)
+	assert.Equal(t, matchCancelled, settled.Status)
+	updated, _ := s.store.Exchanges.Get(context.Background(), request.ID)
+	assert.Equal(t, int64(0), updated.Filled.Minor)
+}
+
+func TestEditPartlyFilledRequest(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+	tokens := map[string]string{}
+	for _, user := range []string{"alice", "bob", "carol", "dave"} {
+		tokens[user] = loginAs(t, s, user)
+	}
+	create := func(user, body string) CurrencyExchangeRequest {
+		var request CurrencyExchangeRequest
+		json.Unmarshal(serve(r, "POST", "/api/currency/exchange", tokens[user], body).Body.Bytes(), &request)
+		return request
+	}
+	bob := create("bob", `{"amount": 4000, "from_currency": "INR", "to_currency": "USD"}`)
+	alice := create("alice", `{"amount": 100, "from_currency": "USD", "to_currency": "INR", "rate": 80}`)
+	matches, _ := s.store.Matches.ListByRequest(ctx, alice.ID)
+	if !assert.Len(t, matches, 1) {
+		return
+	}
+	for user, request := range map[string]CurrencyExchangeRequest{"alice": alice, "bob": bob} {
+		route := "/api/currency/exchange/" + request.ID.Hex() + "/matches/" + matches[0].ID.Hex() + "/accept"
+		assert.Equal(t, http.StatusOK, serve(r, "POST", route, tokens[user], "").Code)
+	}
+	// Carol is proposed the other half; Dave finds nothing left
+	create("carol", `{"amount": 4000, "from_currency": "INR", "to_currency": "USD"}`)
+	dave := create("dave", `{"amount": 4000, "from_currency": "INR", "to_currency": "USD"}`)
+
+	edit := func(body string) int {
+		stored, _ := s.store.Exchanges.Get(ctx, alice.ID)
+		return serve(r, "PATCH", "/api/currency/exchange/"+alice.ID.Hex(), tokens["alice"], fmt.Sprintf(`{"version": %d, %s}`, stored.Version, body)).Code
+	}
+	assert.Equal(t, http.StatusConflict, edit(`"from_currency": "JPY", "to_currency": "EUR"`), "currencies are fixed once filled")
+	assert.Equal(t, http.StatusConflict, edit(`"amount": 80`), "the amount covers the fill and the proposal")
+	assert.Equal(t, http.StatusOK, edit(`"amount": 150`))
+
+	stored, _ := s.store.Exchanges.Get(ctx, alice.ID)
+	assert.Equal(t, money(50, "USD"), stored.Filled)
+	assert.Equal(t, 80.0, stored.Rate)
+	daveMatches, _ := s.store.Matches.ListByRequest(ctx, dave.ID)
+	assert.Len(t, daveMatches, 1, "raising the amount proposes the new room")
+}
+
+func TestMatchRate(t *testing.T) {
+	m := newExchangeMatcher(newMemoryStore())
+	now := time.Now()
+	usd := &CurrencyExchangeRequest{FromCurrency: "USD", ToCurrency: "INR", Rate: 82, RequestDate: now}
+	inr := &CurrencyExchangeRequest{FromCurrency: "INR", ToCurrency: "USD", Rate: 0.012, RequestDate: now.Add(-time.Hour)}
+
+	rate, ok := m.matchRate(context.Background(), usd, inr)
+	assert.True(t, ok)
+	assert.InDelta(t, 83.33, rate, 0.01, "the older request sets the rate")
+
+	inr.RequestDate = now.Add(time.Hour)
+	rate, _ = m.matchRate(context.Background(), usd, inr)
+	assert.Equal(t, 82.0, rate)
+
+	inr.Rate = 0.0125
+	_, ok = m.matchRate(context.Background(), usd, inr)
+	assert.False(t, ok, "82 INR per USD is more than 80 allows")
+
+	_, ok = m.matchRate(context.Background(), &CurrencyExchangeRequest{}, &CurrencyExchangeRequest{})
+	assert.False(t, ok, "without rates or a market rate there is no price")
+	m.marketRate = func(ctx context.Context, from, to string) (float64, bool) { return 83, true }
+	rate, _ = m.matchRate(context.Background(), &CurrencyExchangeRequest{}, &CurrencyExchangeRequest{})
+	assert.Equal(t, 83.0, rate)
+}
+
+func TestConcurrentAcceptsCannotOverfill(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+	tokens := map[string]string{}
+	requests := map[string]CurrencyExchangeRequest{}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		tokens[user] = loginAs(t, s, user)
+	}
+	for _, create := range []struct{ user, body string }{
+		{"alice", `{"amount": 100, "from_currency": "USD", "to_currency": "EUR", "rate": 0.9}`},
+		{"bob", `{"amount": 90, "from_currency": "EUR", "to_currency": "USD", "rate": 1.1}`},
+		{"carol", `{"amount": 90, "from_currency": "EUR", "to_currency": "USD", "rate": 1.1}`},
+	} {
+		var request CurrencyExchangeRequest
+		json.Unmarshal(serve(r, "POST", "/api/currency/exchange", tokens[create.user], create.body).Body.Bytes(), &request)
+		requests[create.user] = request
+	}
+
+	// Bob's match takes all of Alice's request, so a competing one for
+	// Carol is stored directly; Alice has already accepted both
+	matches, _ := s.store.Matches.ListByRequest(ctx, requests["alice"].ID)
+	if !assert.Len(t, matches, 1) {
+		return
+	}
+	first := matches[0]
+	second := first
+	second.ID = primitive.NilObjectID
+	for i := range second.Sides {
+		if second.Sides[i].UserID != "alice" {
+			second.Sides[i].RequestID, second.Sides[i].UserID = requests["carol"].ID, "carol"
+		}
+	}
+	for _, match := range []*ExchangeMatch{&first, &second} {
+		match.Sides[match.side(requests["alice"].ID)].Accepted = true
+	}
+	assert.NoError(t, s.store.Matches.Replace(ctx, &first, first.Version))
+	assert.NoError(t, s.store.Matches.Create(ctx, &second))
+
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i, match := range []ExchangeMatch{first, second} {
+		wg.Add(1)
+		go func(i int, match ExchangeMatch) {
+			defer wg.Done()
+			other := match.Sides[1-match.side(requests["alice"].ID)]
+			route := "/api/currency/exchange/" + other.RequestID.Hex() + "/matches/" + match.ID.Hex() + "/accept"
+			codes[i] = serve(r, "POST", route, tokens[other.UserID], "").Code
+		}(i, match)
+	}
+	wg.Wait()
+	assert.ElementsMatch(t, []int{http.StatusOK, http.StatusConflict}, codes)
+
+	stored, _ := s.store.Exchanges.Get(ctx, requests["alice"].ID)
+	assert.Equal(t, stored.Amount, stored.Filled, "Alice's request is filled exactly once")
+	var statuses []string
+	for _, match := range []ExchangeMatch{first, second} {
+		settled, _ := s.store.Matches.Get(ctx, match.ID)
+		statuses = append(statuses, settled.Status)
+	}
+	assert.ElementsMatch(t, []string{matchAccepted, matchCancelled}, statuses)
+	bob, _ := s.store.Exchanges.Get(ctx, requests["bob"].ID)
+	carol, _ := s.store.Exchanges.Get(ctx, requests["carol"].ID)
+	assert.Equal(t, int64(90_00), bob.Filled.Minor+carol.Filled.Minor, "the cancelled side's fill is released")
+}
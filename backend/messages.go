@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Conversation subjects: what a thread is about.
+const (
+	subjectListing  = "listing"
+	subjectExchange = "exchange"
+	subjectSublease = "sublease"
+)
+
+var errUnknownSubject = fmt.Errorf("subject_type must be %s, %s or %s", subjectListing, subjectExchange, subjectSublease)
+
+// maxMessageLength is the longest message body accepted, in characters.
+const maxMessageLength = 2000
+
+// Conversation is a thread between the owner of a listing, exchange request
+// or sublease and one user who asked about it. Each user has at most one
+// conversation per subject; StartedBy tells them apart.
+type Conversation struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	SubjectType   string             `json:"subject_type" bson:"subject_type"`
+	SubjectID     primitive.ObjectID `json:"subject_id" bson:"subject_id"`
+	Title         string             `json:"title" bson:"title"`
+	StartedBy     string             `json:"started_by" bson:"started_by"`
+	Participants  []Participant      `json:"participants" bson:"participants"`
+	LastMessage   *Message           `json:"last_message,omitempty" bson:"last_message,omitempty"`
+	LastMessageAt time.Time          `json:"last_message_at" bson:"last_message_at"`
+	CreatedAt     time.Time          `json:"created_at" bson:"created_at"`
+	// UnreadCount is filled in for the user the conversation is shown to.
+	UnreadCount int `json:"unread_count" bson:"-"`
+}
+
+// Participant is one user's side of a conversation. Unread counts the
+// messages others sent since the user last read the thread.
+type Participant struct {
+	UserID     string    `json:"user_id" bson:"user_id"`
+	Unread     int       `json:"-" bson:"unread"`
+	LastReadAt time.Time `json:"last_read_at" bson:"last_read_at"`
+}
+
+// Message is one message in a conversation. Deleted messages keep their
+// place in the thread with the body removed.
+type Message struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ConversationID primitive.ObjectID `json:"conversation_id" bson:"conversation_id"`
+	SenderID       string             `json:"sender_id" bson:"sender_id"`
+	Body           string             `json:"body" bson:"body"`
+	SentAt         time.Time          `json:"sent_at" bson:"sent_at"`
+	DeletedAt      *time.Time         `json:"deleted_at,omitempty" bson:"deleted_at,omitempty"`
+}
+
+func (c *Conversation) participant(userID string) *Participant {
+	for i := range c.Participants {
+		if c.Participants[i].UserID == userID {
+			return &c.Participants[i]
+		}
+	}
+	return nil
+}
+
+func (c *Conversation) participantIDs() []string {
+	ids := make([]string, len(c.Participants))
+	for i, p := range c.Participants {
+		ids[i] = p.UserID
+	}
+	return ids
+}
+
+// viewedBy sets UnreadCount for userID.
+func (c *Conversation) viewedBy(userID string) {
+	if p := c.participant(userID); p != nil {
+		c.UnreadCount = p.Unread
+	}
+}
+
+// validateMessageBody trims body and checks its length.
+func validateMessageBody(body string) (string, string) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return "", "Message body is required"
+	}
+	if utf8.RuneCountInString(body) > maxMessageLength {
+		return "", fmt.Sprintf("Messages are limited to %d characters", maxMessageLength)
+	}
+	return body, ""
+}
+
+// conversationSubject looks up the owner and title of what a conversation
+// is about.
+func (s *Server) conversationSubject(ctx context.Context, subjectType string, id primitive.ObjectID) (owner, title string, err error) {
+	switch subjectType {
+	case subjectListing:
+		listing, err := s.store.Listings.Get(ctx, id)
+		if err != nil {
+			return "", "", err
+		}
+		return listing.UserID, listing.Title, nil
+	case subjectExchange:
+		request, err := s.store.Exchanges.Get(ctx, id)
+		if err != nil {
+			return "", "", err
+		}
+		return request.UserID, fmt.Sprintf("%s %s to %s", request.Amount, request.FromCurrency, request.ToCurrency), nil
+	case subjectSublease:
+		sublease, err := s.store.Subleases.Get(ctx, id)
+		if err != nil {
+			return "", "", err
+		}
+		return sublease.UserID, sublease.Title, nil
+	}
+	return "", "", errUnknownSubject
+}
+
+// loadConversation fetches the conversation named in the URL, writing the
+// error response and returning nil unless the caller takes part in it.
+func (s *Server) loadConversation(w http.ResponseWriter, r *http.Request) *Conversation {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return nil
+	}
+	conv, err := s.store.Conversations.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Conversation not found"})
+		return nil
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load conversation"})
+		return nil
+	}
+	if conv.participant(currentUserID(r)) == nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You are not part of this conversation"})
+		return nil
+	}
+	return conv
+}
+
+// sendMessage stores body from the caller in conv.
+func (s *Server) sendMessage(ctx context.Context, conv *Conversation, senderID, body string) (*Message, error) {
+	msg := &Message{
+		ConversationID: conv.ID,
+		SenderID:       senderID,
+		Body:           body,
+		SentAt:         time.Now(),
+	}
+	if err := s.store.Messages.Create(ctx, msg); err != nil {
+		return nil, err
+	}
+	if err := s.store.Conversations.RecordMessage(ctx, conv.ID, msg); err != nil {
+		return nil, err
+	}
+	s.events.Publish(eventMessage, msg, conv.participantIDs()...)
+	for _, p := range conv.Participants {
+		if p.UserID == senderID {
+			continue
+		}
+		title := fmt.Sprintf("New message about %q", conv.Title)
+		if err := s.notifications.Notify(ctx, p.UserID, categoryMessages, title, body, "/api/conversations/"+conv.ID.Hex()); err != nil {
+			log.Printf("Failed to notify %s: %v\n", p.UserID, err)
+		}
+	}
+	return msg, nil
+}
+
+// startConversation opens a thread about a listing, exchange request or
+// sublease with its first message. Asking again about the same subject adds
+// the message to the existing thread.
+func (s *Server) startConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		SubjectType string `json:"subject_type"`
+		SubjectID   string `json:"subject_id"`
+		Body        string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	subjectID, err := primitive.ObjectIDFromHex(body.SubjectID)
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	text, problem := validateMessageBody(body.Body)
+	if problem != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": problem})
+		return
+	}
+
+	owner, title, err := s.conversationSubject(r.Context(), body.SubjectType, subjectID)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Subject not found"})
+		return
+	}
+	if errors.Is(err, errUnknownSubject) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to start conversation"})
+		return
+	}
+	userID := currentUserID(r)
+	if owner == userID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot message yourself about your own post"})
+		return
+	}
+
+	now := time.Now()
+	conv := &Conversation{
+		SubjectType:   body.SubjectType,
+		SubjectID:     subjectID,
+		Title:         title,
+		StartedBy:     userID,
+		Participants:  []Participant{{UserID: owner}, {UserID: userID, LastReadAt: now}},
+		LastMessageAt: now,
+		CreatedAt:     now,
+	}
+	created, err := s.store.Conversations.FindOrCreate(r.Context(), conv)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to start conversation"})
+		return
+	}
+	msg, err := s.sendMessage(r.Context(), conv, userID, text)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to send message"})
+		return
+	}
+	conv.LastMessage, conv.LastMessageAt = msg, msg.SentAt
+	conv.viewedBy(userID)
+
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"conversation": conv, "message": msg})
+}
+
+// getConversations is the caller's inbox, most recently active first.
+func (s *Server) getConversations(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query, err := parseListQuery(r.URL.Query(), map[string]string{"date": "last_message_at"}, "-date")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	userID := currentUserID(r)
+	conversations, next, err := s.store.Conversations.ListByParticipant(r.Context(), userID, query)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve conversations"})
+		return
+	}
+	for i := range conversations {
+		conversations[i].viewedBy(userID)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation_count": len(conversations),
+		"conversations":      conversations,
+		"next_cursor":        next,
+	})
+}
+
+// getUnreadCount totals the caller's unread messages across conversations.
+func (s *Server) getUnreadCount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	unread, err := s.store.Conversations.CountUnread(r.Context(), currentUserID(r))
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to count unread messages"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+}
+
+func (s *Server) getConversation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	conv := s.loadConversation(w, r)
+	if conv == nil {
+		return
+	}
+	conv.viewedBy(currentUserID(r))
+	json.NewEncoder(w).Encode(conv)
+}
+
+// getMessages returns a page of a conversation's messages, newest first,
+// and marks the conversation read for the caller.
+func (s *Server) getMessages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	conv := s.loadConversation(w, r)
+	if conv == nil {
+		return
+	}
+	query, err := parseListQuery(r.URL.Query(), map[string]string{"date": "sent_at"}, "-date")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	messages, next, err := s.store.Messages.ListByConversation(r.Context(), conv.ID, query)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve messages"})
+		return
+	}
+	if err := s.store.Conversations.MarkRead(r.Context(), conv.ID, currentUserID(r), time.Now()); err != nil {
+		log.Printf("Database error: %v\n", err)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message_count": len(messages),
+		"messages":      messages,
+		"next_cursor":   next,
+	})
+}
+
+func (s *Server) postMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	conv := s.loadConversation(w, r)
+	if conv == nil {
+		return
+	}
+	var body struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	text, problem := validateMessageBody(body.Body)
+	if problem != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": problem})
+		return
+	}
+	msg, err := s.sendMessage(r.Context(), conv, currentUserID(r), text)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to send message"})
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// deleteMessage removes the body of one of the caller's messages. The
+// message stays in the thread so replies to it still make sense.
+func (s *Server) deleteMessage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	conv := s.loadConversation(w, r)
+	if conv == nil {
+		return
+	}
+	messageID, err := primitive.ObjectIDFromHex(mux.Vars(r)["messageId"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	msg, err := s.store.Messages.Get(r.Context(), messageID)
+	if errors.Is(err, errNotFound) || (err == nil && msg.ConversationID != conv.ID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Message not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load message"})
+		return
+	}
+	if !canModify(r, msg.SenderID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You can only delete your own messages"})
+		return
+	}
+	if msg.DeletedAt == nil {
+		now := time.Now()
+		msg.Body, msg.DeletedAt = "", &now
+		if err := s.store.Messages.Update(r.Context(), msg); err != nil {
+			log.Printf("Database error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete message"})
+			return
+		}
+		if err := s.store.Conversations.RecordDeletion(r.Context(), conv.ID, msg); err != nil {
+			log.Printf("Database error: %v\n", err)
+		}
+		s.events.Publish(eventMessageDeleted, msg, conv.participantIDs()...)
+	}
+	json.NewEncoder(w).Encode(msg)
+}
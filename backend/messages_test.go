@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type inbox struct {
+	Conversations []Conversation `json:"conversations"`
+	NextCursor    string         `json:"next_cursor"`
+}
+
+func unreadCount(t *testing.T, r *mux.Router, token string) int {
+	rr := serve(r, "GET", "/api/conversations/unread", token, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body struct {
+		Unread int `json:"unread"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	return body.Unread
+}
+
+func TestConversations(t *testing.T) {
+	s, r := newTestServer()
+	alice, bob, carol := loginAs(t, s, "alice"), loginAs(t, s, "bob"), loginAs(t, s, "carol")
+	listing := testListing("alice")
+	s.store.Listings.Create(context.Background(), &listing)
+	start := `{"subject_type": "listing", "subject_id": "` + listing.ID.Hex() + `", "body": "Is this still available?"}`
+
+	tests := []struct {
+		description  string
+		token        string
+		body         string
+		expectedCode int
+	}{
+		{"Owner messages themselves", alice, start, http.StatusBadRequest},
+		{"Unknown subject type", bob, `{"subject_type": "car", "subject_id": "` + listing.ID.Hex() + `", "body": "Hi"}`, http.StatusBadRequest},
+		{"Missing subject", bob, `{"subject_type": "sublease", "subject_id": "` + listing.ID.Hex() + `", "body": "Hi"}`, http.StatusNotFound},
+		{"Blank body", bob, `{"subject_type": "listing", "subject_id": "` + listing.ID.Hex() + `", "body": "  "}`, http.StatusBadRequest},
+		{"Body too long", bob, `{"subject_type": "listing", "subject_id": "` + listing.ID.Hex() + `", "body": "` + strings.Repeat("a", maxMessageLength+1) + `"}`, http.StatusBadRequest},
+		{"Buyer starts a conversation", bob, start, http.StatusCreated},
+		{"Asking again reuses the thread", bob, `{"subject_type": "listing", "subject_id": "` + listing.ID.Hex() + `", "body": "Can I pick it up today?"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		rr := serve(r, "POST", "/api/conversations", test.token, test.body)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+
+	rr := serve(r, "GET", "/api/conversations", alice, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var box inbox
+	json.Unmarshal(rr.Body.Bytes(), &box)
+	if !assert.Len(t, box.Conversations, 1) {
+		return
+	}
+	conv := box.Conversations[0]
+	assert.Equal(t, "Laptop for Sale", conv.Title)
+	assert.Equal(t, 2, conv.UnreadCount)
+	assert.Equal(t, "Can I pick it up today?", conv.LastMessage.Body)
+	assert.Equal(t, 2, unreadCount(t, r, alice))
+	assert.Equal(t, 0, unreadCount(t, r, bob))
+
+	base := "/api/conversations/" + conv.ID.Hex()
+	assert.Equal(t, http.StatusForbidden, serve(r, "GET", base+"/messages", carol, "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(r, "POST", base+"/messages", carol, `{"body": "Me too"}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(r, "GET", "/api/conversations/000000000000000000000000", alice, "").Code)
+
+	// Reading the thread clears the reader's unread count only
+	rr = serve(r, "GET", base+"/messages?limit=1", alice, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var page struct {
+		Messages   []Message `json:"messages"`
+		NextCursor string    `json:"next_cursor"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Len(t, page.Messages, 1)
+	assert.Equal(t, "Can I pick it up today?", page.Messages[0].Body, "newest first")
+	assert.NotEmpty(t, page.NextCursor)
+	rr = serve(r, "GET", base+"/messages?limit=1&cursor="+page.NextCursor, alice, "")
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Equal(t, "Is this still available?", page.Messages[0].Body)
+	assert.Empty(t, page.NextCursor)
+	assert.Equal(t, 0, unreadCount(t, r, alice))
+
+	rr = serve(r, "POST", base+"/messages", alice, `{"body": "Yes, come by at 5"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var reply Message
+	json.Unmarshal(rr.Body.Bytes(), &reply)
+	assert.Equal(t, 1, unreadCount(t, r, bob))
+
+	// Deleting an unread message uncounts it and hides its body
+	assert.Equal(t, http.StatusForbidden, serve(r, "DELETE", base+"/messages/"+reply.ID.Hex(), bob, "").Code)
+	rr = serve(r, "DELETE", base+"/messages/"+reply.ID.Hex(), alice, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 0, unreadCount(t, r, bob))
+	rr = serve(r, "GET", base, bob, "")
+	json.Unmarshal(rr.Body.Bytes(), &conv)
+	assert.Equal(t, "", conv.LastMessage.Body)
+	assert.NotNil(t, conv.LastMessage.DeletedAt)
+
+	rr = serve(r, "GET", "/api/conversations", carol, "")
+	json.Unmarshal(rr.Body.Bytes(), &box)
+	assert.Empty(t, box.Conversations, "the inbox only holds the caller's conversations")
+}
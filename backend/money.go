@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultCurrency is assumed for listings and subleases that name none,
+// which is every one posted before currencies were recorded.
+const defaultCurrency = "USD"
+
+// Money is an exact amount of one currency, counted in its minor units:
+// cents for USD, yen for JPY, fils for KWD.
+//
+// In JSON a Money is a plain decimal number ("price": 12.50) whose currency
+// is a sibling field of the document, so clients that predate Money keep
+// working. A decoded amount cannot be converted to minor units until that
+// currency is known; it is held as text until resolve is called.
+type Money struct {
+	Minor    int64  `bson:"minor"`
+	Currency string `bson:"currency"`
+	pending  string
+}
+
+// moneyFromFloat converts a legacy float amount, rounding to the nearest
+// minor unit.
+func moneyFromFloat(amount float64, currency string) Money {
+	return Money{Minor: int64(math.Round(amount * math.Pow10(minorDigits(currency)))), Currency: currency}
+}
+
+// minorDigits is the number of decimals of currency, or 2 for codes outside
+// the ISO 4217 table.
+func minorDigits(currency string) int {
+	if digits, ok := currencyMinorUnits[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+// IsZero lets bson omitempty skip unset amounts.
+func (m Money) IsZero() bool {
+	return m.Minor == 0 && m.pending == ""
+}
+
+// String formats m with exactly its currency's decimals, e.g. "12.50" or
+// "1500" for JPY.
+func (m Money) String() string {
+	if m.pending != "" {
+		return m.pending
+	}
+	digits := minorDigits(m.Currency)
+	sign, minor := "", m.Minor
+	if minor < 0 {
+		sign, minor = "-", -minor
+	}
+	if digits == 0 {
+		return sign + strconv.FormatInt(minor, 10)
+	}
+	scale := int64(math.Pow10(digits))
+	return fmt.Sprintf("%s%d.%0*d", sign, minor/scale, digits, minor%scale)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a number or a decimal string. The value is checked
+// here but converted by resolve.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*m = Money{}
+		return nil
+	}
+	text := strings.Trim(string(data), `"`)
+	if !decimalPattern.MatchString(text) {
+		return fmt.Errorf("invalid amount %s: use a plain decimal number", data)
+	}
+	m.Minor, m.pending = 0, text
+	return nil
+}
+
+var decimalPattern = regexp.MustCompile(`^-?[0-9]{1,15}(\.[0-9]+)?$`)
+
+// errTooPrecise is returned for amounts finer than a currency's minor unit.
+var errTooPrecise = errors.New("has more decimals than the currency allows")
+
+// resolve fixes m's currency, converting an amount decoded from JSON to
+// minor units. An already resolved amount in another currency keeps its
+// decimal value, so changing a listing from USD to EUR keeps "12.50".
+func (m *Money) resolve(currency string) error {
+	digits, ok := currencyMinorUnits[currency]
+	if !ok {
+		return fmt.Errorf("unknown currency %q", currency)
+	}
+	text := m.pending
+	if text == "" {
+		if m.Currency == currency {
+			return nil
+		}
+		text = m.String()
+	}
+
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(text, "-"), ".")
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > digits {
+		return fmt.Errorf("%s %s %w", text, currency, errTooPrecise)
+	}
+	minor, err := strconv.ParseInt(whole+frac+strings.Repeat("0", digits-len(frac)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount %s: %w", text, err)
+	}
+	if strings.HasPrefix(text, "-") {
+		minor = -minor
+	}
+	*m = Money{Minor: minor, Currency: currency}
+	return nil
+}
+
+// parseMoney parses a decimal amount of currency, as given in a query
+// parameter.
+func parseMoney(text, currency string) (Money, error) {
+	if !decimalPattern.MatchString(text) {
+		return Money{}, fmt.Errorf("invalid amount %q", text)
+	}
+	m := Money{pending: text}
+	return m, m.resolve(currency)
+}
+
+// convertMinor converts minor units of from into minor units of to at rate,
+// in units of to per unit of from, rounding down so a conversion never
+// promises more than is there.
+func convertMinor(minor int64, rate float64, from, to string) int64 {
+	scale := math.Pow10(minorDigits(to) - minorDigits(from))
+	return int64(math.Floor(float64(minor)*rate*scale + 1e-6))
+}
+
+// legacyMoneyField is a money field that documents written before Money
+// existed store as a float. currency is the path of the field naming its
+// currency; fallback applies when that is missing.
+type legacyMoneyField struct {
+	path     string
+	currency string
+	fallback string
+}
+
+var legacyMoneyFields = map[string][]legacyMoneyField{
+	"marketplace_listings": {{path: "price", currency: "currency", fallback: defaultCurrency}},
+	"subleasing_requests":  {{path: "rent", currency: "currency", fallback: defaultCurrency}},
+	"currency_exchange_requests": {
+		{path: "amount", currency: "from_currency"},
+		{path: "min_amount", currency: "from_currency"},
+		{path: "filled", currency: "from_currency"},
+	},
+	"exchange_matches": {
+		{path: "sides.0.amount", currency: "sides.0.currency"},
+		{path: "sides.1.amount", currency: "sides.1.currency"},
+	},
+}
+
+// migrateMoney rewrites float amounts as Money documents. It only touches
+// documents that still have a numeric amount, so running it at every start
+// is cheap once the data has been converted. Documents that cannot be
+// converted, such as exchange requests with a made-up currency, are moved to
+// a <collection>_quarantine collection so they neither stop the server
+// starting nor break reads of the rest.
+func migrateMoney(ctx context.Context, db *mongo.Database) error {
+	for name, fields := range legacyMoneyFields {
+		collection := db.Collection(name)
+		legacy := bson.A{}
+		for _, field := range fields {
+			legacy = append(legacy, bson.M{field.path: bson.M{"$type": "number"}})
+		}
+		cursor, err := collection.Find(ctx, bson.M{"$or": legacy})
+		if err != nil {
+			return err
+		}
+
+		var docs []bson.M
+		if err := cursor.All(ctx, &docs); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			set, err := legacyMoneyUpdate(doc, fields)
+			if err != nil {
+				log.Printf("Quarantining %s %v: %v\n", name, doc["_id"], err)
+				doc["quarantine_reason"] = err.Error()
+				if _, err := db.Collection(name+"_quarantine").InsertOne(ctx, doc); err != nil {
+					return err
+				}
+				if _, err := collection.DeleteOne(ctx, bson.M{"_id": doc["_id"]}); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := collection.UpdateOne(ctx, bson.M{"_id": doc["_id"]}, bson.M{"$set": set}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// legacyMoneyUpdate returns the $set converting doc's float amounts in
+// fields, or an error if one has no valid currency to convert it in.
+func legacyMoneyUpdate(doc bson.M, fields []legacyMoneyField) (bson.M, error) {
+	set := bson.M{}
+	for _, field := range fields {
+		amount, ok := normalizeValue(lookupPath(doc, field.path)).(float64)
+		if !ok {
+			continue
+		}
+		currency, _ := lookupPath(doc, field.currency).(string)
+		if currency = normalizeCurrency(currency); !isCurrency(currency) {
+			if field.fallback == "" {
+				return nil, fmt.Errorf("cannot convert %s without a valid currency", field.path)
+			}
+			currency = field.fallback
+			set[field.currency] = currency
+		}
+		set[field.path] = moneyFromFloat(amount, currency)
+	}
+	return set, nil
+}
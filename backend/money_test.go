@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestMoneyResolve(t *testing.T) {
+	tests := []struct {
+		text     string
+		currency string
+		minor    int64
+		str      string
+		wantErr  bool
+	}{
+		{"12.5", "USD", 1250, "12.50", false},
+		{"-0.07", "USD", -7, "-0.07", false},
+		{"1500", "JPY", 1500, "1500", false},
+		{"1500.00", "JPY", 1500, "1500", false},
+		{"1500.5", "JPY", 0, "", true},
+		{"3.125", "KWD", 3125, "3.125", false},
+		{"0.001", "USD", 0, "", true},
+		{"10", "XYZ", 0, "", true},
+	}
+	for _, test := range tests {
+		m, err := parseMoney(test.text, test.currency)
+		if test.wantErr {
+			assert.Error(t, err, test.text+" "+test.currency)
+			continue
+		}
+		assert.NoError(t, err, test.text+" "+test.currency)
+		assert.Equal(t, test.minor, m.Minor, test.text+" "+test.currency)
+		assert.Equal(t, test.str, m.String(), test.text+" "+test.currency)
+	}
+
+	m := money(12.5, "USD")
+	assert.NoError(t, m.resolve("EUR"))
+	assert.Equal(t, Money{Minor: 1250, Currency: "EUR"}, m, "a currency change keeps the decimal amount")
+	assert.ErrorIs(t, m.resolve("JPY"), errTooPrecise)
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var body struct {
+		Price Money `json:"price"`
+	}
+	for _, input := range []string{`{"price": 19.99}`, `{"price": "19.99"}`} {
+		assert.NoError(t, json.Unmarshal([]byte(input), &body))
+		assert.NoError(t, body.Price.resolve("USD"))
+		assert.Equal(t, int64(1999), body.Price.Minor)
+		out, _ := json.Marshal(body)
+		assert.JSONEq(t, `{"price": 19.99}`, string(out))
+	}
+	assert.Error(t, json.Unmarshal([]byte(`{"price": 1e3}`), &body), "exponents are not plain decimals")
+	assert.Error(t, json.Unmarshal([]byte(`{"price": "ten"}`), &body))
+}
+
+func TestConvertMinor(t *testing.T) {
+	assert.Equal(t, int64(855000), convertMinor(10000, 85.5, "USD", "INR"))
+	assert.Equal(t, int64(14960), convertMinor(10000, 149.6, "USD", "JPY"))
+	assert.Equal(t, int64(6024), convertMinor(499992, 1.0/83, "INR", "USD"), "rounds down")
+}
+
+func TestLookupPathIndexesArrays(t *testing.T) {
+	doc := bson.M{"sides": bson.A{bson.M{"amount": 1.5}, bson.M{"amount": 2.5}}}
+	assert.Equal(t, 2.5, lookupPath(doc, "sides.1.amount"))
+	assert.Nil(t, lookupPath(doc, "sides.2.amount"))
+}
+
+func TestLegacyMoneyUpdate(t *testing.T) {
+	fields := legacyMoneyFields["currency_exchange_requests"]
+	set, err := legacyMoneyUpdate(bson.M{"amount": 100.5, "from_currency": "usd", "filled": int32(0)}, fields)
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"amount": money(100.5, "USD"), "filled": money(0, "USD")}, set)
+
+	_, err = legacyMoneyUpdate(bson.M{"amount": 5000.0, "from_currency": "rupees"}, fields)
+	assert.Error(t, err, "a legacy row with a made-up currency is quarantined")
+
+	set, err = legacyMoneyUpdate(bson.M{"price": 20.0, "currency": "dollars"}, legacyMoneyFields["marketplace_listings"])
+	assert.NoError(t, err)
+	assert.Equal(t, bson.M{"price": money(20, "USD"), "currency": "USD"}, set, "listings fall back to USD")
+}
+
+func TestListingCurrencies(t *testing.T) {
+	s, r := newTestServer()
+	token := loginAs(t, s, "alice")
+	listing := `{"title": "Desk", "description": "Oak", "category": "Furniture", "condition": "Used", "pictures": ["desk.jpg"], "location": {"city": "Gainesville", "state": "FL", "country": "USA"}, `
+
+	tests := []struct {
+		description  string
+		fields       string
+		expectedCode int
+	}{
+		{"Defaults to USD", `"price": 40}`, http.StatusCreated},
+		{"Yen has no decimals", `"price": 4000, "currency": "jpy"}`, http.StatusCreated},
+		{"Fractional yen", `"price": 4000.5, "currency": "JPY"}`, http.StatusBadRequest},
+		{"Unknown currency", `"price": 40, "currency": "BUX"}`, http.StatusBadRequest},
+		{"Sub-cent price", `"price": 40.001}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rr := serve(r, "POST", "/api/postMarketplaceListing", token, listing+test.fields)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+
+	rr := serve(r, "GET", "/api/getMarketplaceListings?currency=JPY&max_price=5000", "", "")
+	var page listingPage
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	if assert.Len(t, page.Listings, 1) {
+		assert.Equal(t, "JPY", page.Listings[0].Currency)
+		assert.Equal(t, "4000", page.Listings[0].Price.String())
+	}
+	rr = serve(r, "GET", "/api/getMarketplaceListings?max_price=100", "", "")
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Len(t, page.Listings, 1, "price bounds default to USD")
+	rr = serve(r, "GET", "/api/currency/exchange/requests?min_amount=10", "", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "amount bounds need from_currency")
+}
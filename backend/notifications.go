@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	// Time zones must resolve even where the host has no zoneinfo
+	_ "time/tzdata"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Notification categories.
+const (
+	categoryMessages       = "messages"
+	categoryMatches        = "matches"
+	categoryOffers         = "offers"
+	categoryListingUpdates = "listing_updates"
+	categoryExpiry         = "expiry"
+	categorySavedSearches  = "saved_searches"
+)
+
+// Ways a category can be emailed.
+const (
+	emailInstant = "instant"
+	emailDigest  = "digest"
+	emailOff     = "off"
+)
+
+// Mail states of a notification. Notifications that are not to be emailed
+// have none.
+const (
+	mailPending  = "pending" // sent on its own at MailAt
+	mailInDigest = "digest"  // sent in the digest due at MailAt
+	mailSent     = "sent"
+)
+
+// eventNotification pushes new in-app notifications to open event streams.
+const eventNotification = "notification"
+
+const (
+	defaultDigestTime = "08:00"
+	notifyBatchSize   = 100
+	// mailRetryDelay is how long a notification waits after its email
+	// failed to send.
+	mailRetryDelay = 15 * time.Minute
+)
+
+// defaultCategories is how each category is delivered until a user says
+// otherwise. Low-priority categories go out in the daily digest.
+var defaultCategories = map[string]CategoryPreference{
+	categoryMessages:       {InApp: true, Email: emailInstant},
+	categoryMatches:        {InApp: true, Email: emailInstant},
+	categoryOffers:         {InApp: true, Email: emailInstant},
+	categoryListingUpdates: {InApp: true, Email: emailDigest},
+	categoryExpiry:         {InApp: true, Email: emailInstant},
+	categorySavedSearches:  {InApp: true, Email: emailInstant},
+}
+
+// CategoryPreference is how one category of notifications reaches a user.
+type CategoryPreference struct {
+	InApp bool   `json:"in_app" bson:"in_app"`
+	Email string `json:"email" bson:"email"`
+}
+
+// QuietHours is a daily span, in HH:MM local time, when no email is sent.
+// It may wrap past midnight.
+type QuietHours struct {
+	Start string `json:"start" bson:"start"`
+	End   string `json:"end" bson:"end"`
+}
+
+// NotificationPreferences is how a user wants to be notified. Categories
+// left out keep their defaults. While muted, nothing is emailed or pushed,
+// though notifications are still listed.
+type NotificationPreferences struct {
+	Categories map[string]CategoryPreference `json:"categories,omitempty" bson:"categories,omitempty"`
+	MutedUntil *time.Time                    `json:"muted_until,omitempty" bson:"muted_until,omitempty"`
+	QuietHours *QuietHours                   `json:"quiet_hours,omitempty" bson:"quiet_hours,omitempty"`
+	DigestTime string                        `json:"digest_time,omitempty" bson:"digest_time,omitempty"`
+	TimeZone   string                        `json:"time_zone,omitempty" bson:"time_zone,omitempty"`
+}
+
+// UnmarshalJSON ignores the free-form text profiles used to send as
+// preferences, so older clients can still save a profile.
+func (p *NotificationPreferences) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return nil
+	}
+	type plain NotificationPreferences
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// category is the effective preference for category.
+func (p *NotificationPreferences) category(category string) CategoryPreference {
+	if pref, ok := p.Categories[category]; ok {
+		return pref
+	}
+	return defaultCategories[category]
+}
+
+// withDefaults spells out every category and setting.
+func (p NotificationPreferences) withDefaults() NotificationPreferences {
+	categories := map[string]CategoryPreference{}
+	for category := range defaultCategories {
+		categories[category] = p.category(category)
+	}
+	p.Categories = categories
+	if p.DigestTime == "" {
+		p.DigestTime = defaultDigestTime
+	}
+	if p.TimeZone == "" {
+		p.TimeZone = "UTC"
+	}
+	return p
+}
+
+func (p *NotificationPreferences) validate() string {
+	for category, pref := range p.Categories {
+		if _, ok := defaultCategories[category]; !ok {
+			names := make([]string, 0, len(defaultCategories))
+			for name := range defaultCategories {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Sprintf("unknown category %q; categories are %s", category, strings.Join(names, ", "))
+		}
+		switch pref.Email {
+		case emailInstant, emailDigest, emailOff:
+		default:
+			return fmt.Sprintf("email for %s must be instant, digest or off", category)
+		}
+	}
+	if p.QuietHours != nil {
+		if _, err := clockMinutes(p.QuietHours.Start); err != nil {
+			return "quiet_hours.start " + err.Error()
+		}
+		if _, err := clockMinutes(p.QuietHours.End); err != nil {
+			return "quiet_hours.end " + err.Error()
+		}
+	}
+	if p.DigestTime != "" {
+		if _, err := clockMinutes(p.DigestTime); err != nil {
+			return "digest_time " + err.Error()
+		}
+	}
+	if _, err := time.LoadLocation(p.TimeZone); err != nil {
+		return "time_zone must be an IANA time zone such as America/New_York"
+	}
+	return ""
+}
+
+// clockMinutes parses HH:MM into minutes past midnight.
+func clockMinutes(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New("must be a time of day (HH:MM)")
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (p *NotificationPreferences) location() *time.Location {
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// atClock is the first time at or after from that reads minutes past
+// midnight in loc.
+func atClock(from time.Time, minutes int, loc *time.Location) time.Time {
+	local := from.In(loc)
+	t := time.Date(local.Year(), local.Month(), local.Day(), minutes/60, minutes%60, 0, 0, loc)
+	if t.Before(from) {
+		t = time.Date(local.Year(), local.Month(), local.Day()+1, minutes/60, minutes%60, 0, 0, loc)
+	}
+	return t
+}
+
+// quietUntil reports whether now is within quiet hours, and when they end.
+func (p *NotificationPreferences) quietUntil(now time.Time) (time.Time, bool) {
+	if p.QuietHours == nil {
+		return time.Time{}, false
+	}
+	start, _ := clockMinutes(p.QuietHours.Start)
+	end, _ := clockMinutes(p.QuietHours.End)
+	local := now.In(p.location())
+	minute := local.Hour()*60 + local.Minute()
+	quiet := (start < end && minute >= start && minute < end) ||
+		(start > end && (minute >= start || minute < end))
+	if !quiet {
+		return time.Time{}, false
+	}
+	return atClock(now, end, p.location()), true
+}
+
+// nextDigest is when the first digest after now goes out, moved past quiet
+// hours if it falls in them.
+func (p *NotificationPreferences) nextDigest(now time.Time) time.Time {
+	digest := defaultDigestTime
+	if p.DigestTime != "" {
+		digest = p.DigestTime
+	}
+	minutes, _ := clockMinutes(digest)
+	at := atClock(now, minutes, p.location())
+	if end, quiet := p.quietUntil(at); quiet {
+		return end
+	}
+	return at
+}
+
+// Notification is one thing a user was told about.
+type Notification struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	Category  string             `json:"category" bson:"category"`
+	Title     string             `json:"title" bson:"title"`
+	Body      string             `json:"body" bson:"body"`
+	Link      string             `json:"link,omitempty" bson:"link,omitempty"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	ReadAt    *time.Time         `json:"read_at,omitempty" bson:"read_at,omitempty"`
+	// InApp is false for notifications kept only to be emailed.
+	InApp  bool      `json:"-" bson:"in_app"`
+	Mail   string    `json:"-" bson:"mail,omitempty"`
+	MailAt time.Time `json:"-" bson:"mail_at,omitempty"`
+}
+
+// NotificationService records notifications and emails them as each user's
+// preferences ask: right away, after quiet hours, or in a daily digest.
+type NotificationService struct {
+	store  *Store
+	mailer Mailer
+	events *EventHub
+	now    func() time.Time
+	// wake asks run to send due mail without waiting for its next tick.
+	wake chan struct{}
+}
+
+func newNotificationService(store *Store, mailer Mailer, events *EventHub) *NotificationService {
+	return &NotificationService{store: store, mailer: mailer, events: events, now: time.Now, wake: make(chan struct{}, 1)}
+}
+
+// recipient looks up the account behind userID. Users without one, such as
+// admins, get defaults and no email.
+func (n *NotificationService) recipient(ctx context.Context, userID string) (NotificationPreferences, string, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return NotificationPreferences{}, "", nil
+	}
+	user, err := n.store.Users.Get(ctx, id)
+	if errors.Is(err, errNotFound) {
+		return NotificationPreferences{}, "", nil
+	}
+	if err != nil {
+		return NotificationPreferences{}, "", err
+	}
+	if user.PreferredEmail != "" {
+		return user.Preferences, user.PreferredEmail, nil
+	}
+	return user.Preferences, user.Email, nil
+}
+
+// Notify tells userID about something in category. link is the API path of
+// what it concerns, if any.
+func (n *NotificationService) Notify(ctx context.Context, userID, category, title, body, link string) error {
+	prefs, to, err := n.recipient(ctx, userID)
+	if err != nil {
+		return err
+	}
+	pref := prefs.category(category)
+	now := n.now()
+	muted := prefs.MutedUntil != nil && prefs.MutedUntil.After(now)
+
+	note := &Notification{
+		UserID:    userID,
+		Category:  category,
+		Title:     title,
+		Body:      body,
+		Link:      link,
+		CreatedAt: now,
+		InApp:     pref.InApp,
+	}
+	if to != "" && !muted {
+		switch pref.Email {
+		case emailInstant:
+			note.Mail, note.MailAt = mailPending, now
+			if end, quiet := prefs.quietUntil(now); quiet {
+				note.MailAt = end
+			}
+		case emailDigest:
+			note.Mail, note.MailAt = mailInDigest, prefs.nextDigest(now)
+		}
+	}
+	if !note.InApp && note.Mail == "" {
+		return nil
+	}
+
+	if err := n.store.Notifications.Create(ctx, note); err != nil {
+		return err
+	}
+	// Mail due now is left to the worker, so a slow relay cannot hold up
+	// the request that caused it
+	if note.Mail == mailPending && !note.MailAt.After(now) {
+		select {
+		case n.wake <- struct{}{}:
+		default:
+		}
+	}
+	if note.InApp && !muted && n.events != nil {
+		n.events.Publish(eventNotification, note, userID)
+	}
+	return nil
+}
+
+// run sends due emails every interval, and whenever Notify records one
+// due right away, until ctx is done.
+func (n *NotificationService) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := n.sendDue(ctx); err != nil {
+			log.Printf("Notification mail failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-n.wake:
+		}
+	}
+}
+
+// sendDue emails one batch of notifications whose time has come: held ones
+// one by one and each user's digest as a single message.
+func (n *NotificationService) sendDue(ctx context.Context) error {
+	now := n.now()
+	due, err := n.store.Notifications.ListDueMail(ctx, now, notifyBatchSize)
+	if err != nil {
+		return err
+	}
+	byUser := map[string][]Notification{}
+	var users []string
+	for _, note := range due {
+		if byUser[note.UserID] == nil {
+			users = append(users, note.UserID)
+		}
+		byUser[note.UserID] = append(byUser[note.UserID], note)
+	}
+
+	var errs []error
+	for _, userID := range users {
+		prefs, to, err := n.recipient(ctx, userID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var digest []Notification
+		for _, note := range byUser[userID] {
+			if note.Mail == mailInDigest {
+				digest = append(digest, note)
+				continue
+			}
+			errs = append(errs, n.deliver(ctx, prefs, to, MailMessage{To: to, Subject: note.Title, Body: note.Body}, []Notification{note}, now))
+		}
+		if len(digest) > 0 {
+			errs = append(errs, n.deliver(ctx, prefs, to, digestMail(to, digest), digest, now))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deliver sends msg and records the outcome on the notifications it covers.
+// Users who have since lost their address are skipped, and failed mail is
+// retried later, after quiet hours if the retry falls in them.
+func (n *NotificationService) deliver(ctx context.Context, prefs NotificationPreferences, to string, msg MailMessage, notes []Notification, now time.Time) error {
+	ids := make([]primitive.ObjectID, len(notes))
+	for i, note := range notes {
+		ids[i] = note.ID
+	}
+	if to == "" {
+		return n.store.Notifications.SetMail(ctx, ids, "", now)
+	}
+	if err := n.mailer.Send(ctx, msg); err != nil {
+		retry := now.Add(mailRetryDelay)
+		if end, quiet := prefs.quietUntil(retry); quiet {
+			retry = end
+		}
+		return errors.Join(err, n.store.Notifications.SetMail(ctx, ids, notes[0].Mail, retry))
+	}
+	return n.store.Notifications.SetMail(ctx, ids, mailSent, now)
+}
+
+func digestMail(to string, notes []Notification) MailMessage {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Here is what happened on UniMarketplace since your last digest:\n")
+	for _, note := range notes {
+		fmt.Fprintf(&b, "\n- %s\n  %s\n", note.Title, note.Body)
+	}
+	subject := "Your UniMarketplace digest: 1 update"
+	if len(notes) > 1 {
+		subject = fmt.Sprintf("Your UniMarketplace digest: %d updates", len(notes))
+	}
+	return MailMessage{To: to, Subject: subject, Body: b.String()}
+}
+
+// migratePreferences drops the free-form preferences text profiles used to
+// store, which nothing read, so the structured preferences can decode.
+func migratePreferences(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection("users").UpdateMany(ctx,
+		bson.M{"preferences": bson.M{"$type": "string"}},
+		bson.M{"$unset": bson.M{"preferences": ""}},
+	)
+	return err
+}
+
+// getNotifications lists the caller's notifications, newest first. With
+// unread=true only unread ones are listed.
+func (s *Server) getNotifications(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query, err := parseListQuery(r.URL.Query(), map[string]string{"date": "created_at"}, "-date")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if r.URL.Query().Get("unread") == "true" {
+		query.filters = append(query.filters, fieldFilter{field: "read_at", op: "$in", value: bson.A{nil}})
+	}
+	notifications, next, err := s.store.Notifications.Find(r.Context(), currentUserID(r), query)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve notifications"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notification_count": len(notifications),
+		"notifications":      notifications,
+		"next_cursor":        next,
+	})
+}
+
+func (s *Server) getUnreadNotificationCount(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	unread, err := s.store.Notifications.CountUnread(r.Context(), currentUserID(r))
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to count notifications"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"unread": unread})
+}
+
+// markNotificationsRead marks the notifications listed in {"ids": [...]}
+// read, or all of the caller's when no ids are given.
+func (s *Server) markNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var ids []primitive.ObjectID
+	for _, hex := range body.IDs {
+		id, err := primitive.ObjectIDFromHex(hex)
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	marked, err := s.store.Notifications.MarkRead(r.Context(), currentUserID(r), ids, time.Now())
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update notifications"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int{"marked": marked})
+}
+
+// accountID is the caller's user ID as an account ID. Preferences live on
+// the account, which sessions not tied to one lack.
+func accountID(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	id, err := primitive.ObjectIDFromHex(currentUserID(r))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return id, false
+	}
+	return id, true
+}
+
+func (s *Server) getNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := accountID(w, r)
+	if !ok {
+		return
+	}
+	user, err := s.store.Users.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load preferences"})
+		return
+	}
+	json.NewEncoder(w).Encode(user.Preferences.withDefaults())
+}
+
+// updateNotificationPreferences replaces the caller's preferences.
+func (s *Server) updateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := accountID(w, r)
+	if !ok {
+		return
+	}
+	var prefs NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if problem := prefs.validate(); problem != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": problem})
+		return
+	}
+	err := s.store.Users.UpdatePreferences(r.Context(), id, prefs)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save preferences"})
+		return
+	}
+	json.NewEncoder(w).Encode(prefs.withDefaults())
+}
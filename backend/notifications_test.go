@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotificationSchedule(t *testing.T) {
+	prefs := NotificationPreferences{
+		QuietHours: &QuietHours{Start: "22:00", End: "07:00"},
+		DigestTime: "06:30",
+		TimeZone:   "America/New_York",
+	}
+	ny, _ := time.LoadLocation("America/New_York")
+
+	tests := []struct {
+		description string
+		now         time.Time
+		quiet       bool
+		until       time.Time
+	}{
+		{"Evening", time.Date(2025, 3, 1, 21, 59, 0, 0, ny), false, time.Time{}},
+		{"Late night", time.Date(2025, 3, 1, 23, 0, 0, 0, ny), true, time.Date(2025, 3, 2, 7, 0, 0, 0, ny)},
+		{"Early morning", time.Date(2025, 3, 2, 3, 0, 0, 0, ny), true, time.Date(2025, 3, 2, 7, 0, 0, 0, ny)},
+		{"Morning", time.Date(2025, 3, 2, 7, 0, 0, 0, ny), false, time.Time{}},
+	}
+	for _, test := range tests {
+		until, quiet := prefs.quietUntil(test.now)
+		assert.Equal(t, test.quiet, quiet, test.description)
+		assert.True(t, test.until.Equal(until), test.description)
+	}
+
+	next := prefs.nextDigest(time.Date(2025, 3, 1, 12, 0, 0, 0, ny))
+	assert.True(t, time.Date(2025, 3, 2, 7, 0, 0, 0, ny).Equal(next), "a digest due in quiet hours waits for them to end")
+	prefs.QuietHours = nil
+	next = prefs.nextDigest(time.Date(2025, 3, 1, 12, 0, 0, 0, ny))
+	assert.True(t, time.Date(2025, 3, 2, 6, 30, 0, 0, ny).Equal(next))
+}
+
+func TestNotify(t *testing.T) {
+	s, _ := newTestServer()
+	mailer, clock := newTestExpiry(s)
+	ctx := context.Background()
+	user, _ := s.store.Users.UpsertLogin(ctx, "bob@ufl.edu", *clock)
+	userID := user.ID.Hex()
+	// 12:00 UTC is 07:00 in New York
+	s.store.Users.UpdatePreferences(ctx, user.ID, NotificationPreferences{
+		QuietHours: &QuietHours{Start: "06:00", End: "08:00"},
+		TimeZone:   "America/New_York",
+		Categories: map[string]CategoryPreference{categoryOffers: {InApp: false, Email: emailOff}},
+	})
+
+	assert.NoError(t, s.notifications.Notify(ctx, userID, categoryMessages, "New message", "Hi", ""))
+	assert.Empty(t, mailer.sent, "instant email waits out quiet hours")
+	assert.NoError(t, s.notifications.Notify(ctx, userID, categoryListingUpdates, "Listing sold", "Sold", ""))
+	assert.NoError(t, s.notifications.Notify(ctx, userID, categoryListingUpdates, "Listing reserved", "Reserved", ""))
+	assert.NoError(t, s.notifications.Notify(ctx, userID, categoryOffers, "Offer", "Ignored", ""))
+	assert.NoError(t, s.notifications.Notify(ctx, "alice", categoryMessages, "No account", "In-app only", ""))
+
+	unread, _ := s.store.Notifications.CountUnread(ctx, userID)
+	assert.Equal(t, 3, unread, "disabled categories are not recorded")
+
+	// Quiet hours and the default digest both end at 08:00 New York time
+	*clock = clock.Add(59 * time.Minute)
+	assert.NoError(t, s.notifications.sendDue(ctx))
+	assert.Empty(t, mailer.sent)
+	*clock = clock.Add(time.Minute)
+	assert.NoError(t, s.notifications.sendDue(ctx))
+	if assert.Len(t, mailer.sent, 2) {
+		assert.Equal(t, "New message", mailer.sent[0].Subject)
+		assert.Equal(t, "bob@ufl.edu", mailer.sent[0].To)
+		assert.Equal(t, "Your UniMarketplace digest: 2 updates", mailer.sent[1].Subject)
+		assert.Contains(t, mailer.sent[1].Body, "Listing reserved")
+	}
+	assert.NoError(t, s.notifications.sendDue(ctx))
+	assert.Len(t, mailer.sent, 2, "mail is sent once")
+
+	muted := clock.Add(time.Hour)
+	s.store.Users.UpdatePreferences(ctx, user.ID, NotificationPreferences{MutedUntil: &muted})
+	assert.NoError(t, s.notifications.Notify(ctx, userID, categoryMessages, "While muted", "Hi", ""))
+	assert.NoError(t, s.notifications.sendDue(ctx))
+	assert.Len(t, mailer.sent, 2, "muted users get no email")
+	unread, _ = s.store.Notifications.CountUnread(ctx, userID)
+	assert.Equal(t, 4, unread, "muted notifications are still listed")
+}
+
+func TestNotifyRetriesAfterQuietHours(t *testing.T) {
+	s, _ := newTestServer()
+	mailer, clock := newTestExpiry(s)
+	ctx := context.Background()
+	user, _ := s.store.Users.UpsertLogin(ctx, "bob@ufl.edu", *clock)
+	// Quiet hours start ten minutes from now, at 12:10 UTC
+	s.store.Users.UpdatePreferences(ctx, user.ID, NotificationPreferences{
+		QuietHours: &QuietHours{Start: "07:10", End: "09:00"},
+		TimeZone:   "America/New_York",
+	})
+
+	assert.NoError(t, s.notifications.Notify(ctx, user.ID.Hex(), categoryMessages, "New message", "Hi", ""))
+	assert.Empty(t, mailer.sent, "instant email is left to the worker")
+
+	mailer.err = errors.New("relay down")
+	assert.Error(t, s.notifications.sendDue(ctx))
+	mailer.err = nil
+	*clock = clock.Add(mailRetryDelay)
+	assert.NoError(t, s.notifications.sendDue(ctx))
+	assert.Empty(t, mailer.sent, "the retry waits out quiet hours")
+
+	*clock = time.Date(2025, 3, 1, 14, 0, 0, 0, time.UTC)
+	assert.NoError(t, s.notifications.sendDue(ctx))
+	if assert.Len(t, mailer.sent, 1) {
+		assert.Equal(t, "New message", mailer.sent[0].Subject)
+	}
+}
+
+func TestNotificationEndpoints(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+	user, _ := s.store.Users.UpsertLogin(ctx, "bob@ufl.edu", time.Now())
+	token := loginAs(t, s, user.ID.Hex())
+
+	rr := serve(r, "GET", "/api/notifications/preferences", token, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var prefs NotificationPreferences
+	json.Unmarshal(rr.Body.Bytes(), &prefs)
+	assert.Equal(t, CategoryPreference{InApp: true, Email: emailDigest}, prefs.Categories[categoryListingUpdates])
+	assert.Equal(t, "UTC", prefs.TimeZone)
+
+	tests := []struct {
+		description  string
+		body         string
+		expectedCode int
+	}{
+		{"Unknown category", `{"categories": {"spam": {"in_app": true, "email": "off"}}}`, http.StatusBadRequest},
+		{"Unknown email mode", `{"categories": {"messages": {"in_app": true, "email": "hourly"}}}`, http.StatusBadRequest},
+		{"Bad quiet hours", `{"quiet_hours": {"start": "25:00", "end": "07:00"}}`, http.StatusBadRequest},
+		{"Bad time zone", `{"time_zone": "Mars/Olympus"}`, http.StatusBadRequest},
+		{"Valid", `{"categories": {"messages": {"in_app": true, "email": "digest"}}, "quiet_hours": {"start": "22:00", "end": "07:00"}, "time_zone": "America/New_York"}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		rr := serve(r, "PUT", "/api/notifications/preferences", token, test.body)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+	stored, _ := s.store.Users.Get(ctx, user.ID)
+	assert.Equal(t, emailDigest, stored.Preferences.category(categoryMessages).Email)
+
+	// Profiles still accept the old free-form preferences without touching these
+	rr = serve(r, "POST", "/api/updateUserProfile/"+user.ID.Hex(), token, `{"name": "Bob", "preferences": "Books"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	stored, _ = s.store.Users.Get(ctx, user.ID)
+	assert.Equal(t, "America/New_York", stored.Preferences.TimeZone)
+
+	assert.Equal(t, http.StatusNotFound, serve(r, "GET", "/api/notifications/preferences", loginAs(t, s, "alice"), "").Code)
+
+	userID := user.ID.Hex()
+	for _, title := range []string{"First", "Second", "Third"} {
+		s.notifications.Notify(ctx, userID, categoryMatches, title, title, "")
+	}
+	rr = serve(r, "GET", "/api/notifications?limit=2", token, "")
+	var page struct {
+		Notifications []Notification `json:"notifications"`
+		NextCursor    string         `json:"next_cursor"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	if assert.Len(t, page.Notifications, 2) {
+		assert.Equal(t, "Third", page.Notifications[0].Title)
+	}
+	assert.NotEmpty(t, page.NextCursor)
+
+	rr = serve(r, "POST", "/api/notifications/read", token, `{"ids": ["`+page.Notifications[0].ID.Hex()+`"]}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"marked": 1}`, rr.Body.String())
+	rr = serve(r, "GET", "/api/notifications?unread=true", token, "")
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Len(t, page.Notifications, 2)
+
+	rr = serve(r, "POST", "/api/notifications/read", token, "")
+	assert.JSONEq(t, `{"marked": 2}`, rr.Body.String())
+	rr = serve(r, "GET", "/api/notifications/unread", token, "")
+	assert.JSONEq(t, `{"unread": 0}`, rr.Body.String())
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Offer statuses. A pending offer waits for the seller and a countered one
+// for the buyer; the rest are final.
+const (
+	offerPending   = "pending"
+	offerCountered = "countered"
+	offerAccepted  = "accepted"
+	offerDeclined  = "declined"
+	offerWithdrawn = "withdrawn"
+	offerExpired   = "expired"
+)
+
+// Offer actions, as recorded in an offer's history.
+const (
+	offerActionOffer    = "offer"
+	offerActionCounter  = "counter"
+	offerActionAccept   = "accept"
+	offerActionDecline  = "decline"
+	offerActionWithdraw = "withdraw"
+	offerActionExpire   = "expire"
+)
+
+// eventOffer pushes offer changes to both parties' event streams.
+const eventOffer = "offer"
+
+// offerWindow is how long the party whose turn it is has to respond before
+// an offer expires.
+const offerWindow = 48 * time.Hour
+
+var (
+	errOfferClosed  = errors.New("this offer is no longer open")
+	errOfferExpired = errors.New("this offer has expired")
+	errNotYourTurn  = errors.New("the other party has to respond to this offer first")
+	errNotOfferer   = errors.New("you are not a party to this offer")
+	errSellerOnly   = errors.New("only the seller can decline an offer")
+	errBuyerOnly    = errors.New("only the buyer can withdraw an offer")
+	// errInvalidOffer rejects a counter-offer with a bad amount.
+	errInvalidOffer = errors.New("invalid offer")
+)
+
+// Offer is a buyer's bid on a marketplace listing and the negotiation that
+// follows. Amount is the latest figure on the table, in the listing's
+// currency.
+type Offer struct {
+	ID           primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ListingID    primitive.ObjectID `json:"listing_id" bson:"listing_id"`
+	ListingTitle string             `json:"listing_title" bson:"listing_title"`
+	SellerID     string             `json:"seller_id" bson:"seller_id"`
+	BuyerID      string             `json:"buyer_id" bson:"buyer_id"`
+	// Parties holds both user IDs so either can be looked up with one index.
+	Parties   []string     `json:"-" bson:"parties"`
+	Amount    Money        `json:"amount" bson:"amount"`
+	Currency  string       `json:"currency" bson:"currency"`
+	Status    string       `json:"status" bson:"status"`
+	ExpiresAt time.Time    `json:"expires_at" bson:"expires_at"`
+	History   []OfferEvent `json:"history" bson:"history"`
+	CreatedAt time.Time    `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at" bson:"updated_at"`
+	Version   int64        `json:"version" bson:"version"`
+}
+
+// OfferEvent is one step of a negotiation. Amount is set on offers and
+// counters.
+type OfferEvent struct {
+	Action string    `json:"action" bson:"action"`
+	By     string    `json:"by" bson:"by"`
+	Amount *Money    `json:"amount,omitempty" bson:"amount,omitempty"`
+	Note   string    `json:"note,omitempty" bson:"note,omitempty"`
+	At     time.Time `json:"at" bson:"at"`
+}
+
+func (o *Offer) open() bool {
+	return o.Status == offerPending || o.Status == offerCountered
+}
+
+// awaiting is who has to respond next, if the offer is open.
+func (o *Offer) awaiting() string {
+	switch o.Status {
+	case offerPending:
+		return o.SellerID
+	case offerCountered:
+		return o.BuyerID
+	}
+	return ""
+}
+
+// role is "buyer" or "seller" for the parties and empty for anyone else.
+func (o *Offer) role(userID string) string {
+	switch userID {
+	case o.BuyerID:
+		return "buyer"
+	case o.SellerID:
+		return "seller"
+	}
+	return ""
+}
+
+// record appends event to the history and moves the offer to status.
+func (o *Offer) record(status string, event OfferEvent) {
+	o.Status = status
+	o.UpdatedAt = event.At
+	o.History = append(o.History, event)
+	if o.open() {
+		o.ExpiresAt = event.At.Add(offerWindow)
+	}
+}
+
+// updateOffer applies change to the stored offer, retrying when a concurrent
+// write bumps the version. An open offer past its window is expired instead
+// and errOfferExpired returned.
+func (s *Server) updateOffer(ctx context.Context, id primitive.ObjectID, change func(*Offer, time.Time) error) (*Offer, error) {
+	for attempt := 0; ; attempt++ {
+		offer, err := s.store.Offers.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		now := s.expiry.now()
+		version := offer.Version
+		expired := offer.open() && !now.Before(offer.ExpiresAt)
+		if expired {
+			offer.record(offerExpired, OfferEvent{Action: offerActionExpire, By: "system", At: now})
+		} else if err := change(offer, now); err != nil {
+			return nil, err
+		}
+		err = s.store.Offers.Replace(ctx, offer, version)
+		if errors.Is(err, errVersionConflict) && attempt < 2 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.offerChanged(ctx, offer)
+		if expired {
+			return offer, errOfferExpired
+		}
+		return offer, nil
+	}
+}
+
+// offerChanged tells both parties about an offer's latest step and
+// notifies whoever did not take it.
+func (s *Server) offerChanged(ctx context.Context, offer *Offer) {
+	s.events.Publish(eventOffer, offer, offer.BuyerID, offer.SellerID)
+
+	last := offer.History[len(offer.History)-1]
+	var title, body string
+	switch last.Action {
+	case offerActionOffer:
+		title = fmt.Sprintf("New offer on %q", offer.ListingTitle)
+		body = fmt.Sprintf("You were offered %s %s.", offer.Amount, offer.Currency)
+	case offerActionCounter:
+		title = fmt.Sprintf("Counter-offer on %q", offer.ListingTitle)
+		body = fmt.Sprintf("The %s countered with %s %s.", offer.role(last.By), offer.Amount, offer.Currency)
+	case offerActionAccept:
+		title = fmt.Sprintf("Offer accepted on %q", offer.ListingTitle)
+		body = fmt.Sprintf("The offer of %s %s was accepted and the listing is reserved for the buyer.", offer.Amount, offer.Currency)
+	case offerActionDecline:
+		title = fmt.Sprintf("Offer declined on %q", offer.ListingTitle)
+		body = fmt.Sprintf("The offer of %s %s was declined.", offer.Amount, offer.Currency)
+	case offerActionWithdraw:
+		title = fmt.Sprintf("Offer withdrawn on %q", offer.ListingTitle)
+		body = fmt.Sprintf("The buyer withdrew their offer of %s %s.", offer.Amount, offer.Currency)
+	case offerActionExpire:
+		title = fmt.Sprintf("Offer expired on %q", offer.ListingTitle)
+		body = fmt.Sprintf("The offer of %s %s expired without a response.", offer.Amount, offer.Currency)
+	}
+	if last.Note != "" {
+		body += " " + last.Note
+	}
+	for _, userID := range []string{offer.BuyerID, offer.SellerID} {
+		if userID == last.By {
+			continue
+		}
+		if err := s.notifications.Notify(ctx, userID, categoryOffers, title, body, "/api/offers/"+offer.ID.Hex()); err != nil {
+			log.Printf("Failed to notify %s: %v\n", userID, err)
+		}
+	}
+}
+
+// closeOffers declines every open offer on a listing that is no longer
+// for sale, giving note as the reason.
+func (s *Server) closeOffers(ctx context.Context, listingID primitive.ObjectID, note string) {
+	offers, err := s.store.Offers.ListByListing(ctx, listingID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		return
+	}
+	for _, offer := range offers {
+		if !offer.open() {
+			continue
+		}
+		_, err := s.updateOffer(ctx, offer.ID, func(o *Offer, now time.Time) error {
+			if !o.open() {
+				return errOfferClosed
+			}
+			o.record(offerDeclined, OfferEvent{Action: offerActionDecline, By: "system", Note: note, At: now})
+			return nil
+		})
+		if err != nil && !errors.Is(err, errOfferClosed) && !errors.Is(err, errOfferExpired) {
+			log.Printf("Database error: %v\n", err)
+		}
+	}
+}
+
+// deleteMarketplaceListing deletes a listing and declines the offers still
+// open on it.
+func (s *Server) deleteMarketplaceListing(ctx context.Context, id primitive.ObjectID) error {
+	if err := s.store.Listings.Delete(ctx, id); err != nil {
+		return err
+	}
+	s.closeOffers(ctx, id, "The listing was removed.")
+	return nil
+}
+
+// expireOffers expires open offers whose window has passed.
+func (e *ExpiryService) expireOffers(ctx context.Context) error {
+	now := e.now()
+	q := listQuery{sort: "expires_at", filters: []fieldFilter{
+		{field: "status", op: "$in", value: bson.A{offerPending, offerCountered}},
+		{field: "expires_at", op: "$lte", value: now},
+	}}
+	return forEachPage(ctx, e.store.Offers.Find, q, func(o *Offer) error {
+		version := o.Version
+		o.record(offerExpired, OfferEvent{Action: offerActionExpire, By: "system", At: now})
+		err := e.store.Offers.Replace(ctx, o, version)
+		if err == nil && e.offerChanged != nil {
+			e.offerChanged(ctx, o)
+		}
+		return ignoreConflict(err)
+	})
+}
+
+// offerBody is the optional body of the offer endpoints.
+type offerBody struct {
+	Amount *Money `json:"amount"`
+	Note   string `json:"note"`
+}
+
+// offerAmount resolves an amount sent for an offer in currency.
+func offerAmount(amount *Money, currency string) (Money, string) {
+	if amount == nil {
+		return Money{}, "amount is required"
+	}
+	if err := amount.resolve(currency); err != nil {
+		return Money{}, "amount: " + err.Error()
+	}
+	if amount.Minor <= 0 {
+		return Money{}, "amount must be positive"
+	}
+	return *amount, ""
+}
+
+// makeOffer handles POST /api/marketplace/listings/{id}/offers with
+// {"amount": ..., "note": ...}. A buyer can have one open offer per listing.
+func (s *Server) makeOffer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	listingID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	var body offerBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	listing, err := s.store.Listings.Get(r.Context(), listingID)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load listing"})
+		return
+	}
+	buyerID := currentUserID(r)
+	if listing.UserID == buyerID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot make an offer on your own listing"})
+		return
+	}
+	if listing.currentStatus() != statusActive {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Only active listings take offers"})
+		return
+	}
+	currency := listing.Price.Currency
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	amount, msg := offerAmount(body.Amount, currency)
+	if msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+
+	existing, err := s.store.Offers.ListByListing(r.Context(), listingID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to make offer"})
+		return
+	}
+	now := s.expiry.now()
+	for _, other := range existing {
+		if other.BuyerID == buyerID && other.open() && now.Before(other.ExpiresAt) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "You already have an open offer on this listing", "offer_id": other.ID.Hex()})
+			return
+		}
+	}
+
+	offer := Offer{
+		ListingID:    listing.ID,
+		ListingTitle: listing.Title,
+		SellerID:     listing.UserID,
+		BuyerID:      buyerID,
+		Parties:      []string{buyerID, listing.UserID},
+		Amount:       amount,
+		Currency:     currency,
+		CreatedAt:    now,
+		Version:      1,
+	}
+	offer.record(offerPending, OfferEvent{Action: offerActionOffer, By: buyerID, Amount: &amount, Note: strings.TrimSpace(body.Note), At: now})
+	if err := s.store.Offers.Create(r.Context(), &offer); err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to make offer"})
+		return
+	}
+	s.offerChanged(r.Context(), &offer)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(offer)
+}
+
+// offerActionHandler returns the handler for accepting, declining,
+// countering ({"amount": ...}) or withdrawing an offer. Whoever's turn it is
+// accepts or counters; the seller can decline and the buyer withdraw at any
+// point while the offer is open. Every action takes an optional
+// {"note": ...}.
+func (s *Server) offerActionHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+		var body offerBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		userID := currentUserID(r)
+		note := strings.TrimSpace(body.Note)
+
+		var problem string
+		// Accepting reserves the listing before the acceptance is saved.
+		// The reservation is kept across retries and released if the
+		// offer is not accepted in the end.
+		var reserved *MarketplaceListing
+		unavailable := false
+		offer, err := s.updateOffer(r.Context(), id, func(o *Offer, now time.Time) error {
+			if o.role(userID) == "" {
+				return errNotOfferer
+			}
+			if !o.open() {
+				return errOfferClosed
+			}
+			event := OfferEvent{Action: action, By: userID, Note: note, At: now}
+			switch action {
+			case offerActionAccept, offerActionCounter:
+				if o.awaiting() != userID {
+					return errNotYourTurn
+				}
+			case offerActionDecline:
+				if userID != o.SellerID {
+					return errSellerOnly
+				}
+			case offerActionWithdraw:
+				if userID != o.BuyerID {
+					return errBuyerOnly
+				}
+			}
+			switch action {
+			case offerActionAccept:
+				if reserved == nil {
+					listing, err := s.reserveForOffer(r.Context(), o, now)
+					if errors.Is(err, errInvalidTransition) || errors.Is(err, errNotFound) {
+						unavailable = true
+						o.record(offerDeclined, OfferEvent{Action: offerActionDecline, By: "system", Note: "The listing is no longer available.", At: now})
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+					reserved = listing
+				}
+				o.record(offerAccepted, event)
+			case offerActionDecline:
+				o.record(offerDeclined, event)
+			case offerActionWithdraw:
+				o.record(offerWithdrawn, event)
+			case offerActionCounter:
+				amount, msg := offerAmount(body.Amount, o.Currency)
+				if msg != "" {
+					problem = msg
+					return errInvalidOffer
+				}
+				event.Amount = &amount
+				o.Amount = amount
+				status := offerCountered
+				if userID == o.BuyerID {
+					status = offerPending
+				}
+				o.record(status, event)
+			}
+			return nil
+		})
+		if reserved != nil {
+			if err == nil && offer.Status == offerAccepted {
+				s.search.putListing(reserved)
+				s.listingStatusChanged(r.Context(), reserved)
+			} else {
+				s.releaseReservation(r.Context(), reserved)
+			}
+		}
+		switch {
+		case errors.Is(err, errNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Offer not found"})
+			return
+		case errors.Is(err, errInvalidOffer):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": problem})
+			return
+		case errors.Is(err, errNotOfferer):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, errOfferClosed), errors.Is(err, errOfferExpired), errors.Is(err, errNotYourTurn),
+			errors.Is(err, errSellerOnly), errors.Is(err, errBuyerOnly), errors.Is(err, errVersionConflict):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case err != nil:
+			log.Printf("Database error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update offer"})
+			return
+		}
+
+		if unavailable {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "The listing is no longer available"})
+			return
+		}
+		json.NewEncoder(w).Encode(offer)
+	}
+}
+
+// reserveForOffer reserves the listing of an offer about to be accepted
+// for its buyer. It fails with errInvalidTransition if the listing is no
+// longer active.
+func (s *Server) reserveForOffer(ctx context.Context, offer *Offer, now time.Time) (*MarketplaceListing, error) {
+	change := StatusChange{
+		To:          statusReserved,
+		By:          offer.SellerID,
+		At:          now,
+		ReservedFor: offer.BuyerID,
+		Note:        fmt.Sprintf("Accepted an offer of %s %s", offer.Amount, offer.Currency),
+	}
+	return transitionListing(ctx, s.store.Listings, offer.ListingID, change, nil)
+}
+
+// releaseReservation makes a listing reserved by reserveForOffer active
+// again when the offer could not be accepted after all. The reservation was
+// never announced, so nobody is told.
+func (s *Server) releaseReservation(ctx context.Context, reserved *MarketplaceListing) {
+	change := StatusChange{To: statusActive, By: "system", At: s.expiry.now(), Note: "The offer could not be accepted."}
+	released, err := transitionListing(ctx, s.store.Listings, reserved.ID, change, func(l *MarketplaceListing) error {
+		if l.currentStatus() != statusReserved || l.ReservedFor != reserved.ReservedFor {
+			return errInvalidTransition
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errInvalidTransition) && !errors.Is(err, errNotFound) {
+		log.Printf("Database error: %v\n", err)
+	}
+	if err == nil {
+		s.search.putListing(released)
+	}
+}
+
+// getListingOffers lists the offers on a listing, newest first: all of them
+// for the seller, and their own for anyone else.
+func (s *Server) getListingOffers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	listingID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	listing, err := s.store.Listings.Get(r.Context(), listingID)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Listing not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load listing"})
+		return
+	}
+	offers, err := s.store.Offers.ListByListing(r.Context(), listingID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve offers"})
+		return
+	}
+
+	seller := canModify(r, listing.UserID)
+	userID := currentUserID(r)
+	visible := []Offer{}
+	for i := len(offers) - 1; i >= 0; i-- {
+		if seller || offers[i].BuyerID == userID {
+			visible = append(visible, offers[i])
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"offer_count": len(visible),
+		"offers":      visible,
+	})
+}
+
+// getOffers lists the offers the caller made or received, most recently
+// active first. role=buyer or role=seller narrows it to one side and status
+// to one status.
+func (s *Server) getOffers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query, err := parseListQuery(r.URL.Query(), map[string]string{"date": "updated_at"}, "-date")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	userID := currentUserID(r)
+	switch role := r.URL.Query().Get("role"); role {
+	case "":
+	case "buyer", "seller":
+		query.filters = append(query.filters, fieldFilter{field: role + "_id", op: "$eq", value: userID})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "role must be buyer or seller"})
+		return
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query.filters = append(query.filters, fieldFilter{field: "status", op: "$eq", value: status})
+	}
+
+	offers, next, err := s.store.Offers.FindByParty(r.Context(), userID, query)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve offers"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"offer_count": len(offers),
+		"offers":      offers,
+		"next_cursor": next,
+	})
+}
+
+// getOffer returns one offer with its negotiation history, to its buyer,
+// its seller or an admin.
+func (s *Server) getOffer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	offer, err := s.store.Offers.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Offer not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load offer"})
+		return
+	}
+	if !canModify(r, offer.BuyerID) && !canModify(r, offer.SellerID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": errNotOfferer.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(offer)
+}
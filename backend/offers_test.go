@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOfferNegotiation(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+	tokens := map[string]string{}
+	for _, user := range []string{"alice", "bob", "carol", "dave"} {
+		tokens[user] = loginAs(t, s, user)
+	}
+	listing := testListing("alice")
+	listing.Version = 1
+	s.store.Listings.Create(ctx, &listing)
+	offers := "/api/marketplace/listings/" + listing.ID.Hex() + "/offers"
+
+	tests := []struct {
+		description  string
+		user         string
+		reqBody      string
+		expectedCode int
+	}{
+		{"Offer on own listing", "alice", `{"amount": 250}`, http.StatusBadRequest},
+		{"Missing amount", "bob", `{"note": "Interested"}`, http.StatusBadRequest},
+		{"Negative amount", "bob", `{"amount": -5}`, http.StatusBadRequest},
+		{"Too many decimals", "bob", `{"amount": 250.001}`, http.StatusBadRequest},
+		{"Valid offer", "bob", `{"amount": 250, "note": "Cash today"}`, http.StatusCreated},
+		{"Second open offer", "bob", `{"amount": 260}`, http.StatusConflict},
+		{"Another buyer", "carol", `{"amount": 240}`, http.StatusCreated},
+	}
+	for _, test := range tests {
+		rr := serve(r, "POST", offers, tokens[test.user], test.reqBody)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+
+	all, _ := s.store.Offers.ListByListing(ctx, listing.ID)
+	if !assert.Len(t, all, 2) {
+		return
+	}
+	bobOffer, carolOffer := all[0], all[1]
+	assert.Equal(t, offerPending, bobOffer.Status)
+	assert.Equal(t, "bob", bobOffer.BuyerID)
+	assert.Equal(t, "alice", bobOffer.SellerID)
+
+	var list struct {
+		Offers []Offer `json:"offers"`
+	}
+	rr := serve(r, "GET", offers, tokens["alice"], "")
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	assert.Len(t, list.Offers, 2, "the seller sees every offer")
+	rr = serve(r, "GET", offers, tokens["bob"], "")
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	assert.Len(t, list.Offers, 1, "buyers only see their own")
+
+	bobRoute := "/api/offers/" + bobOffer.ID.Hex()
+	steps := []struct {
+		description  string
+		user         string
+		action       string
+		reqBody      string
+		expectedCode int
+	}{
+		{"Buyer accepts before the seller", "bob", "/accept", ``, http.StatusConflict},
+		{"Stranger counters", "dave", "/counter", `{"amount": 280}`, http.StatusForbidden},
+		{"Counter without amount", "alice", "/counter", ``, http.StatusBadRequest},
+		{"Seller counters", "alice", "/counter", `{"amount": 280, "note": "Meet me halfway?"}`, http.StatusOK},
+		{"Seller accepts own counter", "alice", "/accept", ``, http.StatusConflict},
+		{"Buyer counters back", "bob", "/counter", `{"amount": 270}`, http.StatusOK},
+		{"Seller withdraws", "alice", "/withdraw", ``, http.StatusConflict},
+		{"Seller accepts", "alice", "/accept", ``, http.StatusOK},
+		{"Accept twice", "alice", "/accept", ``, http.StatusConflict},
+	}
+	for _, step := range steps {
+		rr := serve(r, "POST", bobRoute+step.action, tokens[step.user], step.reqBody)
+		assert.Equal(t, step.expectedCode, rr.Code, step.description)
+	}
+
+	rr = serve(r, "GET", bobRoute, tokens["bob"], "")
+	var accepted Offer
+	json.Unmarshal(rr.Body.Bytes(), &accepted)
+	assert.Equal(t, offerAccepted, accepted.Status)
+	fromStore, _ := s.store.Offers.Get(ctx, bobOffer.ID)
+	assert.Equal(t, money(270, "USD"), fromStore.Amount)
+	var actions []string
+	for _, event := range accepted.History {
+		actions = append(actions, event.Action)
+	}
+	assert.Equal(t, []string{offerActionOffer, offerActionCounter, offerActionCounter, offerActionAccept}, actions)
+	assert.Equal(t, "Meet me halfway?", accepted.History[1].Note)
+	assert.Equal(t, http.StatusForbidden, serve(r, "GET", bobRoute, tokens["dave"], "").Code)
+
+	stored, _ := s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, statusReserved, stored.currentStatus())
+	assert.Equal(t, "bob", stored.ReservedFor)
+	declined, _ := s.store.Offers.Get(ctx, carolOffer.ID)
+	assert.Equal(t, offerDeclined, declined.Status, "accepting one offer declines the rest")
+	assert.Equal(t, "system", declined.History[len(declined.History)-1].By)
+
+	rr = serve(r, "POST", offers, tokens["dave"], `{"amount": 300}`)
+	assert.Equal(t, http.StatusConflict, rr.Code, "reserved listings take no offers")
+
+	unread, _ := s.store.Notifications.CountUnread(ctx, "carol")
+	assert.Equal(t, 1, unread, "the declined buyer is told")
+
+	rr = serve(r, "GET", "/api/offers?role=buyer", tokens["carol"], "")
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	assert.Len(t, list.Offers, 1)
+	rr = serve(r, "GET", "/api/offers?role=seller", tokens["carol"], "")
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	assert.Empty(t, list.Offers)
+	assert.Equal(t, http.StatusBadRequest, serve(r, "GET", "/api/offers?role=admin", tokens["carol"], "").Code)
+}
+
+func TestOfferWithdrawAndExpiry(t *testing.T) {
+	s, r := newTestServer()
+	_, clock := newTestExpiry(s)
+	ctx := context.Background()
+	bob, carol := loginAs(t, s, "bob"), loginAs(t, s, "carol")
+	listing := testListing("alice")
+	listing.DatePosted = *clock
+	listing.Version = 1
+	s.store.Listings.Create(ctx, &listing)
+	offers := "/api/marketplace/listings/" + listing.ID.Hex() + "/offers"
+
+	var offer Offer
+	rr := serve(r, "POST", offers, bob, `{"amount": 200}`)
+	json.Unmarshal(rr.Body.Bytes(), &offer)
+	assert.Equal(t, clock.Add(offerWindow), offer.ExpiresAt)
+	assert.Equal(t, http.StatusOK, serve(r, "POST", "/api/offers/"+offer.ID.Hex()+"/withdraw", bob, "").Code)
+	assert.Equal(t, http.StatusCreated, serve(r, "POST", offers, bob, `{"amount": 210}`).Code, "a withdrawn offer can be replaced")
+
+	rr = serve(r, "POST", offers, carol, `{"amount": 190}`)
+	json.Unmarshal(rr.Body.Bytes(), &offer)
+
+	*clock = clock.Add(offerWindow - time.Minute)
+	assert.NoError(t, s.expiry.sweep(ctx))
+	stored, _ := s.store.Offers.Get(ctx, offer.ID)
+	assert.Equal(t, offerPending, stored.Status)
+
+	*clock = clock.Add(time.Minute)
+	assert.NoError(t, s.expiry.sweep(ctx))
+	stored, _ = s.store.Offers.Get(ctx, offer.ID)
+	assert.Equal(t, offerExpired, stored.Status)
+	assert.Equal(t, http.StatusConflict, serve(r, "POST", "/api/offers/"+offer.ID.Hex()+"/counter", loginAs(t, s, "alice"), `{"amount": 195}`).Code)
+
+	// An offer past its window expires when answered, before any sweep
+	rr = serve(r, "POST", offers, carol, `{"amount": 195}`)
+	json.Unmarshal(rr.Body.Bytes(), &offer)
+	*clock = clock.Add(offerWindow)
+	rr = serve(r, "POST", "/api/offers/"+offer.ID.Hex()+"/accept", loginAs(t, s, "alice"), "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	stored, _ = s.store.Offers.Get(ctx, offer.ID)
+	assert.Equal(t, offerExpired, stored.Status)
+	listed, _ := s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, statusActive, listed.currentStatus())
+}
+
+func TestOfferOnUnavailableListing(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+	alice, bob := loginAs(t, s, "alice"), loginAs(t, s, "bob")
+	listing := testListing("alice")
+	listing.Version = 1
+	s.store.Listings.Create(ctx, &listing)
+
+	var offer Offer
+	rr := serve(r, "POST", "/api/marketplace/listings/"+listing.ID.Hex()+"/offers", bob, `{"amount": 250}`)
+	json.Unmarshal(rr.Body.Bytes(), &offer)
+
+	// Withdrawn behind the offers' back, so the offer is still open
+	stored, _ := s.store.Listings.Get(ctx, listing.ID)
+	stored.Status = statusWithdrawn
+	s.store.Listings.Replace(ctx, stored, stored.Version)
+
+	rr = serve(r, "POST", "/api/offers/"+offer.ID.Hex()+"/accept", alice, "")
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	declined, _ := s.store.Offers.Get(ctx, offer.ID)
+	assert.Equal(t, offerDeclined, declined.Status)
+	stored, _ = s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, statusWithdrawn, stored.currentStatus())
+	assert.Empty(t, stored.ReservedFor)
+
+	var notes struct {
+		Notifications []Notification `json:"notifications"`
+	}
+	rr = serve(r, "GET", "/api/notifications", bob, "")
+	json.Unmarshal(rr.Body.Bytes(), &notes)
+	if assert.Len(t, notes.Notifications, 1, "the buyer is never told the offer was accepted") {
+		assert.Equal(t, `Offer declined on "Laptop for Sale"`, notes.Notifications[0].Title)
+	}
+}
+
+func TestDeleteListingDeclinesOffers(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+	alice, bob := loginAs(t, s, "alice"), loginAs(t, s, "bob")
+	listing := testListing("alice")
+	listing.Version = 1
+	s.store.Listings.Create(ctx, &listing)
+
+	var offer Offer
+	rr := serve(r, "POST", "/api/marketplace/listings/"+listing.ID.Hex()+"/offers", bob, `{"amount": 250}`)
+	json.Unmarshal(rr.Body.Bytes(), &offer)
+
+	assert.Equal(t, http.StatusOK, serve(r, "DELETE", "/api/deleteListing/"+listing.ID.Hex(), alice, "").Code)
+	stored, _ := s.store.Offers.Get(ctx, offer.ID)
+	assert.Equal(t, offerDeclined, stored.Status)
+	assert.Equal(t, "The listing was removed.", stored.History[len(stored.History)-1].Note)
+}
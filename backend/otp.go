@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errOTPNotFound        = errors.New("no code has been requested for this email")
+	errOTPExpired         = errors.New("code has expired")
+	errOTPInvalid         = errors.New("code is incorrect")
+	errOTPTooManyAttempts = errors.New("too many incorrect attempts, request a new code")
+	errOTPCooldown        = errors.New("a code was sent recently, try again shortly")
+)
+
+// otpRecord is the stored state of an outstanding one-time code. Only an
+// HMAC of the code is kept so a database dump does not reveal live codes.
+type otpRecord struct {
+	Email     string    `bson:"email"`
+	CodeHash  string    `bson:"code_hash"`
+	Attempts  int       `bson:"attempts"`
+	SentAt    time.Time `bson:"sent_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+type otpStore interface {
+	get(ctx context.Context, email string) (*otpRecord, error)
+	put(ctx context.Context, rec otpRecord) error
+	// claimAttempt counts one attempt at email's code if it is unexpired at
+	// now and has fewer than max attempts, returning the updated record, or
+	// nil if there is no such code. Only a claimed attempt may be checked,
+	// so concurrent guesses cannot get past the limit.
+	claimAttempt(ctx context.Context, email string, max int, now time.Time) (*otpRecord, error)
+	remove(ctx context.Context, email string) error
+}
+
+// OTPService issues and verifies email one-time codes.
+type OTPService struct {
+	store       otpStore
+	mailer      Mailer
+	secret      []byte
+	ttl         time.Duration
+	cooldown    time.Duration
+	maxAttempts int
+	now         func() time.Time
+}
+
+func newOTPService(store otpStore, mailer Mailer, secret []byte) *OTPService {
+	return &OTPService{
+		store:       store,
+		mailer:      mailer,
+		secret:      secret,
+		ttl:         10 * time.Minute,
+		cooldown:    60 * time.Second,
+		maxAttempts: 5,
+		now:         time.Now,
+	}
+}
+
+func (s *OTPService) hash(email, code string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(email + ":" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Issue generates a fresh code for email, stores its hash and mails it.
+// A new code replaces any earlier one, but not within the resend cooldown.
+func (s *OTPService) Issue(ctx context.Context, email string) error {
+	now := s.now()
+	existing, err := s.store.get(ctx, email)
+	if err != nil {
+		return err
+	}
+	if existing != nil && now.Sub(existing.SentAt) < s.cooldown {
+		return errOTPCooldown
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	rec := otpRecord{
+		Email:     email,
+		CodeHash:  s.hash(email, code),
+		SentAt:    now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	if err := s.store.put(ctx, rec); err != nil {
+		return err
+	}
+
+	return s.mailer.Send(ctx, MailMessage{
+		To:      email,
+		Subject: "Your UniMarketplace login code",
+		Body:    fmt.Sprintf("Your login code is %s. It expires in %d minutes.", code, int(s.ttl.Minutes())),
+	})
+}
+
+// Verify checks code against the outstanding code for email. A successful
+// verification consumes the code.
+func (s *OTPService) Verify(ctx context.Context, email, code string) error {
+	rec, err := s.store.claimAttempt(ctx, email, s.maxAttempts, s.now())
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		// Nothing was claimed; find out why
+		rec, err := s.store.get(ctx, email)
+		switch {
+		case err != nil:
+			return err
+		case rec == nil:
+			return errOTPNotFound
+		case !s.now().Before(rec.ExpiresAt):
+			return errOTPExpired
+		}
+		return errOTPTooManyAttempts
+	}
+	if !hmac.Equal([]byte(rec.CodeHash), []byte(s.hash(email, code))) {
+		if rec.Attempts >= s.maxAttempts {
+			return errOTPTooManyAttempts
+		}
+		return errOTPInvalid
+	}
+	return s.store.remove(ctx, email)
+}
+
+// otpSecret returns the configured key used to hash codes. Without one a
+// random key is generated, which invalidates outstanding codes on restart.
+func otpSecret(cfg Config) []byte {
+	if cfg.OTPSecret != "" {
+		return []byte(cfg.OTPSecret)
+	}
+	log.Println("OTP_SECRET is not set, using a random per-process key")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal(err)
+	}
+	return secret
+}
+
+// normalizeEmail lower-cases and validates an address from a request body.
+func normalizeEmail(raw string) (string, bool) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(raw))
+	if err != nil || addr.Name != "" {
+		return "", false
+	}
+	return strings.ToLower(addr.Address), true
+}
+
+// otpErrorStatus maps verification errors onto HTTP status codes.
+func otpErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errOTPCooldown), errors.Is(err, errOTPTooManyAttempts):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errOTPNotFound), errors.Is(err, errOTPExpired), errors.Is(err, errOTPInvalid):
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (s *Server) requestOTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	email, ok := normalizeEmail(req.Email)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid email address"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	if err := s.otp.Issue(ctx, email); err != nil {
+		status := otpErrorStatus(err)
+		msg := err.Error()
+		if status == http.StatusInternalServerError {
+			log.Printf("Failed to issue OTP: %v\n", err)
+			msg = "Failed to send code"
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Code sent"})
+}
+
+// mongoOTPStore keeps codes in the otp_codes collection. A TTL index on
+// expires_at lets MongoDB clean up codes that were never used.
+type mongoOTPStore struct {
+	collection *mongo.Collection
+}
+
+func newMongoOTPStore(ctx context.Context, db *mongo.Database) (*mongoOTPStore, error) {
+	collection := db.Collection("otp_codes")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoOTPStore{collection: collection}, nil
+}
+
+func (s *mongoOTPStore) get(ctx context.Context, email string) (*otpRecord, error) {
+	var rec otpRecord
+	err := s.collection.FindOne(ctx, bson.M{"email": email}).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *mongoOTPStore) put(ctx context.Context, rec otpRecord) error {
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"email": rec.Email}, rec, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoOTPStore) claimAttempt(ctx context.Context, email string, max int, now time.Time) (*otpRecord, error) {
+	filter := bson.M{"email": email, "attempts": bson.M{"$lt": max}, "expires_at": bson.M{"$gt": now}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var rec otpRecord
+	err := s.collection.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"attempts": 1}}, opts).Decode(&rec)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *mongoOTPStore) remove(ctx context.Context, email string) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"email": email})
+	return err
+}
+
+// memoryOTPStore is an in-process otpStore used by tests.
+type memoryOTPStore struct {
+	mu      sync.Mutex
+	records map[string]otpRecord
+}
+
+func newMemoryOTPStore() *memoryOTPStore {
+	return &memoryOTPStore{records: make(map[string]otpRecord)}
+}
+
+func (s *memoryOTPStore) get(ctx context.Context, email string) (*otpRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[email]
+	if !ok {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+func (s *memoryOTPStore) put(ctx context.Context, rec otpRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.Email] = rec
+	return nil
+}
+
+func (s *memoryOTPStore) claimAttempt(ctx context.Context, email string, max int, now time.Time) (*otpRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec, ok := s.records[email]
+	if !ok || rec.Attempts >= max || !now.Before(rec.ExpiresAt) {
+		return nil, nil
+	}
+	rec.Attempts++
+	s.records[email] = rec
+	return &rec, nil
+}
+
+func (s *memoryOTPStore) remove(ctx context.Context, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, email)
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMailer keeps sent messages in memory so tests can read codes back.
+type recordingMailer struct {
+	mu   sync.Mutex
+	sent []MailMessage
+	// err, when set, fails every send.
+	err error
+}
+
+func (m *recordingMailer) Send(ctx context.Context, msg MailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *recordingMailer) lastCode() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		return ""
+	}
+	return regexp.MustCompile(`\d{6}`).FindString(m.sent[len(m.sent)-1].Body)
+}
+
+func newTestOTPService() (*OTPService, *recordingMailer, *time.Time) {
+	mailer := &recordingMailer{}
+	svc := newOTPService(newMemoryOTPStore(), mailer, []byte("test-secret"))
+	now := time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC)
+	svc.now = func() time.Time { return now }
+	return svc, mailer, &now
+}
+
+func TestOTPIssueAndVerify(t *testing.T) {
+	svc, mailer, _ := newTestOTPService()
+	ctx := context.Background()
+
+	assert.NoError(t, svc.Issue(ctx, "student@ufl.edu"))
+	code := mailer.lastCode()
+	assert.Len(t, code, 6)
+
+	stored, _ := svc.store.get(ctx, "student@ufl.edu")
+	assert.NotContains(t, stored.CodeHash, code, "code must not be stored in clear text")
+
+	assert.NoError(t, svc.Verify(ctx, "student@ufl.edu", code))
+	assert.ErrorIs(t, svc.Verify(ctx, "student@ufl.edu", code), errOTPNotFound, "code is single use")
+}
+
+func TestOTPLimits(t *testing.T) {
+	tests := []struct {
+		description string
+		run         func(t *testing.T, svc *OTPService, mailer *recordingMailer, now *time.Time) error
+		expectedErr error
+	}{
+		{
+			description: "resend within cooldown",
+			run: func(t *testing.T, svc *OTPService, mailer *recordingMailer, now *time.Time) error {
+				*now = now.Add(10 * time.Second)
+				return svc.Issue(context.Background(), "a@ufl.edu")
+			},
+			expectedErr: errOTPCooldown,
+		},
+		{
+			description: "expired code",
+			run: func(t *testing.T, svc *OTPService, mailer *recordingMailer, now *time.Time) error {
+				*now = now.Add(11 * time.Minute)
+				return svc.Verify(context.Background(), "a@ufl.edu", mailer.lastCode())
+			},
+			expectedErr: errOTPExpired,
+		},
+		{
+			description: "too many wrong attempts locks the code",
+			run: func(t *testing.T, svc *OTPService, mailer *recordingMailer, now *time.Time) error {
+				for i := 0; i < 4; i++ {
+					assert.ErrorIs(t, svc.Verify(context.Background(), "a@ufl.edu", "bad"), errOTPInvalid)
+				}
+				assert.ErrorIs(t, svc.Verify(context.Background(), "a@ufl.edu", "bad"), errOTPTooManyAttempts)
+				return svc.Verify(context.Background(), "a@ufl.edu", mailer.lastCode())
+			},
+			expectedErr: errOTPTooManyAttempts,
+		},
+	}
+
+	for _, test := range tests {
+		svc, mailer, now := newTestOTPService()
+		assert.NoError(t, svc.Issue(context.Background(), "a@ufl.edu"), test.description)
+		assert.ErrorIs(t, test.run(t, svc, mailer, now), test.expectedErr, test.description)
+	}
+}
+
+// countingOTPStore counts the attempts Verify was allowed to check.
+type countingOTPStore struct {
+	*memoryOTPStore
+	mu      sync.Mutex
+	claimed int
+}
+
+func (s *countingOTPStore) claimAttempt(ctx context.Context, email string, max int, now time.Time) (*otpRecord, error) {
+	rec, err := s.memoryOTPStore.claimAttempt(ctx, email, max, now)
+	if rec != nil {
+		s.mu.Lock()
+		s.claimed++
+		s.mu.Unlock()
+	}
+	return rec, err
+}
+
+func TestOTPConcurrentGuesses(t *testing.T) {
+	svc, _, _ := newTestOTPService()
+	store := &countingOTPStore{memoryOTPStore: newMemoryOTPStore()}
+	svc.store = store
+	ctx := context.Background()
+	assert.NoError(t, svc.Issue(ctx, "a@ufl.edu"))
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	invalid := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errors.Is(svc.Verify(ctx, "a@ufl.edu", "000000x"), errOTPInvalid) {
+				mu.Lock()
+				invalid++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, svc.maxAttempts, store.claimed, "only maxAttempts guesses are checked")
+	assert.Equal(t, svc.maxAttempts-1, invalid)
+	rec, _ := store.get(ctx, "a@ufl.edu")
+	assert.Equal(t, svc.maxAttempts, rec.Attempts)
+}
+
+func TestOTPHandlers(t *testing.T) {
+	s, _ := newTestServer()
+	s.otp, _, _ = newTestOTPService()
+
+	tests := []struct {
+		description  string
+		route        string
+		expectedCode int
+		reqBody      string
+	}{
+		{
+			description:  "request code",
+			route:        "/api/auth/otp/request",
+			expectedCode: 200,
+			reqBody:      `{"email": "Student@UFL.edu"}`,
+		},
+		{
+			description:  "request code again within cooldown",
+			route:        "/api/auth/otp/request",
+			expectedCode: 429,
+			reqBody:      `{"email": "student@ufl.edu"}`,
+		},
+		{
+			description:  "request code for invalid email",
+			route:        "/api/auth/otp/request",
+			expectedCode: 400,
+			reqBody:      `{"email": "not-an-email"}`,
+		},
+		{
+			description:  "save user without code",
+			route:        "/api/saveUser",
+			expectedCode: 400,
+			reqBody:      `{"email": "student@ufl.edu"}`,
+		},
+		{
+			description:  "save user with wrong code",
+			route:        "/api/saveUser",
+			expectedCode: 401,
+			reqBody:      `{"email": "student@ufl.edu", "code": "000000x"}`,
+		},
+	}
+
+	r := newRouter(s)
+
+	for _, test := range tests {
+		rr := serve(r, "POST", test.route, "", test.reqBody)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// fieldFilter is one condition on a stored field, named by its bson path.
+// op is a MongoDB comparison operator: $eq, $gt, $gte, $lt, $lte, $in with
+// a bson.A value, where a nil element also matches a missing field, or
+// $elemMatch with a []fieldFilter value that one array element must pass.
+type fieldFilter struct {
+	field string
+	op    string
+	value interface{}
+}
+
+// listQuery describes a filtered, sorted page of documents independently of
+// the store. Results are ordered by sort and then _id, which makes the order
+// total so a cursor can resume exactly where the previous page ended.
+type listQuery struct {
+	filters []fieldFilter
+	sort    string
+	desc    bool
+	limit   int
+	after   *pageCursor
+}
+
+// pageCursor is the position after the last document of a page. It is handed
+// to clients as an opaque base64 token.
+type pageCursor struct {
+	Sort string  `json:"s"`
+	Desc bool    `json:"d"`
+	Kind string  `json:"k"`
+	Num  float64 `json:"n,omitempty"`
+	Str  string  `json:"v,omitempty"`
+	ID   string  `json:"id"`
+}
+
+func (c *pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	if _, err := primitive.ObjectIDFromHex(c.ID); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &c, nil
+}
+
+// value returns the cursor's sort value in the form stored documents use.
+func (c *pageCursor) value() interface{} {
+	switch c.Kind {
+	case "time":
+		return time.UnixMilli(int64(c.Num)).UTC()
+	case "num":
+		return c.Num
+	default:
+		return c.Str
+	}
+}
+
+func (c *pageCursor) objectID() primitive.ObjectID {
+	id, _ := primitive.ObjectIDFromHex(c.ID)
+	return id
+}
+
+// cursorAfter builds the cursor that resumes after doc.
+func cursorAfter(doc bson.M, q listQuery) *pageCursor {
+	c := &pageCursor{Sort: q.sort, Desc: q.desc}
+	if id, ok := doc["_id"].(primitive.ObjectID); ok {
+		c.ID = id.Hex()
+	}
+	switch v := normalizeValue(lookupPath(doc, q.sort)).(type) {
+	case float64:
+		c.Kind, c.Num = "num", v
+	case time.Time:
+		c.Kind, c.Num = "time", float64(v.UnixMilli())
+	case string:
+		c.Kind, c.Str = "str", v
+	}
+	return c
+}
+
+// toBSONMap converts a document to the generic form MongoDB would store, so
+// filters and cursors can read fields by their bson paths.
+func toBSONMap(doc interface{}) bson.M {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return bson.M{}
+	}
+	var m bson.M
+	bson.Unmarshal(data, &m)
+	return m
+}
+
+// lookupPath follows a dotted path through doc; numeric parts index arrays,
+// as in MongoDB.
+func lookupPath(doc bson.M, path string) interface{} {
+	var cur interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch c := cur.(type) {
+		case bson.M:
+			cur = c[part]
+		case bson.A:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil
+			}
+			cur = c[i]
+		default:
+			return nil
+		}
+	}
+	return cur
+}
+
+// normalizeValue maps the numeric and date types produced by the driver
+// onto float64 and time.Time so values can be compared.
+func normalizeValue(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	case primitive.DateTime:
+		return n.Time().UTC()
+	case time.Time:
+		return n.UTC()
+	}
+	return v
+}
+
+// compareValues orders a and b the way MongoDB does within one type. ok is
+// false when the values are not comparable.
+func compareValues(a, b interface{}) (cmp int, ok bool) {
+	a, b = normalizeValue(a), normalizeValue(b)
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case time.Time:
+		y, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		return x.Compare(y), true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case primitive.ObjectID:
+		y, ok := b.(primitive.ObjectID)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x.Hex(), y.Hex()), true
+	}
+	return 0, false
+}
+
+func (f fieldFilter) matches(doc bson.M) bool {
+	if f.op == "$elemMatch" {
+		elements, _ := lookupPath(doc, f.field).(bson.A)
+		for _, element := range elements {
+			if element, ok := element.(bson.M); ok && allMatch(f.value.([]fieldFilter), element) {
+				return true
+			}
+		}
+		return false
+	}
+	if f.op == "$in" {
+		v := lookupPath(doc, f.field)
+		for _, candidate := range f.value.(bson.A) {
+			if candidate == nil && v == nil {
+				return true
+			}
+			if cmp, ok := compareValues(v, candidate); ok && cmp == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	cmp, ok := compareValues(lookupPath(doc, f.field), f.value)
+	if !ok {
+		return false
+	}
+	switch f.op {
+	case "$eq":
+		return cmp == 0
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	case "$lte":
+		return cmp <= 0
+	}
+	return false
+}
+
+func allMatch(filters []fieldFilter, doc bson.M) bool {
+	for _, f := range filters {
+		if !f.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// mongoCondition translates f into the condition on its field.
+func (f fieldFilter) mongoCondition() bson.M {
+	if f.op != "$elemMatch" {
+		return bson.M{f.op: f.value}
+	}
+	element := bson.M{}
+	for _, sub := range f.value.([]fieldFilter) {
+		element[sub.field] = sub.mongoCondition()
+	}
+	return bson.M{"$elemMatch": element}
+}
+
+// mongoFilter translates the query's filters and cursor into a MongoDB
+// filter document.
+func (q listQuery) mongoFilter() bson.M {
+	and := bson.A{}
+	for _, f := range q.filters {
+		and = append(and, bson.M{f.field: f.mongoCondition()})
+	}
+	if q.after != nil {
+		op := "$gt"
+		if q.desc {
+			op = "$lt"
+		}
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{q.sort: bson.M{op: q.after.value()}},
+			bson.M{q.sort: q.after.value(), "_id": bson.M{op: q.after.objectID()}},
+		}})
+	}
+	if len(and) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": and}
+}
+
+func (q listQuery) mongoSort() bson.D {
+	dir := 1
+	if q.desc {
+		dir = -1
+	}
+	return bson.D{{Key: q.sort, Value: dir}, {Key: "_id", Value: dir}}
+}
+
+// applyInMemory runs q over documents already converted with toBSONMap and
+// returns the indexes of the page's documents, plus whether more follow.
+func (q listQuery) applyInMemory(docs []bson.M) (page []int, more bool) {
+	var matched []int
+	for i, doc := range docs {
+		if allMatch(q.filters, doc) {
+			matched = append(matched, i)
+		}
+	}
+
+	less := func(a, b bson.M) bool {
+		cmp, _ := compareValues(lookupPath(a, q.sort), lookupPath(b, q.sort))
+		if cmp == 0 {
+			cmp, _ = compareValues(a["_id"], b["_id"])
+		}
+		if q.desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return less(docs[matched[i]], docs[matched[j]]) })
+
+	if q.after != nil {
+		marker := bson.M{"_id": q.after.objectID()}
+		setPath(marker, q.sort, q.after.value())
+		start := sort.Search(len(matched), func(i int) bool { return less(marker, docs[matched[i]]) })
+		matched = matched[start:]
+	}
+
+	if q.limit > 0 && len(matched) > q.limit {
+		return matched[:q.limit], true
+	}
+	return matched, false
+}
+
+func setPath(doc bson.M, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(bson.M)
+		if !ok {
+			next = bson.M{}
+			doc[part] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = value
+}
+
+// parseListQuery reads limit, cursor and sort from the URL. sortFields maps
+// the public sort names to bson paths; sort=price sorts ascending and
+// sort=-price descending. defaultSort is used when no sort is given.
+func parseListQuery(values url.Values, sortFields map[string]string, defaultSort string) (listQuery, error) {
+	q := listQuery{limit: defaultPageSize}
+
+	if v := values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.limit = n
+	}
+
+	sortParam := values.Get("sort")
+	if sortParam == "" {
+		sortParam = defaultSort
+	}
+	name := strings.TrimPrefix(sortParam, "-")
+	field, ok := sortFields[name]
+	if !ok {
+		names := make([]string, 0, len(sortFields))
+		for n := range sortFields {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return q, fmt.Errorf("sort must be one of %s, optionally prefixed with -", strings.Join(names, ", "))
+	}
+	q.sort, q.desc = field, strings.HasPrefix(sortParam, "-")
+
+	if token := values.Get("cursor"); token != "" {
+		c, err := decodeCursor(token)
+		if err != nil {
+			return q, err
+		}
+		if c.Sort != q.sort || c.Desc != q.desc {
+			return q, errors.New("cursor was issued for a different sort order")
+		}
+		q.after = c
+	}
+	return q, nil
+}
+
+// addEquals filters field on the URL parameter param when it is present.
+func (q *listQuery) addEquals(values url.Values, param, field string) {
+	if v := strings.TrimSpace(values.Get(param)); v != "" {
+		q.filters = append(q.filters, fieldFilter{field: field, op: "$eq", value: v})
+	}
+}
+
+// addMoneyRange filters field, a Money, to amounts of currency between the
+// decimal amounts in minParam and maxParam. Amounts in other currencies are
+// not comparable, so any bound also restricts results to currency.
+func (q *listQuery) addMoneyRange(values url.Values, minParam, maxParam, field, currencyField, currency string) error {
+	bounded := false
+	for _, bound := range []struct{ param, op string }{{minParam, "$gte"}, {maxParam, "$lte"}} {
+		v := values.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		m, err := parseMoney(v, currency)
+		if err != nil || m.Minor < 0 {
+			return fmt.Errorf("%s must be a non-negative amount of %s", bound.param, currency)
+		}
+		q.filters = append(q.filters, fieldFilter{field: field + ".minor", op: bound.op, value: m.Minor})
+		bounded = true
+	}
+	if bounded {
+		q.filters = append(q.filters, fieldFilter{field: currencyField, op: "$eq", value: currency})
+	}
+	return nil
+}
+
+// currencyParam reads a currency code query parameter, falling back to def.
+func currencyParam(values url.Values, param, def string) (string, error) {
+	code := normalizeCurrency(values.Get(param))
+	if code == "" {
+		return def, nil
+	}
+	if !isCurrency(code) {
+		return "", fmt.Errorf("%s must be an ISO 4217 currency code", param)
+	}
+	return code, nil
+}
+
+// addDateBound filters field with op against the date in param, given as
+// YYYY-MM-DD or RFC 3339.
+func (q *listQuery) addDateBound(values url.Values, param, op, field string) error {
+	v := values.Get(param)
+	if v == "" {
+		return nil
+	}
+	t, err := parseDateParam(v)
+	if err != nil {
+		return fmt.Errorf("%s must be a date (YYYY-MM-DD)", param)
+	}
+	q.filters = append(q.filters, fieldFilter{field: field, op: op, value: t})
+	return nil
+}
+
+// addAvailability keeps subleases with an availability window covering the
+// whole of available_from to available_to. Either alone asks for that day.
+func (q *listQuery) addAvailability(values url.Values) error {
+	from, to := values.Get("available_from"), values.Get("available_to")
+	if from == "" && to == "" {
+		return nil
+	}
+	if from == "" {
+		from = to
+	}
+	if to == "" {
+		to = from
+	}
+	var stay DateRange
+	var err error
+	if stay.StartDate, err = parseDateParam(from); err != nil {
+		return errors.New("available_from must be a date (YYYY-MM-DD)")
+	}
+	if stay.EndDate, err = parseDateParam(to); err != nil {
+		return errors.New("available_to must be a date (YYYY-MM-DD)")
+	}
+	if stay.EndDate.Before(stay.StartDate) {
+		return errors.New("available_to cannot be before available_from")
+	}
+	q.filters = append(q.filters, fieldFilter{field: "open_windows", op: "$elemMatch", value: []fieldFilter{
+		{field: "start_date", op: "$lte", value: stay.StartDate},
+		{field: "end_date", op: "$gte", value: stay.EndDate},
+	}})
+	return nil
+}
+
+func parseDateParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// listingQueryFromURL parses the marketplace listing filters: category,
+// condition, currency, min_price, max_price, city, state and status. Only
+// active listings are returned unless status names another one or is "all".
+// Price bounds are in currency, USD unless given.
+func listingQueryFromURL(values url.Values) (listQuery, error) {
+	q, err := parseListQuery(values, map[string]string{"date": "date_posted", "price": "price.minor"}, "-date")
+	if err != nil {
+		return q, err
+	}
+	switch status := values.Get("status"); status {
+	case "all":
+	case "", statusActive:
+		q.filters = append(q.filters, fieldFilter{field: "status", op: "$in", value: bson.A{statusActive, nil}})
+	default:
+		if _, ok := listingTransitions[status]; !ok {
+			return q, fmt.Errorf("unknown status %q", status)
+		}
+		q.filters = append(q.filters, fieldFilter{field: "status", op: "$eq", value: status})
+	}
+	q.addEquals(values, "category", "category")
+	q.addEquals(values, "condition", "condition")
+	q.addEquals(values, "city", "location.city")
+	q.addEquals(values, "state", "location.state")
+	currency, err := currencyParam(values, "currency", defaultCurrency)
+	if err != nil {
+		return q, err
+	}
+	if values.Get("currency") != "" {
+		q.filters = append(q.filters, fieldFilter{field: "currency", op: "$eq", value: currency})
+	}
+	return q, q.addMoneyRange(values, "min_price", "max_price", "price", "currency", currency)
+}
+
+// exchangeQueryFromURL parses the currency exchange filters: from_currency,
+// to_currency, min_amount, max_amount and status. Amount bounds are in
+// from_currency, which they therefore require. Only open requests are
+// listed unless status names another one or is "all".
+func exchangeQueryFromURL(values url.Values) (listQuery, error) {
+	q, err := parseListQuery(values, map[string]string{"date": "request_date", "amount": "amount.minor"}, "-date")
+	if err != nil {
+		return q, err
+	}
+	switch status := values.Get("status"); status {
+	case "all":
+	case "", exchangeOpen:
+		q.filters = append(q.filters, fieldFilter{field: "status", op: "$in", value: bson.A{exchangeOpen, nil}})
+	case exchangeMatched:
+		q.filters = append(q.filters, fieldFilter{field: "status", op: "$in", value: bson.A{exchangeMatched, exchangeLegacyFilled}})
+	case exchangeMeetingScheduled, exchangeCompleted, exchangeCancelled, exchangeDisputed:
+		q.filters = append(q.filters, fieldFilter{field: "status", op: "$eq", value: status})
+	default:
+		return q, fmt.Errorf("unknown status %q", status)
+	}
+	for _, param := range []string{"from_currency", "to_currency"} {
+		if v := values.Get(param); v != "" {
+			values.Set(param, strings.ToUpper(v))
+		}
+	}
+	q.addEquals(values, "from_currency", "from_currency")
+	q.addEquals(values, "to_currency", "to_currency")
+	if values.Get("min_amount") == "" && values.Get("max_amount") == "" {
+		return q, nil
+	}
+	from, err := currencyParam(values, "from_currency", "")
+	if err != nil {
+		return q, err
+	}
+	if from == "" {
+		return q, errors.New("min_amount and max_amount need from_currency")
+	}
+	return q, q.addMoneyRange(values, "min_amount", "max_amount", "amount", "from_currency", from)
+}
+
+// subleaseQueryFromURL parses the sublease filters: city, state, currency,
+// min_rent, max_rent, status, a date window where start_after and
+// end_before bound the lease period, and available_from and available_to,
+// a stay that one availability window must cover. Rent bounds are in
+// currency, USD unless given. Expired subleases are hidden unless status is
+// "expired" or "all".
+func subleaseQueryFromURL(values url.Values) (listQuery, error) {
+	q, err := parseListQuery(values, map[string]string{"date": "date_posted", "rent": "rent.minor"}, "-date")
+	if err != nil {
+		return q, err
+	}
+	switch status := values.Get("status"); status {
+	case "all":
+	case "", statusActive:
+		q.filters = append(q.filters, fieldFilter{field: "status", op: "$in", value: bson.A{statusActive, nil}})
+	case statusExpired:
+		q.filters = append(q.filters, fieldFilter{field: "status", op: "$eq", value: status})
+	default:
+		return q, fmt.Errorf("unknown status %q", status)
+	}
+	q.addEquals(values, "city", "location.city")
+	q.addEquals(values, "state", "location.state")
+	currency, err := currencyParam(values, "currency", defaultCurrency)
+	if err != nil {
+		return q, err
+	}
+	if values.Get("currency") != "" {
+		q.filters = append(q.filters, fieldFilter{field: "currency", op: "$eq", value: currency})
+	}
+	if err := q.addMoneyRange(values, "min_rent", "max_rent", "rent", "currency", currency); err != nil {
+		return q, err
+	}
+	if err := q.addDateBound(values, "start_after", "$gte", "period.start_date"); err != nil {
+		return q, err
+	}
+	if err := q.addAvailability(values); err != nil {
+		return q, err
+	}
+	return q, q.addDateBound(values, "end_before", "$lte", "period.end_date")
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type listingPage struct {
+	Count      int                  `json:"listing_count"`
+	Listings   []MarketplaceListing `json:"listings"`
+	NextCursor string               `json:"next_cursor"`
+}
+
+func TestListingPagination(t *testing.T) {
+	s, r := newTestServer()
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, price := range []float64{50, 20, 20, 90, 10} {
+		listing := testListing("alice")
+		listing.Price = money(price, "USD")
+		listing.DatePosted = base.Add(time.Duration(i) * time.Hour)
+		s.store.Listings.Create(context.Background(), &listing)
+	}
+
+	var prices []string
+	route := "/api/getMarketplaceListings?sort=price&limit=2"
+	for pages := 0; route != ""; pages++ {
+		assert.Less(t, pages, 3, "three pages cover five listings")
+		rr := serve(r, "GET", route, "", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var page listingPage
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		assert.Equal(t, len(page.Listings), page.Count)
+		for _, l := range page.Listings {
+			prices = append(prices, l.Price.String())
+		}
+		route = ""
+		if page.NextCursor != "" {
+			route = "/api/getMarketplaceListings?sort=price&limit=2&cursor=" + url.QueryEscape(page.NextCursor)
+		}
+	}
+	assert.Equal(t, []string{"10.00", "20.00", "20.00", "50.00", "90.00"}, prices)
+
+	rr := serve(r, "GET", "/api/getMarketplaceListings?limit=1", "", "")
+	var newest listingPage
+	json.Unmarshal(rr.Body.Bytes(), &newest)
+	assert.Equal(t, "10.00", newest.Listings[0].Price.String(), "newest first by default")
+
+	rr = serve(r, "GET", "/api/getMarketplaceListings?sort=-price&cursor="+url.QueryEscape(newest.NextCursor), "", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "cursor from another sort order")
+}
+
+func TestListingFilters(t *testing.T) {
+	s, r := newTestServer()
+	desk := testListing("alice")
+	desk.Category, desk.Condition, desk.Price = "Furniture", "New", money(120, "USD")
+	desk.Location.City = "Tampa"
+	s.store.Listings.Create(context.Background(), &desk)
+	laptop := testListing("bob")
+	s.store.Listings.Create(context.Background(), &laptop)
+
+	tests := []struct {
+		description  string
+		route        string
+		expectedCode int
+		expectedIDs  []string
+	}{
+		{"Filter by category", "/api/getMarketplaceListings?category=Furniture", http.StatusOK, []string{desk.ID.Hex()}},
+		{"Filter by condition", "/api/getMarketplaceListings?condition=Used", http.StatusOK, []string{laptop.ID.Hex()}},
+		{"Filter by price range", "/api/getMarketplaceListings?min_price=100&max_price=200", http.StatusOK, []string{desk.ID.Hex()}},
+		{"Filter by city and state", "/api/getMarketplaceListings?city=Gainesville&state=FL", http.StatusOK, []string{laptop.ID.Hex()}},
+		{"No match", "/api/getMarketplaceListings?category=Books", http.StatusOK, []string{}},
+		{"Invalid price", "/api/getMarketplaceListings?min_price=cheap", http.StatusBadRequest, nil},
+		{"Invalid limit", "/api/getMarketplaceListings?limit=1000", http.StatusBadRequest, nil},
+		{"Unknown sort", "/api/getMarketplaceListings?sort=rent", http.StatusBadRequest, nil},
+		{"Invalid cursor", "/api/getMarketplaceListings?cursor=abc", http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		rr := serve(r, "GET", test.route, "", "")
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+		if test.expectedIDs == nil {
+			continue
+		}
+		var page listingPage
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		ids := []string{}
+		for _, l := range page.Listings {
+			ids = append(ids, l.ID.Hex())
+		}
+		assert.Equal(t, test.expectedIDs, ids, test.description)
+	}
+}
+
+func TestExchangeAndSubleaseFilters(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+	s.store.Exchanges.Create(ctx, &CurrencyExchangeRequest{UserID: "alice", Amount: money(100, "USD"), FromCurrency: "USD", ToCurrency: "INR"})
+	s.store.Exchanges.Create(ctx, &CurrencyExchangeRequest{UserID: "bob", Amount: money(500, "EUR"), FromCurrency: "EUR", ToCurrency: "USD"})
+
+	rr := serve(r, "GET", "/api/currency/exchange/requests?from_currency=usd&to_currency=INR", "", "")
+	var requests struct {
+		Count    int                       `json:"request_count"`
+		Requests []CurrencyExchangeRequest `json:"requests"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &requests)
+	assert.Equal(t, 1, requests.Count)
+	assert.Equal(t, "alice", requests.Requests[0].UserID)
+
+	summer := SubleasingRequest{UserID: "alice", Rent: money(600, "USD"), Currency: "USD"}
+	summer.Period.StartDate = time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)
+	summer.Period.EndDate = time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	fall := SubleasingRequest{UserID: "bob", Rent: money(700, "USD"), Currency: "USD"}
+	fall.Period.StartDate = time.Date(2025, 8, 15, 0, 0, 0, 0, time.UTC)
+	fall.Period.EndDate = time.Date(2025, 12, 15, 0, 0, 0, 0, time.UTC)
+	s.store.Subleases.Create(ctx, &summer)
+	s.store.Subleases.Create(ctx, &fall)
+
+	tests := []struct {
+		description  string
+		route        string
+		expectedCode int
+		expectedUser string
+	}{
+		{"Window around summer", "/api/getSubleasingRequests?start_after=2025-04-01&end_before=2025-08-31", http.StatusOK, "alice"},
+		{"Starts after summer", "/api/getSubleasingRequests?start_after=2025-06-01", http.StatusOK, "bob"},
+		{"Rent range", "/api/getSubleasingRequests?min_rent=650", http.StatusOK, "bob"},
+		{"Invalid date", "/api/getSubleasingRequests?start_after=june", http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		rr := serve(r, "GET", test.route, "", "")
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+		if test.expectedUser == "" {
+			continue
+		}
+		var page struct {
+			Requests []SubleasingRequest `json:"requests"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		if assert.Len(t, page.Requests, 1, test.description) {
+			assert.Equal(t, test.expectedUser, page.Requests[0].UserID, test.description)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Rent periods: what one payment of SubleasingRequest.Rent covers.
+const (
+	rentMonthly = "monthly"
+	rentWeekly  = "weekly"
+	rentTotal   = "total"
+)
+
+// rentPeriod treats subleases saved before rent periods existed as monthly,
+// which is how students listed them.
+func (s *SubleasingRequest) rentPeriod() string {
+	if s.RentPeriod == "" {
+		return rentMonthly
+	}
+	return s.RentPeriod
+}
+
+// validateRentTerms checks the rent period and resolves utilities and the
+// deposit in the sublease's currency, which must already be set.
+func validateRentTerms(sublease *SubleasingRequest) string {
+	switch sublease.RentPeriod {
+	case "":
+		sublease.RentPeriod = rentMonthly
+	case rentMonthly, rentWeekly, rentTotal:
+	default:
+		return "rent_period must be monthly, weekly or total"
+	}
+	for _, fee := range []struct {
+		amount *Money
+		field  string
+	}{{&sublease.Utilities, "utilities"}, {&sublease.Deposit, "deposit"}} {
+		if err := fee.amount.resolve(sublease.Currency); err != nil {
+			return "Invalid " + fee.field + ": " + err.Error()
+		}
+		if fee.amount.Minor < 0 {
+			return fee.field + " cannot be negative"
+		}
+	}
+	return ""
+}
+
+// QuoteLine is the rent and utilities for one stretch of a stay: a calendar
+// month for monthly rent, otherwise the whole stay.
+type QuoteLine struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Days      int       `json:"days"`
+	Prorated  bool      `json:"prorated"`
+	Rent      Money     `json:"rent"`
+	Utilities Money     `json:"utilities"`
+}
+
+// RentQuote is the cost of staying in a sublease from From to To, both
+// days included. Total is rent plus utilities; the refundable deposit is
+// listed apart and added in DueTotal. MonthlyEquivalent spreads Total over
+// an average month so subleases of different lengths can be compared.
+type RentQuote struct {
+	SubleaseID        primitive.ObjectID `json:"sublease_id"`
+	From              time.Time          `json:"from"`
+	To                time.Time          `json:"to"`
+	Days              int                `json:"days"`
+	Currency          string             `json:"currency"`
+	RentPeriod        string             `json:"rent_period"`
+	Lines             []QuoteLine        `json:"breakdown"`
+	Rent              Money              `json:"rent"`
+	Utilities         Money              `json:"utilities"`
+	Deposit           Money              `json:"deposit"`
+	Total             Money              `json:"total"`
+	DueTotal          Money              `json:"due_total"`
+	MonthlyEquivalent Money              `json:"monthly_equivalent"`
+}
+
+var errStayUnavailable = errors.New("the sublease is not available for the whole stay")
+
+// dayCount is the number of days from from to to, both included.
+func dayCount(from, to time.Time) int {
+	return int(to.Sub(from).Hours()/24+0.5) + 1
+}
+
+// prorate is amount scaled by part/whole, rounded half up.
+func prorate(amount int64, part, whole int) int64 {
+	return (amount*int64(part)*2 + int64(whole)) / (int64(whole) * 2)
+}
+
+// quoteStay prices a stay. Monthly rent is charged in full for each whole
+// calendar month and by the day for partial ones, weekly rent by the day at
+// a seventh of a week, and total rent by the day across the rental period.
+func quoteStay(sublease *SubleasingRequest, stay DateRange) (*RentQuote, error) {
+	windows := sublease.OpenWindows
+	if len(windows) == 0 {
+		windows = []DateRange{sublease.Period}
+	}
+	available := false
+	for _, w := range windows {
+		available = available || w.covers(stay)
+	}
+	if !available {
+		return nil, errStayUnavailable
+	}
+
+	currency := sublease.Currency
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	q := &RentQuote{
+		SubleaseID: sublease.ID,
+		From:       stay.StartDate,
+		To:         stay.EndDate,
+		Days:       dayCount(stay.StartDate, stay.EndDate),
+		Currency:   currency,
+		RentPeriod: sublease.rentPeriod(),
+	}
+	line := func(from, to time.Time, part, whole int) {
+		q.Lines = append(q.Lines, QuoteLine{
+			From:      from,
+			To:        to,
+			Days:      dayCount(from, to),
+			Prorated:  part != whole,
+			Rent:      Money{Minor: prorate(sublease.Rent.Minor, part, whole), Currency: currency},
+			Utilities: Money{Minor: prorate(sublease.Utilities.Minor, part, whole), Currency: currency},
+		})
+	}
+	switch q.RentPeriod {
+	case rentMonthly:
+		for from := stay.StartDate; !from.After(stay.EndDate); {
+			monthStart := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+			monthEnd := monthStart.AddDate(0, 1, -1)
+			to := monthEnd
+			if stay.EndDate.Before(to) {
+				to = stay.EndDate
+			}
+			line(from, to, dayCount(from, to), monthEnd.Day())
+			from = to.AddDate(0, 0, 1)
+		}
+	case rentWeekly:
+		line(stay.StartDate, stay.EndDate, q.Days, 7)
+	case rentTotal:
+		line(stay.StartDate, stay.EndDate, q.Days, dayCount(sublease.Period.StartDate, sublease.Period.EndDate))
+	}
+
+	rent, utilities := int64(0), int64(0)
+	for _, l := range q.Lines {
+		rent += l.Rent.Minor
+		utilities += l.Utilities.Minor
+	}
+	q.Rent = Money{Minor: rent, Currency: currency}
+	q.Utilities = Money{Minor: utilities, Currency: currency}
+	q.Deposit = Money{Minor: sublease.Deposit.Minor, Currency: currency}
+	q.Total = Money{Minor: rent + utilities, Currency: currency}
+	q.DueTotal = Money{Minor: q.Total.Minor + q.Deposit.Minor, Currency: currency}
+	// An average month is 365/12 days
+	q.MonthlyEquivalent = Money{Minor: prorate(q.Total.Minor*365, 1, 12*q.Days), Currency: currency}
+	return q, nil
+}
+
+// getSubleaseQuote prices a stay given by from and to (YYYY-MM-DD, both
+// included), defaulting to the whole rental period.
+func (s *Server) getSubleaseQuote(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	sublease, err := s.store.Subleases.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Sublease not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load sublease"})
+		return
+	}
+
+	stay := DateRange{StartDate: civilDate(sublease.Period.StartDate), EndDate: civilDate(sublease.Period.EndDate)}
+	for _, param := range []struct {
+		name string
+		date *time.Time
+	}{{"from", &stay.StartDate}, {"to", &stay.EndDate}} {
+		if v := r.URL.Query().Get(param.name); v != "" {
+			t, err := parseDateParam(v)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": param.name + " must be a date (YYYY-MM-DD)"})
+				return
+			}
+			*param.date = civilDate(t)
+		}
+	}
+	if stay.EndDate.Before(stay.StartDate) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "to cannot be before from"})
+		return
+	}
+
+	quote, err := quoteStay(sublease, stay)
+	if errors.Is(err, errStayUnavailable) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(quote)
+}
+
+// civilDate is the UTC calendar day of t, at midnight.
+func civilDate(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuoteStay(t *testing.T) {
+	sublease := SubleasingRequest{
+		Rent:      money(900, "USD"),
+		Utilities: money(62, "USD"),
+		Deposit:   money(500, "USD"),
+		Currency:  "USD",
+		Period:    DateRange{StartDate: day(5, 1), EndDate: day(8, 31)},
+	}
+	normalizeAvailability(&sublease)
+
+	quote, err := quoteStay(&sublease, DateRange{StartDate: day(6, 1), EndDate: day(8, 10)})
+	assert.NoError(t, err)
+	assert.Equal(t, 71, quote.Days)
+	if assert.Len(t, quote.Lines, 3) {
+		assert.False(t, quote.Lines[0].Prorated, "June is a whole month")
+		assert.Equal(t, "900.00", quote.Lines[1].Rent.String())
+		assert.True(t, quote.Lines[2].Prorated)
+		assert.Equal(t, 10, quote.Lines[2].Days)
+		assert.Equal(t, "290.32", quote.Lines[2].Rent.String(), "10/31 of 900")
+		assert.Equal(t, "20.00", quote.Lines[2].Utilities.String())
+	}
+	assert.Equal(t, "2090.32", quote.Rent.String())
+	assert.Equal(t, "144.00", quote.Utilities.String())
+	assert.Equal(t, "2234.32", quote.Total.String())
+	assert.Equal(t, "2734.32", quote.DueTotal.String())
+	assert.Equal(t, "957.19", quote.MonthlyEquivalent.String())
+
+	midMonth, _ := quoteStay(&sublease, DateRange{StartDate: day(5, 20), EndDate: day(6, 9)})
+	if assert.Len(t, midMonth.Lines, 2) {
+		assert.Equal(t, "348.39", midMonth.Lines[0].Rent.String(), "12/31 of May")
+		assert.Equal(t, "270.00", midMonth.Lines[1].Rent.String(), "9/30 of June")
+	}
+
+	sublease.RentPeriod = rentWeekly
+	weekly, _ := quoteStay(&sublease, DateRange{StartDate: day(6, 1), EndDate: day(6, 10)})
+	assert.Equal(t, "1285.71", weekly.Rent.String())
+
+	sublease.RentPeriod = rentTotal
+	total, _ := quoteStay(&sublease, sublease.Period)
+	assert.Equal(t, "900.00", total.Rent.String(), "the whole period costs the total")
+
+	_, err = quoteStay(&sublease, DateRange{StartDate: day(8, 1), EndDate: day(9, 15)})
+	assert.ErrorIs(t, err, errStayUnavailable)
+}
+
+func TestGetSubleaseQuote(t *testing.T) {
+	s, r := newTestServer()
+	token := loginAs(t, s, "alice")
+	rr := serve(r, "POST", "/api/subleasing", token, `{"title": "Studio", "description": "Near campus", "location": {"city": "Gainesville", "state": "FL", "country": "USA"},
+		"rent": 200, "rent_period": "weekly", "deposit": 100, "period": {"start_date": "2025-06-01T00:00:00Z", "end_date": "2025-06-28T00:00:00Z"}}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var sublease SubleasingRequest
+	json.Unmarshal(rr.Body.Bytes(), &sublease)
+	route := "/api/subleasing/" + sublease.ID.Hex() + "/quote"
+
+	tests := []struct {
+		description  string
+		query        string
+		expectedCode int
+		expectedDue  string
+	}{
+		{"Whole period", "", http.StatusOK, "900.00"},
+		{"Two weeks", "?from=2025-06-08&to=2025-06-21", http.StatusOK, "500.00"},
+		{"Beyond the period", "?from=2025-06-20&to=2025-07-05", http.StatusBadRequest, ""},
+		{"Backwards", "?from=2025-06-20&to=2025-06-10", http.StatusBadRequest, ""},
+		{"Invalid date", "?from=june", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		rr := serve(r, "GET", route+test.query, "", "")
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+		if test.expectedDue != "" {
+			var quote RentQuote
+			json.Unmarshal(rr.Body.Bytes(), &quote)
+			assert.Equal(t, test.expectedDue, quote.DueTotal.String(), test.description)
+		}
+	}
+
+	rr = serve(r, "POST", "/api/subleasing", token, `{"title": "Room", "description": "Near campus", "location": {"city": "Gainesville", "state": "FL", "country": "USA"},
+		"rent": 200, "rent_period": "daily", "period": {"start_date": "2025-06-01T00:00:00Z", "end_date": "2025-06-28T00:00:00Z"}}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// Dates sent with a time of day and an offset still quote by calendar day
+	rr = serve(r, "POST", "/api/subleasing", token, `{"title": "Loft", "description": "Near campus", "location": {"city": "Gainesville", "state": "FL", "country": "USA"},
+		"rent": 200, "rent_period": "weekly", "deposit": 100, "period": {"start_date": "2025-06-01T09:30:00-04:00", "end_date": "2025-06-28T18:00:00-04:00"},
+		"availability": [{"start_date": "2025-06-01T09:30:00-04:00", "end_date": "2025-06-28T18:00:00-04:00"}]}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &sublease)
+	assert.Equal(t, "2025-06-01T00:00:00Z", sublease.Period.StartDate.Format(time.RFC3339))
+	rr = serve(r, "GET", "/api/subleasing/"+sublease.ID.Hex()+"/quote", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var quote RentQuote
+	json.Unmarshal(rr.Body.Bytes(), &quote)
+	assert.Equal(t, "900.00", quote.DueTotal.String())
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoRate is returned when a provider has no rate for a currency pair.
+var errNoRate = errors.New("no exchange rate for this currency pair")
+
+// RateTable holds the rates from one base currency, as units of each quote
+// currency per unit of Base.
+type RateTable struct {
+	Base   string             `json:"base"`
+	Rates  map[string]float64 `json:"rates"`
+	AsOf   time.Time          `json:"as_of"`
+	Source string             `json:"source"`
+}
+
+// rebase returns the table with base as its base currency, deriving cross
+// rates through the current base.
+func (t RateTable) rebase(base string) (RateTable, error) {
+	if t.Base == base {
+		return t, nil
+	}
+	via, ok := t.Rates[base]
+	if !ok || via <= 0 {
+		return RateTable{}, fmt.Errorf("%w: %s", errNoRate, base)
+	}
+	rates := map[string]float64{t.Base: 1 / via}
+	for code, rate := range t.Rates {
+		if code != base {
+			rates[code] = rate / via
+		}
+	}
+	return RateTable{Base: base, Rates: rates, AsOf: t.AsOf, Source: t.Source}, nil
+}
+
+// RateProvider quotes exchange rates. Implementations may be slow or
+// unavailable; wrap them in a cachingRateProvider before serving requests.
+type RateProvider interface {
+	Rates(ctx context.Context, base string) (RateTable, error)
+}
+
+// rateBetween returns how many units of to one unit of from buys.
+func rateBetween(ctx context.Context, provider RateProvider, from, to string) (float64, time.Time, error) {
+	if from == to {
+		return 1, time.Now(), nil
+	}
+	table, err := provider.Rates(ctx, from)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	rate, ok := table.Rates[to]
+	if !ok || rate <= 0 {
+		return 0, time.Time{}, fmt.Errorf("%w: %s/%s", errNoRate, from, to)
+	}
+	return rate, table.AsOf, nil
+}
+
+// fixtureRates are approximate mid-market rates against the US dollar, used
+// when no rate source is configured so development and tests work offline.
+var fixtureRates = RateTable{
+	Base:   "USD",
+	AsOf:   time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC),
+	Source: "fixture",
+	Rates: map[string]float64{
+		"USD": 1, "EUR": 0.925, "GBP": 0.774, "INR": 85.5, "CNY": 7.27,
+		"JPY": 149.6, "KRW": 1466, "CAD": 1.43, "AUD": 1.59, "MXN": 20.4,
+		"BRL": 5.7, "CHF": 0.883, "SGD": 1.34, "HKD": 7.78, "NGN": 1535,
+		"PKR": 280.3, "BDT": 121.5, "NPR": 136.8, "VND": 25560, "TWD": 33.2,
+		"TRY": 38, "SAR": 3.75, "AED": 3.67, "EGP": 50.6, "COP": 4180,
+	},
+}
+
+// fixtureRateProvider serves a fixed table, either the built-in fixture or
+// one loaded from a JSON file in RateTable form.
+type fixtureRateProvider struct {
+	table RateTable
+}
+
+func newFixtureRateProvider(table RateTable) *fixtureRateProvider {
+	return &fixtureRateProvider{table: table}
+}
+
+// newFileRateProvider loads a rate table from path. Unknown currency codes
+// and non-positive rates are rejected so a typo does not go unnoticed.
+func newFileRateProvider(path string) (*fixtureRateProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rates file: %w", err)
+	}
+	var table RateTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return nil, fmt.Errorf("parsing rates file %s: %w", path, err)
+	}
+	table.Base = normalizeCurrency(table.Base)
+	if !isCurrency(table.Base) {
+		return nil, fmt.Errorf("rates file %s: unknown base currency %q", path, table.Base)
+	}
+	for code, rate := range table.Rates {
+		if !isCurrency(code) || rate <= 0 {
+			return nil, fmt.Errorf("rates file %s: invalid rate for %q", path, code)
+		}
+	}
+	if table.Source == "" {
+		table.Source = "file"
+	}
+	return newFixtureRateProvider(table), nil
+}
+
+func (p *fixtureRateProvider) Rates(ctx context.Context, base string) (RateTable, error) {
+	return p.table.rebase(base)
+}
+
+// httpRateProvider fetches rates from a JSON API. url may contain {base},
+// which is replaced by the requested base currency; otherwise the API's own
+// base is used and cross rates are derived. The response needs a "rates"
+// object and a "base" (or "base_code") field, which most free rate APIs
+// provide.
+type httpRateProvider struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPRateProvider(rawURL string) *httpRateProvider {
+	return &httpRateProvider{url: rawURL, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *httpRateProvider) Rates(ctx context.Context, base string) (RateTable, error) {
+	target := strings.ReplaceAll(p.url, "{base}", url.PathEscape(base))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return RateTable{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return RateTable{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return RateTable{}, fmt.Errorf("rate provider returned %s", resp.Status)
+	}
+
+	var body struct {
+		Base     string             `json:"base"`
+		BaseCode string             `json:"base_code"`
+		Rates    map[string]float64 `json:"rates"`
+		Updated  int64              `json:"time_last_update_unix"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return RateTable{}, fmt.Errorf("decoding rates: %w", err)
+	}
+	if body.Base == "" {
+		body.Base = body.BaseCode
+	}
+	table := RateTable{Base: normalizeCurrency(body.Base), Rates: map[string]float64{}, AsOf: time.Now(), Source: req.URL.Host}
+	if body.Updated > 0 {
+		table.AsOf = time.Unix(body.Updated, 0).UTC()
+	}
+	for code, rate := range body.Rates {
+		if code = normalizeCurrency(code); isCurrency(code) && rate > 0 {
+			table.Rates[code] = rate
+		}
+	}
+	if !isCurrency(table.Base) || len(table.Rates) == 0 {
+		return RateTable{}, errors.New("rate provider returned no usable rates")
+	}
+	return table.rebase(base)
+}
+
+// cachingRateProvider keeps each base's table for ttl. When a refresh fails
+// it keeps serving the stale table, since a slightly old rate is more
+// useful to students comparing offers than none.
+type cachingRateProvider struct {
+	next RateProvider
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	tables  map[string]cachedRates
+	fetches map[string]*rateFetch
+}
+
+type cachedRates struct {
+	table   RateTable
+	fetched time.Time
+}
+
+// rateFetch is an upstream call in flight for one base. table and err are
+// set before done is closed.
+type rateFetch struct {
+	done  chan struct{}
+	table RateTable
+	err   error
+}
+
+func newCachingRateProvider(next RateProvider, ttl time.Duration) *cachingRateProvider {
+	return &cachingRateProvider{next: next, ttl: ttl, now: time.Now, tables: map[string]cachedRates{}, fetches: map[string]*rateFetch{}}
+}
+
+// Rates makes a single upstream call for concurrent misses on a base, and
+// never holds the cache lock across it, so a slow provider only delays
+// callers with nothing cached for that base. While a stale table is being
+// refreshed, other callers get the stale table right away.
+func (c *cachingRateProvider) Rates(ctx context.Context, base string) (RateTable, error) {
+	c.mu.Lock()
+	cached, ok := c.tables[base]
+	if ok && c.now().Sub(cached.fetched) < c.ttl {
+		c.mu.Unlock()
+		return cached.table, nil
+	}
+	fetch, inFlight := c.fetches[base]
+	if inFlight && ok {
+		c.mu.Unlock()
+		return cached.table, nil
+	}
+	if !inFlight {
+		fetch = &rateFetch{done: make(chan struct{})}
+		c.fetches[base] = fetch
+	}
+	c.mu.Unlock()
+
+	if inFlight {
+		select {
+		case <-fetch.done:
+			return fetch.table, fetch.err
+		case <-ctx.Done():
+			return RateTable{}, ctx.Err()
+		}
+	}
+
+	table, err := c.next.Rates(ctx, base)
+	c.mu.Lock()
+	delete(c.fetches, base)
+	if err == nil {
+		c.tables[base] = cachedRates{table: table, fetched: c.now()}
+	}
+	c.mu.Unlock()
+	if err != nil && ok {
+		log.Printf("Exchange rate refresh for %s failed, serving cached rates: %v\n", base, err)
+		table, err = cached.table, nil
+	}
+	fetch.table, fetch.err = table, err
+	close(fetch.done)
+	return table, err
+}
+
+// newRateProvider picks the HTTP provider when a rates URL is configured,
+// the file provider when a rates file is, and the built-in fixture
+// otherwise, behind a cache.
+func newRateProvider(cfg Config) (RateProvider, error) {
+	var provider RateProvider = newFixtureRateProvider(fixtureRates)
+	switch {
+	case cfg.RatesURL != "":
+		provider = newHTTPRateProvider(cfg.RatesURL)
+	case cfg.RatesFile != "":
+		file, err := newFileRateProvider(cfg.RatesFile)
+		if err != nil {
+			return nil, err
+		}
+		provider = file
+	}
+	return newCachingRateProvider(provider, time.Duration(cfg.RatesCacheMinutes)*time.Minute), nil
+}
+
+// marketRate prices exchange matches in which neither side named a rate.
+func (s *Server) marketRate(ctx context.Context, from, to string) (float64, bool) {
+	rate, _, err := rateBetween(ctx, s.rates, from, to)
+	if err != nil {
+		log.Printf("Exchange rate lookup failed: %v\n", err)
+		return 0, false
+	}
+	return rate, true
+}
+
+// quoteExchangeRequest records the current market rate on request. A
+// missing quote is not an error: the request is still useful without it.
+func (s *Server) quoteExchangeRequest(ctx context.Context, request *CurrencyExchangeRequest) {
+	rate, asOf, err := rateBetween(ctx, s.rates, request.FromCurrency, request.ToCurrency)
+	if err != nil {
+		log.Printf("Exchange rate lookup failed: %v\n", err)
+		request.QuotedRate, request.QuotedAt = 0, time.Time{}
+		return
+	}
+	request.QuotedRate, request.QuotedAt = rate, asOf
+}
+
+// getCurrencyRates returns the rates from base (default USD), optionally
+// limited to the comma-separated symbols.
+func (s *Server) getCurrencyRates(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	base := normalizeCurrency(r.URL.Query().Get("base"))
+	if base == "" {
+		base = "USD"
+	}
+	var symbols []string
+	for _, code := range splitList(r.URL.Query().Get("symbols")) {
+		symbols = append(symbols, normalizeCurrency(code))
+	}
+	for _, code := range append([]string{base}, symbols...) {
+		if !isCurrency(code) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("%q is not an ISO 4217 currency code", code)})
+			return
+		}
+	}
+
+	table, err := s.rates.Rates(r.Context(), base)
+	if errors.Is(err, errNoRate) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Exchange rate lookup failed: %v\n", err)
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Exchange rates are unavailable"})
+		return
+	}
+
+	rates := map[string]float64{}
+	if len(symbols) == 0 {
+		for code, rate := range table.Rates {
+			rates[code] = rate
+		}
+	}
+	var missing []string
+	for _, code := range symbols {
+		if rate, ok := table.Rates[code]; ok {
+			rates[code] = rate
+		} else if code != base {
+			missing = append(missing, code)
+		}
+	}
+	delete(rates, base)
+	sort.Strings(missing)
+
+	response := map[string]interface{}{
+		"base":   table.Base,
+		"rates":  rates,
+		"as_of":  table.AsOf,
+		"source": table.Source,
+	}
+	if len(missing) > 0 {
+		response["missing"] = missing
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingRateProvider serves the fixture and counts calls, failing when
+// err is set.
+type countingRateProvider struct {
+	calls int
+	err   error
+}
+
+func (p *countingRateProvider) Rates(ctx context.Context, base string) (RateTable, error) {
+	p.calls++
+	if p.err != nil {
+		return RateTable{}, p.err
+	}
+	return fixtureRates.rebase(base)
+}
+
+func TestRateTableRebase(t *testing.T) {
+	table := RateTable{Base: "USD", Rates: map[string]float64{"USD": 1, "EUR": 0.8, "INR": 80}}
+	eur, err := table.rebase("EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, "EUR", eur.Base)
+	assert.InDelta(t, 1.25, eur.Rates["USD"], 1e-9)
+	assert.InDelta(t, 100, eur.Rates["INR"], 1e-9)
+
+	_, err = table.rebase("GBP")
+	assert.ErrorIs(t, err, errNoRate)
+}
+
+func TestCachingRateProvider(t *testing.T) {
+	upstream := &countingRateProvider{}
+	cache := newCachingRateProvider(upstream, time.Hour)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	cache.Rates(ctx, "USD")
+	cache.Rates(ctx, "USD")
+	assert.Equal(t, 1, upstream.calls, "a fresh table is served from the cache")
+	cache.Rates(ctx, "EUR")
+	assert.Equal(t, 2, upstream.calls, "each base is cached separately")
+
+	now = now.Add(2 * time.Hour)
+	upstream.err = errors.New("upstream down")
+	table, err := cache.Rates(ctx, "USD")
+	assert.NoError(t, err, "stale rates beat no rates")
+	assert.Equal(t, 85.5, table.Rates["INR"])
+	assert.Equal(t, 3, upstream.calls)
+
+	_, err = cache.Rates(ctx, "GBP")
+	assert.Error(t, err, "nothing cached to fall back on")
+}
+
+// blockingRateProvider serves the fixture, holding calls for USD until
+// release is closed.
+type blockingRateProvider struct {
+	release chan struct{}
+	mu      sync.Mutex
+	calls   int
+}
+
+func (p *blockingRateProvider) Rates(ctx context.Context, base string) (RateTable, error) {
+	p.mu.Lock()
+	p.calls++
+	p.mu.Unlock()
+	if base == "USD" {
+		<-p.release
+	}
+	return fixtureRates.rebase(base)
+}
+
+func TestCachingRateProviderSlowUpstream(t *testing.T) {
+	upstream := &blockingRateProvider{release: make(chan struct{})}
+	cache := newCachingRateProvider(upstream, time.Hour)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.Rates(ctx, "USD")
+			assert.NoError(t, err)
+		}()
+	}
+
+	// Other bases are served while USD is stuck upstream
+	_, err := cache.Rates(ctx, "EUR")
+	assert.NoError(t, err)
+	close(upstream.release)
+	wg.Wait()
+	assert.Equal(t, 2, upstream.calls, "concurrent misses for USD share one call")
+}
+
+func TestFileRateProvider(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "rates.json")
+	os.WriteFile(good, []byte(`{"base": "eur", "rates": {"USD": 1.1, "INR": 90}}`), 0o600)
+	provider, err := newFileRateProvider(good)
+	assert.NoError(t, err)
+	rate, _, err := rateBetween(context.Background(), provider, "USD", "INR")
+	assert.NoError(t, err)
+	assert.InDelta(t, 81.82, rate, 0.01)
+
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte(`{"base": "EUR", "rates": {"USX": 1.1}}`), 0o600)
+	_, err = newFileRateProvider(bad)
+	assert.Error(t, err)
+}
+
+func TestHTTPRateProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/USD":
+			w.Write([]byte(`{"base_code": "USD", "time_last_update_unix": 1743465600, "rates": {"USD": 1, "INR": 85, "XXX": 3}}`))
+		case "/eur-only":
+			w.Write([]byte(`{"base": "EUR", "rates": {"USD": 1.25, "INR": 100}}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	table, err := newHTTPRateProvider(server.URL+"/latest/{base}").Rates(ctx, "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"USD": 1, "INR": 85}, table.Rates, "unknown codes are dropped")
+	assert.Equal(t, time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC), table.AsOf)
+
+	table, err = newHTTPRateProvider(server.URL+"/eur-only").Rates(ctx, "USD")
+	assert.NoError(t, err)
+	assert.InDelta(t, 80, table.Rates["INR"], 1e-9, "cross rate through the API's base")
+
+	_, err = newHTTPRateProvider(server.URL+"/latest/{base}").Rates(ctx, "GBP")
+	assert.Error(t, err)
+}
+
+func TestGetCurrencyRates(t *testing.T) {
+	_, r := newTestServer()
+
+	rr := serve(r, "GET", "/api/currency/rates?base=usd&symbols=INR,eur,KES", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body struct {
+		Base    string             `json:"base"`
+		Rates   map[string]float64 `json:"rates"`
+		Source  string             `json:"source"`
+		Missing []string           `json:"missing"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	assert.Equal(t, "USD", body.Base)
+	assert.Equal(t, map[string]float64{"INR": 85.5, "EUR": 0.925}, body.Rates)
+	assert.Equal(t, "fixture", body.Source)
+	assert.Equal(t, []string{"KES"}, body.Missing)
+
+	rr = serve(r, "GET", "/api/currency/rates?base=RUPEES", "", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = serve(r, "GET", "/api/currency/rates?base=KES", "", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code, "a valid code the provider does not cover")
+}
+
+func TestExchangeRequestQuote(t *testing.T) {
+	s, r := newTestServer()
+	token := loginAs(t, s, "alice")
+
+	rr := serve(r, "POST", "/api/currency/exchange", token, `{"amount": 100, "from_currency": "USD", "to_currency": "RUP"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = serve(r, "POST", "/api/currency/exchange", token, `{"amount": 100, "from_currency": "usd", "to_currency": "inr", "quoted_rate": 200}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var request CurrencyExchangeRequest
+	json.Unmarshal(rr.Body.Bytes(), &request)
+	assert.Equal(t, 85.5, request.QuotedRate)
+	assert.Equal(t, fixtureRates.AsOf, request.QuotedAt.UTC())
+
+	rr = serve(r, "PATCH", "/api/currency/exchange/"+request.ID.Hex(), token, `{"version": 1, "to_currency": "EUR"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	json.Unmarshal(rr.Body.Bytes(), &request)
+	assert.Equal(t, 0.925, request.QuotedRate, "editing the pair re-quotes it")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// errNotFound is returned by repositories when no document matches.
+	errNotFound = errors.New("not found")
+	// errVersionConflict is returned by Replace when the stored document has
+	// moved on from the version the caller edited.
+	errVersionConflict = errors.New("document was modified by someone else")
+)
+
+// UserRepository stores user accounts and profiles.
+type UserRepository interface {
+	// UpsertLogin records a login for email, creating the user on first
+	// login, and returns the stored user.
+	UpsertLogin(ctx context.Context, email string, at time.Time) (*User, error)
+	List(ctx context.Context) ([]User, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*User, error)
+	// UpdateProfile overwrites the editable profile fields of a user.
+	UpdateProfile(ctx context.Context, id primitive.ObjectID, profile User) error
+	UpdatePreferences(ctx context.Context, id primitive.ObjectID, prefs NotificationPreferences) error
+}
+
+// ListingRepository stores marketplace listings.
+type ListingRepository interface {
+	Create(ctx context.Context, listing *MarketplaceListing) error
+	List(ctx context.Context) ([]MarketplaceListing, error)
+	// Find returns one page of documents matching q and the cursor for the
+	// next page, which is empty on the last page.
+	Find(ctx context.Context, q listQuery) ([]MarketplaceListing, string, error)
+	ListByUser(ctx context.Context, userID string) ([]MarketplaceListing, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*MarketplaceListing, error)
+	// Replace stores listing if the stored version is still expectedVersion,
+	// bumping its version. The stored watcher count is kept.
+	Replace(ctx context.Context, listing *MarketplaceListing, expectedVersion int64) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// SetWatchers stores how many users watch a document, leaving its
+	// version alone.
+	SetWatchers(ctx context.Context, id primitive.ObjectID, n int) error
+}
+
+// ExchangeRepository stores currency exchange requests.
+type ExchangeRepository interface {
+	Create(ctx context.Context, request *CurrencyExchangeRequest) error
+	List(ctx context.Context) ([]CurrencyExchangeRequest, error)
+	// Find returns one page of documents matching q and the cursor for the
+	// next page, which is empty on the last page.
+	Find(ctx context.Context, q listQuery) ([]CurrencyExchangeRequest, string, error)
+	ListByUser(ctx context.Context, userID string) ([]CurrencyExchangeRequest, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*CurrencyExchangeRequest, error)
+	// Replace stores request if the stored version is still expectedVersion,
+	// bumping its version. The stored watcher count is kept.
+	Replace(ctx context.Context, request *CurrencyExchangeRequest, expectedVersion int64) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// SetWatchers stores how many users watch a document, leaving its
+	// version alone.
+	SetWatchers(ctx context.Context, id primitive.ObjectID, n int) error
+	// AddFilled atomically adds delta minor units of currency to a
+	// request's filled amount, bumping its version. It returns
+	// errCannotFill unless the request is in currency, the result stays
+	// between zero and the request's amount and, when delta is positive,
+	// the request is open.
+	AddFilled(ctx context.Context, id primitive.ObjectID, currency string, delta int64) error
+}
+
+// SubleaseRepository stores subleasing requests.
+type SubleaseRepository interface {
+	Create(ctx context.Context, sublease *SubleasingRequest) error
+	List(ctx context.Context) ([]SubleasingRequest, error)
+	// Find returns one page of documents matching q and the cursor for the
+	// next page, which is empty on the last page.
+	Find(ctx context.Context, q listQuery) ([]SubleasingRequest, string, error)
+	ListByUser(ctx context.Context, userID string) ([]SubleasingRequest, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*SubleasingRequest, error)
+	// Replace stores sublease if the stored version is still expectedVersion,
+	// bumping its version. The stored watcher count is kept.
+	Replace(ctx context.Context, sublease *SubleasingRequest, expectedVersion int64) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// SetWatchers stores how many users watch a document, leaving its
+	// version alone.
+	SetWatchers(ctx context.Context, id primitive.ObjectID, n int) error
+}
+
+// ImageRepository stores what is known about each uploaded image, keyed by
+// its blob key.
+type ImageRepository interface {
+	Create(ctx context.Context, image *ImageRecord) error
+	Get(ctx context.Context, key string) (*ImageRecord, error)
+	Update(ctx context.Context, image *ImageRecord) error
+	// ListPending returns up to limit images whose variants have not been
+	// generated yet, oldest first.
+	ListPending(ctx context.Context, limit int) ([]ImageRecord, error)
+}
+
+// MatchRepository stores proposed and settled currency exchange matches.
+type MatchRepository interface {
+	Create(ctx context.Context, match *ExchangeMatch) error
+	Get(ctx context.Context, id primitive.ObjectID) (*ExchangeMatch, error)
+	// ListByRequest returns every match either side of which is requestID.
+	ListByRequest(ctx context.Context, requestID primitive.ObjectID) ([]ExchangeMatch, error)
+	// Replace stores match if the stored version is still expectedVersion,
+	// bumping its version.
+	Replace(ctx context.Context, match *ExchangeMatch, expectedVersion int64) error
+}
+
+// ConversationRepository stores message threads and each participant's
+// unread count.
+type ConversationRepository interface {
+	// FindOrCreate loads the conversation with conv's subject and starter
+	// into conv, storing conv first if there is none, and reports whether it
+	// did.
+	FindOrCreate(ctx context.Context, conv *Conversation) (bool, error)
+	Get(ctx context.Context, id primitive.ObjectID) (*Conversation, error)
+	// ListBySubject returns every conversation about one post.
+	ListBySubject(ctx context.Context, subjectType string, subjectID primitive.ObjectID) ([]Conversation, error)
+	// ListByParticipant returns one page of userID's conversations matching
+	// q and the cursor for the next page, which is empty on the last page.
+	ListByParticipant(ctx context.Context, userID string, q listQuery) ([]Conversation, string, error)
+	// CountUnread totals userID's unread messages across conversations.
+	CountUnread(ctx context.Context, userID string) (int, error)
+	// RecordMessage makes msg the conversation's last message and counts it
+	// as unread for everyone but its sender.
+	RecordMessage(ctx context.Context, id primitive.ObjectID, msg *Message) error
+	// RecordDeletion uncounts the deleted msg for participants who had not
+	// read it yet, and updates the last message if it was msg.
+	RecordDeletion(ctx context.Context, id primitive.ObjectID, msg *Message) error
+	// MarkRead clears userID's unread count as of at.
+	MarkRead(ctx context.Context, id primitive.ObjectID, userID string, at time.Time) error
+}
+
+// MessageRepository stores the messages of conversations.
+type MessageRepository interface {
+	Create(ctx context.Context, msg *Message) error
+	Get(ctx context.Context, id primitive.ObjectID) (*Message, error)
+	// ListByConversation returns one page of a conversation's messages
+	// matching q and the cursor for the next page.
+	ListByConversation(ctx context.Context, conversationID primitive.ObjectID, q listQuery) ([]Message, string, error)
+	Update(ctx context.Context, msg *Message) error
+}
+
+// NotificationRepository stores users' notifications and what is left to
+// email of them.
+type NotificationRepository interface {
+	Create(ctx context.Context, note *Notification) error
+	// Find returns one page of userID's in-app notifications matching q and
+	// the cursor for the next page.
+	Find(ctx context.Context, userID string, q listQuery) ([]Notification, string, error)
+	CountUnread(ctx context.Context, userID string) (int, error)
+	// MarkRead marks userID's notifications with the given IDs read at at,
+	// or all of them when ids is empty, and returns how many it marked.
+	MarkRead(ctx context.Context, userID string, ids []primitive.ObjectID, at time.Time) (int, error)
+	// ListDueMail returns up to limit notifications with mail due by now,
+	// ordered by user and then due time.
+	ListDueMail(ctx context.Context, now time.Time, limit int) ([]Notification, error)
+	// SetMail records the mail state of notifications and when it is next
+	// due.
+	SetMail(ctx context.Context, ids []primitive.ObjectID, state string, at time.Time) error
+}
+
+// SavedSearchRepository stores users' saved searches and the posts that
+// matched them.
+type SavedSearchRepository interface {
+	Create(ctx context.Context, search *SavedSearch) error
+	Get(ctx context.Context, id primitive.ObjectID) (*SavedSearch, error)
+	ListByUser(ctx context.Context, userID string) ([]SavedSearch, error)
+	// ListByType returns every saved search for posts of itemType.
+	ListByType(ctx context.Context, itemType string) ([]SavedSearch, error)
+	// Delete removes a search and its hits.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// RecordHit stores hit and counts it on its search. A post only hits a
+	// search once.
+	RecordHit(ctx context.Context, hit *SavedSearchHit) error
+	// FindHits returns one page of a search's hits matching q and the
+	// cursor for the next page.
+	FindHits(ctx context.Context, searchID primitive.ObjectID, q listQuery) ([]SavedSearchHit, string, error)
+}
+
+// WatchlistRepository stores the items users watch.
+type WatchlistRepository interface {
+	// Add stores watch unless its user already watches the item, loading
+	// the stored entry into watch either way, and reports whether it did.
+	Add(ctx context.Context, watch *WatchedItem) (bool, error)
+	Remove(ctx context.Context, userID, itemType string, itemID primitive.ObjectID) error
+	// ListByUser returns one page of userID's watched items matching q and
+	// the cursor for the next page.
+	ListByUser(ctx context.Context, userID string, q listQuery) ([]WatchedItem, string, error)
+	// Watchers returns the users watching an item.
+	Watchers(ctx context.Context, itemType string, itemID primitive.ObjectID) ([]string, error)
+	// RemoveItem forgets every watch of a deleted item and returns them.
+	RemoveItem(ctx context.Context, itemType string, itemID primitive.ObjectID) ([]WatchedItem, error)
+}
+
+// OfferRepository stores offers on marketplace listings.
+type OfferRepository interface {
+	Create(ctx context.Context, offer *Offer) error
+	Get(ctx context.Context, id primitive.ObjectID) (*Offer, error)
+	// Replace stores offer if the stored version is still expectedVersion,
+	// bumping its version.
+	Replace(ctx context.Context, offer *Offer, expectedVersion int64) error
+	// ListByListing returns every offer on a listing, oldest first.
+	ListByListing(ctx context.Context, listingID primitive.ObjectID) ([]Offer, error)
+	// Find returns one page of offers matching q and the cursor for the
+	// next page.
+	Find(ctx context.Context, q listQuery) ([]Offer, string, error)
+	// FindByParty is Find limited to offers userID made or received.
+	FindByParty(ctx context.Context, userID string, q listQuery) ([]Offer, string, error)
+}
+
+// record is implemented by pointers to the documents kept in a table, so
+// the generic Mongo and in-memory tables and the edit handlers can reach the
+// fields they manage.
+type record[T any] interface {
+	*T
+	recordID() primitive.ObjectID
+	setRecordID(id primitive.ObjectID)
+	ownerID() string
+	recordVersion() int64
+	setRecordVersion(v int64)
+	setUpdatedAt(t time.Time)
+	watcherCount() int
+	setWatcherCount(n int)
+	// restoreServerFields copies the fields clients may not edit from orig.
+	restoreServerFields(orig *T)
+	// cloneSlices gives the document its own copy of each slice field.
+	cloneSlices()
+}
+
+func (l *MarketplaceListing) recordID() primitive.ObjectID           { return l.ID }
+func (l *MarketplaceListing) setRecordID(id primitive.ObjectID)      { l.ID = id }
+func (l *MarketplaceListing) ownerID() string                        { return l.UserID }
+func (c *CurrencyExchangeRequest) recordID() primitive.ObjectID      { return c.ID }
+func (c *CurrencyExchangeRequest) setRecordID(id primitive.ObjectID) { c.ID = id }
+func (c *CurrencyExchangeRequest) ownerID() string                   { return c.UserID }
+func (s *SubleasingRequest) recordID() primitive.ObjectID            { return s.ID }
+func (s *SubleasingRequest) setRecordID(id primitive.ObjectID)       { s.ID = id }
+func (s *SubleasingRequest) ownerID() string                         { return s.UserID }
+
+func (l *MarketplaceListing) recordVersion() int64          { return l.Version }
+func (l *MarketplaceListing) setRecordVersion(v int64)      { l.Version = v }
+func (l *MarketplaceListing) setUpdatedAt(t time.Time)      { l.UpdatedAt = t }
+func (c *CurrencyExchangeRequest) recordVersion() int64     { return c.Version }
+func (c *CurrencyExchangeRequest) setRecordVersion(v int64) { c.Version = v }
+func (c *CurrencyExchangeRequest) setUpdatedAt(t time.Time) { c.UpdatedAt = t }
+func (s *SubleasingRequest) recordVersion() int64           { return s.Version }
+func (s *SubleasingRequest) setRecordVersion(v int64)       { s.Version = v }
+func (s *SubleasingRequest) setUpdatedAt(t time.Time)       { s.UpdatedAt = t }
+
+func (l *MarketplaceListing) watcherCount() int          { return l.WatcherCount }
+func (l *MarketplaceListing) setWatcherCount(n int)      { l.WatcherCount = n }
+func (c *CurrencyExchangeRequest) watcherCount() int     { return c.WatcherCount }
+func (c *CurrencyExchangeRequest) setWatcherCount(n int) { c.WatcherCount = n }
+func (s *SubleasingRequest) watcherCount() int           { return s.WatcherCount }
+func (s *SubleasingRequest) setWatcherCount(n int)       { s.WatcherCount = n }
+
+func (l *MarketplaceListing) restoreServerFields(orig *MarketplaceListing) {
+	l.ID, l.UserID, l.DatePosted, l.Version = orig.ID, orig.UserID, orig.DatePosted, orig.Version
+	l.Status, l.ReservedFor, l.History = orig.Status, orig.ReservedFor, orig.History
+	l.ExpiresAt, l.ExpiryNotifiedAt = orig.ExpiresAt, orig.ExpiryNotifiedAt
+	l.WatcherCount = orig.WatcherCount
+}
+
+func (c *CurrencyExchangeRequest) restoreServerFields(orig *CurrencyExchangeRequest) {
+	c.ID, c.UserID, c.RequestDate, c.Version = orig.ID, orig.UserID, orig.RequestDate, orig.Version
+	c.Filled, c.Status, c.Timeline = orig.Filled, orig.Status, orig.Timeline
+	c.QuotedRate, c.QuotedAt = orig.QuotedRate, orig.QuotedAt
+	c.WatcherCount = orig.WatcherCount
+}
+
+func (s *SubleasingRequest) restoreServerFields(orig *SubleasingRequest) {
+	s.ID, s.UserID, s.DatePosted, s.Version = orig.ID, orig.UserID, orig.DatePosted, orig.Version
+	s.Status, s.ExpiryNotifiedAt = orig.Status, orig.ExpiryNotifiedAt
+	s.WatcherCount = orig.WatcherCount
+}
+
+func (l *MarketplaceListing) cloneSlices() {
+	l.Pictures, l.History = slices.Clone(l.Pictures), slices.Clone(l.History)
+	l.PictureVariants = slices.Clone(l.PictureVariants)
+}
+
+func (c *CurrencyExchangeRequest) cloneSlices() {
+	c.Timeline = slices.Clone(c.Timeline)
+}
+
+func (s *SubleasingRequest) cloneSlices() {
+	s.Pictures, s.PictureVariants = slices.Clone(s.Pictures), slices.Clone(s.PictureVariants)
+	s.Availability, s.OpenWindows = slices.Clone(s.Availability), slices.Clone(s.OpenWindows)
+}
+
+// Store groups every repository the server depends on. newMongoStore backs
+// it with MongoDB and newMemoryStore keeps everything in process for tests.
+type Store struct {
+	Users         UserRepository
+	Listings      ListingRepository
+	Exchanges     ExchangeRepository
+	Subleases     SubleaseRepository
+	Images        ImageRepository
+	Matches       MatchRepository
+	Conversations ConversationRepository
+	Messages      MessageRepository
+	Notifications NotificationRepository
+	SavedSearches SavedSearchRepository
+	Watchlist     WatchlistRepository
+	Offers        OfferRepository
+	OTPs          otpStore
+	Sessions      sessionStore
+}
@@ -0,0 +1,907 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newMemoryStore returns a Store that keeps every document in process, for
+// tests only; the server itself always runs on MongoDB.
+func newMemoryStore() *Store {
+	return &Store{
+		Users:         newMemoryUserRepository(),
+		Listings:      newMemoryTable[MarketplaceListing](),
+		Exchanges:     memoryExchangeTable{newMemoryTable[CurrencyExchangeRequest]()},
+		Subleases:     newMemoryTable[SubleasingRequest](),
+		Images:        newMemoryImageRepository(),
+		Matches:       newMemoryMatchRepository(),
+		Conversations: newMemoryConversationRepository(),
+		Messages:      newMemoryMessageRepository(),
+		Notifications: newMemoryNotificationRepository(),
+		SavedSearches: newMemorySavedSearchRepository(),
+		Watchlist:     newMemoryWatchlistRepository(),
+		Offers:        newMemoryOfferRepository(),
+		OTPs:          newMemoryOTPStore(),
+		Sessions:      newMemorySessionStore(),
+	}
+}
+
+type memoryUserRepository struct {
+	mu    sync.Mutex
+	users []User
+}
+
+func newMemoryUserRepository() *memoryUserRepository {
+	return &memoryUserRepository{}
+}
+
+func (r *memoryUserRepository) UpsertLogin(ctx context.Context, email string, at time.Time) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.users {
+		if r.users[i].Email == email {
+			r.users[i].LastLogin = at
+			user := r.users[i]
+			return &user, nil
+		}
+	}
+	user := User{ID: primitive.NewObjectID(), Email: email, LastLogin: at}
+	r.users = append(r.users, user)
+	return &user, nil
+}
+
+func (r *memoryUserRepository) List(ctx context.Context) ([]User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]User{}, r.users...), nil
+}
+
+func (r *memoryUserRepository) Get(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.ID == id {
+			return &user, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryUserRepository) UpdateProfile(ctx context.Context, id primitive.ObjectID, profile User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.users {
+		if r.users[i].ID == id {
+			r.users[i].Name = profile.Name
+			r.users[i].PreferredEmail = profile.PreferredEmail
+			r.users[i].Location = profile.Location
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (r *memoryUserRepository) UpdatePreferences(ctx context.Context, id primitive.ObjectID, prefs NotificationPreferences) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.users {
+		if r.users[i].ID == id {
+			r.users[i].Preferences = prefs
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// memoryTable is the in-process counterpart of mongoTable. Documents are
+// kept in insertion order, matching MongoDB's natural order for a fresh
+// collection, and copied in and out with their own slices so callers never
+// share memory with the stored document, as with a real database.
+type memoryTable[T any, P record[T]] struct {
+	mu   sync.Mutex
+	docs []T
+}
+
+func newMemoryTable[T any, P record[T]]() *memoryTable[T, P] {
+	return &memoryTable[T, P]{}
+}
+
+func (t *memoryTable[T, P]) Create(ctx context.Context, doc *T) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if P(doc).recordID().IsZero() {
+		P(doc).setRecordID(primitive.NewObjectID())
+	}
+	t.docs = append(t.docs, *doc)
+	P(&t.docs[len(t.docs)-1]).cloneSlices()
+	return nil
+}
+
+// filter returns copies of the documents match accepts.
+func (t *memoryTable[T, P]) filter(match func(P) bool) []T {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	docs := []T{}
+	for i := range t.docs {
+		if match(&t.docs[i]) {
+			docs = append(docs, t.docs[i])
+			P(&docs[len(docs)-1]).cloneSlices()
+		}
+	}
+	return docs
+}
+
+func (t *memoryTable[T, P]) List(ctx context.Context) ([]T, error) {
+	return t.filter(func(P) bool { return true }), nil
+}
+
+func (t *memoryTable[T, P]) ListByUser(ctx context.Context, userID string) ([]T, error) {
+	return t.filter(func(doc P) bool { return doc.ownerID() == userID }), nil
+}
+
+// Find evaluates q against the bson form of each document so filters and
+// ordering behave as they do in MongoDB.
+func (t *memoryTable[T, P]) Find(ctx context.Context, q listQuery) ([]T, string, error) {
+	results, next := findPageInMemory(t.filter(func(P) bool { return true }), q)
+	return results, next, nil
+}
+
+// findPageInMemory runs q over all and returns the page and the next page's cursor.
+func findPageInMemory[T any](all []T, q listQuery) ([]T, string) {
+	docs := make([]bson.M, len(all))
+	for i := range all {
+		docs[i] = toBSONMap(&all[i])
+	}
+
+	page, more := q.applyInMemory(docs)
+	results := make([]T, 0, len(page))
+	for _, i := range page {
+		results = append(results, all[i])
+	}
+	next := ""
+	if more {
+		next = cursorAfter(docs[page[len(page)-1]], q).encode()
+	}
+	return results, next
+}
+
+func (t *memoryTable[T, P]) Get(ctx context.Context, id primitive.ObjectID) (*T, error) {
+	docs := t.filter(func(doc P) bool { return doc.recordID() == id })
+	if len(docs) == 0 {
+		return nil, errNotFound
+	}
+	return &docs[0], nil
+}
+
+func (t *memoryTable[T, P]) Replace(ctx context.Context, doc *T, expectedVersion int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.docs {
+		if P(&t.docs[i]).recordID() != P(doc).recordID() {
+			continue
+		}
+		if P(&t.docs[i]).recordVersion() != expectedVersion {
+			return errVersionConflict
+		}
+		// Like the Mongo store, keep the watcher count SetWatchers stored
+		watchers := P(&t.docs[i]).watcherCount()
+		P(doc).setRecordVersion(expectedVersion + 1)
+		t.docs[i] = *doc
+		P(&t.docs[i]).cloneSlices()
+		P(&t.docs[i]).setWatcherCount(watchers)
+		return nil
+	}
+	return errNotFound
+}
+
+func (t *memoryTable[T, P]) Delete(ctx context.Context, id primitive.ObjectID) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.docs {
+		if P(&t.docs[i]).recordID() == id {
+			t.docs = append(t.docs[:i], t.docs[i+1:]...)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (t *memoryTable[T, P]) SetWatchers(ctx context.Context, id primitive.ObjectID, n int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.docs {
+		if P(&t.docs[i]).recordID() == id {
+			P(&t.docs[i]).setWatcherCount(n)
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+// memoryExchangeTable adds the atomic fill matching needs to the shared
+// table.
+type memoryExchangeTable struct {
+	*memoryTable[CurrencyExchangeRequest, *CurrencyExchangeRequest]
+}
+
+func (t memoryExchangeTable) AddFilled(ctx context.Context, id primitive.ObjectID, currency string, delta int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.docs {
+		request := &t.docs[i]
+		if request.ID != id {
+			continue
+		}
+		filled := request.Filled.Minor + delta
+		if request.FromCurrency != currency || filled < 0 || filled > request.Amount.Minor ||
+			(delta > 0 && request.exchangeStatus() != exchangeOpen) {
+			return errCannotFill
+		}
+		request.Filled = Money{Minor: filled, Currency: currency}
+		request.Version++
+		return nil
+	}
+	return errNotFound
+}
+
+type memoryImageRepository struct {
+	mu     sync.Mutex
+	images []ImageRecord
+}
+
+func newMemoryImageRepository() *memoryImageRepository {
+	return &memoryImageRepository{}
+}
+
+func (r *memoryImageRepository) Create(ctx context.Context, image *ImageRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.images = append(r.images, *image)
+	return nil
+}
+
+func (r *memoryImageRepository) Get(ctx context.Context, key string) (*ImageRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, image := range r.images {
+		if image.Key == key {
+			return &image, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryImageRepository) Update(ctx context.Context, image *ImageRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.images {
+		if r.images[i].Key == image.Key {
+			r.images[i] = *image
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (r *memoryImageRepository) ListPending(ctx context.Context, limit int) ([]ImageRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	images := []ImageRecord{}
+	for _, image := range r.images {
+		if image.Status == imagePending && len(images) < limit {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+type memoryMatchRepository struct {
+	mu      sync.Mutex
+	matches []ExchangeMatch
+}
+
+func newMemoryMatchRepository() *memoryMatchRepository {
+	return &memoryMatchRepository{}
+}
+
+func (r *memoryMatchRepository) Create(ctx context.Context, match *ExchangeMatch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if match.ID.IsZero() {
+		match.ID = primitive.NewObjectID()
+	}
+	r.matches = append(r.matches, *match)
+	return nil
+}
+
+func (r *memoryMatchRepository) Get(ctx context.Context, id primitive.ObjectID) (*ExchangeMatch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, match := range r.matches {
+		if match.ID == id {
+			return &match, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryMatchRepository) ListByRequest(ctx context.Context, requestID primitive.ObjectID) ([]ExchangeMatch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	matches := []ExchangeMatch{}
+	for _, match := range r.matches {
+		if match.side(requestID) >= 0 {
+			matches = append(matches, match)
+		}
+	}
+	return matches, nil
+}
+
+func (r *memoryMatchRepository) Replace(ctx context.Context, match *ExchangeMatch, expectedVersion int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.matches {
+		if r.matches[i].ID != match.ID {
+			continue
+		}
+		if r.matches[i].Version != expectedVersion {
+			return errVersionConflict
+		}
+		match.Version = expectedVersion + 1
+		r.matches[i] = *match
+		return nil
+	}
+	return errNotFound
+}
+
+type memoryConversationRepository struct {
+	mu            sync.Mutex
+	conversations []Conversation
+}
+
+func newMemoryConversationRepository() *memoryConversationRepository {
+	return &memoryConversationRepository{}
+}
+
+// copyConversation keeps callers from sharing the stored participants.
+func copyConversation(conv Conversation) Conversation {
+	conv.Participants = append([]Participant(nil), conv.Participants...)
+	if conv.LastMessage != nil {
+		msg := *conv.LastMessage
+		conv.LastMessage = &msg
+	}
+	return conv
+}
+
+func (r *memoryConversationRepository) FindOrCreate(ctx context.Context, conv *Conversation) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stored := range r.conversations {
+		if stored.SubjectType == conv.SubjectType && stored.SubjectID == conv.SubjectID && stored.StartedBy == conv.StartedBy {
+			*conv = copyConversation(stored)
+			return false, nil
+		}
+	}
+	if conv.ID.IsZero() {
+		conv.ID = primitive.NewObjectID()
+	}
+	r.conversations = append(r.conversations, copyConversation(*conv))
+	return true, nil
+}
+
+func (r *memoryConversationRepository) Get(ctx context.Context, id primitive.ObjectID) (*Conversation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, conv := range r.conversations {
+		if conv.ID == id {
+			conv = copyConversation(conv)
+			return &conv, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryConversationRepository) ListBySubject(ctx context.Context, subjectType string, subjectID primitive.ObjectID) ([]Conversation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conversations := []Conversation{}
+	for _, conv := range r.conversations {
+		if conv.SubjectType == subjectType && conv.SubjectID == subjectID {
+			conversations = append(conversations, copyConversation(conv))
+		}
+	}
+	return conversations, nil
+}
+
+func (r *memoryConversationRepository) ListByParticipant(ctx context.Context, userID string, q listQuery) ([]Conversation, string, error) {
+	r.mu.Lock()
+	var mine []Conversation
+	for _, conv := range r.conversations {
+		if conv.participant(userID) != nil {
+			mine = append(mine, copyConversation(conv))
+		}
+	}
+	r.mu.Unlock()
+	conversations, next := findPageInMemory(mine, q)
+	return conversations, next, nil
+}
+
+func (r *memoryConversationRepository) CountUnread(ctx context.Context, userID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unread := 0
+	for _, conv := range r.conversations {
+		if p := conv.participant(userID); p != nil {
+			unread += p.Unread
+		}
+	}
+	return unread, nil
+}
+
+// update applies change to the stored conversation id.
+func (r *memoryConversationRepository) update(id primitive.ObjectID, change func(conv *Conversation)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.conversations {
+		if r.conversations[i].ID == id {
+			change(&r.conversations[i])
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (r *memoryConversationRepository) RecordMessage(ctx context.Context, id primitive.ObjectID, msg *Message) error {
+	return r.update(id, func(conv *Conversation) {
+		last := *msg
+		conv.LastMessage, conv.LastMessageAt = &last, msg.SentAt
+		for i := range conv.Participants {
+			if conv.Participants[i].UserID != msg.SenderID {
+				conv.Participants[i].Unread++
+			}
+		}
+	})
+}
+
+func (r *memoryConversationRepository) RecordDeletion(ctx context.Context, id primitive.ObjectID, msg *Message) error {
+	return r.update(id, func(conv *Conversation) {
+		if conv.LastMessage != nil && conv.LastMessage.ID == msg.ID {
+			last := *msg
+			conv.LastMessage = &last
+		}
+		for i := range conv.Participants {
+			p := &conv.Participants[i]
+			if p.UserID != msg.SenderID && p.LastReadAt.Before(msg.SentAt) && p.Unread > 0 {
+				p.Unread--
+			}
+		}
+	})
+}
+
+func (r *memoryConversationRepository) MarkRead(ctx context.Context, id primitive.ObjectID, userID string, at time.Time) error {
+	return r.update(id, func(conv *Conversation) {
+		if p := conv.participant(userID); p != nil {
+			p.Unread, p.LastReadAt = 0, at
+		}
+	})
+}
+
+type memoryMessageRepository struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func newMemoryMessageRepository() *memoryMessageRepository {
+	return &memoryMessageRepository{}
+}
+
+func (r *memoryMessageRepository) Create(ctx context.Context, msg *Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if msg.ID.IsZero() {
+		msg.ID = primitive.NewObjectID()
+	}
+	r.messages = append(r.messages, *msg)
+	return nil
+}
+
+func (r *memoryMessageRepository) Get(ctx context.Context, id primitive.ObjectID) (*Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range r.messages {
+		if msg.ID == id {
+			return &msg, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryMessageRepository) ListByConversation(ctx context.Context, conversationID primitive.ObjectID, q listQuery) ([]Message, string, error) {
+	r.mu.Lock()
+	var thread []Message
+	for _, msg := range r.messages {
+		if msg.ConversationID == conversationID {
+			thread = append(thread, msg)
+		}
+	}
+	r.mu.Unlock()
+	messages, next := findPageInMemory(thread, q)
+	return messages, next, nil
+}
+
+func (r *memoryMessageRepository) Update(ctx context.Context, msg *Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.messages {
+		if r.messages[i].ID == msg.ID {
+			r.messages[i] = *msg
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+type memoryNotificationRepository struct {
+	mu            sync.Mutex
+	notifications []Notification
+}
+
+func newMemoryNotificationRepository() *memoryNotificationRepository {
+	return &memoryNotificationRepository{}
+}
+
+func (r *memoryNotificationRepository) Create(ctx context.Context, note *Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if note.ID.IsZero() {
+		note.ID = primitive.NewObjectID()
+	}
+	r.notifications = append(r.notifications, *note)
+	return nil
+}
+
+func (r *memoryNotificationRepository) Find(ctx context.Context, userID string, q listQuery) ([]Notification, string, error) {
+	r.mu.Lock()
+	var mine []Notification
+	for _, note := range r.notifications {
+		if note.UserID == userID && note.InApp {
+			mine = append(mine, note)
+		}
+	}
+	r.mu.Unlock()
+	notifications, next := findPageInMemory(mine, q)
+	return notifications, next, nil
+}
+
+func (r *memoryNotificationRepository) CountUnread(ctx context.Context, userID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unread := 0
+	for _, note := range r.notifications {
+		if note.UserID == userID && note.InApp && note.ReadAt == nil {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (r *memoryNotificationRepository) MarkRead(ctx context.Context, userID string, ids []primitive.ObjectID, at time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	marked := 0
+	for i := range r.notifications {
+		note := &r.notifications[i]
+		if note.UserID != userID || !note.InApp || note.ReadAt != nil {
+			continue
+		}
+		if len(ids) > 0 && !slices.Contains(ids, note.ID) {
+			continue
+		}
+		readAt := at
+		note.ReadAt = &readAt
+		marked++
+	}
+	return marked, nil
+}
+
+func (r *memoryNotificationRepository) ListDueMail(ctx context.Context, now time.Time, limit int) ([]Notification, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	due := []Notification{}
+	for _, note := range r.notifications {
+		if (note.Mail == mailPending || note.Mail == mailInDigest) && !note.MailAt.After(now) {
+			due = append(due, note)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		if due[i].UserID != due[j].UserID {
+			return due[i].UserID < due[j].UserID
+		}
+		return due[i].MailAt.Before(due[j].MailAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (r *memoryNotificationRepository) SetMail(ctx context.Context, ids []primitive.ObjectID, state string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.notifications {
+		if slices.Contains(ids, r.notifications[i].ID) {
+			r.notifications[i].Mail, r.notifications[i].MailAt = state, at
+		}
+	}
+	return nil
+}
+
+type memorySavedSearchRepository struct {
+	mu       sync.Mutex
+	searches []SavedSearch
+	hits     []SavedSearchHit
+}
+
+func newMemorySavedSearchRepository() *memorySavedSearchRepository {
+	return &memorySavedSearchRepository{}
+}
+
+func (r *memorySavedSearchRepository) Create(ctx context.Context, search *SavedSearch) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if search.ID.IsZero() {
+		search.ID = primitive.NewObjectID()
+	}
+	r.searches = append(r.searches, *search)
+	return nil
+}
+
+func (r *memorySavedSearchRepository) Get(ctx context.Context, id primitive.ObjectID) (*SavedSearch, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, search := range r.searches {
+		if search.ID == id {
+			return &search, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memorySavedSearchRepository) ListByUser(ctx context.Context, userID string) ([]SavedSearch, error) {
+	return r.list(func(search *SavedSearch) bool { return search.UserID == userID }), nil
+}
+
+func (r *memorySavedSearchRepository) ListByType(ctx context.Context, itemType string) ([]SavedSearch, error) {
+	return r.list(func(search *SavedSearch) bool { return search.Type == itemType }), nil
+}
+
+func (r *memorySavedSearchRepository) list(keep func(*SavedSearch) bool) []SavedSearch {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	searches := []SavedSearch{}
+	for _, search := range r.searches {
+		if keep(&search) {
+			searches = append(searches, search)
+		}
+	}
+	return searches
+}
+
+func (r *memorySavedSearchRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.searches)
+	r.searches = slices.DeleteFunc(r.searches, func(search SavedSearch) bool { return search.ID == id })
+	if len(r.searches) == n {
+		return errNotFound
+	}
+	r.hits = slices.DeleteFunc(r.hits, func(hit SavedSearchHit) bool { return hit.SearchID == id })
+	return nil
+}
+
+func (r *memorySavedSearchRepository) RecordHit(ctx context.Context, hit *SavedSearchHit) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, h := range r.hits {
+		if h.SearchID == hit.SearchID && h.ItemID == hit.ItemID {
+			return nil
+		}
+	}
+	for i := range r.searches {
+		if search := &r.searches[i]; search.ID == hit.SearchID {
+			if hit.ID.IsZero() {
+				hit.ID = primitive.NewObjectID()
+			}
+			r.hits = append(r.hits, *hit)
+			matchedAt := hit.MatchedAt
+			search.HitCount++
+			search.LastHitAt = &matchedAt
+			return nil
+		}
+	}
+	return errNotFound
+}
+
+func (r *memorySavedSearchRepository) FindHits(ctx context.Context, searchID primitive.ObjectID, q listQuery) ([]SavedSearchHit, string, error) {
+	r.mu.Lock()
+	var hits []SavedSearchHit
+	for _, hit := range r.hits {
+		if hit.SearchID == searchID {
+			hits = append(hits, hit)
+		}
+	}
+	r.mu.Unlock()
+	page, next := findPageInMemory(hits, q)
+	return page, next, nil
+}
+
+type memoryWatchlistRepository struct {
+	mu      sync.Mutex
+	watches []WatchedItem
+}
+
+func newMemoryWatchlistRepository() *memoryWatchlistRepository {
+	return &memoryWatchlistRepository{}
+}
+
+func (r *memoryWatchlistRepository) Add(ctx context.Context, watch *WatchedItem) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.watches {
+		if existing.UserID == watch.UserID && existing.ItemType == watch.ItemType && existing.ItemID == watch.ItemID {
+			*watch = existing
+			return false, nil
+		}
+	}
+	if watch.ID.IsZero() {
+		watch.ID = primitive.NewObjectID()
+	}
+	r.watches = append(r.watches, *watch)
+	return true, nil
+}
+
+func (r *memoryWatchlistRepository) Remove(ctx context.Context, userID, itemType string, itemID primitive.ObjectID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.watches)
+	r.watches = slices.DeleteFunc(r.watches, func(watch WatchedItem) bool {
+		return watch.UserID == userID && watch.ItemType == itemType && watch.ItemID == itemID
+	})
+	if len(r.watches) == n {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *memoryWatchlistRepository) ListByUser(ctx context.Context, userID string, q listQuery) ([]WatchedItem, string, error) {
+	r.mu.Lock()
+	var mine []WatchedItem
+	for _, watch := range r.watches {
+		if watch.UserID == userID {
+			mine = append(mine, watch)
+		}
+	}
+	r.mu.Unlock()
+	watches, next := findPageInMemory(mine, q)
+	return watches, next, nil
+}
+
+func (r *memoryWatchlistRepository) Watchers(ctx context.Context, itemType string, itemID primitive.ObjectID) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	userIDs := []string{}
+	for _, watch := range r.watches {
+		if watch.ItemType == itemType && watch.ItemID == itemID {
+			userIDs = append(userIDs, watch.UserID)
+		}
+	}
+	return userIDs, nil
+}
+
+func (r *memoryWatchlistRepository) RemoveItem(ctx context.Context, itemType string, itemID primitive.ObjectID) ([]WatchedItem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var removed []WatchedItem
+	r.watches = slices.DeleteFunc(r.watches, func(watch WatchedItem) bool {
+		if watch.ItemType == itemType && watch.ItemID == itemID {
+			removed = append(removed, watch)
+			return true
+		}
+		return false
+	})
+	return removed, nil
+}
+
+type memoryOfferRepository struct {
+	mu     sync.Mutex
+	offers []Offer
+}
+
+func newMemoryOfferRepository() *memoryOfferRepository {
+	return &memoryOfferRepository{}
+}
+
+// copyOffer keeps callers from sharing the stored history and parties.
+func copyOffer(offer Offer) Offer {
+	offer.Parties = slices.Clone(offer.Parties)
+	offer.History = slices.Clone(offer.History)
+	return offer
+}
+
+func (r *memoryOfferRepository) Create(ctx context.Context, offer *Offer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if offer.ID.IsZero() {
+		offer.ID = primitive.NewObjectID()
+	}
+	r.offers = append(r.offers, copyOffer(*offer))
+	return nil
+}
+
+func (r *memoryOfferRepository) Get(ctx context.Context, id primitive.ObjectID) (*Offer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, offer := range r.offers {
+		if offer.ID == id {
+			offer = copyOffer(offer)
+			return &offer, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (r *memoryOfferRepository) Replace(ctx context.Context, offer *Offer, expectedVersion int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.offers {
+		if r.offers[i].ID != offer.ID {
+			continue
+		}
+		if r.offers[i].Version != expectedVersion {
+			return errVersionConflict
+		}
+		offer.Version = expectedVersion + 1
+		r.offers[i] = copyOffer(*offer)
+		return nil
+	}
+	return errNotFound
+}
+
+func (r *memoryOfferRepository) ListByListing(ctx context.Context, listingID primitive.ObjectID) ([]Offer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offers := []Offer{}
+	for _, offer := range r.offers {
+		if offer.ListingID == listingID {
+			offers = append(offers, copyOffer(offer))
+		}
+	}
+	return offers, nil
+}
+
+func (r *memoryOfferRepository) Find(ctx context.Context, q listQuery) ([]Offer, string, error) {
+	return r.find(q, func(Offer) bool { return true })
+}
+
+func (r *memoryOfferRepository) FindByParty(ctx context.Context, userID string, q listQuery) ([]Offer, string, error) {
+	return r.find(q, func(offer Offer) bool { return slices.Contains(offer.Parties, userID) })
+}
+
+func (r *memoryOfferRepository) find(q listQuery, keep func(Offer) bool) ([]Offer, string, error) {
+	r.mu.Lock()
+	var offers []Offer
+	for _, offer := range r.offers {
+		if keep(offer) {
+			offers = append(offers, copyOffer(offer))
+		}
+	}
+	r.mu.Unlock()
+	page, next := findPageInMemory(offers, q)
+	return page, next, nil
+}
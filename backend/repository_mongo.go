@@ -0,0 +1,876 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newMongoStore builds a Store on the collections of db, creating the
+// indexes each repository relies on.
+func newMongoStore(ctx context.Context, db *mongo.Database) (*Store, error) {
+	// Amounts written before Money existed are floats; convert them first
+	if err := migrateMoney(ctx, db); err != nil {
+		return nil, fmt.Errorf("migrating amounts: %w", err)
+	}
+	if err := migrateAvailability(ctx, db); err != nil {
+		return nil, fmt.Errorf("migrating sublease availability: %w", err)
+	}
+	if err := migratePreferences(ctx, db); err != nil {
+		return nil, fmt.Errorf("migrating user preferences: %w", err)
+	}
+	otps, err := newMongoOTPStore(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := newMongoSessionStore(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	listings, err := newMongoTable[MarketplaceListing](ctx, db.Collection("marketplace_listings"), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "date_posted", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "price.minor", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "date_posted", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}}},
+		{Keys: bson.D{{Key: "category", Value: 1}, {Key: "date_posted", Value: -1}}},
+		{Keys: bson.D{{Key: "condition", Value: 1}, {Key: "price.minor", Value: 1}}},
+		{Keys: bson.D{{Key: "currency", Value: 1}, {Key: "price.minor", Value: 1}}},
+		{Keys: bson.D{{Key: "location.state", Value: 1}, {Key: "location.city", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	exchanges, err := newMongoTable[CurrencyExchangeRequest](ctx, db.Collection("currency_exchange_requests"), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "request_date", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "amount.minor", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "from_currency", Value: 1}, {Key: "to_currency", Value: 1}, {Key: "request_date", Value: -1}}},
+		{Keys: bson.D{{Key: "from_currency", Value: 1}, {Key: "to_currency", Value: 1}, {Key: "status", Value: 1}, {Key: "request_date", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	subleases, err := newMongoTable[SubleasingRequest](ctx, db.Collection("subleasing_requests"), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "date_posted", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "rent.minor", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "currency", Value: 1}, {Key: "rent.minor", Value: 1}}},
+		{Keys: bson.D{{Key: "period.start_date", Value: 1}, {Key: "period.end_date", Value: 1}}},
+		{Keys: bson.D{{Key: "open_windows.start_date", Value: 1}, {Key: "open_windows.end_date", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "period.end_date", Value: 1}}},
+		{Keys: bson.D{{Key: "location.state", Value: 1}, {Key: "location.city", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	images, err := newMongoImageRepository(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := newMongoMatchRepository(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	conversations, err := newMongoConversationRepository(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := newMongoMessageRepository(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	notifications, err := newMongoNotificationRepository(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	savedSearches, err := newMongoSavedSearchRepository(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	watchlist, err := newMongoWatchlistRepository(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	offers, err := newMongoOfferRepository(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		Users:         &mongoUserRepository{collection: db.Collection("users")},
+		Listings:      listings,
+		Exchanges:     mongoExchangeTable{exchanges},
+		Subleases:     subleases,
+		Images:        images,
+		Matches:       matches,
+		Conversations: conversations,
+		Messages:      messages,
+		Notifications: notifications,
+		SavedSearches: savedSearches,
+		Watchlist:     watchlist,
+		Offers:        offers,
+		OTPs:          otps,
+		Sessions:      sessions,
+	}, nil
+}
+
+type mongoUserRepository struct {
+	collection *mongo.Collection
+}
+
+func (r *mongoUserRepository) UpsertLogin(ctx context.Context, email string, at time.Time) (*User, error) {
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var user User
+	err := r.collection.FindOneAndUpdate(ctx, bson.M{"email": email}, bson.M{"$set": bson.M{"last_login": at}}, opts).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *mongoUserRepository) List(ctx context.Context) ([]User, error) {
+	return findAll[User](ctx, r.collection, bson.M{})
+}
+
+func (r *mongoUserRepository) Get(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	return findByID[User](ctx, r.collection, id)
+}
+
+func (r *mongoUserRepository) UpdateProfile(ctx context.Context, id primitive.ObjectID, profile User) error {
+	update := bson.M{
+		"$set": bson.M{
+			"name":            profile.Name,
+			"preferred_email": profile.PreferredEmail,
+			"location":        profile.Location,
+		},
+	}
+	result, err := r.collection.UpdateByID(ctx, id, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *mongoUserRepository) UpdatePreferences(ctx context.Context, id primitive.ObjectID, prefs NotificationPreferences) error {
+	result, err := r.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"preferences": prefs}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+type mongoImageRepository struct {
+	collection *mongo.Collection
+}
+
+func newMongoImageRepository(ctx context.Context, db *mongo.Database) (*mongoImageRepository, error) {
+	collection := db.Collection("images")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoImageRepository{collection: collection}, nil
+}
+
+func (r *mongoImageRepository) Create(ctx context.Context, image *ImageRecord) error {
+	_, err := r.collection.InsertOne(ctx, image)
+	return err
+}
+
+func (r *mongoImageRepository) Get(ctx context.Context, key string) (*ImageRecord, error) {
+	var image ImageRecord
+	err := r.collection.FindOne(ctx, bson.M{"key": key}).Decode(&image)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+func (r *mongoImageRepository) Update(ctx context.Context, image *ImageRecord) error {
+	result, err := r.collection.ReplaceOne(ctx, bson.M{"key": image.Key}, image)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *mongoImageRepository) ListPending(ctx context.Context, limit int) ([]ImageRecord, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(int64(limit))
+	return findAll[ImageRecord](ctx, r.collection, bson.M{"status": imagePending}, opts)
+}
+
+type mongoMatchRepository struct {
+	collection *mongo.Collection
+}
+
+func newMongoMatchRepository(ctx context.Context, db *mongo.Database) (*mongoMatchRepository, error) {
+	collection := db.Collection("exchange_matches")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "sides.request_id", Value: 1}, {Key: "status", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoMatchRepository{collection: collection}, nil
+}
+
+func (r *mongoMatchRepository) Create(ctx context.Context, match *ExchangeMatch) error {
+	if match.ID.IsZero() {
+		match.ID = primitive.NewObjectID()
+	}
+	_, err := r.collection.InsertOne(ctx, match)
+	return err
+}
+
+func (r *mongoMatchRepository) Get(ctx context.Context, id primitive.ObjectID) (*ExchangeMatch, error) {
+	return findByID[ExchangeMatch](ctx, r.collection, id)
+}
+
+func (r *mongoMatchRepository) ListByRequest(ctx context.Context, requestID primitive.ObjectID) ([]ExchangeMatch, error) {
+	return findAll[ExchangeMatch](ctx, r.collection, bson.M{"sides.request_id": requestID})
+}
+
+func (r *mongoMatchRepository) Replace(ctx context.Context, match *ExchangeMatch, expectedVersion int64) error {
+	match.Version = expectedVersion + 1
+	result, err := r.collection.ReplaceOne(ctx, bson.M{"_id": match.ID, "version": expectedVersion}, match)
+	if err != nil {
+		match.Version = expectedVersion
+		return err
+	}
+	if result.MatchedCount == 0 {
+		match.Version = expectedVersion
+		if _, err := r.Get(ctx, match.ID); err != nil {
+			return err
+		}
+		return errVersionConflict
+	}
+	return nil
+}
+
+type mongoConversationRepository struct {
+	collection *mongo.Collection
+}
+
+func newMongoConversationRepository(ctx context.Context, db *mongo.Database) (*mongoConversationRepository, error) {
+	collection := db.Collection("conversations")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "subject_type", Value: 1}, {Key: "subject_id", Value: 1}, {Key: "started_by", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "participants.user_id", Value: 1}, {Key: "last_message_at", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoConversationRepository{collection: collection}, nil
+}
+
+// FindOrCreate upserts on the unique subject and starter, so two requests
+// racing to open the same thread end up sharing it.
+func (r *mongoConversationRepository) FindOrCreate(ctx context.Context, conv *Conversation) (bool, error) {
+	if conv.ID.IsZero() {
+		conv.ID = primitive.NewObjectID()
+	}
+	filter := bson.M{"subject_type": conv.SubjectType, "subject_id": conv.SubjectID, "started_by": conv.StartedBy}
+	result, err := r.collection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": conv}, options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	if result.UpsertedCount > 0 {
+		return true, nil
+	}
+	return false, r.collection.FindOne(ctx, filter).Decode(conv)
+}
+
+func (r *mongoConversationRepository) Get(ctx context.Context, id primitive.ObjectID) (*Conversation, error) {
+	return findByID[Conversation](ctx, r.collection, id)
+}
+
+func (r *mongoConversationRepository) ListBySubject(ctx context.Context, subjectType string, subjectID primitive.ObjectID) ([]Conversation, error) {
+	return findAll[Conversation](ctx, r.collection, bson.M{"subject_type": subjectType, "subject_id": subjectID})
+}
+
+func (r *mongoConversationRepository) ListByParticipant(ctx context.Context, userID string, q listQuery) ([]Conversation, string, error) {
+	q.filters = append(q.filters, fieldFilter{field: "participants.user_id", op: "$eq", value: userID})
+	return findPage[Conversation](ctx, r.collection, q)
+}
+
+func (r *mongoConversationRepository) CountUnread(ctx context.Context, userID string) (int, error) {
+	cursor, err := r.collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"participants.user_id": userID}}},
+		{{Key: "$unwind", Value: "$participants"}},
+		{{Key: "$match", Value: bson.M{"participants.user_id": userID}}},
+		{{Key: "$group", Value: bson.M{"_id": nil, "unread": bson.M{"$sum": "$participants.unread"}}}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var totals []struct {
+		Unread int `bson:"unread"`
+	}
+	if err := cursor.All(ctx, &totals); err != nil {
+		return 0, err
+	}
+	if len(totals) == 0 {
+		return 0, nil
+	}
+	return totals[0].Unread, nil
+}
+
+// updateParticipants applies update to conversation id, with the given
+// array filters picking out participants.
+func (r *mongoConversationRepository) updateParticipants(ctx context.Context, id primitive.ObjectID, update bson.M, arrayFilters ...interface{}) error {
+	opts := options.Update()
+	if len(arrayFilters) > 0 {
+		opts.SetArrayFilters(options.ArrayFilters{Filters: arrayFilters})
+	}
+	result, err := r.collection.UpdateByID(ctx, id, update, opts)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *mongoConversationRepository) RecordMessage(ctx context.Context, id primitive.ObjectID, msg *Message) error {
+	update := bson.M{
+		"$set": bson.M{"last_message": msg, "last_message_at": msg.SentAt},
+		"$inc": bson.M{"participants.$[other].unread": 1},
+	}
+	return r.updateParticipants(ctx, id, update, bson.M{"other.user_id": bson.M{"$ne": msg.SenderID}})
+}
+
+func (r *mongoConversationRepository) RecordDeletion(ctx context.Context, id primitive.ObjectID, msg *Message) error {
+	update := bson.M{"$inc": bson.M{"participants.$[unaware].unread": -1}}
+	err := r.updateParticipants(ctx, id, update, bson.M{
+		"unaware.user_id":      bson.M{"$ne": msg.SenderID},
+		"unaware.last_read_at": bson.M{"$lt": msg.SentAt},
+		"unaware.unread":       bson.M{"$gt": 0},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.collection.UpdateOne(ctx, bson.M{"_id": id, "last_message._id": msg.ID}, bson.M{"$set": bson.M{"last_message": msg}})
+	return err
+}
+
+func (r *mongoConversationRepository) MarkRead(ctx context.Context, id primitive.ObjectID, userID string, at time.Time) error {
+	update := bson.M{"$set": bson.M{"participants.$[me].unread": 0, "participants.$[me].last_read_at": at}}
+	return r.updateParticipants(ctx, id, update, bson.M{"me.user_id": userID})
+}
+
+type mongoMessageRepository struct {
+	collection *mongo.Collection
+}
+
+func newMongoMessageRepository(ctx context.Context, db *mongo.Database) (*mongoMessageRepository, error) {
+	collection := db.Collection("messages")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "sent_at", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoMessageRepository{collection: collection}, nil
+}
+
+func (r *mongoMessageRepository) Create(ctx context.Context, msg *Message) error {
+	if msg.ID.IsZero() {
+		msg.ID = primitive.NewObjectID()
+	}
+	_, err := r.collection.InsertOne(ctx, msg)
+	return err
+}
+
+func (r *mongoMessageRepository) Get(ctx context.Context, id primitive.ObjectID) (*Message, error) {
+	return findByID[Message](ctx, r.collection, id)
+}
+
+func (r *mongoMessageRepository) ListByConversation(ctx context.Context, conversationID primitive.ObjectID, q listQuery) ([]Message, string, error) {
+	q.filters = append(q.filters, fieldFilter{field: "conversation_id", op: "$eq", value: conversationID})
+	return findPage[Message](ctx, r.collection, q)
+}
+
+func (r *mongoMessageRepository) Update(ctx context.Context, msg *Message) error {
+	result, err := r.collection.ReplaceOne(ctx, bson.M{"_id": msg.ID}, msg)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+type mongoNotificationRepository struct {
+	collection *mongo.Collection
+}
+
+func newMongoNotificationRepository(ctx context.Context, db *mongo.Database) (*mongoNotificationRepository, error) {
+	collection := db.Collection("notifications")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "mail", Value: 1}, {Key: "mail_at", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoNotificationRepository{collection: collection}, nil
+}
+
+func (r *mongoNotificationRepository) Create(ctx context.Context, note *Notification) error {
+	if note.ID.IsZero() {
+		note.ID = primitive.NewObjectID()
+	}
+	_, err := r.collection.InsertOne(ctx, note)
+	return err
+}
+
+func (r *mongoNotificationRepository) Find(ctx context.Context, userID string, q listQuery) ([]Notification, string, error) {
+	q.filters = append(q.filters,
+		fieldFilter{field: "user_id", op: "$eq", value: userID},
+		fieldFilter{field: "in_app", op: "$eq", value: true},
+	)
+	return findPage[Notification](ctx, r.collection, q)
+}
+
+func (r *mongoNotificationRepository) CountUnread(ctx context.Context, userID string) (int, error) {
+	n, err := r.collection.CountDocuments(ctx, bson.M{"user_id": userID, "in_app": true, "read_at": nil})
+	return int(n), err
+}
+
+func (r *mongoNotificationRepository) MarkRead(ctx context.Context, userID string, ids []primitive.ObjectID, at time.Time) (int, error) {
+	filter := bson.M{"user_id": userID, "in_app": true, "read_at": nil}
+	if len(ids) > 0 {
+		filter["_id"] = bson.M{"$in": ids}
+	}
+	result, err := r.collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"read_at": at}})
+	if err != nil {
+		return 0, err
+	}
+	return int(result.ModifiedCount), nil
+}
+
+func (r *mongoNotificationRepository) ListDueMail(ctx context.Context, now time.Time, limit int) ([]Notification, error) {
+	filter := bson.M{"mail": bson.M{"$in": bson.A{mailPending, mailInDigest}}, "mail_at": bson.M{"$lte": now}}
+	opts := options.Find().SetSort(bson.D{{Key: "user_id", Value: 1}, {Key: "mail_at", Value: 1}}).SetLimit(int64(limit))
+	return findAll[Notification](ctx, r.collection, filter, opts)
+}
+
+func (r *mongoNotificationRepository) SetMail(ctx context.Context, ids []primitive.ObjectID, state string, at time.Time) error {
+	_, err := r.collection.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"mail": state, "mail_at": at}})
+	return err
+}
+
+type mongoSavedSearchRepository struct {
+	searches *mongo.Collection
+	hits     *mongo.Collection
+}
+
+func newMongoSavedSearchRepository(ctx context.Context, db *mongo.Database) (*mongoSavedSearchRepository, error) {
+	searches := db.Collection("saved_searches")
+	_, err := searches.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "type", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	hits := db.Collection("saved_search_hits")
+	_, err = hits.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "search_id", Value: 1}, {Key: "item_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "search_id", Value: 1}, {Key: "matched_at", Value: -1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoSavedSearchRepository{searches: searches, hits: hits}, nil
+}
+
+func (r *mongoSavedSearchRepository) Create(ctx context.Context, search *SavedSearch) error {
+	if search.ID.IsZero() {
+		search.ID = primitive.NewObjectID()
+	}
+	_, err := r.searches.InsertOne(ctx, search)
+	return err
+}
+
+func (r *mongoSavedSearchRepository) Get(ctx context.Context, id primitive.ObjectID) (*SavedSearch, error) {
+	return findByID[SavedSearch](ctx, r.searches, id)
+}
+
+func (r *mongoSavedSearchRepository) ListByUser(ctx context.Context, userID string) ([]SavedSearch, error) {
+	return findAll[SavedSearch](ctx, r.searches, bson.M{"user_id": userID}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+}
+
+func (r *mongoSavedSearchRepository) ListByType(ctx context.Context, itemType string) ([]SavedSearch, error) {
+	return findAll[SavedSearch](ctx, r.searches, bson.M{"type": itemType})
+}
+
+func (r *mongoSavedSearchRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := r.searches.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return errNotFound
+	}
+	_, err = r.hits.DeleteMany(ctx, bson.M{"search_id": id})
+	return err
+}
+
+func (r *mongoSavedSearchRepository) RecordHit(ctx context.Context, hit *SavedSearchHit) error {
+	if hit.ID.IsZero() {
+		hit.ID = primitive.NewObjectID()
+	}
+	if _, err := r.hits.InsertOne(ctx, hit); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil
+		}
+		return err
+	}
+	_, err := r.searches.UpdateOne(ctx, bson.M{"_id": hit.SearchID}, bson.M{
+		"$inc": bson.M{"hit_count": 1},
+		"$set": bson.M{"last_hit_at": hit.MatchedAt},
+	})
+	return err
+}
+
+func (r *mongoSavedSearchRepository) FindHits(ctx context.Context, searchID primitive.ObjectID, q listQuery) ([]SavedSearchHit, string, error) {
+	q.filters = append(q.filters, fieldFilter{field: "search_id", op: "$eq", value: searchID})
+	return findPage[SavedSearchHit](ctx, r.hits, q)
+}
+
+type mongoWatchlistRepository struct {
+	collection *mongo.Collection
+}
+
+func newMongoWatchlistRepository(ctx context.Context, db *mongo.Database) (*mongoWatchlistRepository, error) {
+	collection := db.Collection("watchlist")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "item_type", Value: 1}, {Key: "item_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "added_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "item_type", Value: 1}, {Key: "item_id", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoWatchlistRepository{collection: collection}, nil
+}
+
+func (r *mongoWatchlistRepository) Add(ctx context.Context, watch *WatchedItem) (bool, error) {
+	if watch.ID.IsZero() {
+		watch.ID = primitive.NewObjectID()
+	}
+	filter := bson.M{"user_id": watch.UserID, "item_type": watch.ItemType, "item_id": watch.ItemID}
+	result, err := r.collection.UpdateOne(ctx, filter, bson.M{"$setOnInsert": watch}, options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	if result.UpsertedCount > 0 {
+		return true, nil
+	}
+	return false, r.collection.FindOne(ctx, filter).Decode(watch)
+}
+
+func (r *mongoWatchlistRepository) Remove(ctx context.Context, userID, itemType string, itemID primitive.ObjectID) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"user_id": userID, "item_type": itemType, "item_id": itemID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (r *mongoWatchlistRepository) ListByUser(ctx context.Context, userID string, q listQuery) ([]WatchedItem, string, error) {
+	q.filters = append(q.filters, fieldFilter{field: "user_id", op: "$eq", value: userID})
+	return findPage[WatchedItem](ctx, r.collection, q)
+}
+
+func (r *mongoWatchlistRepository) Watchers(ctx context.Context, itemType string, itemID primitive.ObjectID) ([]string, error) {
+	watches, err := findAll[WatchedItem](ctx, r.collection, bson.M{"item_type": itemType, "item_id": itemID})
+	if err != nil {
+		return nil, err
+	}
+	userIDs := make([]string, len(watches))
+	for i, watch := range watches {
+		userIDs[i] = watch.UserID
+	}
+	return userIDs, nil
+}
+
+func (r *mongoWatchlistRepository) RemoveItem(ctx context.Context, itemType string, itemID primitive.ObjectID) ([]WatchedItem, error) {
+	filter := bson.M{"item_type": itemType, "item_id": itemID}
+	watches, err := findAll[WatchedItem](ctx, r.collection, filter)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.collection.DeleteMany(ctx, filter)
+	return watches, err
+}
+
+type mongoOfferRepository struct {
+	collection *mongo.Collection
+}
+
+func newMongoOfferRepository(ctx context.Context, db *mongo.Database) (*mongoOfferRepository, error) {
+	collection := db.Collection("offers")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "listing_id", Value: 1}, {Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "parties", Value: 1}, {Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoOfferRepository{collection: collection}, nil
+}
+
+func (r *mongoOfferRepository) Create(ctx context.Context, offer *Offer) error {
+	if offer.ID.IsZero() {
+		offer.ID = primitive.NewObjectID()
+	}
+	_, err := r.collection.InsertOne(ctx, offer)
+	return err
+}
+
+func (r *mongoOfferRepository) Get(ctx context.Context, id primitive.ObjectID) (*Offer, error) {
+	return findByID[Offer](ctx, r.collection, id)
+}
+
+func (r *mongoOfferRepository) Replace(ctx context.Context, offer *Offer, expectedVersion int64) error {
+	offer.Version = expectedVersion + 1
+	result, err := r.collection.ReplaceOne(ctx, bson.M{"_id": offer.ID, "version": expectedVersion}, offer)
+	if err != nil {
+		offer.Version = expectedVersion
+		return err
+	}
+	if result.MatchedCount == 0 {
+		offer.Version = expectedVersion
+		if _, err := r.Get(ctx, offer.ID); err != nil {
+			return err
+		}
+		return errVersionConflict
+	}
+	return nil
+}
+
+func (r *mongoOfferRepository) ListByListing(ctx context.Context, listingID primitive.ObjectID) ([]Offer, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}})
+	return findAll[Offer](ctx, r.collection, bson.M{"listing_id": listingID}, opts)
+}
+
+func (r *mongoOfferRepository) Find(ctx context.Context, q listQuery) ([]Offer, string, error) {
+	return findPage[Offer](ctx, r.collection, q)
+}
+
+func (r *mongoOfferRepository) FindByParty(ctx context.Context, userID string, q listQuery) ([]Offer, string, error) {
+	q.filters = append(q.filters, fieldFilter{field: "parties", op: "$eq", value: userID})
+	return findPage[Offer](ctx, r.collection, q)
+}
+
+// mongoTable implements the create/list/get/delete operations shared by the
+// listing, exchange and sublease repositories. Every document type stored in
+// one has a user_id field.
+type mongoTable[T any, P record[T]] struct {
+	collection *mongo.Collection
+}
+
+// newMongoTable returns a table on collection after creating indexes, which
+// back the filters and sort orders the list endpoints offer.
+func newMongoTable[T any, P record[T]](ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel) (mongoTable[T, P], error) {
+	if _, err := collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		return mongoTable[T, P]{}, err
+	}
+	return mongoTable[T, P]{collection: collection}, nil
+}
+
+// Create inserts doc, assigning its ID first so the caller sees it.
+func (t mongoTable[T, P]) Create(ctx context.Context, doc *T) error {
+	if P(doc).recordID().IsZero() {
+		P(doc).setRecordID(primitive.NewObjectID())
+	}
+	_, err := t.collection.InsertOne(ctx, doc)
+	return err
+}
+
+func (t mongoTable[T, P]) List(ctx context.Context) ([]T, error) {
+	return findAll[T](ctx, t.collection, bson.M{})
+}
+
+func (t mongoTable[T, P]) ListByUser(ctx context.Context, userID string) ([]T, error) {
+	return findAll[T](ctx, t.collection, bson.M{"user_id": userID})
+}
+
+func (t mongoTable[T, P]) Find(ctx context.Context, q listQuery) ([]T, string, error) {
+	return findPage[T](ctx, t.collection, q)
+}
+
+// findPage fetches one document past the page size to learn whether another
+// page follows.
+func findPage[T any](ctx context.Context, collection *mongo.Collection, q listQuery) ([]T, string, error) {
+	opts := options.Find().SetSort(q.mongoSort())
+	if q.limit > 0 {
+		opts.SetLimit(int64(q.limit) + 1)
+	}
+	docs, err := findAll[T](ctx, collection, q.mongoFilter(), opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if q.limit <= 0 || len(docs) <= q.limit {
+		return docs, "", nil
+	}
+	docs = docs[:q.limit]
+	return docs, cursorAfter(toBSONMap(&docs[len(docs)-1]), q).encode(), nil
+}
+
+func (t mongoTable[T, P]) Get(ctx context.Context, id primitive.ObjectID) (*T, error) {
+	return findByID[T](ctx, t.collection, id)
+}
+
+// Replace swaps in doc if the stored version is still expectedVersion. The
+// stored watcher count is kept: SetWatchers changes it without bumping the
+// version, so the one doc was read with may be stale.
+func (t mongoTable[T, P]) Replace(ctx context.Context, doc *T, expectedVersion int64) error {
+	filter := bson.M{"_id": P(doc).recordID(), "version": expectedVersion}
+	if expectedVersion == 0 {
+		// Documents written before versioning have no version field
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	P(doc).setRecordVersion(expectedVersion + 1)
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		P(doc).setRecordVersion(expectedVersion)
+		return err
+	}
+	var fields bson.D
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		P(doc).setRecordVersion(expectedVersion)
+		return err
+	}
+	fields = slices.DeleteFunc(fields, func(e bson.E) bool { return e.Key == "watcher_count" })
+	// $literal keeps values starting with "$" from being read as field paths
+	replacement := bson.M{"$mergeObjects": bson.A{bson.M{"$literal": fields}, bson.M{"watcher_count": "$watcher_count"}}}
+	result, err := t.collection.UpdateOne(ctx, filter, mongo.Pipeline{{{Key: "$replaceWith", Value: replacement}}})
+	if err != nil {
+		P(doc).setRecordVersion(expectedVersion)
+		return err
+	}
+	if result.MatchedCount == 0 {
+		P(doc).setRecordVersion(expectedVersion)
+		if _, err := findByID[T](ctx, t.collection, P(doc).recordID()); err != nil {
+			return err
+		}
+		return errVersionConflict
+	}
+	return nil
+}
+
+func (t mongoTable[T, P]) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := t.collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (t mongoTable[T, P]) SetWatchers(ctx context.Context, id primitive.ObjectID, n int) error {
+	result, err := t.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"watcher_count": n}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// mongoExchangeTable adds the atomic fill matching needs to the shared
+// table.
+type mongoExchangeTable struct {
+	mongoTable[CurrencyExchangeRequest, *CurrencyExchangeRequest]
+}
+
+func (t mongoExchangeTable) AddFilled(ctx context.Context, id primitive.ObjectID, currency string, delta int64) error {
+	filled := bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$filled.minor", 0}}, delta}}
+	filter := bson.M{
+		"_id":           id,
+		"from_currency": currency,
+		"$expr": bson.M{"$and": bson.A{
+			bson.M{"$gte": bson.A{filled, 0}},
+			bson.M{"$lte": bson.A{filled, "$amount.minor"}},
+		}},
+	}
+	if delta > 0 {
+		filter["status"] = bson.M{"$in": bson.A{exchangeOpen, "", nil}}
+	}
+	update := bson.M{
+		"$inc": bson.M{"filled.minor": delta, "version": 1},
+		"$set": bson.M{"filled.currency": currency},
+	}
+	result, err := t.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := t.Get(ctx, id); err != nil {
+			return err
+		}
+		return errCannotFill
+	}
+	return nil
+}
+
+func findAll[T any](ctx context.Context, collection *mongo.Collection, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	cursor, err := collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	docs := []T{}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+func findByID[T any](ctx context.Context, collection *mongo.Collection, id primitive.ObjectID) (*T, error) {
+	var doc T
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
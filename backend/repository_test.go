@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testStores returns the stores the repository tests run against: always
+// the in-memory store, plus MongoDB when MONGODB_TEST_URI is set.
+func testStores(t *testing.T) map[string]*Store {
+	stores := map[string]*Store{"memory": newMemoryStore()}
+
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		return stores
+	}
+	ctx := context.Background()
+	testClient, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("Failed to connect to test MongoDB: %v", err)
+	}
+	t.Cleanup(func() { testClient.Disconnect(ctx) })
+
+	db := testClient.Database("uni_marketplace_test")
+	if err := db.Drop(ctx); err != nil {
+		t.Fatalf("Failed to reset test database: %v", err)
+	}
+	store, err := newMongoStore(ctx, db)
+	if err != nil {
+		t.Fatalf("Failed to create Mongo store: %v", err)
+	}
+	stores["mongo"] = store
+	return stores
+}
+
+func TestUserRepository(t *testing.T) {
+	for name, store := range testStores(t) {
+		ctx := context.Background()
+
+		first, err := store.Users.UpsertLogin(ctx, "a@ufl.edu", time.Now())
+		assert.NoError(t, err, name)
+		again, err := store.Users.UpsertLogin(ctx, "a@ufl.edu", time.Now())
+		assert.NoError(t, err, name)
+		assert.Equal(t, first.ID, again.ID, name+": a second login must not create a new user")
+
+		assert.NoError(t, store.Users.UpdateProfile(ctx, first.ID, User{Name: "Alice"}), name)
+		user, err := store.Users.Get(ctx, first.ID)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "Alice", user.Name, name)
+
+		assert.ErrorIs(t, store.Users.UpdateProfile(ctx, primitive.NewObjectID(), User{}), errNotFound, name)
+		_, err = store.Users.Get(ctx, primitive.NewObjectID())
+		assert.ErrorIs(t, err, errNotFound, name)
+	}
+}
+
+func TestListingRepository(t *testing.T) {
+	for name, store := range testStores(t) {
+		ctx := context.Background()
+
+		mine := testListing("alice")
+		assert.NoError(t, store.Listings.Create(ctx, &mine), name)
+		assert.False(t, mine.ID.IsZero(), name+": Create must assign an ID")
+		theirs := testListing("bob")
+		assert.NoError(t, store.Listings.Create(ctx, &theirs), name)
+
+		all, err := store.Listings.List(ctx)
+		assert.NoError(t, err, name)
+		assert.Len(t, all, 2, name)
+
+		byUser, err := store.Listings.ListByUser(ctx, "alice")
+		assert.NoError(t, err, name)
+		assert.Len(t, byUser, 1, name)
+
+		got, err := store.Listings.Get(ctx, mine.ID)
+		assert.NoError(t, err, name)
+		assert.Equal(t, mine.Title, got.Title, name)
+
+		// Documents read back share no memory with the stored one
+		got.Pictures[0] = "changed.jpg"
+		mine.Pictures[1] = "changed.jpg"
+		again, _ := store.Listings.Get(ctx, mine.ID)
+		assert.Equal(t, []string{"img1.jpg", "img2.jpg"}, again.Pictures, name)
+
+		assert.NoError(t, store.Listings.Delete(ctx, mine.ID), name)
+		assert.ErrorIs(t, store.Listings.Delete(ctx, mine.ID), errNotFound, name)
+		_, err = store.Listings.Get(ctx, mine.ID)
+		assert.ErrorIs(t, err, errNotFound, name)
+	}
+}
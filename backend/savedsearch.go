@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	maxSavedSearches      = 20
+	maxSavedSearchNameLen = 100
+)
+
+// SavedSearch is a filter a user wants to hear about new posts for. Type is
+// subjectListing or subjectSublease; Category only applies to listings and
+// Dates, a stay the sublease must be available for, only to subleases.
+// MaxPrice is a listing's price or a sublease's monthly cost with utilities
+// (over Dates when given), and only matches posts priced in its currency.
+type SavedSearch struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	Name      string             `json:"name" bson:"name"`
+	Type      string             `json:"type" bson:"type"`
+	Category  string             `json:"category,omitempty" bson:"category,omitempty"`
+	MaxPrice  *Money             `json:"max_price,omitempty" bson:"max_price,omitempty"`
+	Currency  string             `json:"currency,omitempty" bson:"currency,omitempty"`
+	City      string             `json:"city,omitempty" bson:"city,omitempty"`
+	Dates     *DateRange         `json:"dates,omitempty" bson:"dates,omitempty"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	HitCount  int                `json:"hit_count" bson:"hit_count"`
+	LastHitAt *time.Time         `json:"last_hit_at,omitempty" bson:"last_hit_at,omitempty"`
+}
+
+// SavedSearchHit is a post that matched a saved search when it went up.
+// Price is what was compared with the search's MaxPrice.
+type SavedSearchHit struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	SearchID  primitive.ObjectID `json:"search_id" bson:"search_id"`
+	ItemType  string             `json:"item_type" bson:"item_type"`
+	ItemID    primitive.ObjectID `json:"item_id" bson:"item_id"`
+	Title     string             `json:"title" bson:"title"`
+	Price     Money              `json:"price" bson:"price"`
+	Currency  string             `json:"currency" bson:"currency"`
+	MatchedAt time.Time          `json:"matched_at" bson:"matched_at"`
+}
+
+// validate checks a search sent by a client and puts it in canonical form.
+func (s *SavedSearch) validate() string {
+	s.Name = strings.TrimSpace(s.Name)
+	s.Category = strings.TrimSpace(s.Category)
+	s.City = strings.TrimSpace(s.City)
+	s.Currency = strings.ToUpper(strings.TrimSpace(s.Currency))
+	switch s.Type {
+	case subjectListing:
+		if s.Dates != nil {
+			return "dates only apply to sublease searches"
+		}
+	case subjectSublease:
+		if s.Category != "" {
+			return "category only applies to listing searches"
+		}
+	default:
+		return "type must be listing or sublease"
+	}
+	if len(s.Name) > maxSavedSearchNameLen {
+		return fmt.Sprintf("name cannot be longer than %d characters", maxSavedSearchNameLen)
+	}
+	if s.Dates != nil {
+		if s.Dates.StartDate.IsZero() || s.Dates.EndDate.IsZero() {
+			return "dates need a start_date and an end_date"
+		}
+		s.Dates.StartDate, s.Dates.EndDate = civilDate(s.Dates.StartDate), civilDate(s.Dates.EndDate)
+		if s.Dates.EndDate.Before(s.Dates.StartDate) {
+			return "dates cannot end before they start"
+		}
+	}
+	if s.MaxPrice != nil {
+		if s.Currency == "" {
+			s.Currency = defaultCurrency
+		}
+		if err := s.MaxPrice.resolve(s.Currency); err != nil {
+			return "max_price: " + err.Error()
+		}
+		if s.MaxPrice.Minor <= 0 {
+			return "max_price must be positive"
+		}
+	} else {
+		s.Currency = ""
+	}
+	if s.Name == "" {
+		s.Name = s.describe()
+	}
+	return ""
+}
+
+// describe names a search after its filters, e.g. "Textbooks under 40.00
+// USD in Gainesville".
+func (s *SavedSearch) describe() string {
+	name := "Listings"
+	switch {
+	case s.Category != "":
+		name = s.Category
+	case s.Type == subjectSublease:
+		name = "Subleases"
+	}
+	if s.MaxPrice != nil {
+		name += fmt.Sprintf(" under %s %s", s.MaxPrice, s.Currency)
+	}
+	if s.City != "" {
+		name += " in " + s.City
+	}
+	if s.Dates != nil {
+		name += fmt.Sprintf(" from %s to %s", s.Dates.StartDate.Format("Jan 2"), s.Dates.EndDate.Format("Jan 2, 2006"))
+	}
+	return name
+}
+
+// matchListing returns the hit listing makes on s, if it matches.
+func (s *SavedSearch) matchListing(listing *MarketplaceListing) *SavedSearchHit {
+	if s.Type != subjectListing || listing.UserID == s.UserID {
+		return nil
+	}
+	if s.Category != "" && !strings.EqualFold(s.Category, listing.Category) {
+		return nil
+	}
+	if s.City != "" && !strings.EqualFold(s.City, listing.Location.City) {
+		return nil
+	}
+	if s.MaxPrice != nil && (listing.Price.Currency != s.Currency || listing.Price.Minor > s.MaxPrice.Minor) {
+		return nil
+	}
+	return &SavedSearchHit{
+		SearchID: s.ID, ItemType: subjectListing, ItemID: listing.ID, Title: listing.Title,
+		Price: listing.Price, Currency: listing.Price.Currency,
+	}
+}
+
+// matchSublease returns the hit sublease makes on s, if it matches. A
+// sublease is priced by quoting s.Dates, or its whole period without them.
+func (s *SavedSearch) matchSublease(sublease *SubleasingRequest) *SavedSearchHit {
+	if s.Type != subjectSublease || sublease.UserID == s.UserID {
+		return nil
+	}
+	if s.City != "" && !strings.EqualFold(s.City, sublease.Location.City) {
+		return nil
+	}
+	stay := DateRange{StartDate: civilDate(sublease.Period.StartDate), EndDate: civilDate(sublease.Period.EndDate)}
+	if s.Dates != nil {
+		stay = *s.Dates
+	}
+	quote, err := quoteStay(sublease, stay)
+	if err != nil {
+		if !errors.Is(err, errStayUnavailable) {
+			log.Printf("Failed to quote sublease %s: %v\n", sublease.ID.Hex(), err)
+		}
+		return nil
+	}
+	if s.MaxPrice != nil && (quote.Currency != s.Currency || quote.MonthlyEquivalent.Minor > s.MaxPrice.Minor) {
+		return nil
+	}
+	return &SavedSearchHit{
+		SearchID: s.ID, ItemType: subjectSublease, ItemID: sublease.ID, Title: sublease.Title,
+		Price: quote.MonthlyEquivalent, Currency: quote.Currency,
+	}
+}
+
+// listingPosted alerts the users whose saved searches match a new listing.
+func (s *Server) listingPosted(ctx context.Context, listing *MarketplaceListing) {
+	s.alertSavedSearches(ctx, subjectListing, "/api/marketplace/listings/"+listing.ID.Hex(),
+		func(search *SavedSearch) *SavedSearchHit { return search.matchListing(listing) })
+}
+
+// subleasePosted alerts the users whose saved searches match a new
+// sublease.
+func (s *Server) subleasePosted(ctx context.Context, sublease *SubleasingRequest) {
+	s.alertSavedSearches(ctx, subjectSublease, "/api/subleasing/"+sublease.ID.Hex(),
+		func(search *SavedSearch) *SavedSearchHit { return search.matchSublease(sublease) })
+}
+
+// alertSavedSearches records a hit on every saved search for itemType that
+// match accepts and notifies the search's owner. Failures are logged so the
+// post itself still succeeds.
+func (s *Server) alertSavedSearches(ctx context.Context, itemType, link string, match func(*SavedSearch) *SavedSearchHit) {
+	searches, err := s.store.SavedSearches.ListByType(ctx, itemType)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		return
+	}
+	for i := range searches {
+		search := &searches[i]
+		hit := match(search)
+		if hit == nil {
+			continue
+		}
+		hit.MatchedAt = time.Now()
+		if err := s.store.SavedSearches.RecordHit(ctx, hit); err != nil {
+			log.Printf("Database error: %v\n", err)
+			continue
+		}
+		title := fmt.Sprintf("New match for %q", search.Name)
+		body := fmt.Sprintf("%q was just posted for %s %s.", hit.Title, hit.Price, hit.Currency)
+		if err := s.notifications.Notify(ctx, search.UserID, categorySavedSearches, title, body, link); err != nil {
+			log.Printf("Failed to notify %s: %v\n", search.UserID, err)
+		}
+	}
+}
+
+func (s *Server) createSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var search SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&search); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	if msg := search.validate(); msg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		return
+	}
+
+	userID := currentUserID(r)
+	existing, err := s.store.SavedSearches.ListByUser(r.Context(), userID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save search"})
+		return
+	}
+	if len(existing) >= maxSavedSearches {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("You can save at most %d searches", maxSavedSearches)})
+		return
+	}
+
+	search.ID = primitive.NilObjectID
+	search.UserID = userID
+	search.CreatedAt = time.Now()
+	search.HitCount, search.LastHitAt = 0, nil
+	if err := s.store.SavedSearches.Create(r.Context(), &search); err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save search"})
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(search)
+}
+
+func (s *Server) getSavedSearches(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	searches, err := s.store.SavedSearches.ListByUser(r.Context(), currentUserID(r))
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve saved searches"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"search_count": len(searches),
+		"searches":     searches,
+	})
+}
+
+// loadSavedSearch loads the search named in the URL, writing the error
+// response and returning nil if it is missing or not the caller's.
+func (s *Server) loadSavedSearch(w http.ResponseWriter, r *http.Request) *SavedSearch {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return nil
+	}
+	search, err := s.store.SavedSearches.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Saved search not found"})
+		return nil
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load saved search"})
+		return nil
+	}
+	if !canModify(r, search.UserID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "This is not your saved search"})
+		return nil
+	}
+	return search
+}
+
+func (s *Server) deleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	search := s.loadSavedSearch(w, r)
+	if search == nil {
+		return
+	}
+	if err := s.store.SavedSearches.Delete(r.Context(), search.ID); err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete saved search"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Saved search deleted successfully"})
+}
+
+// getSavedSearchHits lists the posts that matched a saved search, newest
+// first.
+func (s *Server) getSavedSearchHits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	search := s.loadSavedSearch(w, r)
+	if search == nil {
+		return
+	}
+	query, err := parseListQuery(r.URL.Query(), map[string]string{"date": "matched_at"}, "-date")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	hits, next, err := s.store.SavedSearches.FindHits(r.Context(), search.ID, query)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve hits"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hit_count":   len(hits),
+		"hits":        hits,
+		"next_cursor": next,
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSavedSearchValidation(t *testing.T) {
+	s, r := newTestServer()
+	token := loginAs(t, s, "bob")
+
+	tests := []struct {
+		description  string
+		body         string
+		expectedCode int
+	}{
+		{"No type", `{"category": "Books"}`, http.StatusBadRequest},
+		{"Dates on listings", `{"type": "listing", "dates": {"start_date": "2025-06-01T00:00:00Z", "end_date": "2025-07-01T00:00:00Z"}}`, http.StatusBadRequest},
+		{"Category on subleases", `{"type": "sublease", "category": "Books"}`, http.StatusBadRequest},
+		{"Backwards dates", `{"type": "sublease", "dates": {"start_date": "2025-07-01T00:00:00Z", "end_date": "2025-06-01T00:00:00Z"}}`, http.StatusBadRequest},
+		{"Negative ceiling", `{"type": "listing", "max_price": -5}`, http.StatusBadRequest},
+		{"Unknown currency", `{"type": "listing", "max_price": 5, "currency": "BUX"}`, http.StatusBadRequest},
+		{"Valid", `{"type": "listing", "category": "Books", "max_price": 40, "city": "Gainesville"}`, http.StatusCreated},
+	}
+	for _, test := range tests {
+		rr := serve(r, "POST", "/api/searches", token, test.body)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+
+	rr := serve(r, "GET", "/api/searches", token, "")
+	var list struct {
+		Searches []SavedSearch `json:"searches"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if assert.Len(t, list.Searches, 1) {
+		assert.Equal(t, "Books under 40.00 USD in Gainesville", list.Searches[0].Name)
+	}
+
+	for i := 1; i < maxSavedSearches; i++ {
+		serve(r, "POST", "/api/searches", token, `{"type": "sublease"}`)
+	}
+	assert.Equal(t, http.StatusConflict, serve(r, "POST", "/api/searches", token, `{"type": "sublease"}`).Code)
+}
+
+func TestSavedSearchAlerts(t *testing.T) {
+	s, r := newTestServer()
+	alice, bob := loginAs(t, s, "alice"), loginAs(t, s, "bob")
+	save := func(body string) SavedSearch {
+		rr := serve(r, "POST", "/api/searches", bob, body)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		var search SavedSearch
+		json.Unmarshal(rr.Body.Bytes(), &search)
+		return search
+	}
+	books := save(`{"name": "Cheap textbooks", "type": "listing", "category": "books", "max_price": 40, "city": "gainesville"}`)
+	summer := save(`{"type": "sublease", "max_price": 700, "dates": {"start_date": "2025-06-01T00:00:00Z", "end_date": "2025-07-31T00:00:00Z"}}`)
+
+	postListing := func(token, title, fields string) {
+		body := `{"title": "` + title + `", "description": "Good condition", "category": "Books", "condition": "Used", "pictures": ["book.jpg"], "location": {"city": "Gainesville", "state": "FL", "country": "USA"}, ` + fields + `}`
+		assert.Equal(t, http.StatusCreated, serve(r, "POST", "/api/postMarketplaceListing", token, body).Code, title)
+	}
+	postListing(alice, "Calculus textbook", `"price": 35`)
+	postListing(alice, "Physics textbook", `"price": 55`)
+	postListing(alice, "Chemistry textbook", `"price": 30, "currency": "EUR"`)
+	postListing(bob, "Bob's own textbook", `"price": 10`)
+
+	postSublease := func(title, fields string) {
+		body := `{"title": "` + title + `", "description": "Near campus", "location": {"city": "Gainesville", "state": "FL", "country": "USA"}, ` + fields + `}`
+		assert.Equal(t, http.StatusCreated, serve(r, "POST", "/api/subleasing", alice, body).Code, title)
+	}
+	postSublease("Whole summer", `"rent": 600, "period": {"start_date": "2025-05-15T00:00:00Z", "end_date": "2025-08-15T00:00:00Z"}`)
+	postSublease("June only", `"rent": 600, "period": {"start_date": "2025-06-01T00:00:00Z", "end_date": "2025-06-30T00:00:00Z"}`)
+	postSublease("Pricey", `"rent": 600, "utilities": 150, "period": {"start_date": "2025-05-15T00:00:00Z", "end_date": "2025-08-15T00:00:00Z"}`)
+
+	hits := func(search SavedSearch, token string) (int, []SavedSearchHit) {
+		rr := serve(r, "GET", "/api/searches/"+search.ID.Hex()+"/hits", token, "")
+		var page struct {
+			Hits []SavedSearchHit `json:"hits"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		return rr.Code, page.Hits
+	}
+	code, found := hits(books, bob)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, "Calculus textbook", found[0].Title)
+	}
+	_, found = hits(summer, bob)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, "Whole summer", found[0].Title)
+		assert.Equal(t, "598.36", found[0].Price.String(), "priced per average month of the searched stay")
+	}
+	code, _ = hits(books, alice)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	stored, _ := s.store.SavedSearches.Get(context.Background(), books.ID)
+	assert.Equal(t, 1, stored.HitCount)
+	assert.NotNil(t, stored.LastHitAt)
+
+	notes, _, _ := s.store.Notifications.Find(context.Background(), "bob", listQuery{})
+	var titles []string
+	for _, note := range notes {
+		titles = append(titles, note.Title)
+	}
+	assert.ElementsMatch(t, []string{`New match for "Cheap textbooks"`, `New match for "Subleases under 700.00 USD from Jun 1 to Jul 31, 2025"`}, titles)
+
+	assert.Equal(t, http.StatusForbidden, serve(r, "DELETE", "/api/searches/"+books.ID.Hex(), alice, "").Code)
+	assert.Equal(t, http.StatusOK, serve(r, "DELETE", "/api/searches/"+books.ID.Hex(), bob, "").Code)
+	code, _ = hits(books, bob)
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	searchIndexMaxAge  = time.Minute
+	defaultSearchLimit = 20
+	titleWeight        = 3.0
+	descriptionWeight  = 1.0
+)
+
+// searchStopWords are dropped from both documents and queries.
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "the": true, "of": true, "or": true,
+	"for": true, "in": true, "on": true, "to": true, "with": true, "is": true,
+}
+
+// searchDoc is one listing or sublease as the search index sees it.
+type searchDoc struct {
+	kind        string
+	id          string
+	title       string
+	description string
+	category    string
+	location    string
+	item        interface{}
+	// ends is when a sublease's rental period ends and it drops out of
+	// results; zero for listings.
+	ends time.Time
+	// terms maps each term to its weighted frequency across title and
+	// description.
+	terms map[string]float64
+}
+
+// searchIndex is an in-process inverted index over active marketplace
+// listings and unexpired subleases. Writes on this instance update their
+// document in place; the whole index is still rebuilt from the store once
+// it is older than maxAge, so changes made by other server instances show
+// up too. Keeping it in process gives ranking, typo tolerance and
+// highlighting without depending on MongoDB's text search.
+type searchIndex struct {
+	store  *Store
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	builtAt  time.Time
+	stale    bool
+	docs     map[string]*searchDoc
+	postings map[string][]*searchDoc
+}
+
+func newSearchIndex(store *Store) *searchIndex {
+	return &searchIndex{store: store, maxAge: searchIndexMaxAge, now: time.Now, stale: true}
+}
+
+func (idx *searchIndex) ensureFresh(ctx context.Context) error {
+	if !idx.stale && idx.now().Sub(idx.builtAt) < idx.maxAge {
+		return nil
+	}
+	listings, err := idx.store.Listings.List(ctx)
+	if err != nil {
+		return err
+	}
+	subleases, err := idx.store.Subleases.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	idx.docs, idx.postings = map[string]*searchDoc{}, map[string][]*searchDoc{}
+	for i := range listings {
+		idx.add(listingDoc(&listings[i]))
+	}
+	for i := range subleases {
+		idx.add(idx.subleaseDoc(&subleases[i]))
+	}
+	idx.builtAt, idx.stale = idx.now(), false
+	return nil
+}
+
+// listingDoc returns the document for listing, or nil if it is not active.
+func listingDoc(listing *MarketplaceListing) *searchDoc {
+	if listing.currentStatus() != statusActive {
+		return nil
+	}
+	l := *listing
+	l.hidePrivate()
+	return &searchDoc{
+		kind: "listing", id: l.ID.Hex(), title: l.Title, description: l.Description,
+		category: l.Category, location: joinLocation(l.Location.City, l.Location.State), item: &l,
+	}
+}
+
+// subleaseDoc returns the document for sublease, or nil if it has expired
+// or its rental period has ended.
+func (idx *searchIndex) subleaseDoc(sublease *SubleasingRequest) *searchDoc {
+	if sublease.Status == statusExpired || !sublease.Period.EndDate.After(idx.now()) {
+		return nil
+	}
+	s := *sublease
+	return &searchDoc{
+		kind: "sublease", id: s.ID.Hex(), title: s.Title, description: s.Description,
+		category: "Sublease", location: joinLocation(s.Location.City, s.Location.State), item: &s,
+		ends: s.Period.EndDate,
+	}
+}
+
+// add indexes doc, which may be nil.
+func (idx *searchIndex) add(doc *searchDoc) {
+	if doc == nil {
+		return
+	}
+	doc.terms = map[string]float64{}
+	for _, term := range searchTerms(doc.title) {
+		doc.terms[term] += titleWeight
+	}
+	for _, term := range searchTerms(doc.description) {
+		doc.terms[term] += descriptionWeight
+	}
+	for term := range doc.terms {
+		idx.postings[term] = append(idx.postings[term], doc)
+	}
+	idx.docs[doc.id] = doc
+}
+
+// drop removes the document with the given ID, if indexed.
+func (idx *searchIndex) drop(id string) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for term := range doc.terms {
+		postings := slices.DeleteFunc(idx.postings[term], func(d *searchDoc) bool { return d == doc })
+		if len(postings) == 0 {
+			delete(idx.postings, term)
+		} else {
+			idx.postings[term] = postings
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// putListing replaces listing's document after a write. Before the first
+// build there is nothing to update; the build reads the store.
+func (idx *searchIndex) putListing(listing *MarketplaceListing) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.stale {
+		return
+	}
+	idx.drop(listing.ID.Hex())
+	idx.add(listingDoc(listing))
+}
+
+// putSublease replaces sublease's document after a write.
+func (idx *searchIndex) putSublease(sublease *SubleasingRequest) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.stale {
+		return
+	}
+	idx.drop(sublease.ID.Hex())
+	idx.add(idx.subleaseDoc(sublease))
+}
+
+// remove drops a deleted listing or sublease.
+func (idx *searchIndex) remove(id primitive.ObjectID) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.stale {
+		return
+	}
+	idx.drop(id.Hex())
+}
+
+func joinLocation(city, state string) string {
+	switch {
+	case city == "":
+		return state
+	case state == "":
+		return city
+	}
+	return city + ", " + state
+}
+
+// searchWords splits text into lowercase words of letters and digits.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// normalizeTerm folds simple plurals so "fridges" matches "fridge".
+func normalizeTerm(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		return word[:len(word)-3] + "y"
+	case len(word) > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss"):
+		return word[:len(word)-1]
+	}
+	return word
+}
+
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range searchWords(text) {
+		if !searchStopWords[word] {
+			terms = append(terms, normalizeTerm(word))
+		}
+	}
+	return terms
+}
+
+// maxTypos is how many edits a query term of this length may be away from an
+// indexed term and still match.
+func maxTypos(term string) int {
+	switch n := len([]rune(term)); {
+	case n >= 8:
+		return 2
+	case n >= 5:
+		return 1
+	}
+	return 0
+}
+
+// levenshtein returns the edit distance between a and b, giving up early
+// once it exceeds limit.
+func levenshtein(a, b string, limit int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > limit || -d > limit {
+		return limit + 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// expandTerm returns the indexed terms a query term matches and how much
+// each match counts: 1 for exact, less for prefixes (only allowed for the
+// last term, which the user may still be typing) and typo matches.
+func (idx *searchIndex) expandTerm(term string, prefix bool) map[string]float64 {
+	matches := map[string]float64{}
+	if _, ok := idx.postings[term]; ok {
+		matches[term] = 1
+	}
+	typos := maxTypos(term)
+	for indexed := range idx.postings {
+		if indexed == term {
+			continue
+		}
+		if prefix && strings.HasPrefix(indexed, term) {
+			matches[indexed] = 0.8
+			continue
+		}
+		if typos > 0 && levenshtein(term, indexed, typos) <= typos {
+			matches[indexed] = 0.6
+		}
+	}
+	return matches
+}
+
+type searchHit struct {
+	doc     *searchDoc
+	score   float64
+	matched map[string]bool
+}
+
+// search ranks every document matching at least one query term. Each term
+// contributes its best match, weighted by inverse document frequency, and
+// documents matching more of the query rank higher.
+func (idx *searchIndex) search(ctx context.Context, query string) ([]searchHit, error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.ensureFresh(ctx); err != nil {
+		return nil, err
+	}
+
+	// Subleases whose period ended since the last rebuild are skipped here
+	now := idx.now()
+	terms := searchTerms(query)
+	hits := map[*searchDoc]*searchHit{}
+	termsMatched := map[*searchDoc]int{}
+	for i, term := range terms {
+		best := map[*searchDoc]float64{}
+		for indexed, quality := range idx.expandTerm(term, i == len(terms)-1) {
+			docs := idx.postings[indexed]
+			idf := math.Log(1 + float64(len(idx.docs))/float64(len(docs)))
+			for _, d := range docs {
+				if !d.ends.IsZero() && !d.ends.After(now) {
+					continue
+				}
+				tf := d.terms[indexed]
+				score := quality * idf * tf / (tf + 1)
+				if score > best[d] {
+					best[d] = score
+				}
+				hit, ok := hits[d]
+				if !ok {
+					hit = &searchHit{doc: d, matched: map[string]bool{}}
+					hits[d] = hit
+				}
+				hit.matched[indexed] = true
+			}
+		}
+		for d, score := range best {
+			hits[d].score += score
+			termsMatched[d]++
+		}
+	}
+
+	results := make([]searchHit, 0, len(hits))
+	for d, hit := range hits {
+		hit.score *= float64(termsMatched[d]) / float64(len(terms))
+		results = append(results, *hit)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].doc.id > results[j].doc.id
+	})
+	return results, nil
+}
+
+// highlight HTML-escapes text and wraps the words whose terms matched in
+// <mark>. When maxWords is positive the text is cut to a window of that many
+// words around the first match.
+func highlight(text string, matched map[string]bool, maxWords int) string {
+	words := strings.Fields(text)
+	first := -1
+	marked := make([]string, len(words))
+	for i, word := range words {
+		marked[i] = html.EscapeString(word)
+		for _, w := range searchWords(word) {
+			if matched[normalizeTerm(w)] {
+				marked[i] = "<mark>" + marked[i] + "</mark>"
+				if first < 0 {
+					first = i
+				}
+				break
+			}
+		}
+	}
+	if maxWords <= 0 || len(words) <= maxWords {
+		return strings.Join(marked, " ")
+	}
+	start := max(0, first-maxWords/3)
+	end := min(len(words), start+maxWords)
+	snippet := strings.Join(marked[start:end], " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(words) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+type searchResult struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+	Item       interface{}       `json:"item"`
+}
+
+// searchListings handles GET /api/search?q=... with optional type
+// (listing or sublease), category, location, limit and offset parameters.
+// Facet counts cover every match, not just the page, with each facet
+// filtered by the others but not by itself.
+func (s *Server) searchListings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	params := r.URL.Query()
+	q := strings.TrimSpace(params.Get("q"))
+	if len(searchTerms(q)) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "q is required"})
+		return
+	}
+
+	limit, offset := defaultSearchLimit, 0
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+			return
+		}
+		limit = n
+	}
+	if v := params.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+
+	hits, err := s.search.search(r.Context(), q)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Search failed"})
+		return
+	}
+
+	// Each facet is counted over the hits the other filters let through, so
+	// its counts show what picking another value would return
+	facets := map[string]map[string]int{"type": {}, "category": {}, "location": {}}
+	var filtered []searchHit
+	for _, hit := range hits {
+		kind, category, location := params.Get("type"), params.Get("category"), params.Get("location")
+		kindOK := kind == "" || hit.doc.kind == kind
+		categoryOK := category == "" || strings.EqualFold(hit.doc.category, category)
+		locationOK := location == "" || strings.EqualFold(hit.doc.location, location)
+		if kindOK && categoryOK && locationOK {
+			filtered = append(filtered, hit)
+		}
+		if categoryOK && locationOK {
+			facets["type"][hit.doc.kind]++
+		}
+		if kindOK && locationOK && hit.doc.category != "" {
+			facets["category"][hit.doc.category]++
+		}
+		if kindOK && categoryOK && hit.doc.location != "" {
+			facets["location"][hit.doc.location]++
+		}
+	}
+
+	results := []searchResult{}
+	for i := offset; i < len(filtered) && i < offset+limit; i++ {
+		hit := filtered[i]
+		results = append(results, searchResult{
+			Type:  hit.doc.kind,
+			ID:    hit.doc.id,
+			Score: math.Round(hit.score*1000) / 1000,
+			Highlights: map[string]string{
+				"title":       highlight(hit.doc.title, hit.matched, 0),
+				"description": highlight(hit.doc.description, hit.matched, 30),
+			},
+			Item: hit.doc.item,
+		})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query":   q,
+		"total":   len(filtered),
+		"results": results,
+		"facets":  facets,
+	})
+}
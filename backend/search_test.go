@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+type searchResponse struct {
+	Total   int                       `json:"total"`
+	Results []searchResult            `json:"results"`
+	Facets  map[string]map[string]int `json:"facets"`
+}
+
+func seedSearch(s *Server) {
+	ctx := context.Background()
+	fridge := testListing("alice")
+	fridge.Title, fridge.Description, fridge.Category = "Mini fridge", "Compact fridge, fits under a desk", "Appliances"
+	s.store.Listings.Create(ctx, &fridge)
+
+	lamp := testListing("bob")
+	lamp.Title, lamp.Description, lamp.Category = "Desk lamp", "LED lamp with a mini USB port", "Furniture"
+	lamp.Location.City = "Tampa"
+	s.store.Listings.Create(ctx, &lamp)
+
+	room := SubleasingRequest{UserID: "carol", Title: "2BR near campus", Description: "Two bedroom apartment, five minutes from campus"}
+	room.Location.City, room.Location.State = "Gainesville", "FL"
+	room.Period.StartDate = time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)
+	room.Period.EndDate = time.Now().AddDate(1, 0, 0)
+	s.store.Subleases.Create(ctx, &room)
+}
+
+func searchFor(t *testing.T, r *mux.Router, route string) searchResponse {
+	rr := serve(r, "GET", route, "", "")
+	assert.Equal(t, http.StatusOK, rr.Code, route)
+	var body searchResponse
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	return body
+}
+
+func TestSearch(t *testing.T) {
+	s, r := newTestServer()
+	seedSearch(s)
+
+	body := searchFor(t, r, "/api/search?q=mini+fridge")
+	if assert.Equal(t, 2, body.Total) {
+		assert.Equal(t, "<mark>Mini</mark> <mark>fridge</mark>", body.Results[0].Highlights["title"])
+		assert.Greater(t, body.Results[0].Score, body.Results[1].Score, "matching both terms ranks first")
+	}
+	assert.Equal(t, map[string]int{"Appliances": 1, "Furniture": 1}, body.Facets["category"])
+	assert.Equal(t, map[string]int{"Gainesville, FL": 1, "Tampa, FL": 1}, body.Facets["location"])
+
+	body = searchFor(t, r, "/api/search?q=2BR+near+campus")
+	if assert.Equal(t, 1, body.Total) {
+		assert.Equal(t, "sublease", body.Results[0].Type)
+	}
+
+	body = searchFor(t, r, "/api/search?q=frdge")
+	assert.Equal(t, 1, body.Total, "one typo is tolerated")
+
+	body = searchFor(t, r, "/api/search?q=fridges")
+	assert.Equal(t, 1, body.Total, "plurals match")
+
+	body = searchFor(t, r, "/api/search?q=camp")
+	assert.Equal(t, 1, body.Total, "the last term matches as a prefix")
+
+	body = searchFor(t, r, "/api/search?q=mini&category=furniture")
+	assert.Equal(t, 1, body.Total)
+	assert.Equal(t, map[string]int{"Appliances": 1, "Furniture": 1}, body.Facets["category"], "a facet is not narrowed by its own filter")
+	assert.Equal(t, map[string]int{"Tampa, FL": 1}, body.Facets["location"])
+
+	rr := serve(r, "GET", "/api/search?q=the", "", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "only stop words")
+}
+
+func TestSearchSeesWrites(t *testing.T) {
+	s, r := newTestServer()
+	token := loginAs(t, s, "alice")
+	assert.Equal(t, 0, searchFor(t, r, "/api/search?q=bicycle").Total)
+
+	listing := testListing("alice")
+	listing.Title = "Road bicycle"
+	payload, _ := json.Marshal(listing)
+	rr := serve(r, "POST", "/api/postMarketplaceListing", token, string(payload))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	assert.Equal(t, 1, searchFor(t, r, "/api/search?q=bicycle").Total)
+}
+
+func TestSearchUpdatesInPlace(t *testing.T) {
+	s, r := newTestServer()
+	now := time.Now()
+	s.search.now = func() time.Time { return now }
+	s.search.maxAge = 7 * 24 * time.Hour
+	token := loginAs(t, s, "alice")
+	seedSearch(s)
+	assert.Equal(t, 1, searchFor(t, r, "/api/search?q=lamp").Total)
+
+	// Writes that bypass the handlers only show up at the next rebuild
+	stray := testListing("bob")
+	stray.Title = "Stray kettle"
+	s.store.Listings.Create(context.Background(), &stray)
+	assert.Equal(t, 0, searchFor(t, r, "/api/search?q=kettle").Total)
+
+	listing := testListing("alice")
+	listing.Title = "Road bicycle"
+	payload, _ := json.Marshal(listing)
+	rr := serve(r, "POST", "/api/postMarketplaceListing", token, string(payload))
+	json.Unmarshal(rr.Body.Bytes(), &listing)
+	assert.Equal(t, 1, searchFor(t, r, "/api/search?q=bicycle").Total)
+
+	rr = serve(r, "PATCH", "/api/marketplace/listings/"+listing.ID.Hex(), token, `{"version": 1, "title": "Mountain bike"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, 0, searchFor(t, r, "/api/search?q=bicycle").Total)
+	body := searchFor(t, r, "/api/search?q=mountain")
+	if assert.Equal(t, 1, body.Total) {
+		assert.Equal(t, "<mark>Mountain</mark> bike", body.Results[0].Highlights["title"])
+	}
+
+	assert.Equal(t, http.StatusOK, serve(r, "POST", "/api/marketplace/listings/"+listing.ID.Hex()+"/withdraw", token, "").Code)
+	assert.Equal(t, 0, searchFor(t, r, "/api/search?q=mountain").Total, "only active listings are searchable")
+	assert.Equal(t, http.StatusOK, serve(r, "POST", "/api/marketplace/listings/"+listing.ID.Hex()+"/relist", token, "").Code)
+	assert.Equal(t, 1, searchFor(t, r, "/api/search?q=mountain").Total)
+
+	assert.Equal(t, http.StatusOK, serve(r, "DELETE", "/api/deleteListing/"+listing.ID.Hex(), token, "").Code)
+	assert.Equal(t, 0, searchFor(t, r, "/api/search?q=mountain").Total)
+
+	// Subleases drop out once their period ends, before the sweep expires them
+	period := fmt.Sprintf(`{"start_date": %q, "end_date": %q}`, civilDate(now).Format(time.RFC3339), civilDate(now).AddDate(0, 0, 2).Format(time.RFC3339))
+	rr = serve(r, "POST", "/api/subleasing", token, `{"title": "Summer loft", "description": "Near campus", "location": {"city": "Gainesville", "state": "FL", "country": "USA"},
+		"rent": 200, "rent_period": "weekly", "period": `+period+`}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, 1, searchFor(t, r, "/api/search?q=loft").Total)
+	now = now.AddDate(0, 0, 3)
+	assert.Equal(t, 0, searchFor(t, r, "/api/search?q=kettle").Total, "no rebuild yet")
+	assert.Equal(t, 0, searchFor(t, r, "/api/search?q=loft").Total)
+
+	now = now.Add(s.search.maxAge)
+	assert.Equal(t, 1, searchFor(t, r, "/api/search?q=kettle").Total, "the periodic rebuild still picks up other writes")
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	text := "one two three four five six seven eight nine <b>fridge</b> eleven twelve"
+	got := highlight(text, map[string]bool{"fridge": true}, 6)
+	assert.Equal(t, "…eight nine <mark>&lt;b&gt;fridge&lt;/b&gt;</mark> eleven twelve", got)
+}
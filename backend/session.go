@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errSessionNotFound = errors.New("session not found or revoked")
+	errSessionExpired  = errors.New("session has expired")
+)
+
+// Session is a logged-in device. Tokens are opaque random strings handed to
+// the client once; only their SHA-256 hashes are stored.
+type Session struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty"`
+	UserID           string             `bson:"user_id"`
+	Email            string             `bson:"email"`
+	Role             string             `bson:"role,omitempty"`
+	AccessHash       string             `bson:"access_hash"`
+	RefreshHash      string             `bson:"refresh_hash"`
+	AccessExpiresAt  time.Time          `bson:"access_expires_at"`
+	RefreshExpiresAt time.Time          `bson:"refresh_expires_at"`
+	CreatedAt        time.Time          `bson:"created_at"`
+}
+
+// TokenPair is returned to the client on login and refresh.
+type TokenPair struct {
+	AccessToken      string    `json:"access_token"`
+	RefreshToken     string    `json:"refresh_token"`
+	AccessExpiresAt  time.Time `json:"access_expires_at"`
+	RefreshExpiresAt time.Time `json:"refresh_expires_at"`
+}
+
+type sessionStore interface {
+	create(ctx context.Context, s Session) error
+	findByAccessHash(ctx context.Context, hash string) (*Session, error)
+	findByRefreshHash(ctx context.Context, hash string) (*Session, error)
+	rotate(ctx context.Context, id primitive.ObjectID, oldRefreshHash, accessHash, refreshHash string, accessExpiresAt time.Time) error
+	remove(ctx context.Context, id primitive.ObjectID) error
+}
+
+// SessionService issues, resolves, refreshes and revokes session tokens.
+type SessionService struct {
+	store      sessionStore
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	now        func() time.Time
+}
+
+func newSessionService(store sessionStore) *SessionService {
+	return &SessionService{
+		store:      store,
+		accessTTL:  time.Hour,
+		refreshTTL: 30 * 24 * time.Hour,
+		now:        time.Now,
+	}
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create starts a new session for a verified user. The user's role is
+// captured at login, so role changes apply from the next login.
+func (s *SessionService) Create(ctx context.Context, userID, email, role string) (TokenPair, error) {
+	access, err := newToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, err := newToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	now := s.now()
+	sess := Session{
+		UserID:           userID,
+		Email:            email,
+		Role:             role,
+		AccessHash:       hashToken(access),
+		RefreshHash:      hashToken(refresh),
+		AccessExpiresAt:  now.Add(s.accessTTL),
+		RefreshExpiresAt: now.Add(s.refreshTTL),
+		CreatedAt:        now,
+	}
+	if err := s.store.create(ctx, sess); err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:      access,
+		RefreshToken:     refresh,
+		AccessExpiresAt:  sess.AccessExpiresAt,
+		RefreshExpiresAt: sess.RefreshExpiresAt,
+	}, nil
+}
+
+// Authenticate resolves an access token to its session.
+func (s *SessionService) Authenticate(ctx context.Context, accessToken string) (*Session, error) {
+	sess, err := s.store.findByAccessHash(ctx, hashToken(accessToken))
+	if err != nil {
+		return nil, err
+	}
+	if sess == nil {
+		return nil, errSessionNotFound
+	}
+	if !s.now().Before(sess.AccessExpiresAt) {
+		return nil, errSessionExpired
+	}
+	return sess, nil
+}
+
+// Refresh exchanges a refresh token for a new token pair. Both tokens are
+// rotated so a leaked refresh token can be used at most once.
+func (s *SessionService) Refresh(ctx context.Context, refreshToken string) (TokenPair, error) {
+	sess, err := s.store.findByRefreshHash(ctx, hashToken(refreshToken))
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if sess == nil {
+		return TokenPair{}, errSessionNotFound
+	}
+	now := s.now()
+	if !now.Before(sess.RefreshExpiresAt) {
+		s.store.remove(ctx, sess.ID)
+		return TokenPair{}, errSessionExpired
+	}
+
+	access, err := newToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	refresh, err := newToken()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	accessExpiresAt := now.Add(s.accessTTL)
+	if err := s.store.rotate(ctx, sess.ID, sess.RefreshHash, hashToken(access), hashToken(refresh), accessExpiresAt); err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:      access,
+		RefreshToken:     refresh,
+		AccessExpiresAt:  accessExpiresAt,
+		RefreshExpiresAt: sess.RefreshExpiresAt,
+	}, nil
+}
+
+// Revoke ends a session so neither of its tokens can be used again.
+func (s *SessionService) Revoke(ctx context.Context, sess *Session) error {
+	return s.store.remove(ctx, sess.ID)
+}
+
+type contextKey string
+
+const sessionContextKey contextKey = "session"
+
+// requireAuth is mux middleware that rejects requests without a valid
+// "Authorization: Bearer <access token>" header and stores the caller's
+// session on the request context.
+func (s *Server) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		sess, err := s.sessions.Authenticate(r.Context(), token)
+		if errors.Is(err, errSessionNotFound) || errors.Is(err, errSessionExpired) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to authenticate request: %v\n", err)
+			http.Error(w, "Failed to authenticate", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey, sess)))
+	})
+}
+
+// currentSession returns the session resolved by requireAuth, or nil on
+// routes that are not behind the middleware.
+func currentSession(r *http.Request) *Session {
+	sess, _ := r.Context().Value(sessionContextKey).(*Session)
+	return sess
+}
+
+// currentUserID returns the authenticated caller's user ID.
+func currentUserID(r *http.Request) string {
+	if sess := currentSession(r); sess != nil {
+		return sess.UserID
+	}
+	return ""
+}
+
+func (s *Server) refreshSession(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "refresh_token is required", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.sessions.Refresh(r.Context(), req.RefreshToken)
+	if errors.Is(err, errSessionNotFound) || errors.Is(err, errSessionExpired) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to refresh session: %v\n", err)
+		http.Error(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tokens)
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := s.sessions.Revoke(r.Context(), currentSession(r)); err != nil {
+		log.Printf("Failed to revoke session: %v\n", err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+// mongoSessionStore keeps sessions in the sessions collection; a TTL index
+// drops them once the refresh token has expired.
+type mongoSessionStore struct {
+	collection *mongo.Collection
+}
+
+func newMongoSessionStore(ctx context.Context, db *mongo.Database) (*mongoSessionStore, error) {
+	collection := db.Collection("sessions")
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "access_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "refresh_hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "refresh_expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoSessionStore{collection: collection}, nil
+}
+
+func (s *mongoSessionStore) create(ctx context.Context, sess Session) error {
+	_, err := s.collection.InsertOne(ctx, sess)
+	return err
+}
+
+func (s *mongoSessionStore) findOne(ctx context.Context, filter bson.M) (*Session, error) {
+	var sess Session
+	err := s.collection.FindOne(ctx, filter).Decode(&sess)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (s *mongoSessionStore) findByAccessHash(ctx context.Context, hash string) (*Session, error) {
+	return s.findOne(ctx, bson.M{"access_hash": hash})
+}
+
+func (s *mongoSessionStore) findByRefreshHash(ctx context.Context, hash string) (*Session, error) {
+	return s.findOne(ctx, bson.M{"refresh_hash": hash})
+}
+
+// rotate only matches while the old refresh hash is current, so two
+// concurrent refreshes with the same token cannot both succeed.
+func (s *mongoSessionStore) rotate(ctx context.Context, id primitive.ObjectID, oldRefreshHash, accessHash, refreshHash string, accessExpiresAt time.Time) error {
+	result, err := s.collection.UpdateOne(ctx, bson.M{"_id": id, "refresh_hash": oldRefreshHash}, bson.M{"$set": bson.M{
+		"access_hash":       accessHash,
+		"refresh_hash":      refreshHash,
+		"access_expires_at": accessExpiresAt,
+	}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errSessionNotFound
+	}
+	return nil
+}
+
+func (s *mongoSessionStore) remove(ctx context.Context, id primitive.ObjectID) error {
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// memorySessionStore is an in-process sessionStore used by tests.
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[primitive.ObjectID]Session
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[primitive.ObjectID]Session)}
+}
+
+func (s *memorySessionStore) create(ctx context.Context, sess Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.ID.IsZero() {
+		sess.ID = primitive.NewObjectID()
+	}
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *memorySessionStore) find(match func(Session) bool) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if match(sess) {
+			return &sess, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memorySessionStore) findByAccessHash(ctx context.Context, hash string) (*Session, error) {
+	return s.find(func(sess Session) bool { return sess.AccessHash == hash })
+}
+
+func (s *memorySessionStore) findByRefreshHash(ctx context.Context, hash string) (*Session, error) {
+	return s.find(func(sess Session) bool { return sess.RefreshHash == hash })
+}
+
+func (s *memorySessionStore) rotate(ctx context.Context, id primitive.ObjectID, oldRefreshHash, accessHash, refreshHash string, accessExpiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok || sess.RefreshHash != oldRefreshHash {
+		return errSessionNotFound
+	}
+	sess.AccessHash = accessHash
+	sess.RefreshHash = refreshHash
+	sess.AccessExpiresAt = accessExpiresAt
+	s.sessions[id] = sess
+	return nil
+}
+
+func (s *memorySessionStore) remove(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
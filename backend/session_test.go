@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSessionService() (*SessionService, *time.Time) {
+	svc := newSessionService(newMemorySessionStore())
+	now := time.Date(2025, 4, 1, 12, 0, 0, 0, time.UTC)
+	svc.now = func() time.Time { return now }
+	return svc, &now
+}
+
+func TestSessionRefreshAndRevoke(t *testing.T) {
+	svc, now := newTestSessionService()
+	ctx := context.Background()
+
+	tokens, err := svc.Create(ctx, "user-1", "a@ufl.edu", "")
+	assert.NoError(t, err)
+
+	sess, err := svc.Authenticate(ctx, tokens.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user-1", sess.UserID)
+
+	*now = now.Add(2 * time.Hour)
+	_, err = svc.Authenticate(ctx, tokens.AccessToken)
+	assert.ErrorIs(t, err, errSessionExpired)
+
+	refreshed, err := svc.Refresh(ctx, tokens.RefreshToken)
+	assert.NoError(t, err)
+	_, err = svc.Refresh(ctx, tokens.RefreshToken)
+	assert.ErrorIs(t, err, errSessionNotFound, "refresh tokens are single use")
+
+	sess, err = svc.Authenticate(ctx, refreshed.AccessToken)
+	assert.NoError(t, err)
+	assert.NoError(t, svc.Revoke(ctx, sess))
+	_, err = svc.Authenticate(ctx, refreshed.AccessToken)
+	assert.ErrorIs(t, err, errSessionNotFound)
+
+	*now = now.Add(31 * 24 * time.Hour)
+	_, err = svc.Refresh(ctx, refreshed.RefreshToken)
+	assert.Error(t, err)
+}
+
+func TestRequireAuth(t *testing.T) {
+	s, r := newTestServer()
+	tokens, _ := s.sessions.Create(context.Background(), "user-1", "a@ufl.edu", "")
+
+	tests := []struct {
+		description  string
+		method       string
+		route        string
+		token        string
+		expectedCode int
+		reqBody      string
+	}{
+		{
+			description:  "post listing without token",
+			method:       "POST",
+			route:        "/api/postMarketplaceListing",
+			expectedCode: 401,
+			reqBody:      `{"user_id": "someone-else", "title": "Desk"}`,
+		},
+		{
+			description:  "post listing with unknown token",
+			method:       "POST",
+			route:        "/api/postMarketplaceListing",
+			token:        "not-a-token",
+			expectedCode: 401,
+			reqBody:      `{"user_id": "someone-else", "title": "Desk"}`,
+		},
+		{
+			description:  "authenticated post reaches handler validation",
+			method:       "POST",
+			route:        "/api/postMarketplaceListing",
+			token:        tokens.AccessToken,
+			expectedCode: 400,
+			reqBody:      `{"user_id": "someone-else", "title": ""}`,
+		},
+		{
+			description:  "delete without token",
+			method:       "DELETE",
+			route:        "/api/deleteListing/6616b8f3e4b0a1a2b3c4d5e6",
+			expectedCode: 401,
+		},
+		{
+			description:  "refresh with unknown token",
+			method:       "POST",
+			route:        "/api/auth/refresh",
+			expectedCode: 401,
+			reqBody:      `{"refresh_token": "nope"}`,
+		},
+		{
+			description:  "logout",
+			method:       "POST",
+			route:        "/api/auth/logout",
+			token:        tokens.AccessToken,
+			expectedCode: 200,
+		},
+		{
+			description:  "token is revoked after logout",
+			method:       "POST",
+			route:        "/api/auth/logout",
+			token:        tokens.AccessToken,
+			expectedCode: 401,
+		},
+	}
+
+	for _, test := range tests {
+		rr := serve(r, test.method, test.route, test.token, test.reqBody)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+}
+
+func TestCurrentUserIDComesFromSession(t *testing.T) {
+	s, _ := newTestServer()
+	tokens, _ := s.sessions.Create(context.Background(), "user-1", "a@ufl.edu", "")
+
+	var seen string
+	handler := s.requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = currentUserID(r)
+		json.NewEncoder(w).Encode(map[string]string{"user_id": seen})
+	}))
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"user_id": "someone-else"}`)))
+	req.Header.Add("Authorization", "Bearer "+tokens.AccessToken)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, 200, rr.Code)
+	assert.Equal(t, "user-1", seen)
+}
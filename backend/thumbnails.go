@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// Image processing states.
+const (
+	imagePending     = "pending"
+	imageReady       = "ready"
+	imageUnsupported = "unsupported"
+	imageFailed      = "failed"
+)
+
+// imageSize is one generated variant. Crop makes a square thumbnail;
+// otherwise the image is scaled to Width keeping its aspect ratio.
+type imageSize struct {
+	Name  string
+	Width int
+	Crop  bool
+}
+
+// imageSizes are the variants generated for every upload, smallest first.
+var imageSizes = []imageSize{
+	{Name: "thumb", Width: 160, Crop: true},
+	{Name: "small", Width: 320},
+	{Name: "medium", Width: 640},
+	{Name: "large", Width: 1280},
+}
+
+// ImageRecord tracks an uploaded image and the variants made from it.
+type ImageRecord struct {
+	Key         string                  `json:"key" bson:"key"`
+	UserID      string                  `json:"user_id" bson:"user_id"`
+	ContentType string                  `json:"content_type" bson:"content_type"`
+	Width       int                     `json:"width,omitempty" bson:"width,omitempty"`
+	Height      int                     `json:"height,omitempty" bson:"height,omitempty"`
+	Status      string                  `json:"status" bson:"status"`
+	Variants    map[string]ImageVariant `json:"variants,omitempty" bson:"variants,omitempty"`
+	CreatedAt   time.Time               `json:"created_at" bson:"created_at"`
+}
+
+// ImageVariant is one stored rendition of an image.
+type ImageVariant struct {
+	Key    string `json:"key" bson:"key"`
+	Width  int    `json:"width" bson:"width"`
+	Height int    `json:"height" bson:"height"`
+}
+
+// PictureVariants holds the URLs of one picture's renditions. Until the
+// worker has generated a variant its URL serves the original.
+type PictureVariants struct {
+	Original string `json:"original" bson:"original"`
+	Thumb    string `json:"thumb,omitempty" bson:"thumb,omitempty"`
+	Small    string `json:"small,omitempty" bson:"small,omitempty"`
+	Medium   string `json:"medium,omitempty" bson:"medium,omitempty"`
+	Large    string `json:"large,omitempty" bson:"large,omitempty"`
+}
+
+// pictureVariants lists the variant URLs for each picture. Pictures that
+// were not uploaded through /api/images only get their original URL.
+func pictureVariants(pictures []string) []PictureVariants {
+	if len(pictures) == 0 {
+		return nil
+	}
+	variants := make([]PictureVariants, len(pictures))
+	for i, picture := range pictures {
+		variants[i].Original = picture
+		if !strings.Contains(picture, "/api/images/") || strings.Contains(picture, "?") {
+			continue
+		}
+		variants[i].Thumb = picture + "?size=thumb"
+		variants[i].Small = picture + "?size=small"
+		variants[i].Medium = picture + "?size=medium"
+		variants[i].Large = picture + "?size=large"
+	}
+	return variants
+}
+
+// ImageService stores uploads and generates their variants in the
+// background. WebP uploads are served as uploaded: the standard library can
+// neither decode nor encode WebP, so variants are JPEG or PNG like their
+// source.
+type ImageService struct {
+	records ImageRepository
+	blobs   BlobStore
+	queue   chan string
+}
+
+func newImageService(records ImageRepository, blobs BlobStore) *ImageService {
+	return &ImageService{records: records, blobs: blobs, queue: make(chan string, 256)}
+}
+
+// enqueue schedules variant generation for key. When the queue is full the
+// image stays pending and is picked up by the next scan.
+func (s *ImageService) enqueue(key string) {
+	select {
+	case s.queue <- key:
+	default:
+	}
+}
+
+// run processes queued images until ctx is done, rescanning for pending
+// images (for example ones uploaded before a restart) every interval.
+func (s *ImageService) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	s.enqueuePending(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-s.queue:
+			if err := s.process(ctx, key); err != nil {
+				log.Printf("Image processing failed for %s: %v\n", key, err)
+			}
+		case <-ticker.C:
+			s.enqueuePending(ctx)
+		}
+	}
+}
+
+func (s *ImageService) enqueuePending(ctx context.Context) {
+	pending, err := s.records.ListPending(ctx, cap(s.queue)-len(s.queue))
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		return
+	}
+	for _, image := range pending {
+		s.enqueue(image.Key)
+	}
+}
+
+// process generates and stores the variants of one image.
+func (s *ImageService) process(ctx context.Context, key string) error {
+	record, err := s.records.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if record.Status != imagePending {
+		return nil
+	}
+
+	data, contentType, err := s.blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		record.Status = imageUnsupported
+		return s.records.Update(ctx, record)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		record.Status = imageFailed
+		return errors.Join(err, s.records.Update(ctx, record))
+	}
+	rgba := toRGBA(src)
+	if contentType == "image/jpeg" {
+		rgba = applyOrientation(rgba, jpegFileOrientation(data))
+	}
+	record.Width, record.Height = rgba.Rect.Dx(), rgba.Rect.Dy()
+
+	variants := map[string]ImageVariant{}
+	for _, size := range imageSizes {
+		var scaled *image.RGBA
+		if size.Crop {
+			scaled = scaleRGBA(cropSquare(rgba), size.Width, size.Width)
+		} else if size.Width < record.Width {
+			scaled = scaleRGBA(rgba, size.Width, record.Height*size.Width/record.Width)
+		} else {
+			// Never upscale; larger sizes fall back to the original
+			continue
+		}
+
+		encoded, err := encodeVariant(scaled, contentType)
+		if err != nil {
+			return err
+		}
+		ext := path.Ext(key)
+		variantKey := strings.TrimSuffix(key, ext) + "_" + size.Name + ext
+		if err := s.blobs.Put(ctx, variantKey, contentType, encoded); err != nil {
+			return err
+		}
+		variants[size.Name] = ImageVariant{Key: variantKey, Width: scaled.Rect.Dx(), Height: scaled.Rect.Dy()}
+	}
+
+	record.Variants = variants
+	record.Status = imageReady
+	return s.records.Update(ctx, record)
+}
+
+// variantKey picks the stored key to serve for a request: the named size,
+// or for a width the smallest non-cropped variant at least that wide. It
+// returns key itself when no variant fits or none has been made yet.
+func (r *ImageRecord) variantKey(key, size string, width int) string {
+	if r == nil || r.Status != imageReady {
+		return key
+	}
+	if size != "" {
+		if v, ok := r.Variants[size]; ok {
+			return v.Key
+		}
+		return key
+	}
+	if width > 0 {
+		for _, s := range imageSizes {
+			if v, ok := r.Variants[s.Name]; ok && !s.Crop && v.Width >= width {
+				return v.Key
+			}
+		}
+	}
+	return key
+}
+
+func encodeVariant(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 82})
+	}
+	return buf.Bytes(), err
+}
+
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, src, b.Min, draw.Src)
+	return dst
+}
+
+func cropSquare(src *image.RGBA) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	side := min(w, h)
+	x, y := (w-side)/2, (h-side)/2
+	return src.SubImage(image.Rect(x, y, x+side, y+side)).(*image.RGBA)
+}
+
+// scaleRGBA resizes src to w×h by averaging the source pixels that fall in
+// each destination pixel, which is a good filter for downscaling.
+func scaleRGBA(src *image.RGBA, w, h int) *image.RGBA {
+	w, h = max(w, 1), max(h, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	ox, oy := src.Rect.Min.X, src.Rect.Min.Y
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				row := src.PixOffset(ox+x0, oy+sy)
+				for sx := x0; sx < x1; sx++ {
+					p := src.Pix[row : row+4 : row+4]
+					r, g, b, a = r+uint32(p[0]), g+uint32(p[1]), b+uint32(p[2]), a+uint32(p[3])
+					n++
+					row += 4
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// jpegFileOrientation returns the EXIF orientation of a JPEG file, or 1.
+func jpegFileOrientation(data []byte) uint16 {
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		if end > len(data) {
+			break
+		}
+		if marker == 0xE1 {
+			if o := jpegOrientation(data[i+4 : end]); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+		i = end
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips src so it displays upright for the
+// given EXIF orientation (1-8).
+func applyOrientation(src *image.RGBA, orientation uint16) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			s, d := src.PixOffset(src.Rect.Min.X+x, src.Rect.Min.Y+y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+	return dst
+}
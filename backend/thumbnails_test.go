@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeTestImage(t *testing.T, s *Server, key, contentType string, data []byte) {
+	ctx := context.Background()
+	if err := s.images.blobs.Put(ctx, key, contentType, data); err != nil {
+		t.Fatal(err)
+	}
+	record := ImageRecord{Key: key, UserID: "alice", ContentType: contentType, Status: imagePending, CreatedAt: time.Now()}
+	if err := s.images.records.Create(ctx, &record); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessImage(t *testing.T) {
+	s, r := newTestServer()
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1000, 500)))
+	storeTestImage(t, s, "wide.png", "image/png", buf.Bytes())
+
+	rr := serve(r, "GET", "/api/images/wide.png?size=thumb", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"), "the original is served while pending")
+	assert.Equal(t, buf.Len(), rr.Body.Len())
+
+	assert.NoError(t, s.images.process(ctx, "wide.png"))
+	record, _ := s.images.records.Get(ctx, "wide.png")
+	assert.Equal(t, imageReady, record.Status)
+	assert.Equal(t, map[string]ImageVariant{
+		"thumb":  {Key: "wide_thumb.png", Width: 160, Height: 160},
+		"small":  {Key: "wide_small.png", Width: 320, Height: 160},
+		"medium": {Key: "wide_medium.png", Width: 640, Height: 320},
+	}, record.Variants, "no variant is larger than the original")
+
+	tests := []struct {
+		route         string
+		expectedWidth int
+	}{
+		{"/api/images/wide.png?size=thumb", 160},
+		{"/api/images/wide.png?size=medium", 640},
+		{"/api/images/wide.png?size=large", 1000},
+		{"/api/images/wide.png?w=400", 640},
+		{"/api/images/wide.png?w=2000", 1000},
+		{"/api/images/wide.png", 1000},
+	}
+	for _, test := range tests {
+		rr := serve(r, "GET", test.route, "", "")
+		assert.Equal(t, http.StatusOK, rr.Code, test.route)
+		cfg, err := png.DecodeConfig(rr.Body)
+		assert.NoError(t, err, test.route)
+		assert.Equal(t, test.expectedWidth, cfg.Width, test.route)
+	}
+}
+
+func TestProcessImageOrientation(t *testing.T) {
+	s, _ := newTestServer()
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 800, 400)), nil)
+	withOrientation := append(append([]byte{0xFF, 0xD8}, minimalEXIF(6)...), buf.Bytes()[2:]...)
+	storeTestImage(t, s, "phone.jpg", "image/jpeg", withOrientation)
+
+	assert.NoError(t, s.images.process(ctx, "phone.jpg"))
+	record, _ := s.images.records.Get(ctx, "phone.jpg")
+	assert.Equal(t, 400, record.Width, "rotated upright")
+	assert.Equal(t, 800, record.Height)
+	assert.Equal(t, ImageVariant{Key: "phone_small.jpg", Width: 320, Height: 640}, record.Variants["small"])
+}
+
+func TestProcessWebPIsSkipped(t *testing.T) {
+	s, _ := newTestServer()
+	storeTestImage(t, s, "anim.webp", "image/webp", []byte("RIFF"))
+	assert.NoError(t, s.images.process(context.Background(), "anim.webp"))
+	record, _ := s.images.records.Get(context.Background(), "anim.webp")
+	assert.Equal(t, imageUnsupported, record.Status)
+}
+
+func TestScaleAndOrient(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.RGBA{R: 200, A: 255})
+	src.Set(1, 0, color.RGBA{B: 100, A: 255})
+
+	scaled := scaleRGBA(src, 1, 1)
+	assert.Equal(t, color.RGBA{R: 100, B: 50, A: 255}, scaled.At(0, 0), "pixels are averaged")
+
+	rotated := applyOrientation(src, 6)
+	assert.Equal(t, image.Rect(0, 0, 1, 2), rotated.Rect)
+	assert.Equal(t, color.RGBA{R: 200, A: 255}, rotated.At(0, 0), "90° clockwise puts the left pixel on top")
+}
+
+func TestListingPictureVariants(t *testing.T) {
+	s, r := newTestServer()
+	token := loginAs(t, s, "alice")
+
+	listing := testListing("alice")
+	listing.Pictures = []string{"https://api.example.edu/api/images/ab12.jpg", "https://elsewhere.example/cat.jpg"}
+	payload, _ := json.Marshal(listing)
+	rr := serve(r, "POST", "/api/postMarketplaceListing", token, string(payload))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var created MarketplaceListing
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	assert.Equal(t, []PictureVariants{
+		{
+			Original: "https://api.example.edu/api/images/ab12.jpg",
+			Thumb:    "https://api.example.edu/api/images/ab12.jpg?size=thumb",
+			Small:    "https://api.example.edu/api/images/ab12.jpg?size=small",
+			Medium:   "https://api.example.edu/api/images/ab12.jpg?size=medium",
+			Large:    "https://api.example.edu/api/images/ab12.jpg?size=large",
+		},
+		{Original: "https://elsewhere.example/cat.jpg"},
+	}, created.PictureVariants)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Currency exchange request statuses. A request is open while part of it is
+// unmatched, and matched once accepted matches cover all of it. It moves to
+// meeting_scheduled when every one of those trades has a meeting and to
+// completed when both parties of every trade have confirmed it. A dispute on
+// any trade marks the request disputed until the trade is confirmed by both.
+// Only cancellation is set directly; every other status is derived from the
+// request's matches by settledStatus.
+const (
+	exchangeOpen             = "open"
+	exchangeMatched          = "matched"
+	exchangeMeetingScheduled = "meeting_scheduled"
+	exchangeCompleted        = "completed"
+	exchangeCancelled        = "cancelled"
+	exchangeDisputed         = "disputed"
+
+	// exchangeLegacyFilled is what fully matched requests were stored as
+	// before trades had a lifecycle.
+	exchangeLegacyFilled = "filled"
+)
+
+// Exchange timeline event types.
+const (
+	eventCreated          = "created"
+	eventMatched          = "matched"
+	eventMeetingScheduled = "meeting_scheduled"
+	eventConfirmed        = "confirmed"
+	eventCompleted        = "completed"
+	eventDisputed         = "disputed"
+	eventMatchCancelled   = "match_cancelled"
+	eventCancelled        = "cancelled"
+)
+
+var (
+	errNotRequestOwner = errors.New("you can only cancel your own exchange requests")
+	errTradeConfirmed  = errors.New("a trade awaiting confirmation cannot be cancelled; dispute it instead")
+	errInvalidMeeting  = errors.New("a meeting needs a place and a time in the future")
+	errNoDisputeReason = errors.New("reason is required to dispute a trade")
+)
+
+// ExchangeEvent is one entry in an exchange request's timeline. Status is
+// the request's status after the event.
+type ExchangeEvent struct {
+	Type         string              `json:"type" bson:"type"`
+	By           string              `json:"by" bson:"by"`
+	At           time.Time           `json:"at" bson:"at"`
+	Status       string              `json:"status" bson:"status"`
+	MatchID      *primitive.ObjectID `json:"match_id,omitempty" bson:"match_id,omitempty"`
+	Counterparty string              `json:"counterparty,omitempty" bson:"counterparty,omitempty"`
+	Note         string              `json:"note,omitempty" bson:"note,omitempty"`
+}
+
+// ExchangeMeeting is where and when the two parties of a trade hand over
+// the money.
+type ExchangeMeeting struct {
+	At          time.Time `json:"at" bson:"at"`
+	Place       string    `json:"place" bson:"place"`
+	ScheduledBy string    `json:"scheduled_by" bson:"scheduled_by"`
+}
+
+// isTrade reports whether both sides have agreed to the match, whatever has
+// happened to the trade since.
+func (m *ExchangeMatch) isTrade() bool {
+	switch m.Status {
+	case matchAccepted, matchMeetingScheduled, matchCompleted, matchDisputed:
+		return true
+	}
+	return false
+}
+
+// settledStatus derives request's status from its matches.
+func settledStatus(request *CurrencyExchangeRequest, matches []ExchangeMatch) string {
+	if request.exchangeStatus() == exchangeCancelled {
+		return exchangeCancelled
+	}
+	trades, completed, scheduled := 0, 0, 0
+	for _, match := range matches {
+		if !match.isTrade() {
+			continue
+		}
+		trades++
+		switch match.Status {
+		case matchDisputed:
+			return exchangeDisputed
+		case matchCompleted:
+			completed++
+		case matchMeetingScheduled:
+			scheduled++
+		}
+	}
+	switch {
+	case request.remaining() > 0:
+		return exchangeOpen
+	case completed == trades:
+		return exchangeCompleted
+	case completed+scheduled == trades:
+		return exchangeMeetingScheduled
+	}
+	return exchangeMatched
+}
+
+// event builds a timeline entry about match for the request on side i.
+func (m *ExchangeMatcher) event(kind, by string, match *ExchangeMatch, i int) ExchangeEvent {
+	id := match.ID
+	return ExchangeEvent{Type: kind, By: by, At: m.now(), MatchID: &id, Counterparty: match.Sides[1-i].UserID}
+}
+
+// advanceTrade applies change to an accepted match on behalf of requestID's
+// owner and records the resulting event on both requests. change returns
+// the event type to record.
+func (m *ExchangeMatcher) advanceTrade(ctx context.Context, matchID, requestID primitive.ObjectID, allowed func(owner string) bool, note string, change func(match *ExchangeMatch, i int) (string, error)) (*ExchangeMatch, error) {
+	var kind, by string
+	match, err := m.updateMatch(ctx, matchID, requestID, allowed, func(match *ExchangeMatch, i int) error {
+		var err error
+		by = match.Sides[i].UserID
+		kind, err = change(match, i)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, side := range match.Sides {
+		event := m.event(kind, by, match, i)
+		event.Note = note
+		if err := m.updateRequest(ctx, side.RequestID, event, nil); err != nil {
+			log.Printf("Failed to update exchange request %s: %v\n", side.RequestID.Hex(), err)
+		}
+	}
+	return match, nil
+}
+
+// scheduleMeeting sets or moves the meeting for an accepted trade.
+func (m *ExchangeMatcher) scheduleMeeting(ctx context.Context, matchID, requestID primitive.ObjectID, allowed func(owner string) bool, meeting ExchangeMeeting, note string) (*ExchangeMatch, error) {
+	meeting.Place = strings.TrimSpace(meeting.Place)
+	if meeting.Place == "" || !meeting.At.After(m.now()) {
+		return nil, errInvalidMeeting
+	}
+	return m.advanceTrade(ctx, matchID, requestID, allowed, note, func(match *ExchangeMatch, i int) (string, error) {
+		if match.Status != matchAccepted && match.Status != matchMeetingScheduled {
+			return "", fmt.Errorf("%w: cannot schedule a meeting for a %s match", errInvalidTransition, match.Status)
+		}
+		meeting.ScheduledBy = match.Sides[i].UserID
+		match.Meeting = &meeting
+		match.Status = matchMeetingScheduled
+		return eventMeetingScheduled, nil
+	})
+}
+
+// confirmTrade records that one party's side of the trade took place. The
+// trade completes once both parties have confirmed, which also settles a
+// dispute.
+func (m *ExchangeMatcher) confirmTrade(ctx context.Context, matchID, requestID primitive.ObjectID, allowed func(owner string) bool, note string) (*ExchangeMatch, error) {
+	return m.advanceTrade(ctx, matchID, requestID, allowed, note, func(match *ExchangeMatch, i int) (string, error) {
+		switch {
+		case match.Status != matchAccepted && match.Status != matchMeetingScheduled && match.Status != matchDisputed:
+			return "", fmt.Errorf("%w: cannot confirm a %s match", errInvalidTransition, match.Status)
+		case match.Sides[i].Confirmed:
+			return "", fmt.Errorf("%w: already confirmed", errInvalidTransition)
+		}
+		match.Sides[i].Confirmed = true
+		if !match.Sides[1-i].Confirmed {
+			return eventConfirmed, nil
+		}
+		match.Status = matchCompleted
+		return eventCompleted, nil
+	})
+}
+
+// disputeTrade flags an accepted trade that has not completed as disputed.
+func (m *ExchangeMatcher) disputeTrade(ctx context.Context, matchID, requestID primitive.ObjectID, allowed func(owner string) bool, reason string) (*ExchangeMatch, error) {
+	if reason = strings.TrimSpace(reason); reason == "" {
+		return nil, errNoDisputeReason
+	}
+	return m.advanceTrade(ctx, matchID, requestID, allowed, reason, func(match *ExchangeMatch, i int) (string, error) {
+		if match.Status != matchAccepted && match.Status != matchMeetingScheduled {
+			return "", fmt.Errorf("%w: cannot dispute a %s match", errInvalidTransition, match.Status)
+		}
+		match.Status = matchDisputed
+		match.DisputedBy = match.Sides[i].UserID
+		match.Dispute = reason
+		return eventDisputed, nil
+	})
+}
+
+// cancel closes request id and cancels its pending proposals and the trades
+// that have not been carried out, returning the counterparty requests whose
+// amounts were freed. Trades either party has confirmed must be disputed
+// instead, and completed trades stay completed.
+func (m *ExchangeMatcher) cancel(ctx context.Context, id primitive.ObjectID, allowed func(owner string) bool, note string) ([]primitive.ObjectID, error) {
+	request, err := m.store.Exchanges.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed(request.UserID) {
+		return nil, errNotRequestOwner
+	}
+	if status := request.exchangeStatus(); status == exchangeCompleted || status == exchangeCancelled {
+		return nil, fmt.Errorf("%w: %s to %s", errInvalidTransition, status, exchangeCancelled)
+	}
+	matches, err := m.store.Matches.ListByRequest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		if cancellable(&match) && (match.Sides[0].Confirmed || match.Sides[1].Confirmed) {
+			return nil, errTradeConfirmed
+		}
+	}
+
+	var freed []primitive.ObjectID
+	released := int64(0)
+	for _, match := range matches {
+		if !cancellable(&match) {
+			continue
+		}
+		wasTrade := match.isTrade()
+		cancelled, err := m.updateMatch(ctx, match.ID, id, func(string) bool { return true }, func(match *ExchangeMatch, i int) error {
+			if !cancellable(match) {
+				return errMatchClosed
+			}
+			if match.Sides[0].Confirmed || match.Sides[1].Confirmed {
+				return errTradeConfirmed
+			}
+			match.Status = matchCancelled
+			return nil
+		})
+		if errors.Is(err, errMatchClosed) {
+			continue
+		}
+		if err != nil {
+			return freed, err
+		}
+
+		i := cancelled.side(id)
+		other := cancelled.Sides[1-i]
+		freed = append(freed, other.RequestID)
+		if !wasTrade {
+			continue
+		}
+		released += cancelled.Sides[i].Amount.Minor
+		event := m.event(eventMatchCancelled, request.UserID, cancelled, 1-i)
+		event.Note = note
+		err = m.updateRequest(ctx, other.RequestID, event, func(counterparty *CurrencyExchangeRequest) error {
+			counterparty.Filled.Minor -= other.Amount.Minor
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to reopen exchange request %s: %v\n", other.RequestID.Hex(), err)
+		}
+	}
+
+	event := ExchangeEvent{Type: eventCancelled, By: request.UserID, At: m.now(), Note: note}
+	return freed, m.updateRequest(ctx, id, event, func(request *CurrencyExchangeRequest) error {
+		request.Filled.Minor -= released
+		request.Status = exchangeCancelled
+		return nil
+	})
+}
+
+// deleteExchangeRequest cancels an open request's proposals and trades,
+// lets the counterparties it freed look for new matches, then deletes it.
+// Like cancelling, it fails with errTradeConfirmed while a trade is half
+// confirmed.
+func (s *Server) deleteExchangeRequest(ctx context.Context, id primitive.ObjectID) error {
+	freed, err := s.matcher.cancel(ctx, id, func(string) bool { return true }, "The request was deleted")
+	if err != nil && !errors.Is(err, errInvalidTransition) {
+		return err
+	}
+	for _, other := range freed {
+		if request, err := s.store.Exchanges.Get(ctx, other); err == nil {
+			if err := s.matcher.propose(ctx, request); err != nil {
+				log.Printf("Database error: %v\n", err)
+			}
+		}
+	}
+	return s.store.Exchanges.Delete(ctx, id)
+}
+
+// cancellable reports whether cancelling a request cancels match too.
+func cancellable(match *ExchangeMatch) bool {
+	switch match.Status {
+	case matchProposed, matchAccepted, matchMeetingScheduled:
+		return true
+	}
+	return false
+}
+
+// tradeActionHandler returns the handler for one action on an accepted
+// match: "meeting" takes {"at": ..., "place": ...}, "dispute" takes
+// {"reason": ...} and "confirm" an optional {"note": ...}.
+func (s *Server) tradeActionHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		requestID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+		matchID, err := primitive.ObjectIDFromHex(mux.Vars(r)["matchId"])
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+
+		var body struct {
+			At     time.Time `json:"at"`
+			Place  string    `json:"place"`
+			Reason string    `json:"reason"`
+			Note   string    `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		allowed := func(owner string) bool { return canModify(r, owner) }
+		var match *ExchangeMatch
+		switch action {
+		case "meeting":
+			match, err = s.matcher.scheduleMeeting(r.Context(), matchID, requestID, allowed, ExchangeMeeting{At: body.At, Place: body.Place}, body.Note)
+		case "confirm":
+			match, err = s.matcher.confirmTrade(r.Context(), matchID, requestID, allowed, body.Note)
+		case "dispute":
+			match, err = s.matcher.disputeTrade(r.Context(), matchID, requestID, allowed, body.Reason)
+		}
+		switch {
+		case errors.Is(err, errNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Match not found"})
+			return
+		case errors.Is(err, errNotMatchParty):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, errInvalidMeeting), errors.Is(err, errNoDisputeReason):
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case errors.Is(err, errInvalidTransition), errors.Is(err, errVersionConflict):
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		case err != nil:
+			log.Printf("Database error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update trade"})
+			return
+		}
+		json.NewEncoder(w).Encode(match)
+	}
+}
+
+// cancelExchangeRequest cancels one of the caller's requests, taking an
+// optional {"note": ...}, and offers the amounts it freed to other requests.
+func (s *Server) cancelExchangeRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Note string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	freed, err := s.matcher.cancel(r.Context(), id, func(owner string) bool { return canModify(r, owner) }, body.Note)
+	switch {
+	case errors.Is(err, errNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Exchange request not found"})
+		return
+	case errors.Is(err, errNotRequestOwner):
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case errors.Is(err, errInvalidTransition), errors.Is(err, errTradeConfirmed), errors.Is(err, errVersionConflict):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to cancel exchange request"})
+		return
+	}
+
+	for _, other := range freed {
+		if request, err := s.store.Exchanges.Get(r.Context(), other); err == nil {
+			if err := s.matcher.propose(r.Context(), request); err != nil {
+				log.Printf("Database error: %v\n", err)
+			}
+		}
+	}
+	request, err := s.store.Exchanges.Get(r.Context(), id)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load exchange request"})
+		return
+	}
+	w.Header().Set("ETag", etag(request.Version))
+	json.NewEncoder(w).Encode(request)
+}
+
+// getExchangeTimeline returns the status and timeline of one of the
+// caller's requests, oldest event first.
+func (s *Server) getExchangeTimeline(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+
+	request, err := s.store.Exchanges.Get(r.Context(), id)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Exchange request not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to load exchange request"})
+		return
+	}
+	if !canModify(r, request.UserID) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You can only view the timeline of your own requests"})
+		return
+	}
+
+	timeline := request.Timeline
+	if timeline == nil {
+		timeline = []ExchangeEvent{}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"request_id": request.ID,
+		"status":     request.exchangeStatus(),
+		"timeline":   timeline,
+	})
+}
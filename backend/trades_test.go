@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// tradeFixture is an accepted match between Alice's 100 USD and Bob's
+// 8500 INR.
+type tradeFixture struct {
+	s            *Server
+	r            *mux.Router
+	tokens       map[string]string
+	alice, bob   CurrencyExchangeRequest
+	match        ExchangeMatch
+	aliceMatches string
+	bobMatches   string
+}
+
+func newTradeFixture(t *testing.T) *tradeFixture {
+	s, r := newTestServer()
+	f := &tradeFixture{s: s, r: r, tokens: map[string]string{}}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		f.tokens[user] = loginAs(t, s, user)
+	}
+	create := func(user, body string) CurrencyExchangeRequest {
+		rr := serve(r, "POST", "/api/currency/exchange", f.tokens[user], body)
+		var request CurrencyExchangeRequest
+		json.Unmarshal(rr.Body.Bytes(), &request)
+		return request
+	}
+	f.bob = create("bob", `{"amount": 8500, "from_currency": "INR", "to_currency": "USD"}`)
+	f.alice = create("alice", `{"amount": 100, "from_currency": "USD", "to_currency": "INR", "rate": 85}`)
+
+	matches, _ := s.store.Matches.ListByRequest(context.Background(), f.alice.ID)
+	if !assert.Len(t, matches, 1) {
+		t.FailNow()
+	}
+	f.match = matches[0]
+	f.aliceMatches = "/api/currency/exchange/" + f.alice.ID.Hex() + "/matches/" + f.match.ID.Hex()
+	f.bobMatches = "/api/currency/exchange/" + f.bob.ID.Hex() + "/matches/" + f.match.ID.Hex()
+	assert.Equal(t, http.StatusOK, f.post("alice", f.aliceMatches+"/accept", ""))
+	assert.Equal(t, http.StatusOK, f.post("bob", f.bobMatches+"/accept", ""))
+	return f
+}
+
+func (f *tradeFixture) post(user, route, body string) int {
+	return serve(f.r, "POST", route, f.tokens[user], body).Code
+}
+
+func (f *tradeFixture) status(request CurrencyExchangeRequest) string {
+	stored, _ := f.s.store.Exchanges.Get(context.Background(), request.ID)
+	return stored.exchangeStatus()
+}
+
+func TestTradeLifecycle(t *testing.T) {
+	f := newTradeFixture(t)
+	assert.Equal(t, exchangeMatched, f.status(f.alice))
+	assert.Equal(t, exchangeMatched, f.status(f.bob))
+
+	when := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		description  string
+		user         string
+		route        string
+		reqBody      string
+		expectedCode int
+	}{
+		{"Meeting in the past", "alice", f.aliceMatches + "/meeting", `{"at": "2020-01-01T10:00:00Z", "place": "Library"}`, http.StatusBadRequest},
+		{"Meeting without a place", "alice", f.aliceMatches + "/meeting", `{"at": "` + when + `"}`, http.StatusBadRequest},
+		{"Meeting for someone else's trade", "carol", f.aliceMatches + "/meeting", `{"at": "` + when + `", "place": "Library"}`, http.StatusForbidden},
+		{"Schedule a meeting", "alice", f.aliceMatches + "/meeting", `{"at": "` + when + `", "place": "Library"}`, http.StatusOK},
+		{"Bob confirms", "bob", f.bobMatches + "/confirm", ``, http.StatusOK},
+		{"Bob confirms twice", "bob", f.bobMatches + "/confirm", ``, http.StatusConflict},
+		{"Cancel after the other side confirmed", "alice", "/api/currency/exchange/" + f.alice.ID.Hex() + "/cancel", ``, http.StatusConflict},
+		{"Alice confirms", "alice", f.aliceMatches + "/confirm", `{"note": "all good"}`, http.StatusOK},
+		{"Dispute a completed trade", "bob", f.bobMatches + "/dispute", `{"reason": "short"}`, http.StatusConflict},
+		{"Cancel a completed request", "alice", "/api/currency/exchange/" + f.alice.ID.Hex() + "/cancel", ``, http.StatusConflict},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expectedCode, f.post(test.user, test.route, test.reqBody), test.description)
+	}
+	assert.Equal(t, exchangeCompleted, f.status(f.alice))
+	assert.Equal(t, exchangeCompleted, f.status(f.bob))
+
+	rr := serve(f.r, "GET", "/api/currency/exchange/"+f.alice.ID.Hex()+"/timeline", f.tokens["bob"], "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = serve(f.r, "GET", "/api/currency/exchange/"+f.alice.ID.Hex()+"/timeline", f.tokens["alice"], "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var body struct {
+		Status   string          `json:"status"`
+		Timeline []ExchangeEvent `json:"timeline"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &body)
+	assert.Equal(t, exchangeCompleted, body.Status)
+	var kinds, statuses []string
+	for _, event := range body.Timeline {
+		kinds = append(kinds, event.Type)
+		statuses = append(statuses, event.Status)
+	}
+	assert.Equal(t, []string{eventCreated, eventMatched, eventMeetingScheduled, eventConfirmed, eventCompleted}, kinds)
+	assert.Equal(t, []string{exchangeOpen, exchangeMatched, exchangeMeetingScheduled, exchangeMeetingScheduled, exchangeCompleted}, statuses)
+	if len(body.Timeline) == 5 {
+		assert.Equal(t, "bob", body.Timeline[3].By)
+		assert.Equal(t, "bob", body.Timeline[3].Counterparty)
+		assert.Equal(t, "all good", body.Timeline[4].Note)
+	}
+	assert.NotContains(t, serve(f.r, "GET", "/api/currency/exchange/requests?status=all", "", "").Body.String(), "timeline")
+}
+
+func TestTradeDispute(t *testing.T) {
+	f := newTradeFixture(t)
+	assert.Equal(t, http.StatusBadRequest, f.post("bob", f.bobMatches+"/dispute", `{}`))
+	assert.Equal(t, http.StatusOK, f.post("bob", f.bobMatches+"/dispute", `{"reason": "Alice did not show up"}`))
+	assert.Equal(t, exchangeDisputed, f.status(f.alice))
+	assert.Equal(t, exchangeDisputed, f.status(f.bob))
+
+	match, _ := f.s.store.Matches.Get(context.Background(), f.match.ID)
+	assert.Equal(t, "bob", match.DisputedBy)
+	assert.Equal(t, "Alice did not show up", match.Dispute)
+
+	// Both confirming settles the dispute
+	assert.Equal(t, http.StatusOK, f.post("alice", f.aliceMatches+"/confirm", ""))
+	assert.Equal(t, exchangeDisputed, f.status(f.alice))
+	assert.Equal(t, http.StatusOK, f.post("bob", f.bobMatches+"/confirm", ""))
+	assert.Equal(t, exchangeCompleted, f.status(f.alice))
+}
+
+func TestCancelExchangeRequest(t *testing.T) {
+	f := newTradeFixture(t)
+	cancel := "/api/currency/exchange/" + f.alice.ID.Hex() + "/cancel"
+	assert.Equal(t, http.StatusForbidden, f.post("bob", cancel, ""))
+	assert.Equal(t, http.StatusOK, f.post("alice", cancel, `{"note": "changed plans"}`))
+	assert.Equal(t, http.StatusConflict, f.post("alice", cancel, ""))
+	assert.Equal(t, exchangeCancelled, f.status(f.alice))
+
+	match, _ := f.s.store.Matches.Get(context.Background(), f.match.ID)
+	assert.Equal(t, matchCancelled, match.Status)
+	bob, _ := f.s.store.Exchanges.Get(context.Background(), f.bob.ID)
+	assert.Equal(t, exchangeOpen, bob.exchangeStatus(), "the counterparty is back in the market")
+	assert.Equal(t, int64(0), bob.Filled.Minor)
+	last := bob.Timeline[len(bob.Timeline)-1]
+	assert.Equal(t, eventMatchCancelled, last.Type)
+	assert.Equal(t, "alice", last.By)
+	assert.Equal(t, "changed plans", last.Note)
+
+	assert.Equal(t, http.StatusConflict, f.post("bob", f.bobMatches+"/confirm", ""))
+	alice, _ := f.s.store.Exchanges.Get(context.Background(), f.alice.ID)
+	rr := serve(f.r, "PATCH", "/api/currency/exchange/"+f.alice.ID.Hex(), f.tokens["alice"], fmt.Sprintf(`{"version": %d, "amount": 50}`, alice.Version))
+	assert.Equal(t, http.StatusBadRequest, rr.Code, "closed requests cannot be edited")
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WatchedItem is a listing, exchange request or sublease a user has
+// bookmarked. ItemType is one of the subject constants. Title is kept from
+// when it was added so watchers can be told what was deleted.
+type WatchedItem struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID   string             `json:"user_id" bson:"user_id"`
+	ItemType string             `json:"item_type" bson:"item_type"`
+	ItemID   primitive.ObjectID `json:"item_id" bson:"item_id"`
+	Title    string             `json:"title" bson:"title"`
+	AddedAt  time.Time          `json:"added_at" bson:"added_at"`
+	// Item is the watched document as it is now, filled in when listing
+	// the watchlist; it is missing once the document is gone.
+	Item interface{} `json:"item,omitempty" bson:"-"`
+}
+
+// subjectLink is the API path of a listing, exchange request or sublease.
+func subjectLink(subjectType string, id primitive.ObjectID) string {
+	switch subjectType {
+	case subjectListing:
+		return "/api/marketplace/listings/" + id.Hex()
+	case subjectExchange:
+		return "/api/currency/exchange/" + id.Hex()
+	}
+	return "/api/subleasing/" + id.Hex()
+}
+
+// watchers returns who is watching an item, logging failures.
+func (s *Server) watchers(ctx context.Context, itemType string, itemID primitive.ObjectID) []string {
+	userIDs, err := s.store.Watchlist.Watchers(ctx, itemType, itemID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+	}
+	return userIDs
+}
+
+// notifyWatchers notifies everyone watching an item.
+func (s *Server) notifyWatchers(ctx context.Context, itemType string, itemID primitive.ObjectID, title, body string) {
+	for _, userID := range s.watchers(ctx, itemType, itemID) {
+		if err := s.notifications.Notify(ctx, userID, categoryListingUpdates, title, body, subjectLink(itemType, itemID)); err != nil {
+			log.Printf("Failed to notify %s: %v\n", userID, err)
+		}
+	}
+}
+
+// recountWatchers stores an item's watcher count on the item. It is counted
+// afresh each time, so a recount that lost a race is fixed by the next.
+func (s *Server) recountWatchers(ctx context.Context, itemType string, itemID primitive.ObjectID) {
+	userIDs, err := s.store.Watchlist.Watchers(ctx, itemType, itemID)
+	if err == nil {
+		switch itemType {
+		case subjectListing:
+			err = s.store.Listings.SetWatchers(ctx, itemID, len(userIDs))
+		case subjectExchange:
+			err = s.store.Exchanges.SetWatchers(ctx, itemID, len(userIDs))
+		case subjectSublease:
+			err = s.store.Subleases.SetWatchers(ctx, itemID, len(userIDs))
+		}
+	}
+	if err != nil && !errors.Is(err, errNotFound) {
+		log.Printf("Database error: %v\n", err)
+	}
+}
+
+// listingPriceChanged tells watchers when an edit lowers a listing's price.
+func (s *Server) listingPriceChanged(ctx context.Context, before, after *MarketplaceListing) {
+	if after.Price.Currency != before.Price.Currency || after.Price.Minor >= before.Price.Minor {
+		return
+	}
+	title := fmt.Sprintf("Price drop on %q", after.Title)
+	body := fmt.Sprintf("%q is now %s %s, down from %s %s.", after.Title, after.Price, after.Price.Currency, before.Price, before.Price.Currency)
+	s.notifyWatchers(ctx, subjectListing, after.ID, title, body)
+}
+
+// subleaseRentChanged tells watchers when an edit lowers a sublease's rent.
+func (s *Server) subleaseRentChanged(ctx context.Context, before, after *SubleasingRequest) {
+	if after.Rent.Currency != before.Rent.Currency || after.rentPeriod() != before.rentPeriod() || after.Rent.Minor >= before.Rent.Minor {
+		return
+	}
+	title := fmt.Sprintf("Rent drop on %q", after.Title)
+	body := fmt.Sprintf("%q now rents for %s %s %s, down from %s %s.", after.Title, after.Rent, after.Rent.Currency, after.rentPeriod(), before.Rent, before.Rent.Currency)
+	s.notifyWatchers(ctx, subjectSublease, after.ID, title, body)
+}
+
+// subleaseStatusChanged tells watchers a sublease expired or came back.
+func (s *Server) subleaseStatusChanged(ctx context.Context, sublease *SubleasingRequest) {
+	title := fmt.Sprintf("%q is now %s", sublease.Title, sublease.Status)
+	s.notifyWatchers(ctx, subjectSublease, sublease.ID, title, title+".")
+}
+
+// exchangeStatusChanged tells watchers an exchange request changed status.
+func (s *Server) exchangeStatusChanged(ctx context.Context, request *CurrencyExchangeRequest) {
+	title := fmt.Sprintf("Exchange of %s %s to %s is now %s", request.Amount, request.FromCurrency, request.ToCurrency, request.exchangeStatus())
+	s.notifyWatchers(ctx, subjectExchange, request.ID, title, title+".")
+}
+
+// itemDeleted tells watchers an item was deleted and forgets its watches.
+func (s *Server) itemDeleted(ctx context.Context, itemType string, itemID primitive.ObjectID) {
+	watches, err := s.store.Watchlist.RemoveItem(ctx, itemType, itemID)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		return
+	}
+	for _, watch := range watches {
+		title := fmt.Sprintf("%q was removed", watch.Title)
+		body := fmt.Sprintf("%q, which you were watching, was taken down by its owner.", watch.Title)
+		if err := s.notifications.Notify(ctx, watch.UserID, categoryListingUpdates, title, body, ""); err != nil {
+			log.Printf("Failed to notify %s: %v\n", watch.UserID, err)
+		}
+	}
+}
+
+// watchItem adds {"item_type": ..., "item_id": ...} to the caller's
+// watchlist. It answers 201 when newly added and 200 if already watched.
+func (s *Server) watchItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var body struct {
+		ItemType string `json:"item_type"`
+		ItemID   string `json:"item_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	itemID, err := primitive.ObjectIDFromHex(body.ItemID)
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+
+	owner, title, err := s.conversationSubject(r.Context(), body.ItemType, itemID)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Item not found"})
+		return
+	}
+	if errors.Is(err, errUnknownSubject) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "item_type must be listing, exchange or sublease"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to watch item"})
+		return
+	}
+	userID := currentUserID(r)
+	if owner == userID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot watch your own listing"})
+		return
+	}
+
+	watch := WatchedItem{UserID: userID, ItemType: body.ItemType, ItemID: itemID, Title: title, AddedAt: time.Now()}
+	added, err := s.store.Watchlist.Add(r.Context(), &watch)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to watch item"})
+		return
+	}
+	if added {
+		s.recountWatchers(r.Context(), watch.ItemType, watch.ItemID)
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(watch)
+}
+
+func (s *Server) unwatchItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	vars := mux.Vars(r)
+	itemID, err := primitive.ObjectIDFromHex(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		return
+	}
+	err = s.store.Watchlist.Remove(r.Context(), currentUserID(r), vars["type"], itemID)
+	if errors.Is(err, errNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You are not watching this item"})
+		return
+	}
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to unwatch item"})
+		return
+	}
+	s.recountWatchers(r.Context(), vars["type"], itemID)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Item removed from watchlist"})
+}
+
+// getWatchlist lists the caller's watched items, most recently added first,
+// each with the item as it is now. type narrows it to one item type.
+func (s *Server) getWatchlist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query, err := parseListQuery(r.URL.Query(), map[string]string{"date": "added_at"}, "-date")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if v := r.URL.Query().Get("type"); v != "" {
+		query.filters = append(query.filters, fieldFilter{field: "item_type", op: "$eq", value: v})
+	}
+	watches, next, err := s.store.Watchlist.ListByUser(r.Context(), currentUserID(r), query)
+	if err != nil {
+		log.Printf("Database error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to retrieve watchlist"})
+		return
+	}
+	for i := range watches {
+		watch := &watches[i]
+		switch watch.ItemType {
+		case subjectListing:
+			if item, err := s.store.Listings.Get(r.Context(), watch.ItemID); err == nil {
+				item.hidePrivate()
+				watch.Item = item
+			}
+		case subjectExchange:
+			if item, err := s.store.Exchanges.Get(r.Context(), watch.ItemID); err == nil {
+				watch.Item = item
+			}
+		case subjectSublease:
+			if item, err := s.store.Subleases.Get(r.Context(), watch.ItemID); err == nil {
+				watch.Item = item
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"item_count":  len(watches),
+		"items":       watches,
+		"next_cursor": next,
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchlist(t *testing.T) {
+	s, r := newTestServer()
+	alice, bob := loginAs(t, s, "alice"), loginAs(t, s, "bob")
+	ctx := context.Background()
+	listing := testListing("alice")
+	s.store.Listings.Create(ctx, &listing)
+	watch := `{"item_type": "listing", "item_id": "` + listing.ID.Hex() + `"}`
+
+	tests := []struct {
+		description  string
+		token        string
+		body         string
+		expectedCode int
+	}{
+		{"Watch a listing", bob, watch, http.StatusCreated},
+		{"Watch it again", bob, watch, http.StatusOK},
+		{"Watch your own listing", alice, watch, http.StatusBadRequest},
+		{"Unknown item type", bob, `{"item_type": "car", "item_id": "` + listing.ID.Hex() + `"}`, http.StatusBadRequest},
+		{"Missing item", bob, `{"item_type": "sublease", "item_id": "` + listing.ID.Hex() + `"}`, http.StatusNotFound},
+		{"Invalid ID", bob, `{"item_type": "listing", "item_id": "nope"}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		rr := serve(r, "POST", "/api/watchlist", test.token, test.body)
+		assert.Equal(t, test.expectedCode, rr.Code, test.description)
+	}
+
+	stored, _ := s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, 1, stored.WatcherCount)
+
+	// A write based on a read from before a watch keeps the new count
+	stale := listing
+	assert.NoError(t, s.store.Listings.Replace(ctx, &stale, stale.Version))
+	stored, _ = s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, 1, stored.WatcherCount, "replacing does not overwrite the watcher count")
+
+	rr := serve(r, "GET", "/api/watchlist", bob, "")
+	var page struct {
+		Items []struct {
+			ItemType string             `json:"item_type"`
+			Title    string             `json:"title"`
+			Item     MarketplaceListing `json:"item"`
+		} `json:"items"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	if assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "Laptop for Sale", page.Items[0].Title)
+		assert.Equal(t, 1, page.Items[0].Item.WatcherCount)
+	}
+	rr = serve(r, "GET", "/api/watchlist?type=sublease", bob, "")
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Empty(t, page.Items)
+
+	route := "/api/watchlist/listing/" + listing.ID.Hex()
+	assert.Equal(t, http.StatusNotFound, serve(r, "DELETE", route, alice, "").Code)
+	assert.Equal(t, http.StatusOK, serve(r, "DELETE", route, bob, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(r, "DELETE", route, bob, "").Code)
+	stored, _ = s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, 0, stored.WatcherCount)
+}
+
+func TestWatcherNotifications(t *testing.T) {
+	s, r := newTestServer()
+	alice, bob := loginAs(t, s, "alice"), loginAs(t, s, "bob")
+	ctx := context.Background()
+	listing := testListing("alice")
+	listing.Version = 1
+	s.store.Listings.Create(ctx, &listing)
+	rr := serve(r, "POST", "/api/subleasing", alice, `{"title": "Summer room", "description": "Near campus", "location": {"city": "Gainesville", "state": "FL", "country": "USA"}, "rent": 600, "period": {"start_date": "2025-05-01T00:00:00Z", "end_date": "2025-08-01T00:00:00Z"}}`)
+	var sublease SubleasingRequest
+	json.Unmarshal(rr.Body.Bytes(), &sublease)
+	rr = serve(r, "POST", "/api/currency/exchange", alice, `{"amount": 100, "from_currency": "USD", "to_currency": "EUR"}`)
+	var exchange CurrencyExchangeRequest
+	json.Unmarshal(rr.Body.Bytes(), &exchange)
+
+	for _, item := range []struct{ itemType, id string }{
+		{"listing", listing.ID.Hex()}, {"sublease", sublease.ID.Hex()}, {"exchange", exchange.ID.Hex()},
+	} {
+		rr := serve(r, "POST", "/api/watchlist", bob, `{"item_type": "`+item.itemType+`", "item_id": "`+item.id+`"}`)
+		assert.Equal(t, http.StatusCreated, rr.Code, item.itemType)
+	}
+	notified := func() []string {
+		notes, _, _ := s.store.Notifications.Find(ctx, "bob", listQuery{sort: "created_at"})
+		titles := []string{}
+		for _, note := range notes {
+			titles = append(titles, note.Title)
+		}
+		return titles
+	}
+	patch := func(route, body string, version int64) {
+		req := serve(r, "PATCH", route, alice, `{"version": `+strconv.FormatInt(version, 10)+`, `+body+`}`)
+		assert.Equal(t, http.StatusOK, req.Code, body)
+	}
+
+	patch("/api/marketplace/listings/"+listing.ID.Hex(), `"price": 350`, 1)
+	patch("/api/marketplace/listings/"+listing.ID.Hex(), `"price": 250`, 2)
+	patch("/api/subleasing/"+sublease.ID.Hex(), `"rent": 550`, 1)
+	assert.Equal(t, []string{`Price drop on "Laptop for Sale"`, `Rent drop on "Summer room"`}, notified())
+
+	stored, _ := s.store.Listings.Get(ctx, listing.ID)
+	assert.Equal(t, 1, stored.WatcherCount, "edits keep the watcher count")
+
+	assert.Equal(t, http.StatusOK, serve(r, "POST", "/api/marketplace/listings/"+listing.ID.Hex()+"/reserve", alice, `{"buyer_id": "carol"}`).Code)
+	assert.Equal(t, http.StatusOK, serve(r, "POST", "/api/currency/exchange/"+exchange.ID.Hex()+"/cancel", alice, "").Code)
+	assert.Equal(t, http.StatusOK, serve(r, "DELETE", "/api/deleteListing/"+sublease.ID.Hex(), alice, "").Code)
+	assert.Equal(t, []string{
+		`Price drop on "Laptop for Sale"`,
+		`Rent drop on "Summer room"`,
+		`"Laptop for Sale" is now reserved`,
+		"Exchange of 100.00 USD to EUR is now cancelled",
+		`"Summer room" was removed`,
+	}, notified())
+
+	rr = serve(r, "GET", "/api/watchlist", bob, "")
+	assert.Contains(t, rr.Body.String(), `"item_count":2`)
+}
@@ -1,5 +1,5 @@
 import React, { useState, useEffect } from "react";
-import emailjs from "emailjs-com";
+import { authFetch, saveSession, clearSession } from "./auth";
 import ItemListing from "./ItemListing"; 
 import UserActivitiesSection from "./HomePage.jsx";
 import CurrencyExchangeListing from "./CurrencyExchange.jsx";
@@ -38,42 +38,36 @@ import { saveAs } from "file-saver";
 import ExpandMoreIcon from '@mui/icons-material/ExpandMore';
 
 
-// OTPPage component as is
+// OTPPage asks the backend for a code and exchanges it for a session
 const OTPPage = ({ onLogin }) => {
   const [email, setEmail] = useState("");
   const [otp, setOtp] = useState("");
-  const [generatedOtp, setGeneratedOtp] = useState(null);
   const [step, setStep] = useState(1);
   const [emailError, setEmailError] = useState("");
 
-  const generateOtp = () => Math.floor(100000 + Math.random() * 900000).toString();
-
   const validateEmail = (email) => {
     const emailRegex = /^[a-zA-Z0-9._%+-]+@ufl\.edu$/;
     return emailRegex.test(email);
   };
 
+  // The backend generates the code, mails it and keeps only a hash of it
   const sendOtp = async () => {
     if (!validateEmail(email)) {
       setEmailError("Please enter a valid @ufl.edu email address.");
       return;
     }
 
-    const newOtp = generateOtp();
-    setGeneratedOtp(newOtp);
-
-    const templateParams = {
-      user_email: email,
-      otp: newOtp,
-    };
-
     try {
-      await emailjs.send(
-        import.meta.env.VITE_EMAIL_SERVICE_ID,
-        import.meta.env.VITE_EMAIL_TEMPLATE_ID,
-        templateParams,
-        import.meta.env.VITE_EMAIL_USER_ID
-      );
+      const response = await fetch("http://localhost:8080/api/auth/otp/request", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ email }),
+      });
+      if (!response.ok) {
+        const errorData = await response.json();
+        alert(errorData.error || "Failed to send OTP. Please try again.");
+        return;
+      }
       alert("OTP sent to your email!");
       setStep(2);
     } catch (error) {
@@ -83,39 +77,24 @@ const OTPPage = ({ onLogin }) => {
   };
 
   const verifyOtp = async () => {
-    if (otp === generatedOtp) {
-      const user = {
-        email: email,
-        last_login: new Date().toISOString(),
-      };
-      console.log("Sending user data to backend:", user); // Debug log
-  
-      try {
-        const response = await fetch("http://localhost:8080/api/saveUser", {
-          method: "POST",
-          headers: {
-            "Content-Type": "application/json",
-          },
-          body: JSON.stringify(user),
-        });
-  
-        console.log("Backend response status:", response.status); // Debug log
-        if (response.ok) {
-          const data = await response.json();
-          localStorage.setItem("isLoggedIn", "true");
-          localStorage.setItem("userID", data.userID);
-          onLogin();
-        } else {
-          const errorData = await response.json(); // Parse error response
-          console.error("Backend error:", errorData); // Debug log
-          alert("Failed to save user details.");
-        }
-      } catch (error) {
-        console.error("Error saving user details:", error);
-        alert("Failed to save user details.");
+    try {
+      const response = await fetch("http://localhost:8080/api/auth/otp/verify", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ email, code: otp.trim() }),
+      });
+
+      if (response.ok) {
+        const data = await response.json();
+        saveSession(data);
+        onLogin();
+      } else {
+        const errorData = await response.json().catch(() => ({}));
+        alert(errorData.error || "Invalid OTP. Please try again.");
       }
-    } else {
-      alert("Invalid OTP. Please try again.");
+    } catch (error) {
+      console.error("Error verifying OTP:", error);
+      alert("Failed to verify OTP.");
     }
   };
 
@@ -361,7 +340,7 @@ const MainWebsite = () => {
   const saveProfile = async (profile) => {
     try {
       const userID = localStorage.getItem("userID");
-      const response = await fetch(`http://localhost:8080/api/updateUserProfile/${userID}`, {
+      const response = await authFetch(`http://localhost:8080/api/updateUserProfile/${userID}`, {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
@@ -384,8 +363,13 @@ const MainWebsite = () => {
   };
   
 
-  const logout = () => {
-    localStorage.removeItem("isLoggedIn");
+  const logout = async () => {
+    try {
+      await authFetch("http://localhost:8080/api/auth/logout", { method: "POST" });
+    } catch (error) {
+      console.error("Error logging out:", error);
+    }
+    clearSession();
     window.location.reload();
   };
   const userID = localStorage.getItem("userID");
@@ -525,7 +509,10 @@ const MainWebsite = () => {
 
 // App component to manage login state
 const App = () => {
-  const [isLoggedIn, setIsLoggedIn] = useState(localStorage.getItem("isLoggedIn") === "true");
+  // Logins from before server-issued sessions have no token and must sign in again
+  const [isLoggedIn, setIsLoggedIn] = useState(
+    localStorage.getItem("isLoggedIn") === "true" && !!localStorage.getItem("accessToken")
+  );
 
   return isLoggedIn ? <MainWebsite /> : <OTPPage onLogin={() => setIsLoggedIn(true)} />;
 };
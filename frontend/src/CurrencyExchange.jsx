@@ -1,4 +1,5 @@
 import React, { useState, useEffect } from "react";
+import { authFetch } from "./auth";
 import {
   Card, CardContent, Typography, Button, Modal, TextField, Box, MenuItem, Select
 } from "@mui/material";
@@ -42,7 +43,7 @@ const CurrencyExchangeListing = () => {
       const userID = localStorage.getItem("userID");
       if (!userID) throw new Error("User not authenticated");
 
-      const response = await fetch("http://localhost:8080/api/currency/exchange", {
+      const response = await authFetch("http://localhost:8080/api/currency/exchange", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({ ...formData, user_id: userID, amount: parseFloat(formData.amount) })
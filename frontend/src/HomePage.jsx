@@ -1,4 +1,5 @@
 import React, { useState, useEffect } from "react";
+import { authFetch } from "./auth";
 import {
   Box,
   Typography,
@@ -59,7 +60,7 @@ const UserActivitiesSection = () => {
 
   const handleSave = async () => {
     try {
-      await fetch(`http://localhost:8080/api/updateListing`, {
+      await authFetch(`http://localhost:8080/api/updateListing`, {
         method: "PUT",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify(editItem),
@@ -73,7 +74,7 @@ const UserActivitiesSection = () => {
 
   const handleDelete = async () => {
     try {
-      const response = await fetch(`http://localhost:8080/api/deleteListing/${editItem.id}`, {
+      const response = await authFetch(`http://localhost:8080/api/deleteListing/${editItem.id}`, {
         method: "DELETE",
       });
   
@@ -102,7 +103,7 @@ const UserActivitiesSection = () => {
 
   const handleMarkAsSold = async () => {
     try {
-      await fetch(`http://localhost:8080/api/markAsSold`, {
+      await authFetch(`http://localhost:8080/api/markAsSold`, {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({ id: editItem.id }),
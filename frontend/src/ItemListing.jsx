@@ -1,4 +1,5 @@
 import React, { useState, useEffect } from "react";
+import { authFetch } from "./auth";
 import { Card, CardContent, Typography, Button, Modal, TextField, Box, MenuItem, Select } from "@mui/material";
 
 const ItemListing = () => {
@@ -52,7 +53,7 @@ const ItemListing = () => {
       const userID = localStorage.getItem("userID");
       if (!userID) throw new Error("User not authenticated");
 
-      const response = await fetch("http://localhost:8080/api/postMarketplaceListing", {
+      const response = await authFetch("http://localhost:8080/api/postMarketplaceListing", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({
@@ -1,4 +1,5 @@
 import React, { useEffect, useState } from "react";
+import { authFetch } from "./auth";
 import {
   Box, Button, Card, CardContent, Modal, TextField, Typography
 } from "@mui/material";
@@ -55,7 +56,7 @@ const SubLeasingListing = () => {
       const userID = localStorage.getItem("userID");
       if (!userID) throw new Error("User not authenticated");
 
-      const response = await fetch("http://localhost:8080/api/subleasing", {
+      const response = await authFetch("http://localhost:8080/api/subleasing", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({
@@ -0,0 +1,47 @@
+// Session handling for the backend's OTP login. The tokens returned by
+// /api/auth/otp/verify are kept in localStorage; authFetch sends the access
+// token as a bearer token and renews it once with the refresh token when it
+// has expired.
+const API = "http://localhost:8080";
+
+export const saveSession = (data) => {
+  localStorage.setItem("isLoggedIn", "true");
+  localStorage.setItem("userID", data.userID);
+  localStorage.setItem("accessToken", data.access_token);
+  localStorage.setItem("refreshToken", data.refresh_token);
+};
+
+export const clearSession = () => {
+  ["isLoggedIn", "userID", "accessToken", "refreshToken"].forEach((key) => localStorage.removeItem(key));
+};
+
+const withToken = (options = {}) => ({
+  ...options,
+  headers: {
+    ...(options.headers || {}),
+    Authorization: `Bearer ${localStorage.getItem("accessToken")}`,
+  },
+});
+
+const refreshSession = async () => {
+  const refreshToken = localStorage.getItem("refreshToken");
+  if (!refreshToken) return false;
+  const response = await fetch(`${API}/api/auth/refresh`, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ refresh_token: refreshToken }),
+  });
+  if (!response.ok) return false;
+  const tokens = await response.json();
+  localStorage.setItem("accessToken", tokens.access_token);
+  localStorage.setItem("refreshToken", tokens.refresh_token);
+  return true;
+};
+
+export const authFetch = async (url, options) => {
+  const response = await fetch(url, withToken(options));
+  if (response.status !== 401 || !(await refreshSession())) {
+    return response;
+  }
+  return fetch(url, withToken(options));
+};